@@ -0,0 +1,145 @@
+package clients
+
+import (
+	"bytes"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"github.com/qdmc/websocket_packet/frame"
+	"sync"
+)
+
+// broadcastWorkers    批量发送时并发入队的协程数
+const broadcastWorkers = 64
+
+// encodedPacket    只编码一次、多个客户端共享的报文
+type encodedPacket struct {
+	raw            []byte
+	userProperties userProperties // MQTT 5客户端的PUBLISH中写入的用户属性
+	frameOnce      sync.Once
+	frames         []byte
+	frameErr       error
+}
+
+func encodePacket(p mqtt_packet.ControlPacketInterface) (*encodedPacket, error) {
+	if p == nil {
+		return nil, enmu.PacketEmptyError
+	}
+	buf := bytes.NewBuffer([]byte{})
+	_, err := p.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+	return &encodedPacket{raw: buf.Bytes()}, nil
+}
+
+// websocketFrames    websocket二进制帧,首次调用时生成
+func (e *encodedPacket) websocketFrames() ([]byte, error) {
+	e.frameOnce.Do(func() {
+		e.frames, e.frameErr = frame.AutoBinaryFramesBytes(e.raw)
+	})
+	return e.frames, e.frameErr
+}
+
+func (m *defaultClientManager) Broadcast(p mqtt_packet.ControlPacketInterface) clients_dto.BroadcastResult {
+	return m.SendPacketMany(nil, p)
+}
+
+// SendPacketMany   向filter选中的客户端并发发送同一报文,filter为nil时发送给所有客户端;
+// filter在释放管理器的锁之后执行,耗时或panic的filter不会阻塞其他客户端的接入与断开
+func (m *defaultClientManager) SendPacketMany(filter ClientFilter, p mqtt_packet.ControlPacketInterface) clients_dto.BroadcastResult {
+	res := clients_dto.BroadcastResult{Results: map[string]clients_dto.SendResult{}}
+	m.mu.RLock()
+	all := make([]clientInterface, 0, len(m.clientMap))
+	for _, client := range m.clientMap {
+		all = append(all, client)
+	}
+	hooks := m.hooks()
+	m.mu.RUnlock()
+	cs := all
+	if filter != nil {
+		cs = all[:0]
+		for _, client := range all {
+			if filter(client.GetDataBase()) {
+				cs = append(cs, client)
+			}
+		}
+	}
+	res.Total = len(cs)
+	if len(cs) == 0 {
+		return res
+	}
+	var shared *encodedPacket
+	var err error
+	// 有钩子时每个客户端的报文可能被修改,不能共享编码结果
+	if len(hooks) == 0 {
+		shared, err = encodePacket(p)
+		if err != nil {
+			for _, client := range cs {
+				res.Results[client.GetId()] = clients_dto.SendResult{Err: err}
+			}
+			res.Failed = len(cs)
+			return res
+		}
+	}
+	chans := make([]<-chan clients_dto.SendResult, len(cs))
+	jobs := make(chan int)
+	wg := sync.WaitGroup{}
+	workers := broadcastWorkers
+	if len(cs) < workers {
+		workers = len(cs)
+	}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				client := cs[index]
+				if shared != nil {
+					m.storeOutgoing(client.GetId(), p, true)
+					chans[index] = client.asyncWriteEncoded(shared)
+					continue
+				}
+				chans[index] = m.deliverOnce(hooks, client, p)
+			}
+		}()
+	}
+	for index := range cs {
+		jobs <- index
+	}
+	close(jobs)
+	wg.Wait()
+	for index, ch := range chans {
+		r := <-ch
+		res.Results[cs[index].GetId()] = r
+		if r.Err != nil {
+			res.Failed++
+		} else {
+			res.Success++
+		}
+	}
+	return res
+}
+
+// deliverOnce    对单个客户端执行OnDeliver钩子后发送;PUBLISH报文连同固定报头复制后再交给钩子,避免客户端之间相互影响
+func (m *defaultClientManager) deliverOnce(hooks hooksChain, client clientInterface, p mqtt_packet.ControlPacketInterface) <-chan clients_dto.SendResult {
+	if packet, ok := p.(*mqtt_packet.PublishPacket); ok {
+		p = clonePublish(packet)
+	}
+	if err := hooks.onDeliver(client.GetId(), p); err != nil {
+		return sendResultChan(0, err)
+	}
+	m.storeOutgoing(client.GetId(), p, true)
+	return client.AsyncWritePacket(p)
+}
+
+// clonePublish    复制PUBLISH报文;编码时会写入固定报头的剩余长度,浅复制共享报头会在并发编码时相互覆盖
+func clonePublish(p *packets.PublishPacket) *packets.PublishPacket {
+	head := *p.GetFixedHead()
+	cp := packets.NewPublish(&head)
+	cp.TopicName = p.TopicName
+	cp.MessageID = p.MessageID
+	cp.Payload = p.Payload
+	return cp
+}
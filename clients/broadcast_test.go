@@ -0,0 +1,137 @@
+package clients
+
+import (
+	"fmt"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/store"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// retainHook    只为指定客户端设置保留标志
+type retainHook struct {
+	HooksBase
+	id string
+}
+
+func (h retainHook) OnDeliver(id string, p *packets.PublishPacket) error {
+	if id == h.id {
+		p.GetFixedHead().Retain = true
+	}
+	return nil
+}
+
+// TestSendPacketManyHookIsolation    钩子修改固定报头只影响对应的客户端
+func TestSendPacketManyHookIsolation(t *testing.T) {
+	port := freePort(t)
+	m := NewClientManagerInstance(&ClientManagerOptions{
+		TcpPort: port,
+		Hooks:   []Hooks{retainHook{id: "c0"}},
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	const n = 8
+	conns := make([]net.Conn, n)
+	for i := range conns {
+		conns[i], _ = dialMqtt(t, port, fmt.Sprintf("c%d", i), "")
+	}
+	p := publishPacket("news", "hello", 0, 0)
+	if res := m.Broadcast(p); res.Success != n {
+		t.Fatalf("broadcast result %+v", res)
+	}
+	if p.GetFixedHead().Retain {
+		t.Fatal("hook modified the fixed header of the original packet")
+	}
+	for i, c := range conns {
+		got, err := readPacket(c, 5*time.Second)
+		if err != nil {
+			t.Fatalf("c%d: %v", i, err)
+		}
+		pp, ok := got.(*packets.PublishPacket)
+		if !ok || string(pp.Payload) != "hello" {
+			t.Fatalf("c%d: unexpected packet %#v", i, got)
+		}
+		if retain := pp.GetFixedHead().Retain; retain != (i == 0) {
+			t.Fatalf("c%d: retain %v", i, retain)
+		}
+	}
+}
+
+// TestSendPacketManyStoresInflight    批量发送给持久会话的QoS1消息与单个发送一样记为飞行中
+func TestSendPacketManyStoresInflight(t *testing.T) {
+	for _, hooks := range [][]Hooks{nil, {HooksBase{}}} {
+		port := freePort(t)
+		st, err := store.NewFileStore(filepath.Join(t.TempDir(), "session.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := NewClientManagerInstance(&ClientManagerOptions{
+			TcpPort:      port,
+			SessionStore: st,
+			Hooks:        hooks,
+		})
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		if _, code := dialConnect(t, port, connectPacket("s1", false)); code != 0 {
+			t.Fatalf("connack %d", code)
+		}
+		if res := m.Broadcast(publishPacket("news", "hello", 1, 7)); res.Success != 1 {
+			t.Fatalf("broadcast result %+v", res)
+		}
+		inflight, err := st.Inflight("s1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(inflight) != 1 || inflight[0].MessageId != 7 {
+			t.Fatalf("hooks %d: inflight %+v", len(hooks), inflight)
+		}
+		_ = m.Stop()
+	}
+}
+
+// TestSendPacketManyFilterOutsideLock    filter在管理器的锁之外执行,耗时或panic时其他客户端仍能接入
+func TestSendPacketManyFilterOutsideLock(t *testing.T) {
+	port := freePort(t)
+	m, _, _ := limitManager(t, &ClientManagerOptions{TcpPort: port})
+	dialMqtt(t, port, "c0", "")
+
+	started, release := make(chan struct{}), make(chan struct{})
+	done := make(chan clients_dto.BroadcastResult)
+	go func() {
+		done <- m.SendPacketMany(func(db clients_dto.ConnectionDatabase) bool {
+			close(started)
+			<-release
+			return true
+		}, publishPacket("news", "hello", 0, 0))
+	}()
+	<-started
+	// 握手需要管理器的写锁,filter持有读锁时在此超时
+	if _, code := dialMqtt(t, port, "c1", ""); code != 0 {
+		t.Fatalf("connect during a slow filter: %d", code)
+	}
+	close(release)
+	if res := <-done; res.Total != 1 || res.Success != 1 {
+		t.Fatalf("broadcast result %+v", res)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("filter panic is swallowed")
+			}
+		}()
+		m.SendPacketMany(func(clients_dto.ConnectionDatabase) bool { panic("filter") }, publishPacket("news", "hello", 0, 0))
+	}()
+	if _, code := dialMqtt(t, port, "c2", ""); code != 0 {
+		t.Fatalf("connect after a filter panic: %d", code)
+	}
+	if n := m.Len(); n != 3 {
+		t.Fatalf("clients %d", n)
+	}
+}
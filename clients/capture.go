@@ -0,0 +1,232 @@
+package clients
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"os"
+	"sync"
+	"time"
+)
+
+// CaptureOptions   抓包配置,Ids与Filter均为空时抓取全部客户端
+type CaptureOptions struct {
+	File       string       // 抓包文件,每行一条clients_dto.CapturedPacket的JSON;已存在时追加
+	Ids        []string     // 按ClientId选择
+	Filter     ClientFilter // 按条件选择,在开始抓包及客户端链接时判断
+	MaxPackets uint64       // 记录的报文数达到后不再记录,默认:0,不限制
+}
+
+// capture    一次抓包,记录选中客户端收发的报文
+type capture struct {
+	mu      sync.Mutex
+	opt     CaptureOptions
+	ids     map[string]bool
+	file    *os.File
+	w       *bufio.Writer
+	enc     *json.Encoder
+	clients map[string]bool
+	packets uint64
+	start   int64
+	stop    int64
+	err     error
+}
+
+func newCapture(opt CaptureOptions) (*capture, error) {
+	f, err := os.OpenFile(opt.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	c := &capture{
+		opt:     opt,
+		file:    f,
+		w:       bufio.NewWriter(f),
+		clients: map[string]bool{},
+		start:   time.Now().UnixNano(),
+	}
+	c.enc = json.NewEncoder(c.w)
+	if len(opt.Ids) > 0 {
+		c.ids = make(map[string]bool, len(opt.Ids))
+		for _, id := range opt.Ids {
+			c.ids[id] = true
+		}
+	}
+	return c, nil
+}
+
+// match    客户端是否需要抓包
+func (c *capture) match(db clients_dto.ConnectionDatabase) bool {
+	if c.ids == nil && c.opt.Filter == nil {
+		return true
+	}
+	return c.ids[db.Id] || (c.opt.Filter != nil && c.opt.Filter(db))
+}
+
+// attach    开始抓取客户端的报文,先记录其CONNECT报文以便回放。
+// MQTT 5客户端记录的是转换后的3.1.1报文,CONNECT的协议版本也记录为3.1.1
+func (c *capture) attach(client clientInterface) {
+	c.mu.Lock()
+	if c.stop != 0 {
+		c.mu.Unlock()
+		return
+	}
+	c.clients[client.GetId()] = true
+	c.mu.Unlock()
+	if p := client.connectPacket(); p != nil {
+		if p.ProtocolVersion == mqtt5Version {
+			p = withoutPassword(p)
+			p.ProtocolVersion = mqtt311Version
+		}
+		c.recordPacket(client.GetId(), enmu.InboundCapture, p)
+	}
+	client.setCapture(c)
+}
+
+func (c *capture) recordPacket(id string, dir enmu.CaptureDirection, p mqtt_packet.ControlPacketInterface) {
+	if e, err := encodePacket(p); err == nil {
+		c.record(id, dir, e.raw)
+	}
+}
+
+// record    写入一条记录;已停止、写失败或达到MaxPackets后忽略
+func (c *capture) record(id string, dir enmu.CaptureDirection, bs []byte) {
+	if len(bs) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != 0 || c.err != nil || (c.opt.MaxPackets > 0 && c.packets >= c.opt.MaxPackets) {
+		return
+	}
+	c.err = c.enc.Encode(clients_dto.CapturedPacket{
+		Nano:      time.Now().UnixNano(),
+		ClientId:  id,
+		Direction: dir,
+		Type:      bs[0] >> 4,
+		Data:      bs,
+	})
+	if c.err == nil {
+		c.packets++
+	}
+}
+
+// close    停止记录并关闭文件
+func (c *capture) close() clients_dto.CaptureStatistics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop == 0 {
+		c.stop = time.Now().UnixNano()
+		if err := c.w.Flush(); err != nil && c.err == nil {
+			c.err = err
+		}
+		if err := c.file.Close(); err != nil && c.err == nil {
+			c.err = err
+		}
+	}
+	return c.statistics()
+}
+
+// statistics    调用方需持有锁
+func (c *capture) statistics() clients_dto.CaptureStatistics {
+	return clients_dto.CaptureStatistics{
+		File:      c.opt.File,
+		Clients:   len(c.clients),
+		Packets:   c.packets,
+		StartNano: c.start,
+		StopNano:  c.stop,
+		Err:       c.err,
+	}
+}
+
+// StartCapture    开始抓包,同一时间只能有一个抓包;已链接与之后链接的选中客户端都会被记录。
+// 打开文件、执行Filter与记录已链接客户端的CONNECT都在管理器的锁之外进行
+func (m *defaultClientManager) StartCapture(opt CaptureOptions) error {
+	m.mu.RLock()
+	running := m.capture != nil
+	m.mu.RUnlock()
+	if running {
+		return enmu.CaptureRunningError
+	}
+	c, err := newCapture(opt)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if m.capture != nil {
+		m.mu.Unlock()
+		c.close()
+		return enmu.CaptureRunningError
+	}
+	m.capture = c
+	cs := make([]clientInterface, 0, len(m.clientMap))
+	for _, client := range m.clientMap {
+		cs = append(cs, client)
+	}
+	m.mu.Unlock()
+	// 之后链接的客户端由attachCapture在握手时记录;在此期间停止抓包时,c.record不再写入
+	for _, client := range cs {
+		if c.match(client.GetDataBase()) {
+			c.attach(client)
+		}
+	}
+	return nil
+}
+
+// StopCapture    停止抓包并返回统计
+func (m *defaultClientManager) StopCapture() (clients_dto.CaptureStatistics, error) {
+	m.mu.Lock()
+	c := m.capture
+	m.capture = nil
+	if c != nil {
+		for _, client := range m.clientMap {
+			client.setCapture(nil)
+		}
+	}
+	m.mu.Unlock()
+	if c == nil {
+		return clients_dto.CaptureStatistics{}, enmu.CaptureNotRunningError
+	}
+	st := c.close()
+	return st, st.Err
+}
+
+// CaptureStatistics    返回当前抓包的统计
+func (m *defaultClientManager) CaptureStatistics() (clients_dto.CaptureStatistics, error) {
+	m.mu.RLock()
+	c := m.capture
+	m.mu.RUnlock()
+	if c == nil {
+		return clients_dto.CaptureStatistics{}, enmu.CaptureNotRunningError
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.statistics(), nil
+}
+
+// attachCapture    新链接的客户端匹配时开始抓包,在回复CONNACK之前调用;调用方需持有锁
+func (m *defaultClientManager) attachCapture(client clientInterface) {
+	if m.capture != nil && m.capture.match(client.GetDataBase()) {
+		m.capture.attach(client)
+	}
+}
+
+// withoutPassword    复制CONNECT报文并清除密码
+func withoutPassword(p *packets.ConnectPacket) *packets.ConnectPacket {
+	cp := packets.NewConnect(nil)
+	cp.ProtocolName = p.ProtocolName
+	cp.ProtocolVersion = p.ProtocolVersion
+	cp.CleanSession = p.CleanSession
+	cp.WillFlag = p.WillFlag
+	cp.WillQos = p.WillQos
+	cp.WillRetain = p.WillRetain
+	cp.UsernameFlag = p.UsernameFlag
+	cp.Keepalive = p.Keepalive
+	cp.ClientIdentifier = p.ClientIdentifier
+	cp.WillTopic = p.WillTopic
+	cp.WillMessage = p.WillMessage
+	cp.Username = p.Username
+	return cp
+}
@@ -0,0 +1,126 @@
+package clients
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readCaptureFile(t *testing.T, path string) []clients_dto.CapturedPacket {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var list []clients_dto.CapturedPacket
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		var cp clients_dto.CapturedPacket
+		if err = json.Unmarshal(s.Bytes(), &cp); err != nil {
+			t.Fatalf("line %q: %v", s.Text(), err)
+		}
+		list = append(list, cp)
+	}
+	return list
+}
+
+// TestCapture    已链接与之后链接的选中客户端都被记录,CONNECT在最前且不含密码,未选中的客户端不记录
+func TestCapture(t *testing.T) {
+	port := freePort(t)
+	m, _, received := limitManager(t, &ClientManagerOptions{TcpPort: port})
+	dev, _ := dialMqtt(t, port, "dev", "")
+	dialMqtt(t, port, "other", "")
+	file := filepath.Join(t.TempDir(), "capture.jsonl")
+	if err := m.StartCapture(CaptureOptions{File: file, Ids: []string{"dev", "late"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.StartCapture(CaptureOptions{File: file}); !errors.Is(err, enmu.CaptureRunningError) {
+		t.Fatalf("second capture %v", err)
+	}
+	writePacket(t, dev, publishPacket("a", "x", 0, 0))
+	<-received
+	if _, err := m.SendPacketOnce("dev", publishPacket("b", "y", 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPacket(dev, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	late := connectPacket("late", true)
+	late.UsernameFlag, late.Username = true, "u"
+	late.PasswordFlag, late.Password = true, []byte("secret")
+	dialConnect(t, port, late)
+	if st, err := m.CaptureStatistics(); err != nil || st.Clients != 2 || st.StopNano != 0 {
+		t.Fatalf("statistics %+v %v", st, err)
+	}
+	st, err := m.StopCapture()
+	if err != nil || st.Clients != 2 || st.Packets != 5 || st.StopNano == 0 {
+		t.Fatalf("stop %+v %v", st, err)
+	}
+	if _, err = m.StopCapture(); !errors.Is(err, enmu.CaptureNotRunningError) {
+		t.Fatalf("second stop %v", err)
+	}
+	list := readCaptureFile(t, file)
+	want := []struct {
+		id   string
+		dir  enmu.CaptureDirection
+		kind byte
+	}{
+		{"dev", enmu.InboundCapture, 1},
+		{"dev", enmu.InboundCapture, 3},
+		{"dev", enmu.OutboundCapture, 3},
+		{"late", enmu.InboundCapture, 1},
+		{"late", enmu.OutboundCapture, 2},
+	}
+	if len(list) != len(want) {
+		t.Fatalf("records %+v", list)
+	}
+	for i, w := range want {
+		if cp := list[i]; cp.ClientId != w.id || cp.Direction != w.dir || cp.Type != w.kind || cp.Data[0]>>4 != w.kind {
+			t.Fatalf("record %d: %+v", i, cp)
+		}
+	}
+	p, err := mqtt_packet.ReadOnce(bytes.NewReader(list[3].Data))
+	if cp, ok := p.(*packets.ConnectPacket); err != nil || !ok || cp.Username != "u" || cp.PasswordFlag || len(cp.Password) != 0 {
+		t.Fatalf("captured connect %+v %v", p, err)
+	}
+
+	// 打开文件失败时不开始抓包
+	if err = m.StartCapture(CaptureOptions{File: filepath.Join(t.TempDir(), "missing", "capture.jsonl")}); err == nil {
+		t.Fatal("capture into a missing directory")
+	}
+	if _, err = m.CaptureStatistics(); !errors.Is(err, enmu.CaptureNotRunningError) {
+		t.Fatalf("statistics after failed start %v", err)
+	}
+}
+
+// TestCaptureMaxPackets    达到MaxPackets后不再记录
+func TestCaptureMaxPackets(t *testing.T) {
+	port := freePort(t)
+	m, _, received := limitManager(t, &ClientManagerOptions{TcpPort: port})
+	c, _ := dialMqtt(t, port, "dev", "")
+	file := filepath.Join(t.TempDir(), "capture.jsonl")
+	if err := m.StartCapture(CaptureOptions{File: file, MaxPackets: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		writePacket(t, c, publishPacket("a", "x", 0, 0))
+		<-received
+	}
+	st, err := m.StopCapture()
+	if err != nil || st.Packets != 2 {
+		t.Fatalf("stop %+v %v", st, err)
+	}
+	if list := readCaptureFile(t, file); len(list) != 2 || list[0].Type != 1 || list[1].Type != 3 {
+		t.Fatalf("records %+v", list)
+	}
+}
@@ -0,0 +1,217 @@
+package clients
+
+import (
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"sort"
+	"strings"
+)
+
+// connectedEntry   链接时间索引项
+type connectedEntry struct {
+	nano int64
+	id   string
+}
+
+func (e connectedEntry) less(o connectedEntry) bool {
+	if e.nano != o.nano {
+		return e.nano < o.nano
+	}
+	return e.id < o.id
+}
+
+// clientIndex   客户端索引,索引字段在链接期间不会变化;调用方需持有管理器的锁
+type clientIndex struct {
+	ids       *sortedList[string]         // ClientId升序
+	connected *sortedList[connectedEntry] // 链接开始时间升序
+	userNames map[string]map[string]struct{}
+	protocols map[enmu.ClientProtocol]map[string]struct{}
+}
+
+func newClientIndex() *clientIndex {
+	return &clientIndex{
+		ids:       newSortedList(func(a, b string) bool { return a < b }),
+		connected: newSortedList(connectedEntry.less),
+		userNames: map[string]map[string]struct{}{},
+		protocols: map[enmu.ClientProtocol]map[string]struct{}{},
+	}
+}
+
+func (x *clientIndex) add(client clientInterface) {
+	db := client.GetDataBase()
+	if !x.ids.insert(db.Id) {
+		return
+	}
+	x.connected.insert(connectedEntry{nano: db.ConnectedNano, id: db.Id})
+	addToSet(x.userNames, db.UserName, db.Id)
+	addToSet(x.protocols, db.Protocol, db.Id)
+}
+
+func (x *clientIndex) remove(client clientInterface) {
+	db := client.GetDataBase()
+	x.ids.remove(db.Id)
+	x.connected.remove(connectedEntry{nano: db.ConnectedNano, id: db.Id})
+	removeFromSet(x.userNames, db.UserName, db.Id)
+	removeFromSet(x.protocols, db.Protocol, db.Id)
+}
+
+// prefixRange   ClientId前缀对应的ids区间[lo,hi)
+func (x *clientIndex) prefixRange(prefix string) (int, int) {
+	lo := x.ids.search(func(id string) bool { return id >= prefix })
+	hi := x.ids.search(func(id string) bool { return id > prefix && !strings.HasPrefix(id, prefix) })
+	return lo, hi
+}
+
+const sortedBlockSize = 512
+
+// sortedList   分块的有序列表,插入与删除只移动一个块内的元素;按位置访问需要遍历块,复杂度为O(n/sortedBlockSize)
+type sortedList[T comparable] struct {
+	less   func(a, b T) bool
+	blocks [][]T // 每块非空且有序,块之间首尾相接
+	n      int
+}
+
+func newSortedList[T comparable](less func(a, b T) bool) *sortedList[T] {
+	return &sortedList[T]{less: less}
+}
+
+func (l *sortedList[T]) len() int {
+	return l.n
+}
+
+// locate   第一个满足pred的元素所在的块与块内位置,pred须对有序元素单调;都不满足时返回len(blocks),0
+func (l *sortedList[T]) locate(pred func(T) bool) (int, int) {
+	b := sort.Search(len(l.blocks), func(i int) bool {
+		block := l.blocks[i]
+		return pred(block[len(block)-1])
+	})
+	if b == len(l.blocks) {
+		return b, 0
+	}
+	block := l.blocks[b]
+	return b, sort.Search(len(block), func(i int) bool { return pred(block[i]) })
+}
+
+// search   第一个满足pred的元素的位置,都不满足时返回len()
+func (l *sortedList[T]) search(pred func(T) bool) int {
+	b, i := l.locate(pred)
+	for _, block := range l.blocks[:b] {
+		i += len(block)
+	}
+	return i
+}
+
+// insert   插入v,已存在时返回false
+func (l *sortedList[T]) insert(v T) bool {
+	b, i := l.locate(func(e T) bool { return !l.less(e, v) })
+	if b == len(l.blocks) {
+		if b == 0 {
+			l.blocks = append(l.blocks, []T{v})
+			l.n++
+			return true
+		}
+		b--
+		i = len(l.blocks[b])
+	} else if l.blocks[b][i] == v {
+		return false
+	}
+	block := append(l.blocks[b], v)
+	copy(block[i+1:], block[i:])
+	block[i] = v
+	l.blocks[b] = block
+	l.n++
+	if len(block) >= 2*sortedBlockSize {
+		// 拆分为两块,后半块复制到新的底层数组
+		tail := append([]T(nil), block[sortedBlockSize:]...)
+		l.blocks[b] = block[:sortedBlockSize:sortedBlockSize]
+		l.blocks = append(l.blocks, nil)
+		copy(l.blocks[b+2:], l.blocks[b+1:])
+		l.blocks[b+1] = tail
+	}
+	return true
+}
+
+// remove   删除v,不存在时返回false
+func (l *sortedList[T]) remove(v T) bool {
+	b, i := l.locate(func(e T) bool { return !l.less(e, v) })
+	if b == len(l.blocks) || l.blocks[b][i] != v {
+		return false
+	}
+	block := l.blocks[b]
+	if len(block) == 1 {
+		l.blocks = append(l.blocks[:b], l.blocks[b+1:]...)
+	} else {
+		l.blocks[b] = append(block[:i], block[i+1:]...)
+	}
+	l.n--
+	return true
+}
+
+// walk   按顺序(desc为true时逆序)访问位置区间[lo,hi)内的元素,fn返回false时停止
+func (l *sortedList[T]) walk(lo, hi int, desc bool, fn func(T) bool) {
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > l.n {
+		hi = l.n
+	}
+	if lo >= hi {
+		return
+	}
+	if desc {
+		start := l.n
+		for b := len(l.blocks) - 1; b >= 0; b-- {
+			block := l.blocks[b]
+			start -= len(block)
+			for i := min(hi-start, len(block)) - 1; i >= 0 && start+i >= lo; i-- {
+				if !fn(block[i]) {
+					return
+				}
+			}
+			if start <= lo {
+				return
+			}
+		}
+		return
+	}
+	start := 0
+	for _, block := range l.blocks {
+		if start+len(block) > lo {
+			for i := max(lo-start, 0); i < len(block) && start+i < hi; i++ {
+				if !fn(block[i]) {
+					return
+				}
+			}
+		}
+		start += len(block)
+		if start >= hi {
+			return
+		}
+	}
+}
+
+// all   按顺序返回全部元素
+func (l *sortedList[T]) all() []T {
+	vs := make([]T, 0, l.n)
+	for _, block := range l.blocks {
+		vs = append(vs, block...)
+	}
+	return vs
+}
+
+func addToSet[K comparable](m map[K]map[string]struct{}, key K, id string) {
+	set, ok := m[key]
+	if !ok {
+		set = map[string]struct{}{}
+		m[key] = set
+	}
+	set[id] = struct{}{}
+}
+
+func removeFromSet[K comparable](m map[K]map[string]struct{}, key K, id string) {
+	if set, ok := m[key]; ok {
+		delete(set, id)
+		if len(set) == 0 {
+			delete(m, key)
+		}
+	}
+}
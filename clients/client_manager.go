@@ -1,13 +1,22 @@
 package clients
 
 import (
+	"context"
+	"errors"
 	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
 	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
 	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"github.com/qdmc/mqtt_single_proxy/rules"
+	"github.com/qdmc/mqtt_single_proxy/schema"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"log/slog"
 	"net"
 	"net/http"
-	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,30 +25,73 @@ var managerOnce sync.Once
 
 func NewClientManager(opts ...*ClientManagerOptions) ClientManagerInterface {
 	managerOnce.Do(func() {
-		opt := newOptions()
-		if opts != nil && len(opts) == 1 && opts[0] != nil {
-			opt = opt.merge(opts[0])
-		}
-		manager = &defaultClientManager{
-			mu:          sync.RWMutex{},
-			clientMap:   map[string]clientInterface{},
-			tcpListener: nil,
-			udpListener: nil,
-			webListener: nil,
-			opt:         opt,
-		}
+		manager = newClientManager(opts...)
 	})
 	return manager
 }
 
+// NewClientManagerInstance    创建独立于单例的管理器,可在同一进程内运行多个集群节点
+func NewClientManagerInstance(opts ...*ClientManagerOptions) ClientManagerInterface {
+	return newClientManager(opts...)
+}
+
+func newClientManager(opts ...*ClientManagerOptions) *defaultClientManager {
+	opt := newOptions()
+	if opts != nil && len(opts) == 1 && opts[0] != nil {
+		opt = opt.merge(opts[0])
+	}
+	m := &defaultClientManager{
+		mu:          sync.RWMutex{},
+		clientMap:   map[string]clientInterface{},
+		index:       newClientIndex(),
+		tcpListener: nil,
+		udpListener: nil,
+		webListener: nil,
+		journal:     newJournal(opt.JournalSize),
+		flap:        newFlapDetector(),
+		rules:       rules.NewEngine(),
+		schemas:     schema.NewRegistry(),
+		logLevels:   newLogLevels(),
+		mounts:      newTopicMounts(),
+	}
+	m.dispatcher = newDispatcher(opt.DispatchWorkers, opt.DispatchQueue, m.logPanic)
+	m.delayed = newDelayedQueue(m.releaseDelayed)
+	m.sequencer = newDispatchSequencer()
+	m.opts.Store(opt)
+	return m
+}
+
 type defaultClientManager struct {
 	mu          sync.RWMutex
 	clientMap   map[string]clientInterface
+	index       *clientIndex
 	tcpListener *net.TCPListener
 	udpListener net.Listener
 	webListener *net.TCPListener
-	opt         *ClientManagerOptions
+	opts        atomic.Pointer[ClientManagerOptions] // 运行中可被ReloadOptions整体替换
 	isStart     bool
+	dispatcher  *dispatcher
+	httpServer  *http.Server
+	journal     *journal
+	flap        *flapDetector
+	forwarded   []*net.IPNet // 可信的http代理网段,Start时解析
+	cluster     *cluster     // 未开启集群时为nil
+	sessionMu   sync.Mutex
+	session     sessionState
+	expiryStop  chan struct{} // 未开启会话过期时为nil
+	expiryDone  chan struct{}
+	rules       *rules.Engine
+	schemas     *schema.Registry
+	delayed     *delayedQueue
+	sequencer   *dispatchSequencer
+	capture     *capture // 未抓包时为nil
+	logLevels   *logLevels
+	mounts      *topicMounts // 在线客户端的挂载点
+}
+
+// options    当前配置,只读;修改时复制后整体替换
+func (m *defaultClientManager) options() *ClientManagerOptions {
+	return m.opts.Load()
 }
 
 func (m *defaultClientManager) Len() int {
@@ -48,8 +100,17 @@ func (m *defaultClientManager) Len() int {
 	return len(m.clientMap)
 }
 func (m *defaultClientManager) doTcpConnection(conn net.Conn) {
-	client, err := handshakeTcp(conn, m.opt.Handshake, m.opt.MaxHandshakeTime)
+	_, span := m.rootSpan("mqtt.handshake", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("mqtt.protocol", string(enmu.TcpProtocol))))
+	client, err := handshakeTcp(conn, m.options())
+	// PROXY协议头在首次读取时解析,握手设置期限之后再取地址,避免无期限地阻塞
+	span.SetAttributes(attribute.String("network.peer.address", addrString(conn.RemoteAddr())))
+	if err == nil {
+		span.SetAttributes(attribute.String("messaging.client_id", client.GetId()))
+	}
+	endSpan(span, err)
 	if err != nil {
+		m.log(slog.LevelWarn, "handshake failed", "", append(connAttrs(conn.RemoteAddr(), enmu.TcpProtocol), slog.Any("err", err))...)
 		conn.Close()
 		return
 	}
@@ -58,16 +119,31 @@ func (m *defaultClientManager) doTcpConnection(conn net.Conn) {
 func (m *defaultClientManager) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	var conn net.Conn
 	var err error
-	conn, err = websocketUpgradeHandler(req, w, m.opt.WebsocketHandle)
+	_, span := m.rootSpan("mqtt.handshake", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("network.peer.address", req.RemoteAddr), attribute.String("mqtt.protocol", string(enmu.Websocket))))
+	defer func() {
+		endSpan(span, err)
+	}()
+	conn, err = websocketUpgradeHandler(req, w, m.options().WebsocketHandle)
 	if err != nil {
+		m.log(slog.LevelWarn, "websocket upgrade failed", "", slog.String("remote_addr", req.RemoteAddr),
+			slog.String("protocol", string(enmu.Websocket)), slog.String("path", req.URL.Path), slog.Any("err", err))
 		httpResponseError(w, 404, err)
 		return
 	}
+	m.log(slog.LevelDebug, "accept", "", connAttrs(conn.RemoteAddr(), enmu.Websocket)...)
+	defer func() {
+		if err != nil {
+			m.log(slog.LevelWarn, "handshake failed", "", append(connAttrs(conn.RemoteAddr(), enmu.Websocket), slog.Any("err", err))...)
+			_ = conn.Close()
+		}
+	}()
 	err = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
 	if err != nil {
 		return
 	}
-	_, err = conn.Write(makeServerHandshakeBytes(req))
+	subprotocol := selectSubprotocol(req)
+	_, err = conn.Write(makeServerHandshakeBytes(req, subprotocol))
 	if err != nil {
 		return
 	}
@@ -79,93 +155,527 @@ func (m *defaultClientManager) ServeHTTP(w http.ResponseWriter, req *http.Reques
 	if err != nil {
 		return
 	}
-	client, err := handshakeWebsocket(conn, m.opt.Handshake, m.opt.MaxHandshakeTime)
+	httpCtx := newHttpContext(req, conn.RemoteAddr())
+	m.mu.RLock()
+	trusted := m.forwarded
+	m.mu.RUnlock()
+	addr := realRemoteAddr(conn.RemoteAddr(), httpCtx.ForwardedFor, trusted)
+	client, err := handshakeWebsocket(conn, httpCtx, addr, m.options())
 	if err != nil {
 		return
 	}
+	client.subprotocol = subprotocol
+	span.SetAttributes(attribute.String("messaging.client_id", client.GetId()))
 	go m.addClient(client)
 }
 func (m *defaultClientManager) addClient(client clientInterface) {
+	var tasks dispatchBatch
+	var started bool
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	defer func() {
+		m.unlockAndDispatch(&tasks)
+		// 链接回调与会话恢复入队后再开始读取,保证先于该客户端的报文回调执行
+		if started {
+			go client.AsyncDoConnection()
+		}
+	}()
 	if !m.isStart {
+		client.ForceClose()
 		return
 	}
 	id := client.GetId()
-	if oldClient, ok := m.clientMap[id]; ok {
-		oldClient.DisConnect(true)
-		db := oldClient.GetDataBase()
-		m.doDisConnectCb(&db)
-		delete(m.clientMap, id)
+	mount, ok := m.mountPointOf(client)
+	if !ok {
+		m.log(slog.LevelWarn, "handshake rejected", id, append(clientAttrs(client.GetDataBase()), slog.String("reason", "invalid mount point"))...)
+		m.rejectClient(client, enmu.UserNameOrPasswordError)
+		return
+	}
+	if m.flap.isBanned(id) {
+		m.log(slog.LevelWarn, "handshake rejected", id, append(clientAttrs(client.GetDataBase()), slog.Any("err", enmu.ClientIdBannedError))...)
+		m.rejectClient(client, enmu.ServeError)
+		return
+	}
+	oldClient, isLocal := m.clientMap[id]
+	if isLocal || m.cluster.owner(id) != "" {
+		switch m.options().TakeoverPolicy {
+		case enmu.RejectNewPolicy:
+			m.log(slog.LevelWarn, "handshake rejected", id, append(clientAttrs(client.GetDataBase()), slog.String("reason", "duplicate client id"))...)
+			m.rejectClient(client, enmu.IdError)
+			return
+		case enmu.AllowBothPolicy:
+			newId, err := m.suffixId(id)
+			if err != nil {
+				m.log(slog.LevelWarn, "handshake rejected", id, append(clientAttrs(client.GetDataBase()), slog.Any("err", err))...)
+				m.rejectClient(client, enmu.IdError)
+				return
+			}
+			id = newId
+			client.setId(id)
+		default:
+			// 本节点的旧客户端在此断开,其他节点的旧客户端在收到claim后断开
+			if isLocal {
+				m.log(slog.LevelInfo, "takeover", id, append(clientAttrs(client.GetDataBase()), slog.String("old_addr", addrString(oldClient.GetDataBase().Addr)))...)
+				m.takeoverClient(oldClient, &tasks)
+			}
+			window := time.Duration(m.options().FlapWindow) * time.Second
+			banTime := time.Duration(m.options().FlapBanTime) * time.Second
+			if m.flap.takeover(id, m.options().FlapThreshold, window, banTime) {
+				m.log(slog.LevelWarn, "client id banned for flapping", id, clientAttrs(client.GetDataBase())...)
+				m.rejectClient(client, enmu.ServeError)
+				return
+			}
+		}
+	}
+	m.mountClient(client, mount)
+	m.attachCapture(client)
+	sessionPresent := m.openSession(client, &tasks)
+	if err := client.writeConnAck(enmu.Success, sessionPresent); err != nil {
+		m.log(slog.LevelWarn, "handshake failed", id, append(clientAttrs(client.GetDataBase()), slog.Any("err", err))...)
+		client.ForceClose()
+		return
 	}
-	m.clientMap[id] = client
-	go m.doConnectedCb(id)
+	m.log(slog.LevelInfo, "connected", id, append(clientAttrs(client.GetDataBase()), slog.Bool("session_present", sessionPresent))...)
+	m.putClient(client)
+	m.cluster.claim(id, client.GetDataBase().ConnectedNano)
+	m.journal.record(newJournalEvent(enmu.ConnectEvent, client.GetDataBase()))
+	client.SetTimeOut(m.options().ClientTimeOut)
+	client.SetStatistics(m.options().IsStatistics)
+	client.SetPacketHandle(func(id string, p mqtt_packet.ControlPacketInterface) {
+		m.doPacketCb(client, id, p)
+	})
+	client.SetDisConnectCallback(func(cd *clients_dto.ConnectionDatabase) {
+		m.doDisConnectCb(client, cd)
+	})
+	m.doConnectedCb(client, &tasks)
+	if sessionPresent {
+		tasks.add(id, func() { m.restoreSession(client) })
+	}
+	started = true
 }
-func (m *defaultClientManager) List(start, end int) (int, []clients_dto.ConnectionDatabase) {
+
+// takeoverClient    移除被接管的客户端并发出断开事件,保证同一ClientId的断开回调在新链接回调之前;调用方需持有锁
+func (m *defaultClientManager) takeoverClient(oldClient clientInterface, tasks *dispatchBatch) {
+	m.removeClient(oldClient)
+	oldClient.DisConnect(true)
+	db := oldClient.GetDataBase()
+	db.Status = false
+	db.CloseNano = time.Now().UnixNano()
+	db.Err = enmu.ClientTakeoverError
+	m.emitDisconnect(&db, tasks)
+}
+
+// clusterTakeover    其他节点接入了相同ClientId的客户端,KickOldPolicy下断开本地客户端;
+// 两个节点同时接入时按接入时间与节点Id排序,本地客户端保留时返回false。nano为0(对端未带接入时间)时按对端较新处理
+func (m *defaultClientManager) clusterTakeover(id, node string, nano int64) bool {
+	var tasks dispatchBatch
+	m.mu.Lock()
+	defer m.unlockAndDispatch(&tasks)
+	if m.options().TakeoverPolicy == enmu.RejectNewPolicy || m.options().TakeoverPolicy == enmu.AllowBothPolicy {
+		return true
+	}
+	client, ok := m.clientMap[id]
+	if !ok {
+		return true
+	}
+	if local := client.GetDataBase().ConnectedNano; nano != 0 && (local > nano || local == nano && m.cluster.nodeId > node) {
+		m.log(slog.LevelInfo, "cluster takeover ignored", id, append(clientAttrs(client.GetDataBase()), slog.String("node", node))...)
+		return false
+	}
+	m.log(slog.LevelInfo, "cluster takeover", id, clientAttrs(client.GetDataBase())...)
+	m.takeoverClient(client, &tasks)
+	return true
+}
+
+// localIds    返回本节点的ClientId
+func (m *defaultClientManager) localIds() []string {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
-	var ds []clients_dto.ConnectionDatabase
-	var cs clients
-	length := len(m.clientMap)
-	if length == 0 {
-		return length, ds
+	return m.index.ids.all()
+}
+
+// deliverRemote    处理其他节点转发的PUBLISH:在发布者的分发分片中执行PacketCb与PacketContextCb(ctx中带有来源节点,见ClusterOrigin),
+// 在各订阅者的分发分片中按QoS0投递,投递前执行OnDeliver钩子;OnPublish钩子、规则、负载校验与持久化已在来源节点执行。
+// 分片队列满时丢弃,不阻塞节点链接的读协程
+func (m *defaultClientManager) deliverRemote(node, publisher string, ids []string, topic string, payload []byte) {
+	m.mu.RLock()
+	var cs []clientInterface
+	for _, id := range ids {
+		if client, ok := m.clientMap[id]; ok {
+			cs = append(cs, client)
+		}
 	}
-	for _, client := range m.clientMap {
-		cs = append(cs, client)
+	hooks, d, opt := m.hooks(), m.dispatcher, m.options()
+	m.mu.RUnlock()
+	newPublish := func() *packets.PublishPacket {
+		p := packets.NewPublish(nil)
+		p.TopicName = topic
+		p.Payload = payload
+		return p
+	}
+	if opt.PacketCb != nil || opt.PacketContextCb != nil {
+		ok := d.tryDispatch(publisher, func() {
+			m.runPacketCb(context.WithValue(context.Background(), clusterOriginKey{}, node), publisher, newPublish())
+		})
+		if !ok {
+			m.log(slog.LevelWarn, "cluster publish callback dropped", publisher, slog.String("topic", topic), slog.String("node", node))
+		}
 	}
-	sort.Sort(cs)
-	for index, c := range cs {
-		if index >= start && index < end {
-			ds = append(ds, c.GetDataBase())
+	for _, client := range cs {
+		client := client
+		if !d.tryDispatch(client.GetId(), func() { m.deliverOnce(hooks, client, newPublish()) }) {
+			m.log(slog.LevelWarn, "cluster publish dropped", client.GetId(), slog.String("topic", topic))
 		}
 	}
+}
+
+// rejectClient    回复CONNACK拒绝码后关闭链接
+func (m *defaultClientManager) rejectClient(client clientInterface, code enmu.HandshakeResult) {
+	_ = client.writeConnAck(code, false)
+	client.ForceClose()
+}
+
+// List    按ClientId降序返回[start,end)区间的客户端
+func (m *defaultClientManager) List(start, end int) (int, []clients_dto.ConnectionDatabase) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var ds []clients_dto.ConnectionDatabase
+	length := m.index.ids.len()
+	if start < 0 {
+		start = 0
+	}
+	m.index.ids.walk(length-end, length-start, true, func(id string) bool {
+		if client, ok := m.clientMap[id]; ok {
+			ds = append(ds, client.GetDataBase())
+		}
+		return true
+	})
 	return length, ds
 }
 
+// unlockAndDispatch    释放管理器的锁后投递tasks;回调中调用SendPacketOnce等需要管理器锁的方法时,分片队列满也不会死锁
+func (m *defaultClientManager) unlockAndDispatch(tasks *dispatchBatch) {
+	if len(*tasks) == 0 {
+		m.mu.Unlock()
+		return
+	}
+	ticket, d := m.sequencer.take(), m.dispatcher
+	m.mu.Unlock()
+	m.sequencer.run(ticket, func() {
+		for _, task := range *tasks {
+			d.dispatch(task.id, task.fn)
+		}
+	})
+}
+
+// putClient    加入客户端并建立索引,调用方需持有锁
+func (m *defaultClientManager) putClient(client clientInterface) {
+	m.clientMap[client.GetId()] = client
+	m.index.add(client)
+}
+
+// removeClient    移除客户端及其索引,调用方需持有锁
+func (m *defaultClientManager) removeClient(client clientInterface) {
+	delete(m.clientMap, client.GetId())
+	m.mounts.set(client.GetId(), "")
+	m.index.remove(client)
+}
+
 func (m *defaultClientManager) Start() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	var err error
-	defer func() {
+	if m.isStart {
+		return nil
+	}
+	if m.dispatcher.stopped() {
+		m.dispatcher = newDispatcher(m.options().DispatchWorkers, m.options().DispatchQueue, m.logPanic)
+	}
+	err := m.options().ClientIdRule.compile()
+	if err != nil {
+		return err
+	}
+	if err = m.options().TopicMapping.compile(); err != nil {
+		return err
+	}
+	var pp *proxyProtocol
+	if m.options().ProxyProtocol {
+		pp, err = newProxyProtocol(m.options().ProxyTrusted, time.Duration(m.options().MaxHandshakeTime)*time.Second)
 		if err != nil {
-			m.isStart = true
-		} else {
-
+			return err
 		}
-	}()
-	// todo
+	}
+	m.forwarded, err = parseCidrs(m.options().ForwardedTrusted)
+	if err != nil {
+		return err
+	}
+	err = m.rules.Load(m.options().Rules)
+	if err != nil {
+		return err
+	}
+	err = m.loadSessions()
+	if err != nil {
+		return err
+	}
+	delayed, err := m.storedDelayed()
+	if err != nil {
+		return err
+	}
+	err = m.journal.open(m.options().JournalFile)
+	if err != nil {
+		return err
+	}
+	m.cluster = nil
+	if m.options().ClusterNodeId != "" {
+		cl := newCluster(m, m.options())
+		if err = cl.start(); err != nil {
+			_ = m.journal.close()
+			return err
+		}
+		m.cluster = cl
+	}
+	tcpListener, err := m.listenTcp(m.options(), pp)
+	if err != nil {
+		m.cluster.stop()
+		_ = m.journal.close()
+		return err
+	}
+	m.tcpListener = tcpListener
+	if m.options().IsWebsocket {
+		m.webListener, m.httpServer, err = m.listenWebsocket(m.options(), pp)
+		if err != nil {
+			_ = tcpListener.Close()
+			m.tcpListener = nil
+			m.cluster.stop()
+			_ = m.journal.close()
+			return err
+		}
+	}
+	m.delayed.start(delayed)
+	m.startSessionExpiry()
+	m.isStart = true
 	return nil
 }
 
-func (m *defaultClientManager) Stop() error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if !m.isStart {
-		return nil
+// listenTcp    启动tcp监听
+func (m *defaultClientManager) listenTcp(opt *ClientManagerOptions, pp *proxyProtocol) (*net.TCPListener, error) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{Port: int(opt.TcpPort)})
+	if err != nil {
+		return nil, err
+	}
+	go m.acceptTcp(l, pp)
+	return l, nil
+}
+
+// listenWebsocket    启动websocket监听;关闭返回的http.Server不影响已升级的链接
+func (m *defaultClientManager) listenWebsocket(opt *ClientManagerOptions, pp *proxyProtocol) (*net.TCPListener, *http.Server, error) {
+	webListener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: int(opt.WebsocketPort)})
+	if err != nil {
+		return nil, nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(opt.WebsocketPath, m)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: time.Duration(opt.MaxHandshakeTime) * time.Second,
 	}
+	var l net.Listener = webListener
+	if pp != nil {
+		l = &proxyListener{Listener: webListener, pp: pp}
+	}
+	go server.Serve(l)
+	return webListener, server, nil
+}
+
+// acceptTcp    tcp监听循环,监听关闭后退出
+func (m *defaultClientManager) acceptTcp(l *net.TCPListener, pp *proxyProtocol) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			m.log(slog.LevelError, "accept failed", "", slog.Any("err", err))
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		m.log(slog.LevelDebug, "accept", "", connAttrs(conn.RemoteAddr(), enmu.TcpProtocol)...)
+		go m.doTcpConnection(pp.wrap(conn))
+	}
+}
+
+// closeListeners    关闭所有监听,调用方需持有锁
+func (m *defaultClientManager) closeListeners() error {
 	var err error
-	err = m.tcpListener.Close()
+	if m.tcpListener != nil {
+		err = m.tcpListener.Close()
+		m.tcpListener = nil
+	}
 	if m.udpListener != nil {
 		err = m.udpListener.Close()
+		m.udpListener = nil
 	}
-	if m.webListener != nil {
+	if e := m.closeWebsocket(); e != nil {
+		err = e
+	}
+	return err
+}
+
+// closeWebsocket    关闭websocket监听,调用方需持有锁
+func (m *defaultClientManager) closeWebsocket() error {
+	var err error
+	if m.httpServer != nil {
+		err = m.httpServer.Close()
+	} else if m.webListener != nil {
 		err = m.webListener.Close()
 	}
+	m.httpServer, m.webListener = nil, nil
+	return err
+}
+
+func (m *defaultClientManager) Stop() error {
+	m.mu.Lock()
+	if !m.isStart {
+		m.mu.Unlock()
+		return nil
+	}
+	err := m.closeListeners()
+	m.cluster.stop()
+	m.delayed.stop()
+	expiryDone := m.stopSessionExpiry()
 	for _, client := range m.clientMap {
 		go client.DisConnect(true)
 	}
 	m.clientMap = map[string]clientInterface{}
+	m.index = newClientIndex()
 	m.isStart = false
+	_ = m.journal.close()
+	d := m.dispatcher
+	m.mu.Unlock()
+	// 在锁外等待已入队的回调执行完成,回调中可能调用需要管理器锁的方法;在回调中调用Stop时不等待
+	d.stop()
+	if expiryDone != nil {
+		<-expiryDone
+	}
 	return err
 }
 
+// Shutdown   优雅关闭:停止监听,向客户端发送DISCONNECT并写完发送队列,等待读协程与回调结束;ctx到期后强制关闭剩余链接。
+// 在回调中调用时在后台完成关闭,立即返回
+func (m *defaultClientManager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	if !m.isStart {
+		m.mu.Unlock()
+		return nil
+	}
+	err := m.closeListeners()
+	m.cluster.stop()
+	m.delayed.stop()
+	expiryDone := m.stopSessionExpiry()
+	m.isStart = false
+	var cs []clientInterface
+	for _, client := range m.clientMap {
+		cs = append(cs, client)
+	}
+	d := m.dispatcher
+	m.mu.Unlock()
+	// 在回调中调用时等待会阻塞该分片,读协程可能因分片队列满而无法结束;改为在后台完成关闭
+	if d.inWorker() {
+		go func() { _ = m.awaitShutdown(ctx, cs, d, expiryDone) }()
+		return err
+	}
+	if waitErr := m.awaitShutdown(ctx, cs, d, expiryDone); waitErr != nil {
+		return waitErr
+	}
+	return err
+}
+
+// awaitShutdown    向客户端发送DISCONNECT并等待链接与回调结束,最后清空客户端
+func (m *defaultClientManager) awaitShutdown(ctx context.Context, cs []clientInterface, d *dispatcher, expiryDone <-chan struct{}) error {
+	defer func() {
+		m.mu.Lock()
+		m.clientMap = map[string]clientInterface{}
+		m.index = newClientIndex()
+		_ = m.journal.close()
+		m.mu.Unlock()
+	}()
+	// 阻塞策略下DISCONNECT入队可能等待WriteTimeOut,并发发送,ctx到期后ForceClose使其返回
+	for _, client := range cs {
+		go client.Shutdown()
+	}
+	for _, client := range cs {
+		select {
+		case <-client.Done():
+		case <-ctx.Done():
+			for _, c := range cs {
+				c.ForceClose()
+			}
+			go d.stop()
+			return ctx.Err()
+		}
+	}
+	stopped := make(chan struct{})
+	go func() {
+		d.stop()
+		if expiryDone != nil {
+			<-expiryDone
+		}
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (m *defaultClientManager) SetOptions(options *ClientManagerOptions) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if m.isStart {
 		return
 	}
-	m.opt = m.opt.merge(options)
+	m.setOptions(options)
+}
+
+// setOptions    未启动时替换配置,调用方需持有锁
+func (m *defaultClientManager) setOptions(options *ClientManagerOptions) {
+	m.opts.Store(m.options().merge(options))
+	if m.options().JournalSize != len(m.journal.events) {
+		m.journal = newJournal(m.options().JournalSize)
+	}
+	if m.options().DispatchWorkers != m.dispatcher.workers() || m.options().DispatchQueue != m.dispatcher.queueSize {
+		m.dispatcher.stop()
+		m.dispatcher = newDispatcher(m.options().DispatchWorkers, m.options().DispatchQueue, m.logPanic)
+	}
+}
+func (m *defaultClientManager) AddHooks(hs ...Hooks) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.isStart {
+		return
+	}
+	opt := *m.options()
+	opt.Hooks = append(append([]Hooks{}, opt.Hooks...), hs...)
+	m.opts.Store(&opt)
+}
+
+// Journal    查询链接日志(链接与断开事件),结果按时间先后排列
+func (m *defaultClientManager) Journal(q clients_dto.JournalQuery) []clients_dto.JournalEvent {
+	m.mu.RLock()
+	j := m.journal
+	m.mu.RUnlock()
+	return j.query(q)
+}
+func (m *defaultClientManager) ClusterNodes() []clients_dto.ClusterNode {
+	m.mu.RLock()
+	cl := m.cluster
+	m.mu.RUnlock()
+	return cl.nodes()
+}
+func (m *defaultClientManager) DispatchStatistics() clients_dto.DispatchStatistics {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.dispatcher.statistics()
 }
 func (m *defaultClientManager) CloseOnce(id string) error {
 	m.mu.Lock()
@@ -185,47 +695,196 @@ func (m *defaultClientManager) GetOnce(id string) (*clients_dto.ConnectionDataba
 	}
 	return nil, enmu.NotFoundClientError
 }
-func (m *defaultClientManager) SendPacketOnce(id string, p mqtt_packet.ControlPacketInterface) (int64, error) {
+func (m *defaultClientManager) SetTags(id string, tags map[string]string) error {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 	if client, ok := m.clientMap[id]; ok {
-		return client.WritePacketOnce(p)
+		client.SetTags(tags)
+		return nil
+	}
+	return enmu.NotFoundClientError
+}
+func (m *defaultClientManager) SendPacketOnce(id string, p mqtt_packet.ControlPacketInterface) (int64, error) {
+	res := <-m.AsyncSendPacketOnce(id, p)
+	return res.Length, res.Err
+}
+func (m *defaultClientManager) AsyncSendPacketOnce(id string, p mqtt_packet.ControlPacketInterface) <-chan clients_dto.SendResult {
+	return m.sendPacket(id, p, nil)
+}
+
+// sendPacket    props为MQTT 5客户端的PUBLISH中写入的用户属性
+func (m *defaultClientManager) sendPacket(id string, p mqtt_packet.ControlPacketInterface, props userProperties) <-chan clients_dto.SendResult {
+	// 只在锁内查找客户端,阻塞策略下入队可能等待WriteTimeOut,不能持有管理器的锁
+	m.mu.RLock()
+	client, ok := m.clientMap[id]
+	m.mu.RUnlock()
+	if ok {
+		if err := m.hooks().onDeliver(id, p); err != nil {
+			return sendResultChan(0, err)
+		}
+		m.storeOutgoing(id, p, true)
+		if len(props) == 0 {
+			return client.AsyncWritePacket(p)
+		}
+		e, err := encodePacket(p)
+		if err != nil {
+			return sendResultChan(0, err)
+		}
+		e.userProperties = props
+		return client.asyncWriteEncoded(e)
+	}
+	if m.storeOutgoing(id, p, false) {
+		ch := make(chan clients_dto.SendResult, 1)
+		ch <- clients_dto.SendResult{Queued: true}
+		return ch
 	}
-	return 0, enmu.NotFoundClientError
+	return sendResultChan(0, enmu.NotFoundClientError)
 }
-func (m *defaultClientManager) doDisConnectCb(cd *clients_dto.ConnectionDatabase) {
+
+// doDisConnectCb    客户端断开;只处理仍在管理器中的客户端,已被接管的客户端在接管时已发出断开事件
+func (m *defaultClientManager) doDisConnectCb(client clientInterface, cd *clients_dto.ConnectionDatabase) {
+	var tasks dispatchBatch
 	m.mu.Lock()
-	defer m.mu.Unlock()
+	defer m.unlockAndDispatch(&tasks)
 	if cd == nil {
 		return
 	}
-	if _, ok := m.clientMap[cd.Id]; ok {
-		delete(m.clientMap, cd.Id)
-		if m.opt.DisConnectCb != nil {
-			go m.opt.DisConnectCb(cd)
-		}
+	if current, ok := m.clientMap[cd.Id]; ok && current == client {
+		m.removeClient(client)
+		m.emitDisconnect(cd, &tasks)
 	}
 }
-func (m *defaultClientManager) doPacketCb(id string, p mqtt_packet.ControlPacketInterface) {
-	if m.opt.PacketCb != nil {
-		go m.opt.PacketCb(id, p)
+
+// emitDisconnect    记录断开日志,断开钩子与回调加入tasks;调用方需持有锁
+func (m *defaultClientManager) emitDisconnect(cd *clients_dto.ConnectionDatabase, tasks *dispatchBatch) {
+	m.journal.record(newJournalEvent(enmu.DisconnectEvent, *cd))
+	m.logDisconnect(cd)
+	m.closeSession(cd.Id, tasks)
+	if cd.CleanSession {
+		m.delayed.clearPubRel(cd.Id)
+	}
+	if cl := m.cluster; cl != nil {
+		cl.release(cd.Id)
+		tasks.add(cd.Id, func() { cl.removeClient(cd.Id) })
+	}
+	hooks, cb, whs := m.hooks(), m.options().DisConnectCb, m.options().Webhooks
+	if len(hooks) > 0 || cb != nil || len(whs) > 0 {
+		tasks.add(cd.Id, func() {
+			hooks.OnDisconnect(cd)
+			if len(whs) > 0 {
+				emitWebhook(whs, disconnectedWebhookEvent(cd))
+			}
+			if cb != nil {
+				cb(cd)
+			}
+		})
 	}
 }
-func (m *defaultClientManager) doConnectedCb(id string) {
-	if m.opt.ConnectedCb != nil {
-		go m.opt.ConnectedCb(id)
+func (m *defaultClientManager) doPacketCb(client clientInterface, id string, p mqtt_packet.ControlPacketInterface) {
+	if m.replyPubRel(id, p) {
+		return
+	}
+	opt := m.options()
+	hooks, cb, cl, st, delayed := m.hooks(), opt.PacketCb, m.cluster, opt.SessionStore, isDelayed(p)
+	if len(hooks) == 0 && cb == nil && opt.PacketContextCb == nil && cl == nil && st == nil && len(opt.Webhooks) == 0 && m.rules.Len() == 0 && m.schemas.Len() == 0 && !delayed {
+		return
+	}
+	ctx, span := context.Background(), trace.Span(noop.Span{})
+	if pp, ok := p.(*packets.PublishPacket); ok {
+		ctx, span = m.tracePublish(client, id, pp)
 	}
+	_, queued := m.startSpan(ctx, "mqtt.dispatch")
+	m.dispatcher.dispatch(id, func() {
+		queued.End()
+		defer span.End()
+		var delay int64
+		if delayed {
+			// 延迟发布:钩子、负载校验看到的是目标主题,规则与路由在到期时执行
+			pp := p.(*packets.PublishPacket)
+			d, topic, err := parseDelayed(pp.TopicName, m.options().MaxDelay)
+			if err != nil {
+				m.log(slog.LevelWarn, "delayed message dropped", id, slog.String("topic", pp.TopicName), slog.Any("err", err))
+				return
+			}
+			delay, pp.TopicName = d, topic
+		}
+		if len(hooks) > 0 {
+			_, hs := m.startSpan(ctx, "mqtt.hooks")
+			err := hooks.onPacket(id, p)
+			endSpan(hs, err)
+			if err != nil {
+				return
+			}
+		}
+		if pp, ok := p.(*packets.PublishPacket); ok {
+			var dropped bool
+			if ctx, dropped = m.applySchemas(ctx, id, pp); dropped {
+				return
+			}
+			if delayed {
+				m.scheduleDelayed(id, pp, delay)
+				return
+			}
+			if m.applyRules(ctx, id, pp) {
+				return
+			}
+		}
+		m.routePacket(ctx, id, p)
+	})
 }
 
-type clients []clientInterface
-
-func (cs clients) Len() int {
-	return len(cs)
+// routePacket    钩子与规则之后的处理:会话持久化、集群转发、webhook、PacketCb、保留消息下发
+func (m *defaultClientManager) routePacket(ctx context.Context, id string, p mqtt_packet.ControlPacketInterface) {
+	ctx, span := m.startSpan(ctx, "mqtt.route")
+	defer span.End()
+	cl, st, whs := m.cluster, m.options().SessionStore, m.options().Webhooks
+	if st != nil {
+		m.onSessionPacket(id, p)
+	}
+	if len(whs) > 0 {
+		m.emitPacketWebhook(whs, id, p)
+	}
+	if cl != nil {
+		cl.onPacket(id, p)
+	}
+	m.runPacketCb(ctx, id, p)
+	if sp, ok := p.(*packets.SubscribePacket); ok && st != nil {
+		m.deliverRetained(id, sp)
+	}
 }
-func (cs clients) Less(i, j int) bool {
-	return cs[i].GetId() > cs[j].GetId()
+
+// runPacketCb    执行PacketCb与PacketContextCb,在mqtt.callback span中
+func (m *defaultClientManager) runPacketCb(ctx context.Context, id string, p mqtt_packet.ControlPacketInterface) {
+	cb, ctxCb := m.options().PacketCb, m.options().PacketContextCb
+	if cb == nil && ctxCb == nil {
+		return
+	}
+	ctx, span := m.startSpan(ctx, "mqtt.callback")
+	defer span.End()
+	if cb != nil {
+		cb(id, p)
+	}
+	if ctxCb != nil {
+		ctxCb(ctx, id, p)
+	}
 }
 
-func (cs clients) Swap(i, j int) {
-	cs[i], cs[j] = cs[j], cs[i]
+// doConnectedCb    链接回调与webhook加入tasks;调用方需持有锁
+func (m *defaultClientManager) doConnectedCb(client clientInterface, tasks *dispatchBatch) {
+	id, cb, whs := client.GetId(), m.options().ConnectedCb, m.options().Webhooks
+	if cb == nil && len(whs) == 0 {
+		return
+	}
+	var ev clients_dto.WebhookEvent
+	if len(whs) > 0 {
+		ev = connectedWebhookEvent(client.GetDataBase())
+	}
+	tasks.add(id, func() {
+		if len(whs) > 0 {
+			emitWebhook(whs, ev)
+		}
+		if cb != nil {
+			cb(id)
+		}
+	})
 }
@@ -0,0 +1,318 @@
+package clients
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultQueryLimit = 100
+
+// clientMatcher   查询条件匹配
+type clientMatcher struct {
+	q     clients_dto.ClientQuery
+	ipNet *net.IPNet
+}
+
+func newClientMatcher(q clients_dto.ClientQuery) (*clientMatcher, error) {
+	cm := &clientMatcher{q: q}
+	if q.Cidr != "" {
+		_, ipNet, err := net.ParseCIDR(q.Cidr)
+		if err != nil {
+			return nil, err
+		}
+		cm.ipNet = ipNet
+	}
+	if q.IdPattern != "" {
+		if _, err := path.Match(q.IdPattern, ""); err != nil {
+			return nil, err
+		}
+	}
+	return cm, nil
+}
+
+func (cm *clientMatcher) match(db clients_dto.ConnectionDatabase) bool {
+	q := cm.q
+	if q.Protocol != "" && db.Protocol != q.Protocol {
+		return false
+	}
+	if q.Status != nil && db.Status != *q.Status {
+		return false
+	}
+	if q.UserName != "" && db.UserName != q.UserName {
+		return false
+	}
+	if q.ConnectedSince > 0 && db.ConnectedNano < q.ConnectedSince {
+		return false
+	}
+	if q.IdPattern != "" {
+		if ok, _ := path.Match(q.IdPattern, db.Id); !ok {
+			return false
+		}
+	}
+	if cm.ipNet != nil {
+		ip := addrIP(db.Addr)
+		if ip == nil || !cm.ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// idPrefix   IdPattern中通配符之前的固定前缀
+func (cm *clientMatcher) idPrefix() string {
+	if i := strings.IndexAny(cm.q.IdPattern, `*?[\`); i >= 0 {
+		return cm.q.IdPattern[:i]
+	}
+	return cm.q.IdPattern
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// queryCursor   分页游标:上一页最后一条的排序值与ClientId
+type queryCursor struct {
+	value int64
+	id    string
+}
+
+func decodeQueryCursor(s string) (*queryCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, enmu.QueryCursorError
+	}
+	value, id, ok := strings.Cut(string(bs), "|")
+	if !ok {
+		return nil, enmu.QueryCursorError
+	}
+	v, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, enmu.QueryCursorError
+	}
+	return &queryCursor{value: v, id: id}, nil
+}
+
+func encodeQueryCursor(db clients_dto.ConnectionDatabase, key enmu.ClientSortKey) string {
+	s := strconv.FormatInt(sortValue(db, key), 10) + "|" + db.Id
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+func sortValue(db clients_dto.ConnectionDatabase, key enmu.ClientSortKey) int64 {
+	switch key {
+	case enmu.SortByConnectedTime:
+		return db.ConnectedNano
+	case enmu.SortByReadLength:
+		return int64(db.ReadLength)
+	case enmu.SortByWriteLength:
+		return int64(db.WriteLength)
+	}
+	return 0
+}
+
+// sortLess   按排序字段比较,相同值按ClientId
+func sortLess(a, b clients_dto.ConnectionDatabase, key enmu.ClientSortKey, desc bool) bool {
+	va, vb := sortValue(a, key), sortValue(b, key)
+	if desc {
+		va, vb = vb, va
+		a, b = b, a
+	}
+	if va != vb {
+		return va < vb
+	}
+	return a.Id < b.Id
+}
+
+// after   db是否排在游标之后
+func (c *queryCursor) after(db clients_dto.ConnectionDatabase, key enmu.ClientSortKey, desc bool) bool {
+	return sortLess(clients_dto.ConnectionDatabase{Id: c.id, ConnectedNano: c.value, ReadLength: uint64(c.value), WriteLength: uint64(c.value)}, db, key, desc)
+}
+
+// Query    按条件筛选客户端并分页;按ClientId或链接时间排序时沿索引顺序读取,只访问返回页附近的客户端。
+// 收发长度在链接期间不断变化,按长度排序时遍历全部客户端只返回排序最靠前的一页,不支持游标
+func (m *defaultClientManager) Query(q clients_dto.ClientQuery) (clients_dto.ClientQueryResult, error) {
+	var res clients_dto.ClientQueryResult
+	cm, err := newClientMatcher(q)
+	if err != nil {
+		return res, err
+	}
+	lengthSort := q.SortBy == enmu.SortByReadLength || q.SortBy == enmu.SortByWriteLength
+	if lengthSort && q.Cursor != "" {
+		return res, enmu.QueryCursorError
+	}
+	cursor, err := decodeQueryCursor(q.Cursor)
+	if err != nil {
+		return res, err
+	}
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultQueryLimit
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var dbs []clients_dto.ConnectionDatabase
+	if ids, ok := m.indexCandidates(q); ok {
+		top := newQueryTop(limit+1, q)
+		for id := range ids {
+			if client, exist := m.clientMap[id]; exist {
+				top.addMatched(cm, cursor, client)
+			}
+		}
+		dbs = top.sorted()
+	} else if q.SortBy == enmu.SortById {
+		dbs = m.walkIds(cm, cursor, limit)
+	} else if q.SortBy == enmu.SortByConnectedTime {
+		dbs = m.walkConnected(cm, cursor, limit)
+	} else {
+		top := newQueryTop(limit+1, q)
+		for _, client := range m.clientMap {
+			top.addMatched(cm, cursor, client)
+		}
+		dbs = top.sorted()
+	}
+	if len(dbs) > limit {
+		dbs = dbs[:limit]
+		if !lengthSort {
+			res.NextCursor = encodeQueryCursor(dbs[limit-1], q.SortBy)
+		}
+	}
+	res.List = dbs
+	return res, nil
+}
+
+// queryTop   保留排序最靠前的n条,用于不能沿索引读取的查询;堆顶为其中排序最靠后的一条
+type queryTop struct {
+	dbs  []clients_dto.ConnectionDatabase
+	n    int
+	key  enmu.ClientSortKey
+	desc bool
+}
+
+func newQueryTop(n int, q clients_dto.ClientQuery) *queryTop {
+	return &queryTop{n: n, key: q.SortBy, desc: q.Desc}
+}
+
+func (h *queryTop) Len() int           { return len(h.dbs) }
+func (h *queryTop) Less(i, j int) bool { return sortLess(h.dbs[j], h.dbs[i], h.key, h.desc) }
+func (h *queryTop) Swap(i, j int)      { h.dbs[i], h.dbs[j] = h.dbs[j], h.dbs[i] }
+func (h *queryTop) Push(x any)         { h.dbs = append(h.dbs, x.(clients_dto.ConnectionDatabase)) }
+func (h *queryTop) Pop() any {
+	db := h.dbs[len(h.dbs)-1]
+	h.dbs = h.dbs[:len(h.dbs)-1]
+	return db
+}
+
+func (h *queryTop) addMatched(cm *clientMatcher, cursor *queryCursor, client clientInterface) {
+	db := client.GetDataBase()
+	if !cm.match(db) {
+		return
+	}
+	if cursor != nil && !cursor.after(db, h.key, h.desc) {
+		return
+	}
+	if len(h.dbs) < h.n {
+		heap.Push(h, db)
+	} else if sortLess(db, h.dbs[0], h.key, h.desc) {
+		h.dbs[0] = db
+		heap.Fix(h, 0)
+	}
+}
+
+// sorted   按排序字段返回保留的记录
+func (h *queryTop) sorted() []clients_dto.ConnectionDatabase {
+	sort.Slice(h.dbs, func(i, j int) bool {
+		return sortLess(h.dbs[i], h.dbs[j], h.key, h.desc)
+	})
+	return h.dbs
+}
+
+// indexCandidates    用户名或协议条件命中的最小候选集合
+func (m *defaultClientManager) indexCandidates(q clients_dto.ClientQuery) (map[string]struct{}, bool) {
+	var ids map[string]struct{}
+	found := false
+	if q.UserName != "" {
+		ids, found = m.index.userNames[q.UserName], true
+	}
+	if q.Protocol != "" {
+		set := m.index.protocols[q.Protocol]
+		if !found || len(set) < len(ids) {
+			ids, found = set, true
+		}
+	}
+	return ids, found
+}
+
+// walkIds   沿ClientId索引读取,最多返回limit+1条
+func (m *defaultClientManager) walkIds(cm *clientMatcher, cursor *queryCursor, limit int) []clients_dto.ConnectionDatabase {
+	ids := m.index.ids
+	lo, hi := 0, ids.len()
+	if prefix := cm.idPrefix(); prefix != "" {
+		lo, hi = m.index.prefixRange(prefix)
+	}
+	if cursor != nil {
+		if cm.q.Desc {
+			hi = min(hi, ids.search(func(id string) bool { return id >= cursor.id }))
+		} else {
+			lo = max(lo, ids.search(func(id string) bool { return id > cursor.id }))
+		}
+	}
+	var dbs []clients_dto.ConnectionDatabase
+	ids.walk(lo, hi, cm.q.Desc, func(id string) bool {
+		if client, ok := m.clientMap[id]; ok {
+			if db := client.GetDataBase(); cm.match(db) {
+				dbs = append(dbs, db)
+			}
+		}
+		return len(dbs) <= limit
+	})
+	return dbs
+}
+
+// walkConnected   沿链接时间索引读取,最多返回limit+1条
+func (m *defaultClientManager) walkConnected(cm *clientMatcher, cursor *queryCursor, limit int) []clients_dto.ConnectionDatabase {
+	entries := m.index.connected
+	lo, hi := 0, entries.len()
+	if cm.q.ConnectedSince > 0 {
+		since := connectedEntry{nano: cm.q.ConnectedSince}
+		lo = entries.search(func(e connectedEntry) bool { return !e.less(since) })
+	}
+	if cursor != nil {
+		c := connectedEntry{nano: cursor.value, id: cursor.id}
+		if cm.q.Desc {
+			hi = min(hi, entries.search(func(e connectedEntry) bool { return !e.less(c) }))
+		} else {
+			lo = max(lo, entries.search(func(e connectedEntry) bool { return c.less(e) }))
+		}
+	}
+	var dbs []clients_dto.ConnectionDatabase
+	entries.walk(lo, hi, cm.q.Desc, func(e connectedEntry) bool {
+		if client, ok := m.clientMap[e.id]; ok {
+			if db := client.GetDataBase(); cm.match(db) {
+				dbs = append(dbs, db)
+			}
+		}
+		return len(dbs) <= limit
+	})
+	return dbs
+}
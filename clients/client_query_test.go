@@ -0,0 +1,189 @@
+package clients
+
+import (
+	"errors"
+	"fmt"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSortedList(t *testing.T) {
+	l := newSortedList(func(a, b int) bool { return a < b })
+	ref := map[int]bool{}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		v := r.Intn(5000)
+		if r.Intn(3) == 0 {
+			if l.remove(v) != ref[v] {
+				t.Fatalf("remove %d", v)
+			}
+			delete(ref, v)
+		} else {
+			if l.insert(v) == ref[v] {
+				t.Fatalf("insert %d", v)
+			}
+			ref[v] = true
+		}
+	}
+	var want []int
+	for v := range ref {
+		want = append(want, v)
+	}
+	sort.Ints(want)
+	if got := l.all(); l.len() != len(want) || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("len %d, want %d", l.len(), len(want))
+	}
+	if len(l.blocks) < 2 {
+		t.Fatalf("blocks %d", len(l.blocks))
+	}
+	for _, v := range []int{-1, 0, 1234, 4999, 5000} {
+		if got, exp := l.search(func(e int) bool { return e >= v }), sort.SearchInts(want, v); got != exp {
+			t.Fatalf("search %d: %d, want %d", v, got, exp)
+		}
+	}
+	for _, rg := range [][2]int{{0, len(want)}, {-5, 3}, {100, 1700}, {511, 513}, {len(want) - 2, len(want) + 5}, {7, 7}, {9, 3}} {
+		var asc, desc []int
+		l.walk(rg[0], rg[1], false, func(v int) bool { asc = append(asc, v); return true })
+		l.walk(rg[0], rg[1], true, func(v int) bool { desc = append(desc, v); return true })
+		lo, hi := max(rg[0], 0), min(rg[1], len(want))
+		var exp []int
+		if lo < hi {
+			exp = want[lo:hi]
+		}
+		if fmt.Sprint(asc) != fmt.Sprint(exp) {
+			t.Fatalf("walk %v: %v", rg, asc)
+		}
+		for i, j := 0, len(desc)-1; i < j; i, j = i+1, j-1 {
+			desc[i], desc[j] = desc[j], desc[i]
+		}
+		if fmt.Sprint(desc) != fmt.Sprint(exp) {
+			t.Fatalf("walk desc %v", rg)
+		}
+	}
+	n := 0
+	l.walk(0, l.len(), true, func(int) bool { n++; return n < 10 })
+	if n != 10 {
+		t.Fatalf("walk does not stop: %d", n)
+	}
+}
+
+// queryAll    沿游标读取全部分页,返回ClientId
+func queryAll(t *testing.T, m ClientManagerInterface, q clients_dto.ClientQuery) []string {
+	t.Helper()
+	var ids []string
+	for pages := 0; ; pages++ {
+		res, err := m.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.List) > q.Limit {
+			t.Fatalf("page size %d", len(res.List))
+		}
+		for _, db := range res.List {
+			ids = append(ids, db.Id)
+		}
+		if res.NextCursor == "" || pages > 100 {
+			return ids
+		}
+		q.Cursor = res.NextCursor
+	}
+}
+
+func TestQuery(t *testing.T) {
+	port := freePort(t)
+	m, _, _ := limitManager(t, &ClientManagerOptions{TcpPort: port, IsStatistics: true})
+	connectOrder := []string{"dev-05", "other-1", "dev-02", "dev-07", "dev-01", "other-2", "dev-04", "dev-06", "dev-03"}
+	conns := map[string]net.Conn{}
+	for i, id := range connectOrder {
+		user := "u2"
+		if i%2 == 0 {
+			user = "u1"
+		}
+		conns[id], _ = dialMqtt(t, port, id, user)
+	}
+	byId := append([]string{}, connectOrder...)
+	sort.Strings(byId)
+	reversed := func(ids []string) []string {
+		out := make([]string, 0, len(ids))
+		for i := len(ids) - 1; i >= 0; i-- {
+			out = append(out, ids[i])
+		}
+		return out
+	}
+	since, _ := m.GetOnce(connectOrder[3])
+	cases := []struct {
+		name string
+		q    clients_dto.ClientQuery
+		want []string
+	}{
+		{"id", clients_dto.ClientQuery{Limit: 2}, byId},
+		{"id desc", clients_dto.ClientQuery{Limit: 4, Desc: true}, reversed(byId)},
+		{"id pattern", clients_dto.ClientQuery{Limit: 2, IdPattern: "dev-0[2-5]"}, []string{"dev-02", "dev-03", "dev-04", "dev-05"}},
+		{"id pattern desc", clients_dto.ClientQuery{Limit: 1, Desc: true, IdPattern: "other-*"}, []string{"other-2", "other-1"}},
+		{"connected", clients_dto.ClientQuery{Limit: 2, SortBy: enmu.SortByConnectedTime}, connectOrder},
+		{"connected desc since", clients_dto.ClientQuery{Limit: 4, SortBy: enmu.SortByConnectedTime, Desc: true, ConnectedSince: since.ConnectedNano}, reversed(connectOrder[3:])},
+		{"username", clients_dto.ClientQuery{Limit: 2, UserName: "u1"}, []string{"dev-01", "dev-02", "dev-03", "dev-04", "dev-05"}},
+		{"username connected desc", clients_dto.ClientQuery{Limit: 3, UserName: "u2", SortBy: enmu.SortByConnectedTime, Desc: true}, []string{"dev-06", "other-2", "dev-07", "other-1"}},
+		{"protocol", clients_dto.ClientQuery{Limit: 5, Protocol: enmu.TcpProtocol, Desc: true}, reversed(byId)},
+		{"cidr", clients_dto.ClientQuery{Limit: 100, Cidr: "127.0.0.0/8"}, byId},
+		{"no match", clients_dto.ClientQuery{Limit: 2, Cidr: "10.0.0.0/8"}, nil},
+	}
+	for _, c := range cases {
+		if got := queryAll(t, m, c.q); strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("%s: %v, want %v", c.name, got, c.want)
+		}
+	}
+	if total, list := m.List(1, 3); total != len(byId) || len(list) != 2 || list[0].Id != byId[len(byId)-2] || list[1].Id != byId[len(byId)-3] {
+		t.Fatalf("list %d %v", total, list)
+	}
+
+	for _, q := range []clients_dto.ClientQuery{{Cursor: "!"}, {Cidr: "x"}, {IdPattern: "["}} {
+		if _, err := m.Query(q); err == nil {
+			t.Errorf("query %+v is accepted", q)
+		}
+	}
+
+	// 断开的客户端从索引中移除
+	_ = conns["dev-03"].Close()
+	waitFor(t, "dev-03 to disconnect", func() bool { return m.Len() == len(byId)-1 })
+	if got := queryAll(t, m, clients_dto.ClientQuery{Limit: 3, SortBy: enmu.SortByConnectedTime}); strings.Join(got, ",") != strings.Join(connectOrder[:len(connectOrder)-1], ",") {
+		t.Fatalf("after disconnect %v", got)
+	}
+}
+
+// TestQueryLengthSort    按收发长度排序时只返回排序最靠前的一页,不返回也不接受游标
+func TestQueryLengthSort(t *testing.T) {
+	port := freePort(t)
+	m, _, received := limitManager(t, &ClientManagerOptions{TcpPort: port, IsStatistics: true})
+	for i, size := range []int{300, 100, 500, 0, 200} {
+		c, _ := dialMqtt(t, port, fmt.Sprintf("c%d", i), "")
+		writePacket(t, c, publishPacket("t", strings.Repeat("x", size), 0, 0))
+		<-received
+	}
+	res, err := m.Query(clients_dto.ClientQuery{Limit: 3, SortBy: enmu.SortByReadLength, Desc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, db := range res.List {
+		ids = append(ids, db.Id)
+	}
+	if strings.Join(ids, ",") != "c2,c0,c4" || res.NextCursor != "" {
+		t.Fatalf("top by read length %v %q", ids, res.NextCursor)
+	}
+	res, _ = m.Query(clients_dto.ClientQuery{Limit: 2, SortBy: enmu.SortByReadLength})
+	if len(res.List) != 2 || res.List[0].Id != "c3" || res.List[1].Id != "c1" {
+		t.Fatalf("bottom by read length %v", res.List)
+	}
+	cursor, _ := m.Query(clients_dto.ClientQuery{Limit: 1})
+	for _, key := range []enmu.ClientSortKey{enmu.SortByReadLength, enmu.SortByWriteLength} {
+		if _, err = m.Query(clients_dto.ClientQuery{SortBy: key, Cursor: cursor.NextCursor}); !errors.Is(err, enmu.QueryCursorError) {
+			t.Fatalf("sort %d with cursor: %v", key, err)
+		}
+	}
+}
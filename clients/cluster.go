@@ -0,0 +1,725 @@
+package clients
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"io"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultClusterPort  = 1885
+	clusterDialInterval = 3 * time.Second
+	clusterPingInterval = 5 * time.Second
+	clusterReadTimeout  = 15 * time.Second
+	clusterSendQueue    = 4096
+	clusterMaxFrame     = 16 << 20
+)
+
+// 节点间消息类型
+const (
+	clusterHello   = "hello"   // 握手,交换节点Id、通告地址与随机数
+	clusterAuth    = "auth"    // 握手应答,证明持有共享密钥;校验通过前不处理其他消息
+	clusterPeers   = "peers"   // 已知节点地址,用于组成全连接
+	clusterSync    = "sync"    // 全量同步:本节点的ClientId与订阅
+	clusterClaim   = "claim"   // 客户端接入,其他节点按接管策略断开相同ClientId的客户端
+	clusterRelease = "release" // 客户端断开
+	clusterSub     = "sub"     // 新出现的主题过滤器
+	clusterUnsub   = "unsub"   // 不再有订阅者的主题过滤器
+	clusterPublish = "publish" // 转发的PUBLISH
+	clusterPing    = "ping"
+)
+
+// clusterMessage    节点间消息,以4字节长度前缀的JSON传输
+type clusterMessage struct {
+	Type    string            `json:"type"`
+	Node    string            `json:"node,omitempty"`
+	Addr    string            `json:"addr,omitempty"`
+	Port    int               `json:"port,omitempty"`
+	Id      string            `json:"id,omitempty"`
+	Ids     []string          `json:"ids,omitempty"`
+	Filters []string          `json:"filters,omitempty"`
+	Peers   map[string]string `json:"peers,omitempty"`
+	Topic   string            `json:"topic,omitempty"`
+	Payload []byte            `json:"payload,omitempty"`
+	Nonce   []byte            `json:"nonce,omitempty"`
+	Mac     []byte            `json:"mac,omitempty"`
+	Nano    int64             `json:"nano,omitempty"` // claim时客户端的接入时间
+}
+
+/*
+cluster    多节点集群:节点之间通过种子地址发现并组成TCP全连接
+  - 共享ClientId注册表,客户端接入时通知其他节点,接管策略跨节点生效;同时接入时接入时间较晚者保留,时间相同时节点Id较大者保留
+  - 同步各节点的订阅主题过滤器,本地客户端的PUBLISH只转发给有匹配订阅者的节点
+  - 转发的PUBLISH经过PacketCb后按QoS0投递给本地订阅者,不再继续转发;跨节点的消息不保证送达,原QoS只在来源节点生效
+  - 对端需通过共享密钥的挑战应答或TLS双向认证(ClientAuth为RequireAndVerifyClientCert),校验通过前不处理任何消息
+*/
+type cluster struct {
+	m             *defaultClientManager
+	nodeId        string
+	port          int
+	bind          string
+	secret        string
+	tls           *tls.Config
+	advertise     string
+	seeds         []string
+	listener      net.Listener
+	mu            sync.Mutex
+	peers         map[string]*clusterPeer        // nodeId -> 节点链接
+	addrs         map[string]string              // nodeId -> 已知的节点地址
+	seedNodes     map[string]string              // 种子地址 -> nodeId
+	dialing       map[string]bool                // 正在拨号的地址
+	registry      map[string]string              // 其他节点的ClientId -> nodeId
+	remoteFilters map[string]map[string]struct{} // nodeId -> 主题过滤器
+	subs          *subscriptions
+	dialNow       chan struct{}
+	quit          chan struct{}
+	stopOnce      sync.Once
+	wg            sync.WaitGroup
+}
+
+func newCluster(m *defaultClientManager, opt *ClientManagerOptions) *cluster {
+	port := int(opt.ClusterPort)
+	if port == 0 {
+		port = defaultClusterPort
+	}
+	return &cluster{
+		m:             m,
+		nodeId:        opt.ClusterNodeId,
+		port:          port,
+		bind:          opt.ClusterBind,
+		secret:        opt.ClusterSecret,
+		tls:           opt.ClusterTLS,
+		advertise:     opt.ClusterAdvertise,
+		seeds:         append([]string{}, opt.ClusterSeeds...),
+		peers:         map[string]*clusterPeer{},
+		addrs:         map[string]string{},
+		seedNodes:     map[string]string{},
+		dialing:       map[string]bool{},
+		registry:      map[string]string{},
+		remoteFilters: map[string]map[string]struct{}{},
+		subs:          newSubscriptions(),
+		dialNow:       make(chan struct{}, 1),
+		quit:          make(chan struct{}),
+	}
+}
+
+// clusterOriginKey    ctx中转发报文的来源节点Id
+type clusterOriginKey struct{}
+
+// ClusterOrigin    PacketContextCb中其他节点转发的PUBLISH返回来源节点Id,本节点客户端的报文返回空
+func ClusterOrigin(ctx context.Context) string {
+	node, _ := ctx.Value(clusterOriginKey{}).(string)
+	return node
+}
+
+// start    监听集群端口并开始连接种子节点;未配置共享密钥,且TLS未要求并校验对端证书时返回enmu.ClusterAuthRequiredError
+func (c *cluster) start() error {
+	if c.secret == "" && !mutualTLS(c.tls) {
+		return enmu.ClusterAuthRequiredError
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(c.bind, strconv.Itoa(c.port)))
+	if err != nil {
+		return err
+	}
+	if c.tls != nil {
+		l = tls.NewListener(l, c.tls)
+	}
+	c.listener = l
+	c.wg.Add(2)
+	go c.acceptLoop()
+	go c.dialLoop()
+	return nil
+}
+
+// mutualTLS    TLS配置是否双向校验证书:监听时要求并校验客户端证书,拨号时校验服务端证书
+func mutualTLS(cfg *tls.Config) bool {
+	return cfg != nil && cfg.ClientAuth == tls.RequireAndVerifyClientCert && !cfg.InsecureSkipVerify
+}
+
+// stop    关闭监听与所有节点链接
+func (c *cluster) stop() {
+	if c == nil {
+		return
+	}
+	c.stopOnce.Do(func() {
+		close(c.quit)
+		if c.listener != nil {
+			_ = c.listener.Close()
+		}
+		c.mu.Lock()
+		for _, p := range c.peers {
+			p.close()
+		}
+		c.mu.Unlock()
+		c.wg.Wait()
+	})
+}
+
+func (c *cluster) acceptLoop() {
+	defer c.wg.Done()
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		go c.serveConn(conn, "", false)
+	}
+}
+
+// dialLoop    定时连接尚未建立链接的种子与已知节点
+func (c *cluster) dialLoop() {
+	defer c.wg.Done()
+	t := time.NewTicker(clusterDialInterval)
+	defer t.Stop()
+	for {
+		c.dialMissing()
+		select {
+		case <-c.quit:
+			return
+		case <-t.C:
+		case <-c.dialNow:
+		}
+	}
+}
+
+func (c *cluster) dialMissing() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, seed := range c.seeds {
+		if node, ok := c.seedNodes[seed]; ok && (node == c.nodeId || c.peers[node] != nil) {
+			continue
+		}
+		c.dialLocked(seed, true)
+	}
+	for node, addr := range c.addrs {
+		if c.peers[node] == nil {
+			c.dialLocked(addr, false)
+		}
+	}
+}
+
+// dialLocked    调用方需持有锁
+func (c *cluster) dialLocked(addr string, isSeed bool) {
+	if c.dialing[addr] {
+		return
+	}
+	c.dialing[addr] = true
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.dialing, addr)
+			c.mu.Unlock()
+		}()
+		conn, err := c.dial(addr)
+		if err != nil {
+			return
+		}
+		seed := ""
+		if isSeed {
+			seed = addr
+		}
+		c.serveConn(conn, seed, true)
+	}()
+}
+
+// dial    连接其他节点,配置了TLS时未指定ServerName则使用地址中的主机名
+func (c *cluster) dial(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: clusterDialInterval}
+	if c.tls == nil {
+		return dialer.Dial("tcp", addr)
+	}
+	cfg := c.tls.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	return tls.DialWithDialer(dialer, "tcp", addr, cfg)
+}
+
+// handshake    交换hello;配置了共享密钥时双方再交换应答,任一方校验失败即断开
+func (c *cluster) handshake(conn net.Conn, outgoing bool) (*clusterMessage, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	hello := &clusterMessage{Type: clusterHello, Node: c.nodeId, Addr: c.advertise, Port: c.port, Nonce: nonce}
+	if err := writeClusterMessage(conn, hello); err != nil {
+		return nil, err
+	}
+	msg, err := readClusterMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Type != clusterHello || msg.Node == "" {
+		return nil, enmu.ClusterAuthError
+	}
+	if c.secret == "" {
+		return msg, nil
+	}
+	if len(msg.Nonce) != len(nonce) {
+		return nil, enmu.ClusterAuthError
+	}
+	auth := &clusterMessage{Type: clusterAuth, Mac: clusterMac(c.secret, outgoing, c.nodeId, nonce, msg.Nonce)}
+	if err = writeClusterMessage(conn, auth); err != nil {
+		return nil, err
+	}
+	reply, err := readClusterMessage(conn)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Type != clusterAuth || !hmac.Equal(reply.Mac, clusterMac(c.secret, !outgoing, msg.Node, msg.Nonce, nonce)) {
+		return nil, enmu.ClusterAuthError
+	}
+	return msg, nil
+}
+
+// clusterMac    HMAC-SHA256(密钥, 方向|节点Id|本方随机数|对方随机数);包含方向,转发给其他节点的应答无法通过校验
+func clusterMac(secret string, outgoing bool, node string, own, peer []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	if outgoing {
+		h.Write([]byte("dial\x00"))
+	} else {
+		h.Write([]byte("accept\x00"))
+	}
+	h.Write([]byte(node))
+	h.Write([]byte{0})
+	h.Write(own)
+	h.Write(peer)
+	return h.Sum(nil)
+}
+
+// serveConn    认证后注册节点,发送全量同步并处理消息直到链接断开
+func (c *cluster) serveConn(conn net.Conn, seed string, outgoing bool) {
+	_ = conn.SetDeadline(time.Now().Add(clusterReadTimeout))
+	msg, err := c.handshake(conn, outgoing)
+	if err != nil {
+		c.m.log(slog.LevelWarn, "cluster peer rejected", "", slog.String("addr", conn.RemoteAddr().String()), slog.Any("err", err))
+		_ = conn.Close()
+		return
+	}
+	if seed != "" {
+		c.mu.Lock()
+		c.seedNodes[seed] = msg.Node
+		c.mu.Unlock()
+	}
+	if msg.Node == c.nodeId {
+		_ = conn.Close()
+		return
+	}
+	_ = conn.SetDeadline(time.Time{})
+	addr := msg.Addr
+	if addr == "" {
+		addr = net.JoinHostPort(addrIP(conn.RemoteAddr()).String(), strconv.Itoa(msg.Port))
+	}
+	dialer := msg.Node
+	if outgoing {
+		dialer = c.nodeId
+	}
+	p := newClusterPeer(msg.Node, addr, dialer, conn)
+	if !c.addPeer(p) {
+		p.close()
+		return
+	}
+	go p.writeLoop()
+	p.send(c.syncMessage())
+	c.broadcastPeers()
+	c.readLoop(p)
+}
+
+// addPeer    注册节点链接;两个节点互相发起链接时,双方都保留由较小nodeId发起的链接
+func (c *cluster) addPeer(p *clusterPeer) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.quit:
+		return false
+	default:
+	}
+	if old, ok := c.peers[p.nodeId]; ok {
+		if old.dialer <= p.dialer {
+			return false
+		}
+		old.close()
+	}
+	c.peers[p.nodeId] = p
+	c.addrs[p.nodeId] = p.addr
+	return true
+}
+
+// removePeer    节点链接断开后清除该节点的ClientId与订阅
+func (c *cluster) removePeer(p *clusterPeer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.peers[p.nodeId] != p {
+		return
+	}
+	delete(c.peers, p.nodeId)
+	delete(c.remoteFilters, p.nodeId)
+	for id, node := range c.registry {
+		if node == p.nodeId {
+			delete(c.registry, id)
+		}
+	}
+}
+
+func (c *cluster) readLoop(p *clusterPeer) {
+	defer func() {
+		p.close()
+		c.removePeer(p)
+	}()
+	for {
+		_ = p.conn.SetReadDeadline(time.Now().Add(clusterReadTimeout))
+		msg, err := readClusterMessage(p.conn)
+		if err != nil {
+			return
+		}
+		c.handle(p, msg)
+	}
+}
+
+func (c *cluster) handle(p *clusterPeer, msg *clusterMessage) {
+	switch msg.Type {
+	case clusterPeers:
+		c.mu.Lock()
+		found := false
+		for node, addr := range msg.Peers {
+			if _, ok := c.addrs[node]; !ok && node != c.nodeId && addr != "" {
+				c.addrs[node] = addr
+				found = true
+			}
+		}
+		c.mu.Unlock()
+		if found {
+			select {
+			case c.dialNow <- struct{}{}:
+			default:
+			}
+		}
+	case clusterSync:
+		c.mu.Lock()
+		for id, node := range c.registry {
+			if node == p.nodeId {
+				delete(c.registry, id)
+			}
+		}
+		for _, id := range msg.Ids {
+			c.registry[id] = p.nodeId
+		}
+		fs := map[string]struct{}{}
+		for _, filter := range msg.Filters {
+			fs[filter] = struct{}{}
+		}
+		c.remoteFilters[p.nodeId] = fs
+		c.mu.Unlock()
+	case clusterClaim:
+		// 本地客户端保留时不记录对端,对端收到本节点的claim后断开其客户端
+		if !c.m.clusterTakeover(msg.Id, p.nodeId, msg.Nano) {
+			return
+		}
+		c.mu.Lock()
+		c.registry[msg.Id] = p.nodeId
+		c.mu.Unlock()
+	case clusterRelease:
+		c.mu.Lock()
+		if c.registry[msg.Id] == p.nodeId {
+			delete(c.registry, msg.Id)
+		}
+		c.mu.Unlock()
+	case clusterSub:
+		c.mu.Lock()
+		fs, ok := c.remoteFilters[p.nodeId]
+		if !ok {
+			fs = map[string]struct{}{}
+			c.remoteFilters[p.nodeId] = fs
+		}
+		for _, filter := range msg.Filters {
+			fs[filter] = struct{}{}
+		}
+		c.mu.Unlock()
+	case clusterUnsub:
+		c.mu.Lock()
+		for _, filter := range msg.Filters {
+			delete(c.remoteFilters[p.nodeId], filter)
+		}
+		c.mu.Unlock()
+	case clusterPublish:
+		c.m.deliverRemote(p.nodeId, msg.Id, c.match(msg.Topic), msg.Topic, msg.Payload)
+	}
+}
+
+// syncMessage    本节点的全量状态;先取ClientId再加集群锁,与管理器的加锁顺序一致
+func (c *cluster) syncMessage() *clusterMessage {
+	ids := c.m.localIds()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return &clusterMessage{Type: clusterSync, Ids: ids, Filters: c.subs.filters()}
+}
+
+func (c *cluster) broadcastPeers() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	peers := make(map[string]string, len(c.peers))
+	for node, p := range c.peers {
+		peers[node] = p.addr
+	}
+	c.broadcastLocked(&clusterMessage{Type: clusterPeers, Peers: peers})
+}
+
+// broadcastLocked    发送给所有节点,调用方需持有锁;在锁内入队保证各节点收到的顺序一致
+func (c *cluster) broadcastLocked(msg *clusterMessage) {
+	if len(c.peers) == 0 {
+		return
+	}
+	bs, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	for _, p := range c.peers {
+		p.sendBytes(bs)
+	}
+}
+
+// owner    返回持有ClientId的其他节点,没有时为空
+func (c *cluster) owner(id string) string {
+	if c == nil {
+		return ""
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.registry[id]
+}
+
+// claim    本地客户端接入
+func (c *cluster) claim(id string, connectedNano int64) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.registry, id)
+	c.broadcastLocked(&clusterMessage{Type: clusterClaim, Id: id, Nano: connectedNano})
+}
+
+// release    本地客户端断开
+func (c *cluster) release(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.broadcastLocked(&clusterMessage{Type: clusterRelease, Id: id})
+}
+
+// removeClient    清除本地客户端的订阅,需与该客户端的报文在同一分发分片中执行
+func (c *cluster) removeClient(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if removed := c.subs.removeClient(id); len(removed) > 0 {
+		c.broadcastLocked(&clusterMessage{Type: clusterUnsub, Filters: removed})
+	}
+}
+
+// onPacket    跟踪本地订阅并转发PUBLISH,在钩子之后执行
+func (c *cluster) onPacket(id string, p mqtt_packet.ControlPacketInterface) {
+	switch packet := p.(type) {
+	case *mqtt_packet.SubscribePacket:
+		filters := make([]string, 0, len(packet.List))
+		for _, tf := range packet.List {
+			if tf != nil && tf.Qos <= 2 {
+				filters = append(filters, tf.Topic)
+			}
+		}
+		c.subscribe(id, filters)
+	case *mqtt_packet.UnSubscribePacket:
+		c.mu.Lock()
+		if removed := c.subs.remove(id, packet.Topics); len(removed) > 0 {
+			c.broadcastLocked(&clusterMessage{Type: clusterUnsub, Filters: removed})
+		}
+		c.mu.Unlock()
+	case *mqtt_packet.PublishPacket:
+		c.publish(id, packet.TopicName, packet.Payload)
+	}
+}
+
+// subscribe    添加本地订阅,新出现的主题过滤器通知其他节点
+func (c *cluster) subscribe(id string, filters []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if added := c.subs.add(id, filters); len(added) > 0 {
+		c.broadcastLocked(&clusterMessage{Type: clusterSub, Filters: added})
+	}
+}
+
+// publish    只转发给有匹配订阅者的节点,id为本地的发布者
+func (c *cluster) publish(id, topic string, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var bs []byte
+	for node, fs := range c.remoteFilters {
+		p := c.peers[node]
+		if p == nil || !matchAny(fs, topic) {
+			continue
+		}
+		if bs == nil {
+			var err error
+			bs, err = json.Marshal(&clusterMessage{Type: clusterPublish, Id: id, Topic: topic, Payload: payload})
+			if err != nil {
+				return
+			}
+		}
+		p.sendBytes(bs)
+	}
+}
+
+// match    返回订阅了topic的本地ClientId
+func (c *cluster) match(topic string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.subs.match(topic)
+}
+
+// nodes    返回已连接的节点,按nodeId排序
+func (c *cluster) nodes() []clients_dto.ClusterNode {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := map[string]int{}
+	for _, node := range c.registry {
+		counts[node]++
+	}
+	var ns []clients_dto.ClusterNode
+	for node, p := range c.peers {
+		ns = append(ns, clients_dto.ClusterNode{
+			NodeId:        node,
+			Addr:          p.addr,
+			Clients:       counts[node],
+			Filters:       len(c.remoteFilters[node]),
+			ConnectedNano: p.connectedNano,
+		})
+	}
+	sort.Slice(ns, func(i, j int) bool { return ns[i].NodeId < ns[j].NodeId })
+	return ns
+}
+
+// clusterPeer    到其他节点的链接
+type clusterPeer struct {
+	nodeId        string
+	addr          string
+	dialer        string // 发起链接的节点
+	conn          net.Conn
+	sendChan      chan []byte
+	quit          chan struct{}
+	closeOnce     sync.Once
+	connectedNano int64
+}
+
+func newClusterPeer(nodeId, addr, dialer string, conn net.Conn) *clusterPeer {
+	return &clusterPeer{
+		nodeId:        nodeId,
+		addr:          addr,
+		dialer:        dialer,
+		conn:          conn,
+		sendChan:      make(chan []byte, clusterSendQueue),
+		quit:          make(chan struct{}),
+		connectedNano: time.Now().UnixNano(),
+	}
+}
+
+func (p *clusterPeer) send(msg *clusterMessage) {
+	if bs, err := json.Marshal(msg); err == nil {
+		p.sendBytes(bs)
+	}
+}
+
+// sendBytes    不阻塞入队;队列满时断开该节点,重连后通过全量同步恢复状态
+func (p *clusterPeer) sendBytes(bs []byte) {
+	select {
+	case p.sendChan <- bs:
+	default:
+		p.close()
+	}
+}
+
+func (p *clusterPeer) writeLoop() {
+	t := time.NewTicker(clusterPingInterval)
+	defer t.Stop()
+	ping, _ := json.Marshal(&clusterMessage{Type: clusterPing})
+	for {
+		var bs []byte
+		select {
+		case <-p.quit:
+			return
+		case bs = <-p.sendChan:
+		case <-t.C:
+			bs = ping
+		}
+		_ = p.conn.SetWriteDeadline(time.Now().Add(clusterReadTimeout))
+		if err := writeClusterFrame(p.conn, bs); err != nil {
+			p.close()
+			return
+		}
+	}
+}
+
+func (p *clusterPeer) close() {
+	p.closeOnce.Do(func() {
+		close(p.quit)
+		_ = p.conn.Close()
+	})
+}
+
+func writeClusterMessage(w io.Writer, msg *clusterMessage) error {
+	bs, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return writeClusterFrame(w, bs)
+}
+
+func writeClusterFrame(w io.Writer, bs []byte) error {
+	frame := make([]byte, 4+len(bs))
+	binary.BigEndian.PutUint32(frame, uint32(len(bs)))
+	copy(frame[4:], bs)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readClusterMessage(r io.Reader) (*clusterMessage, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(head)
+	if length > clusterMaxFrame {
+		return nil, enmu.ClusterFrameTooLargeError
+	}
+	bs := make([]byte, length)
+	if _, err := io.ReadFull(r, bs); err != nil {
+		return nil, err
+	}
+	msg := &clusterMessage{}
+	if err := json.Unmarshal(bs, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,335 @@
+package clients
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+var secretAuth = ClientManagerOptions{ClusterSecret: "cluster-secret"}
+
+// clusterNode    在127.0.0.1上启动一个集群节点,auth提供ClusterSecret、ClusterTLS以及可选的回调与钩子
+func clusterNode(t *testing.T, node string, auth ClientManagerOptions, seeds ...string) (*defaultClientManager, uint16, uint16) {
+	t.Helper()
+	port, clusterPort := freePort(t), freePort(t)
+	m := newClientManager(&ClientManagerOptions{
+		TcpPort:         port,
+		DispatchWorkers: 4,
+		WriteQueueSize:  4,
+		ClusterNodeId:   node,
+		ClusterPort:     clusterPort,
+		ClusterBind:     "127.0.0.1",
+		ClusterSecret:   auth.ClusterSecret,
+		ClusterTLS:      auth.ClusterTLS,
+		ClusterSeeds:    seeds,
+		PacketCb:        auth.PacketCb,
+		PacketContextCb: auth.PacketContextCb,
+		Hooks:           auth.Hooks,
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = m.Stop() })
+	return m, port, clusterPort
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func subscribe(t *testing.T, c net.Conn, filter string) {
+	t.Helper()
+	p := packets.NewSubscribe(nil)
+	p.GetFixedHead().Qos = 1
+	p.MessageID = 1
+	p.List = []*packets.TopicFilter{{Topic: filter}}
+	writePacket(t, c, p)
+}
+
+// TestClusterForwardsPublish    两个节点通过共享密钥组成集群,PUBLISH转发给另一节点的订阅者
+func TestClusterForwardsPublish(t *testing.T) {
+	a, portA, clusterA := clusterNode(t, "a", secretAuth)
+	b, portB, _ := clusterNode(t, "b", secretAuth, fmt.Sprintf("127.0.0.1:%d", clusterA))
+	waitFor(t, "nodes to connect", func() bool { return len(a.ClusterNodes()) == 1 && len(b.ClusterNodes()) == 1 })
+	sub, _ := dialMqtt(t, portB, "sub", "")
+	subscribe(t, sub, "news/#")
+	waitFor(t, "subscription to sync", func() bool {
+		a.cluster.mu.Lock()
+		defer a.cluster.mu.Unlock()
+		return len(a.cluster.remoteFilters["b"]) == 1
+	})
+	pub, _ := dialMqtt(t, portA, "pub", "")
+	writePacket(t, pub, publishPacket("news/1", "hello", 0, 0))
+	got, err := readPacket(sub, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pp, ok := got.(*packets.PublishPacket); !ok || pp.TopicName != "news/1" || string(pp.Payload) != "hello" {
+		t.Fatalf("unexpected packet %#v", got)
+	}
+}
+
+// testClusterTLS    自签名证书同时作为CA、服务端与客户端证书
+func testClusterTLS(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "cluster"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+}
+
+// TestClusterMutualTLS    通过TLS双向认证组成集群,没有客户端证书的链接被拒绝
+func TestClusterMutualTLS(t *testing.T) {
+	auth := ClientManagerOptions{ClusterTLS: testClusterTLS(t)}
+	a, _, clusterA := clusterNode(t, "a", auth)
+	b, _, _ := clusterNode(t, "b", auth, fmt.Sprintf("127.0.0.1:%d", clusterA))
+	waitFor(t, "nodes to connect", func() bool { return len(a.ClusterNodes()) == 1 && len(b.ClusterNodes()) == 1 })
+	conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", clusterA), &tls.Config{RootCAs: auth.ClusterTLS.RootCAs})
+	if err == nil {
+		defer conn.Close()
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err = readClusterMessage(conn); err == nil {
+			t.Fatal("peer without a client certificate is accepted")
+		}
+	}
+}
+
+// TestClusterRequiresAuth    未配置共享密钥,且TLS没有双向校验证书时不启动集群
+func TestClusterRequiresAuth(t *testing.T) {
+	mutual := testClusterTLS(t)
+	serverOnly := mutual.Clone()
+	serverOnly.ClientAuth = tls.NoClientCert
+	requestOnly := mutual.Clone()
+	requestOnly.ClientAuth = tls.RequestClientCert
+	insecure := mutual.Clone()
+	insecure.InsecureSkipVerify = true
+	cases := []struct {
+		name string
+		auth ClientManagerOptions
+		ok   bool
+	}{
+		{"none", ClientManagerOptions{}, false},
+		{"tls without client auth", ClientManagerOptions{ClusterTLS: serverOnly}, false},
+		{"tls requesting but not verifying", ClientManagerOptions{ClusterTLS: requestOnly}, false},
+		{"tls skipping server verification", ClientManagerOptions{ClusterTLS: insecure}, false},
+		{"mutual tls", ClientManagerOptions{ClusterTLS: mutual}, true},
+		{"secret", secretAuth, true},
+		{"secret over server-only tls", ClientManagerOptions{ClusterSecret: "s", ClusterTLS: serverOnly}, true},
+	}
+	for _, c := range cases {
+		m := newClientManager(&ClientManagerOptions{TcpPort: freePort(t), ClusterNodeId: "a", ClusterPort: freePort(t),
+			ClusterBind: "127.0.0.1", ClusterSecret: c.auth.ClusterSecret, ClusterTLS: c.auth.ClusterTLS})
+		err := m.Start()
+		_ = m.Stop()
+		if c.ok && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if !c.ok && !errors.Is(err, enmu.ClusterAuthRequiredError) {
+			t.Errorf("%s: start error %v", c.name, err)
+		}
+	}
+}
+
+// TestClusterRejectsWrongSecret    密钥不同的节点无法加入
+func TestClusterRejectsWrongSecret(t *testing.T) {
+	a, _, clusterA := clusterNode(t, "a", secretAuth)
+	b, _, _ := clusterNode(t, "b", ClientManagerOptions{ClusterSecret: "other-secret"}, fmt.Sprintf("127.0.0.1:%d", clusterA))
+	time.Sleep(500 * time.Millisecond)
+	if n := len(a.ClusterNodes()) + len(b.ClusterNodes()); n != 0 {
+		t.Fatalf("nodes with different secrets connected: %d", n)
+	}
+}
+
+// TestClusterUnauthenticatedClaim    未认证的对端发送claim不会断开本地客户端
+func TestClusterUnauthenticatedClaim(t *testing.T) {
+	a, port, clusterA := clusterNode(t, "a", secretAuth)
+	dialMqtt(t, port, "victim", "")
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", clusterA))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = readClusterMessage(conn); err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range []*clusterMessage{
+		{Type: clusterHello, Node: "evil", Nonce: make([]byte, 16)},
+		{Type: clusterAuth, Mac: make([]byte, 32)},
+		{Type: clusterClaim, Id: "victim"},
+	} {
+		_ = writeClusterMessage(conn, msg)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, err = readClusterMessage(conn); err != nil {
+			break
+		}
+	}
+	if _, err = a.GetOnce("victim"); err != nil {
+		t.Fatalf("local client is kicked by an unauthenticated peer: %v", err)
+	}
+	if len(a.ClusterNodes()) != 0 {
+		t.Fatal("unauthenticated peer is registered")
+	}
+}
+
+// TestClusterSlowSubscriber    不读取的订阅者不会阻塞节点链接,其他订阅者仍能收到转发的消息
+func TestClusterSlowSubscriber(t *testing.T) {
+	a, portA, clusterA := clusterNode(t, "a", secretAuth)
+	b, portB, _ := clusterNode(t, "b", secretAuth, fmt.Sprintf("127.0.0.1:%d", clusterA))
+	waitFor(t, "nodes to connect", func() bool { return len(a.ClusterNodes()) == 1 && len(b.ClusterNodes()) == 1 })
+	// 两个订阅者在不同的分发分片中
+	fastId := "fast"
+	for i := 0; b.dispatcher.shardIndex(fastId) == b.dispatcher.shardIndex("slow"); i++ {
+		fastId = fmt.Sprintf("fast%d", i)
+	}
+	slow, _ := dialMqtt(t, portB, "slow", "")
+	subscribe(t, slow, "big")
+	fast, _ := dialMqtt(t, portB, fastId, "")
+	subscribe(t, fast, "small")
+	waitFor(t, "subscriptions to sync", func() bool {
+		a.cluster.mu.Lock()
+		defer a.cluster.mu.Unlock()
+		return len(a.cluster.remoteFilters["b"]) == 2
+	})
+	pub, _ := dialMqtt(t, portA, "pub", "")
+	payload := string(make([]byte, 256<<10))
+	for i := 0; i < 64; i++ {
+		writePacket(t, pub, publishPacket("big", payload, 0, 0))
+	}
+	writePacket(t, pub, publishPacket("small", "ping", 0, 0))
+	got, err := readPacket(fast, 5*time.Second)
+	if err != nil {
+		t.Fatalf("fast subscriber is stalled behind the slow one: %v", err)
+	}
+	if pp, ok := got.(*packets.PublishPacket); !ok || string(pp.Payload) != "ping" {
+		t.Fatalf("unexpected packet %#v", got)
+	}
+}
+
+// denyDeliver    拒绝投递指定主题的钩子
+type denyDeliver struct {
+	HooksBase
+	topic string
+}
+
+func (h denyDeliver) OnDeliver(_ string, p *packets.PublishPacket) error {
+	if p.TopicName == h.topic {
+		return errors.New("denied")
+	}
+	return nil
+}
+
+// TestClusterRemoteDispatch    转发的PUBLISH在接收节点经过PacketCb与PacketContextCb(带来源节点),按QoS0投递并执行OnDeliver钩子
+func TestClusterRemoteDispatch(t *testing.T) {
+	type seen struct {
+		id, origin, topic string
+		qos               byte
+	}
+	ctxSeen := make(chan seen, 8)
+	cbSeen := make(chan string, 8)
+	auth := secretAuth
+	auth.PacketCb = func(id string, p mqtt_packet.ControlPacketInterface) {
+		if pp, ok := p.(*packets.PublishPacket); ok {
+			cbSeen <- id + " " + pp.TopicName
+		}
+	}
+	auth.PacketContextCb = func(ctx context.Context, id string, p mqtt_packet.ControlPacketInterface) {
+		if pp, ok := p.(*packets.PublishPacket); ok {
+			ctxSeen <- seen{id: id, origin: ClusterOrigin(ctx), topic: pp.TopicName, qos: pp.Qos()}
+		}
+	}
+	auth.Hooks = []Hooks{denyDeliver{topic: "news/denied"}}
+	a, portA, clusterA := clusterNode(t, "a", secretAuth)
+	b, portB, _ := clusterNode(t, "b", auth, fmt.Sprintf("127.0.0.1:%d", clusterA))
+	waitFor(t, "nodes to connect", func() bool { return len(a.ClusterNodes()) == 1 && len(b.ClusterNodes()) == 1 })
+	sub, _ := dialMqtt(t, portB, "sub", "")
+	subscribe(t, sub, "news/#")
+	waitFor(t, "subscription to sync", func() bool {
+		a.cluster.mu.Lock()
+		defer a.cluster.mu.Unlock()
+		return len(a.cluster.remoteFilters["b"]) == 1
+	})
+	// 本地的SUBSCRIBE也经过回调,先取出
+	for len(ctxSeen) > 0 || len(cbSeen) > 0 {
+		select {
+		case <-ctxSeen:
+		case <-cbSeen:
+		}
+	}
+	pub, _ := dialMqtt(t, portA, "pub", "")
+	writePacket(t, pub, publishPacket("news/denied", "no", 1, 5))
+	writePacket(t, pub, publishPacket("news/1", "hello", 1, 6))
+	got, err := readPacket(sub, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pp, ok := got.(*packets.PublishPacket); !ok || pp.TopicName != "news/1" || pp.Qos() != 0 || pp.MessageID != 0 {
+		t.Fatalf("unexpected packet %#v", got)
+	}
+	for _, topic := range []string{"news/denied", "news/1"} {
+		select {
+		case s := <-ctxSeen:
+			if s != (seen{id: "pub", origin: "a", topic: topic}) {
+				t.Fatalf("PacketContextCb %+v", s)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("PacketContextCb is not called for %s", topic)
+		}
+		select {
+		case s := <-cbSeen:
+			if s != "pub "+topic {
+				t.Fatalf("PacketCb %s", s)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("PacketCb is not called for %s", topic)
+		}
+	}
+}
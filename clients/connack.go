@@ -0,0 +1,54 @@
+package clients
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"net"
+	"time"
+)
+
+// connAckBytes    生成CONNACK报文;MQTT 5时使用对应的原因码,assignedId不为空且握手成功时带Assigned Client Identifier属性
+func connAckBytes(code enmu.HandshakeResult, sessionPresent bool, version byte, assignedId string) []byte {
+	if version == mqtt5Version {
+		var flags byte
+		if sessionPresent && code == enmu.Success {
+			flags = 1
+		}
+		var props []byte
+		if assignedId != "" && code == enmu.Success {
+			props = binary.BigEndian.AppendUint16([]byte{assignedClientIdProp}, uint16(len(assignedId)))
+			props = append(props, assignedId...)
+		}
+		body := appendVarint([]byte{flags, connAck5(code)}, len(props))
+		return append(appendVarint([]byte{connAckType << 4}, len(body)+len(props)), append(body, props...)...)
+	}
+	p := packets.NewConnAck(nil)
+	p.ReturnCode = byte(code)
+	p.SessionPresent = sessionPresent && code == enmu.Success
+	buf := bytes.NewBuffer([]byte{})
+	_, _ = p.Write(buf)
+	return buf.Bytes()
+}
+
+// assignedClientId    ClientId由服务端分配或加了后缀时返回实际使用的ClientId,否则为空
+func assignedClientId(id string, info connectInfo) string {
+	if info.connect == nil || info.connect.ClientIdentifier == id {
+		return ""
+	}
+	return id
+}
+
+// writeHandshakeBytes    在读写协程启动前直接写入链接
+func writeHandshakeBytes(conn net.Conn, bs []byte) error {
+	err := conn.SetWriteDeadline(time.Now().Add(defaultWriteTimeOut * time.Second))
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(bs)
+	if err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(time.Time{})
+}
@@ -0,0 +1,365 @@
+package clients
+
+import (
+	"container/heap"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"github.com/qdmc/mqtt_single_proxy/rules"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	delayedPrefix       = "$delayed/"
+	defaultMaxDelay     = 4294967 // 秒,约49.7天
+	delayedReleaseBatch = 1024    // 每次持锁取出的到期消息数上限
+)
+
+// DelayedStore    SessionStore的可选接口;实现时持久化等待中的延迟消息,Start时加载
+type DelayedStore interface {
+	SaveDelayed(d clients_dto.DelayedMessage) error
+	DeleteDelayed(id string) error
+	Delayed() ([]clients_dto.DelayedMessage, error)
+}
+
+type delayedItem struct {
+	msg   clients_dto.DelayedMessage
+	index int
+}
+
+// delayedHeap    按到期时间排序的最小堆
+type delayedHeap []*delayedItem
+
+func (h delayedHeap) Len() int           { return len(h) }
+func (h delayedHeap) Less(i, j int) bool { return h[i].msg.ReleaseNano < h[j].msg.ReleaseNano }
+func (h delayedHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *delayedHeap) Push(x any) {
+	item := x.(*delayedItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *delayedHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+/*
+delayedQueue    等待中的延迟消息
+  - 最小堆加单个定时器,插入与取消O(log n),不为每条消息创建定时器
+  - 到期的消息在调度协程中按批取出,release在锁外执行
+*/
+type delayedQueue struct {
+	mu       sync.Mutex
+	heap     delayedHeap
+	items    map[string]*delayedItem
+	wake     chan struct{}
+	stopChan chan struct{}
+	done     chan struct{}
+	release  func(d clients_dto.DelayedMessage)
+	pubrecMu sync.Mutex
+	pubrec   map[string]map[uint16]struct{} // 已回复PUBREC、等待PUBREL的QoS2延迟消息,ClientId -> MessageID
+}
+
+func newDelayedQueue(release func(d clients_dto.DelayedMessage)) *delayedQueue {
+	return &delayedQueue{
+		items:   map[string]*delayedItem{},
+		wake:    make(chan struct{}, 1),
+		release: release,
+		pubrec:  map[string]map[uint16]struct{}{},
+	}
+}
+
+// start    清空后加载pending并启动调度协程;已过期的消息立即发布
+func (q *delayedQueue) start(pending []clients_dto.DelayedMessage) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopChan != nil {
+		return
+	}
+	q.heap = make(delayedHeap, 0, len(pending))
+	q.items = make(map[string]*delayedItem, len(pending))
+	for _, d := range pending {
+		item := &delayedItem{msg: d, index: len(q.heap)}
+		q.heap = append(q.heap, item)
+		q.items[d.Id] = item
+	}
+	heap.Init(&q.heap)
+	q.stopChan, q.done = make(chan struct{}), make(chan struct{})
+	go q.run(q.stopChan, q.done)
+}
+
+// stop    停止调度协程;下次start时从存储重新加载,未持久化的消息丢弃
+func (q *delayedQueue) stop() {
+	q.mu.Lock()
+	stopChan, done := q.stopChan, q.done
+	q.stopChan, q.done = nil, nil
+	q.mu.Unlock()
+	if stopChan == nil {
+		return
+	}
+	close(stopChan)
+	<-done
+}
+
+func (q *delayedQueue) add(d clients_dto.DelayedMessage) {
+	q.mu.Lock()
+	item := &delayedItem{msg: d}
+	heap.Push(&q.heap, item)
+	q.items[d.Id] = item
+	first := item.index == 0
+	q.mu.Unlock()
+	if first {
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (q *delayedQueue) cancel(id string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item, ok := q.items[id]
+	if !ok {
+		return false
+	}
+	heap.Remove(&q.heap, item.index)
+	delete(q.items, id)
+	return true
+}
+
+func (q *delayedQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.heap)
+}
+
+// awaitPubRel    记录回复了PUBREC的QoS2延迟消息
+func (q *delayedQueue) awaitPubRel(id string, mid uint16) {
+	q.pubrecMu.Lock()
+	defer q.pubrecMu.Unlock()
+	if q.pubrec[id] == nil {
+		q.pubrec[id] = map[uint16]struct{}{}
+	}
+	q.pubrec[id][mid] = struct{}{}
+}
+
+// takePubRel    PUBREL属于延迟消息时移除记录并返回true
+func (q *delayedQueue) takePubRel(id string, mid uint16) bool {
+	q.pubrecMu.Lock()
+	defer q.pubrecMu.Unlock()
+	if _, ok := q.pubrec[id][mid]; !ok {
+		return false
+	}
+	delete(q.pubrec[id], mid)
+	if len(q.pubrec[id]) == 0 {
+		delete(q.pubrec, id)
+	}
+	return true
+}
+
+// clearPubRel    清除客户端的记录,清除会话的客户端断开时调用
+func (q *delayedQueue) clearPubRel(id string) {
+	q.pubrecMu.Lock()
+	defer q.pubrecMu.Unlock()
+	delete(q.pubrec, id)
+}
+
+// list    按到期时间返回符合条件的消息
+func (q *delayedQueue) list(query clients_dto.DelayedQuery) []clients_dto.DelayedMessage {
+	q.mu.Lock()
+	list := make([]clients_dto.DelayedMessage, 0, len(q.heap))
+	for _, item := range q.heap {
+		if query.ClientId != "" && item.msg.ClientId != query.ClientId {
+			continue
+		}
+		if query.Topic != "" && !rules.MatchTopic(query.Topic, item.msg.Topic) {
+			continue
+		}
+		list = append(list, item.msg)
+	}
+	q.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ReleaseNano < list[j].ReleaseNano })
+	if query.Limit > 0 && len(list) > query.Limit {
+		list = list[:query.Limit]
+	}
+	return list
+}
+
+func (q *delayedQueue) run(stopChan, done chan struct{}) {
+	defer close(done)
+	for {
+		q.mu.Lock()
+		now := time.Now().UnixNano()
+		var due []clients_dto.DelayedMessage
+		for len(q.heap) > 0 && q.heap[0].msg.ReleaseNano <= now && len(due) < delayedReleaseBatch {
+			item := heap.Pop(&q.heap).(*delayedItem)
+			delete(q.items, item.msg.Id)
+			due = append(due, item.msg)
+		}
+		wait := time.Duration(-1)
+		if len(q.heap) > 0 {
+			wait = max(time.Duration(q.heap[0].msg.ReleaseNano-now), 0)
+		}
+		q.mu.Unlock()
+		for _, d := range due {
+			q.release(d)
+		}
+		var timeout <-chan time.Time
+		var timer *time.Timer
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-stopChan:
+		case <-q.wake:
+		case <-timeout:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-stopChan:
+			return
+		default:
+		}
+	}
+}
+
+// parseDelayed    解析$delayed/<秒>/<主题>,返回延迟秒数与目标主题
+func parseDelayed(topic string, maxInterval int64) (int64, string, error) {
+	rest := strings.TrimPrefix(topic, delayedPrefix)
+	seconds, target, found := strings.Cut(rest, "/")
+	if !found || target == "" || strings.ContainsAny(target, "+#") || strings.HasPrefix(target, delayedPrefix) {
+		return 0, "", enmu.DelayedTopicError
+	}
+	delay, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil || delay < 0 || delay > maxInterval {
+		return 0, "", enmu.DelayedTopicError
+	}
+	return delay, target, nil
+}
+
+func isDelayed(p mqtt_packet.ControlPacketInterface) bool {
+	pp, ok := p.(*packets.PublishPacket)
+	return ok && strings.HasPrefix(pp.TopicName, delayedPrefix)
+}
+
+func newDelayedId() string {
+	p := make([]byte, 12)
+	_, _ = rand.Read(p)
+	return hex.EncodeToString(p)
+}
+
+// DelayedMessages    查询等待中的延迟消息
+func (m *defaultClientManager) DelayedMessages(q clients_dto.DelayedQuery) []clients_dto.DelayedMessage {
+	return m.delayed.list(q)
+}
+
+// CancelDelayed    取消等待中的延迟消息,已发布或不存在时返回enmu.DelayedNotFoundError
+func (m *defaultClientManager) CancelDelayed(id string) error {
+	if !m.delayed.cancel(id) {
+		return enmu.DelayedNotFoundError
+	}
+	if ds, ok := m.options().SessionStore.(DelayedStore); ok {
+		_ = ds.DeleteDelayed(id)
+	}
+	m.log(slog.LevelInfo, "delayed message canceled", "", slog.String("delayed_id", id))
+	return nil
+}
+
+// storedDelayed    Start时加载持久化的延迟消息,未实现DelayedStore时为空
+func (m *defaultClientManager) storedDelayed() ([]clients_dto.DelayedMessage, error) {
+	if ds, ok := m.options().SessionStore.(DelayedStore); ok {
+		return ds.Delayed()
+	}
+	return nil, nil
+}
+
+// scheduleDelayed    保存延迟消息,QoS1/2由管理器回复PUBACK/PUBREC,QoS2的PUBREL由replyPubRel回复PUBCOMP;在钩子与负载校验之后、分发分片中执行
+func (m *defaultClientManager) scheduleDelayed(id string, p *packets.PublishPacket, delay int64) {
+	opt := m.options()
+	if opt.MaxDelayedCount > 0 && m.delayed.len() >= opt.MaxDelayedCount {
+		m.log(slog.LevelWarn, "delayed message dropped", id, slog.String("topic", p.TopicName), slog.Any("err", enmu.DelayedQueueFullError))
+		return
+	}
+	now := time.Now()
+	d := clients_dto.DelayedMessage{
+		Id:          newDelayedId(),
+		ClientId:    id,
+		Topic:       p.TopicName,
+		Payload:     p.Payload,
+		Qos:         p.Qos(),
+		Retain:      p.GetFixedHead().Retain,
+		Nano:        now.UnixNano(),
+		ReleaseNano: now.Add(time.Duration(delay) * time.Second).UnixNano(),
+	}
+	if ds, ok := opt.SessionStore.(DelayedStore); ok {
+		if err := ds.SaveDelayed(d); err != nil {
+			m.log(slog.LevelError, "delayed message dropped", id, slog.String("topic", p.TopicName), slog.Any("err", err))
+			return
+		}
+	}
+	m.delayed.add(d)
+	m.log(slog.LevelDebug, "delayed message scheduled", id, slog.String("delayed_id", d.Id), slog.String("topic", d.Topic), slog.Int64("delay", delay))
+	switch p.Qos() {
+	case 1:
+		ack := packets.NewPubAck(nil)
+		ack.MessageID = p.MessageID
+		m.AsyncSendPacketOnce(id, ack)
+	case 2:
+		m.delayed.awaitPubRel(id, p.MessageID)
+		rec := packets.NewPubRec(nil)
+		rec.MessageID = p.MessageID
+		m.AsyncSendPacketOnce(id, rec)
+	}
+}
+
+// replyPubRel    PUBREL属于已回复PUBREC的延迟消息时由管理器回复PUBCOMP,不再交给钩子与回调
+func (m *defaultClientManager) replyPubRel(id string, p mqtt_packet.ControlPacketInterface) bool {
+	rel, ok := p.(*packets.PubRelPacket)
+	if !ok || !m.delayed.takePubRel(id, rel.MessageID) {
+		return false
+	}
+	comp := packets.NewPubComp(nil)
+	comp.MessageID = rel.MessageID
+	m.AsyncSendPacketOnce(id, comp)
+	return true
+}
+
+// releaseDelayed    以发布者的身份发布到期的消息,经过规则与路由,不再经过钩子与负载校验;发布后从存储中删除
+func (m *defaultClientManager) releaseDelayed(d clients_dto.DelayedMessage) {
+	m.dispatcher.dispatch(d.ClientId, func() {
+		p := packets.NewPublish(nil)
+		p.TopicName = d.Topic
+		p.Payload = d.Payload
+		p.GetFixedHead().Qos = d.Qos
+		p.GetFixedHead().Retain = d.Retain
+		ctx, span := m.rootSpan("mqtt.delayed", trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(publishAttrs(d.ClientId, p)...))
+		if !m.applyRules(ctx, d.ClientId, p) {
+			m.routePacket(ctx, d.ClientId, p)
+		}
+		span.End()
+		if ds, ok := m.options().SessionStore.(DelayedStore); ok {
+			_ = ds.DeleteDelayed(d.Id)
+		}
+		m.log(slog.LevelDebug, "delayed message released", d.ClientId, slog.String("delayed_id", d.Id), slog.String("topic", d.Topic))
+	})
+}
@@ -0,0 +1,66 @@
+package clients
+
+import (
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestDelayedQos2PubComp    QoS2延迟消息回复PUBREC后,PUBREL由管理器回复PUBCOMP,不交给回调
+func TestDelayedQos2PubComp(t *testing.T) {
+	port := freePort(t)
+	var pubRels int32
+	m := NewClientManagerInstance(&ClientManagerOptions{
+		TcpPort: port,
+		PacketCb: func(id string, p mqtt_packet.ControlPacketInterface) {
+			if _, ok := p.(*packets.PubRelPacket); ok {
+				atomic.AddInt32(&pubRels, 1)
+			}
+		},
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	c, code := dialMqtt(t, port, "c1", "")
+	if code != 0 {
+		t.Fatalf("connack %d", code)
+	}
+	writePacket(t, c, publishPacket("$delayed/60/a", "x", 2, 7))
+	p, err := readPacket(c, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec, ok := p.(*packets.PubRecPacket); !ok || rec.MessageID != 7 {
+		t.Fatalf("got %v, want PUBREC 7", p)
+	}
+	rel := packets.NewPubRel(nil)
+	rel.MessageID = 7
+	writePacket(t, c, rel)
+	p, err = readPacket(c, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comp, ok := p.(*packets.PubCompPacket); !ok || comp.MessageID != 7 {
+		t.Fatalf("got %v, want PUBCOMP 7", p)
+	}
+	if n := atomic.LoadInt32(&pubRels); n != 0 {
+		t.Fatalf("PacketCb received %d PUBREL of the delayed message", n)
+	}
+	if list := m.DelayedMessages(clients_dto.DelayedQuery{}); len(list) != 1 || list[0].Topic != "a" {
+		t.Fatalf("delayed messages %+v", list)
+	}
+	// 不属于延迟消息的PUBREL照常交给回调
+	rel.MessageID = 8
+	writePacket(t, c, rel)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&pubRels) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("PUBREL of another message is not passed to PacketCb")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
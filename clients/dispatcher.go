@@ -0,0 +1,245 @@
+package clients
+
+import (
+	"bytes"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"hash/fnv"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const defaultDispatchQueueSize = 1024
+
+// dispatchTask   分发任务
+type dispatchTask struct {
+	id        string
+	fn        func()
+	queueNano int64 // 入队时间
+}
+
+// dispatcher    按ClientId分片的回调工作池;同一客户端的回调固定在同一分片内按顺序执行
+type dispatcher struct {
+	mu         sync.RWMutex
+	shards     []chan dispatchTask
+	queueSize  int
+	quit       chan struct{}
+	closed     atomic.Bool
+	wg         sync.WaitGroup
+	workerIds  sync.Map // 工作协程的id,用于判断stop是否在回调中调用
+	dispatched uint64
+	panics     uint64
+	lastLag    int64
+	maxLag     int64
+	totalLag   int64
+	onPanic    func(id string, r any) // 回调panic时调用,可为nil
+}
+
+func newDispatcher(workers, queueSize int, onPanic func(id string, r any)) *dispatcher {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if queueSize <= 0 {
+		queueSize = defaultDispatchQueueSize
+	}
+	d := &dispatcher{
+		shards:    make([]chan dispatchTask, workers),
+		queueSize: queueSize,
+		quit:      make(chan struct{}),
+		onPanic:   onPanic,
+	}
+	for i := range d.shards {
+		d.shards[i] = make(chan dispatchTask, queueSize)
+		d.wg.Add(1)
+		go d.work(d.shards[i])
+	}
+	return d
+}
+
+func (d *dispatcher) work(shard chan dispatchTask) {
+	defer d.wg.Done()
+	d.workerIds.Store(goroutineId(), struct{}{})
+	for task := range shard {
+		lag := time.Now().UnixNano() - task.queueNano
+		atomic.StoreInt64(&d.lastLag, lag)
+		atomic.AddInt64(&d.totalLag, lag)
+		for {
+			maxLag := atomic.LoadInt64(&d.maxLag)
+			if lag <= maxLag || atomic.CompareAndSwapInt64(&d.maxLag, maxLag, lag) {
+				break
+			}
+		}
+		d.run(task.id, task.fn)
+		atomic.AddUint64(&d.dispatched, 1)
+	}
+}
+
+// run   执行回调,回调panic不影响分片内后续任务
+func (d *dispatcher) run(id string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&d.panics, 1)
+			if d.onPanic != nil {
+				d.onPanic(id, r)
+			}
+		}
+	}()
+	fn()
+}
+
+// dispatch    按id投递任务,分片队列满时阻塞调用方(即该客户端的读协程)
+func (d *dispatcher) dispatch(id string, fn func()) {
+	if fn == nil {
+		return
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	select {
+	case <-d.quit:
+		return
+	default:
+	}
+	select {
+	case d.shards[d.shardIndex(id)] <- dispatchTask{id: id, fn: fn, queueNano: time.Now().UnixNano()}:
+	case <-d.quit:
+	}
+}
+
+// tryDispatch    按id投递任务,分片队列满或已停止时不阻塞,返回false
+func (d *dispatcher) tryDispatch(id string, fn func()) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	select {
+	case <-d.quit:
+		return false
+	default:
+	}
+	select {
+	case d.shards[d.shardIndex(id)] <- dispatchTask{id: id, fn: fn, queueNano: time.Now().UnixNano()}:
+		return true
+	default:
+		return false
+	}
+}
+
+// dispatchBatch    在管理器的锁内收集的分发任务,释放锁后再投递,避免分片队列满时持锁阻塞
+type dispatchBatch []dispatchTask
+
+func (b *dispatchBatch) add(id string, fn func()) {
+	*b = append(*b, dispatchTask{id: id, fn: fn})
+}
+
+// dispatchSequencer    按取号顺序投递批量任务;在管理器的锁内取号,使锁外的投递顺序与加锁顺序一致
+type dispatchSequencer struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	issued uint64
+	next   uint64
+}
+
+func newDispatchSequencer() *dispatchSequencer {
+	s := &dispatchSequencer{}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+func (s *dispatchSequencer) take() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ticket := s.issued
+	s.issued++
+	return ticket
+}
+
+// run    等待轮到ticket后执行fn
+func (s *dispatchSequencer) run(ticket uint64, fn func()) {
+	s.mu.Lock()
+	for s.next != ticket {
+		s.cond.Wait()
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.next++
+		s.mu.Unlock()
+		s.cond.Broadcast()
+	}()
+	fn()
+}
+
+func (d *dispatcher) stopped() bool {
+	select {
+	case <-d.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (d *dispatcher) workers() int {
+	return len(d.shards)
+}
+
+func (d *dispatcher) shardIndex(id string) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(id))
+	return int(h.Sum32() % uint32(len(d.shards)))
+}
+
+// stop     停止接收任务,等待已入队的任务执行完成;在回调中调用时只停止接收,不等待(等待会与调用方所在的工作协程死锁)
+func (d *dispatcher) stop() {
+	if d.closed.CompareAndSwap(false, true) {
+		close(d.quit)
+		d.mu.Lock()
+		for _, shard := range d.shards {
+			close(shard)
+		}
+		d.mu.Unlock()
+	}
+	if d.inWorker() {
+		return
+	}
+	d.wg.Wait()
+}
+
+// inWorker    当前协程是否为工作协程
+func (d *dispatcher) inWorker() bool {
+	_, ok := d.workerIds.Load(goroutineId())
+	return ok
+}
+
+// goroutineId    当前协程的id,解析runtime.Stack首行的"goroutine N [...]"
+func goroutineId() uint64 {
+	var buf [64]byte
+	line := buf[:runtime.Stack(buf[:], false)]
+	line = bytes.TrimPrefix(line, []byte("goroutine "))
+	if i := bytes.IndexByte(line, ' '); i >= 0 {
+		line = line[:i]
+	}
+	id, _ := strconv.ParseUint(string(line), 10, 64)
+	return id
+}
+
+func (d *dispatcher) statistics() clients_dto.DispatchStatistics {
+	s := clients_dto.DispatchStatistics{
+		Workers:     len(d.shards),
+		QueueSize:   d.queueSize,
+		Dispatched:  atomic.LoadUint64(&d.dispatched),
+		Panics:      atomic.LoadUint64(&d.panics),
+		LastLagNano: atomic.LoadInt64(&d.lastLag),
+		MaxLagNano:  atomic.LoadInt64(&d.maxLag),
+	}
+	for _, shard := range d.shards {
+		l := len(shard)
+		s.Pending += l
+		if l > s.MaxShardPending {
+			s.MaxShardPending = l
+		}
+	}
+	if s.Dispatched > 0 {
+		s.AvgLagNano = atomic.LoadInt64(&d.totalLag) / int64(s.Dispatched)
+	}
+	return s
+}
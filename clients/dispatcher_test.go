@@ -0,0 +1,75 @@
+package clients
+
+import (
+	"context"
+	"github.com/qdmc/mqtt_packet"
+	"testing"
+	"time"
+)
+
+func TestGoroutineId(t *testing.T) {
+	id := goroutineId()
+	other := make(chan uint64)
+	go func() { other <- goroutineId() }()
+	if o := <-other; id == 0 || o == 0 || o == id || goroutineId() != id {
+		t.Fatalf("goroutine ids %d %d", id, o)
+	}
+}
+
+// TestDispatcherStopFromWorker    回调中调用stop只停止接收,不等待自身;其他协程调用stop等待已入队的任务
+func TestDispatcherStopFromWorker(t *testing.T) {
+	d := newDispatcher(2, 4, nil)
+	stopped := make(chan struct{})
+	d.dispatch("a", func() {
+		d.stop()
+		close(stopped)
+	})
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop from a worker deadlocks")
+	}
+	if d.tryDispatch("a", func() {}) {
+		t.Fatal("task is accepted after stop")
+	}
+	d.stop()
+	if d.inWorker() {
+		t.Fatal("test goroutine is a worker")
+	}
+}
+
+// TestStopFromPacketCb    PacketCb中调用Stop或Shutdown不会死锁
+func TestStopFromPacketCb(t *testing.T) {
+	for _, name := range []string{"Stop", "Shutdown"} {
+		port := freePort(t)
+		var m ClientManagerInterface
+		returned := make(chan error, 1)
+		m = NewClientManagerInstance(&ClientManagerOptions{
+			TcpPort: port,
+			PacketCb: func(string, mqtt_packet.ControlPacketInterface) {
+				if name == "Stop" {
+					returned <- m.Stop()
+				} else {
+					returned <- m.Shutdown(context.Background())
+				}
+			},
+		})
+		if err := m.Start(); err != nil {
+			t.Fatal(err)
+		}
+		c, _ := dialMqtt(t, port, "dev", "")
+		writePacket(t, c, publishPacket("a", "x", 0, 0))
+		select {
+		case err := <-returned:
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s from PacketCb deadlocks", name)
+		}
+		if _, err := readPacket(c, 5*time.Second); err == nil && name == "Stop" {
+			t.Fatal("Stop: connection is not closed")
+		}
+		waitFor(t, "clients to be removed", func() bool { return m.Len() == 0 })
+	}
+}
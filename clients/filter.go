@@ -0,0 +1,63 @@
+package clients
+
+import (
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"strings"
+)
+
+// ClientFilter    客户端筛选条件,返回true表示选中
+type ClientFilter func(clients_dto.ConnectionDatabase) bool
+
+// FilterByProtocol    按协议筛选
+func FilterByProtocol(protocol enmu.ClientProtocol) ClientFilter {
+	return func(db clients_dto.ConnectionDatabase) bool {
+		return db.Protocol == protocol
+	}
+}
+
+// FilterByUserName    按用户名筛选
+func FilterByUserName(userName string) ClientFilter {
+	return func(db clients_dto.ConnectionDatabase) bool {
+		return db.UserName == userName
+	}
+}
+
+// FilterByIdPrefix    按ClientId前缀筛选
+func FilterByIdPrefix(prefix string) ClientFilter {
+	return func(db clients_dto.ConnectionDatabase) bool {
+		return strings.HasPrefix(db.Id, prefix)
+	}
+}
+
+// FilterByTag    按标签筛选,value为空时只要求存在该标签
+func FilterByTag(key, value string) ClientFilter {
+	return func(db clients_dto.ConnectionDatabase) bool {
+		v, ok := db.Tags[key]
+		return ok && (value == "" || v == value)
+	}
+}
+
+// FilterAnd    所有条件都满足
+func FilterAnd(filters ...ClientFilter) ClientFilter {
+	return func(db clients_dto.ConnectionDatabase) bool {
+		for _, f := range filters {
+			if f != nil && !f(db) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// FilterOr    任一条件满足
+func FilterOr(filters ...ClientFilter) ClientFilter {
+	return func(db clients_dto.ConnectionDatabase) bool {
+		for _, f := range filters {
+			if f != nil && f(db) {
+				return true
+			}
+		}
+		return false
+	}
+}
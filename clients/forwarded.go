@@ -0,0 +1,113 @@
+package clients
+
+import (
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func parseCidrs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// newHttpContext    生成websocket升级请求的上下文
+func newHttpContext(req *http.Request, peer net.Addr) *clients_dto.HttpContext {
+	return &clients_dto.HttpContext{
+		Host:         req.Host,
+		Path:         req.URL.Path,
+		Header:       req.Header.Clone(),
+		Cookies:      req.Cookies(),
+		Query:        req.URL.Query(),
+		TLS:          req.TLS,
+		Peer:         peer,
+		ForwardedFor: forwardedFor(req.Header),
+	}
+}
+
+// realRemoteAddr    对端为可信代理时,从右向左跳过可信代理,取第一个不可信的地址作为客户端地址
+func realRemoteAddr(peer net.Addr, hops []string, trusted []*net.IPNet) net.Addr {
+	if !containsIP(trusted, addrIP(peer)) {
+		return peer
+	}
+	addr := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseForwardedAddr(hops[i])
+		if hop == nil {
+			break
+		}
+		addr = hop
+		if !containsIP(trusted, hop.IP) {
+			break
+		}
+	}
+	return addr
+}
+
+// forwardedFor    读取地址链,优先使用Forwarded(RFC 7239),其次X-Forwarded-For
+func forwardedFor(header http.Header) []string {
+	var hops []string
+	if values := header.Values("Forwarded"); len(values) > 0 {
+		for _, value := range values {
+			for _, element := range strings.Split(value, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+					if ok && strings.EqualFold(k, "for") {
+						hops = append(hops, strings.Trim(v, `"`))
+					}
+				}
+			}
+		}
+		return hops
+	}
+	for _, value := range header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	return hops
+}
+
+// parseForwardedAddr    支持:1.2.3.4, 1.2.3.4:80, 2001:db8::1, [2001:db8::1]:80;未知或混淆的地址返回nil
+func parseForwardedAddr(hop string) *net.TCPAddr {
+	if ip := net.ParseIP(hop); ip != nil {
+		return &net.TCPAddr{IP: ip}
+	}
+	host, port, err := net.SplitHostPort(hop)
+	if err != nil {
+		ip := net.ParseIP(strings.Trim(hop, "[]"))
+		if ip == nil {
+			return nil
+		}
+		return &net.TCPAddr{IP: ip}
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	p, _ := strconv.ParseUint(port, 10, 16)
+	return &net.TCPAddr{IP: ip, Port: int(p)}
+}
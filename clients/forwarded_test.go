@@ -0,0 +1,109 @@
+package clients
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestForwardedFor(t *testing.T) {
+	cases := []struct {
+		name   string
+		header http.Header
+		want   []string
+	}{
+		{"none", http.Header{}, nil},
+		{"x-forwarded-for", http.Header{"X-Forwarded-For": {"203.0.113.1, 10.0.0.1", " 10.0.0.2 ,,"}}, []string{"203.0.113.1", "10.0.0.1", "10.0.0.2"}},
+		{"forwarded", http.Header{"Forwarded": {`for=192.0.2.60;proto=http;by=203.0.113.43`}}, []string{"192.0.2.60"}},
+		{"forwarded quoted ipv6", http.Header{"Forwarded": {`For="[2001:db8:cafe::17]:4711"`}}, []string{"[2001:db8:cafe::17]:4711"}},
+		{"forwarded hops", http.Header{"Forwarded": {`for=192.0.2.43, for="[2001:db8::1]"`, `proto=https; for=10.0.0.1`}}, []string{"192.0.2.43", "[2001:db8::1]", "10.0.0.1"}},
+		{"forwarded obfuscated", http.Header{"Forwarded": {`for=_hidden, for=unknown`}}, []string{"_hidden", "unknown"}},
+		{"forwarded wins", http.Header{"Forwarded": {`for=192.0.2.1`}, "X-Forwarded-For": {"198.51.100.1"}}, []string{"192.0.2.1"}},
+		{"forwarded without for", http.Header{"Forwarded": {`proto=https`}, "X-Forwarded-For": {"198.51.100.1"}}, nil},
+	}
+	for _, c := range cases {
+		if got := forwardedFor(c.header); strings.Join(got, "|") != strings.Join(c.want, "|") {
+			t.Errorf("%s: %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestParseForwardedAddr(t *testing.T) {
+	cases := []struct {
+		hop  string
+		want string // 为空表示nil
+	}{
+		{"192.0.2.1", "192.0.2.1:0"},
+		{"192.0.2.1:8080", "192.0.2.1:8080"},
+		{"2001:db8::1", "[2001:db8::1]:0"},
+		{"[2001:db8::1]", "[2001:db8::1]:0"},
+		{"[2001:db8::1]:4711", "[2001:db8::1]:4711"},
+		{"_hidden", ""},
+		{"unknown", ""},
+		{"example.com:80", ""},
+		{"", ""},
+	}
+	for _, c := range cases {
+		addr := parseForwardedAddr(c.hop)
+		if got := ""; addr != nil {
+			got = addr.String()
+			if got != c.want {
+				t.Errorf("%q: %s, want %s", c.hop, got, c.want)
+			}
+		} else if c.want != "" {
+			t.Errorf("%q: nil, want %s", c.hop, c.want)
+		}
+	}
+}
+
+func TestRealRemoteAddr(t *testing.T) {
+	trusted, err := parseCidrs([]string{"10.0.0.0/8", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234}
+	cases := []struct {
+		name string
+		peer net.Addr
+		hops []string
+		want string
+	}{
+		{"untrusted peer ignores headers", &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 1}, []string{"203.0.113.1"}, "198.51.100.7:1"},
+		{"no hops", peer, nil, "10.0.0.1:1234"},
+		{"client behind trusted proxy", peer, []string{"203.0.113.1"}, "203.0.113.1:0"},
+		{"skips trusted hops", peer, []string{"203.0.113.1", "10.0.0.3", "10.0.0.2"}, "203.0.113.1:0"},
+		{"spoofed leftmost hop is ignored", peer, []string{"1.1.1.1", "203.0.113.1", "10.0.0.2"}, "203.0.113.1:0"},
+		{"ipv6 hop with port", peer, []string{"[2001:db8::1]:4711", "[fd00::2]"}, "[2001:db8::1]:4711"},
+		{"obfuscated hop stops", peer, []string{"203.0.113.1", "_hidden", "10.0.0.2"}, "10.0.0.2:0"},
+		{"all trusted", peer, []string{"10.0.0.3", "10.0.0.2"}, "10.0.0.3:0"},
+	}
+	for _, c := range cases {
+		if got := realRemoteAddr(c.peer, c.hops, trusted); addrString(got) != c.want {
+			t.Errorf("%s: %s, want %s", c.name, addrString(got), c.want)
+		}
+	}
+}
+
+// TestForwardedThroughWebsocket    只信任可信代理发来的X-Forwarded-For
+func TestForwardedThroughWebsocket(t *testing.T) {
+	for _, c := range []struct {
+		trusted string
+		want    string
+	}{
+		{"127.0.0.0/8", "203.0.113.9"},
+		{"10.0.0.0/8", "127.0.0.1"},
+	} {
+		port := freePort(t)
+		m, _, _ := limitManager(t, &ClientManagerOptions{TcpPort: freePort(t), IsWebsocket: true, WebsocketPort: port, ForwardedTrusted: []string{c.trusted}})
+		conn, r := dialWebsocket(t, port, http.Header{"X-Forwarded-For": {"203.0.113.9, 127.0.0.2"}})
+		wsConnect(t, conn, r, "dev")
+		db, err := m.GetOnce("dev")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if host, _, _ := net.SplitHostPort(addrString(db.Addr)); host != c.want {
+			t.Errorf("trusted %s: address %s, want %s", c.trusted, addrString(db.Addr), c.want)
+		}
+	}
+}
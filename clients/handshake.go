@@ -0,0 +1,109 @@
+package clients
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"net"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const defaultAssignPrefix = "auto-"
+
+// ClientIdRule   ClientId校验规则,零值字段不校验;自动分配的ClientId不受规则限制
+type ClientIdRule struct {
+	MinLength        int      // 最小长度
+	MaxLength        int      // 最大长度
+	Charset          string   // 允许的字符集合,如:abc...0123456789-_
+	Pattern          string   // 正则表达式,需完整匹配
+	ReservedPrefixes []string // 客户端不能使用的前缀
+	AssignPrefix     string   // 自动分配ClientId的前缀,默认:auto-
+	pattern          *regexp.Regexp
+}
+
+// compile   编译正则,在Start时调用
+func (r *ClientIdRule) compile() error {
+	if r == nil || r.Pattern == "" {
+		return nil
+	}
+	pattern, err := regexp.Compile("^(?:" + r.Pattern + ")$")
+	if err != nil {
+		return err
+	}
+	r.pattern = pattern
+	return nil
+}
+
+func (r *ClientIdRule) check(id string) error {
+	if r == nil {
+		return nil
+	}
+	length := utf8.RuneCountInString(id)
+	if r.MinLength > 0 && length < r.MinLength {
+		return enmu.ClientIdInvalidError
+	}
+	if r.MaxLength > 0 && length > r.MaxLength {
+		return enmu.ClientIdInvalidError
+	}
+	if r.Charset != "" {
+		for _, char := range id {
+			if !strings.ContainsRune(r.Charset, char) {
+				return enmu.ClientIdInvalidError
+			}
+		}
+	}
+	if r.pattern != nil && !r.pattern.MatchString(id) {
+		return enmu.ClientIdInvalidError
+	}
+	for _, prefix := range r.ReservedPrefixes {
+		if prefix != "" && strings.HasPrefix(id, prefix) {
+			return enmu.ClientIdInvalidError
+		}
+	}
+	return nil
+}
+
+// generateClientId   生成随机的ClientId
+func (r *ClientIdRule) generateClientId() string {
+	prefix := defaultAssignPrefix
+	if r != nil && r.AssignPrefix != "" {
+		prefix = r.AssignPrefix
+	}
+	p := make([]byte, 12)
+	_, _ = rand.Read(p)
+	return prefix + hex.EncodeToString(p)
+}
+
+// checkConnect    校验CONNECT报文:ClientId分配与规则、握手校验Handle、OnConnect钩子
+func checkConnect(addr net.Addr, httpCtx *clients_dto.HttpContext, packet *packets.ConnectPacket, opt *ClientManagerOptions) (clients_dto.ConnectionHandshakeDatabase, enmu.HandshakeResult) {
+	hd := clients_dto.ConnectionHandshakeDatabase{
+		ClientId: packet.ClientIdentifier,
+		UserName: packet.Username,
+		Password: string(packet.Password),
+		Addr:     addr,
+		Http:     httpCtx,
+	}
+	if hd.ClientId == "" {
+		// 空ClientId只允许清理会话的客户端,由服务端分配
+		if !packet.CleanSession {
+			return hd, enmu.IdError
+		}
+		hd.ClientId = opt.ClientIdRule.generateClientId()
+		hd.IsAssignedId = true
+	} else if opt.ClientIdRule.check(hd.ClientId) != nil {
+		return hd, enmu.IdError
+	}
+	if opt.Handshake != nil {
+		if res := opt.Handshake(hd); res != enmu.Success {
+			return hd, res
+		}
+	}
+	if res := hooksChain(opt.Hooks).OnConnect(&hd); res != enmu.Success {
+		return hd, res
+	}
+	return hd, enmu.Success
+}
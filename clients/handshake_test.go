@@ -0,0 +1,150 @@
+package clients
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestClientIdRuleCheck(t *testing.T) {
+	cases := []struct {
+		name string
+		rule *ClientIdRule
+		id   string
+		ok   bool
+	}{
+		{"nil rule", nil, "any id", true},
+		{"min length", &ClientIdRule{MinLength: 3}, "ab", false},
+		{"min length ok", &ClientIdRule{MinLength: 3}, "abc", true},
+		{"max length counts runes", &ClientIdRule{MaxLength: 2}, "设备", true},
+		{"max length", &ClientIdRule{MaxLength: 2}, "abc", false},
+		{"charset", &ClientIdRule{Charset: "abc-"}, "ab-c", true},
+		{"charset rejects", &ClientIdRule{Charset: "abc-"}, "ab_c", false},
+		{"pattern is anchored", &ClientIdRule{Pattern: "dev[0-9]+"}, "xdev1", false},
+		{"pattern alternation is anchored", &ClientIdRule{Pattern: "a|b"}, "ab", false},
+		{"pattern", &ClientIdRule{Pattern: "dev[0-9]+"}, "dev12", true},
+		{"reserved prefix", &ClientIdRule{ReservedPrefixes: []string{"", "auto-"}}, "auto-x", false},
+		{"empty reserved prefix is ignored", &ClientIdRule{ReservedPrefixes: []string{""}}, "x", true},
+	}
+	for _, c := range cases {
+		if err := c.rule.compile(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if err := c.rule.check(c.id); (err == nil) != c.ok {
+			t.Errorf("%s: %q: %v", c.name, c.id, err)
+		}
+	}
+	if err := (&ClientIdRule{Pattern: "("}).compile(); err == nil {
+		t.Fatal("invalid pattern is compiled")
+	}
+}
+
+func TestCheckConnectClientId(t *testing.T) {
+	rule := &ClientIdRule{Charset: "abcdefghijklmnopqrstuvwxyz-", ReservedPrefixes: []string{"srv-"}, AssignPrefix: "srv-"}
+	opt := newOptions().merge(&ClientManagerOptions{ClientIdRule: rule})
+	cases := []struct {
+		id    string
+		clean bool
+		want  enmu.HandshakeResult
+	}{
+		{"dev", false, enmu.Success},
+		{"dev1", true, enmu.IdError},
+		{"srv-dev", true, enmu.IdError},
+		{"", false, enmu.IdError},
+	}
+	for _, c := range cases {
+		if _, res := checkConnect(nil, nil, connectPacket(c.id, c.clean), opt); res != c.want {
+			t.Errorf("%q clean %v: %d, want %d", c.id, c.clean, res, c.want)
+		}
+	}
+	// 分配的ClientId带AssignPrefix,不受规则限制
+	seen := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		hd, res := checkConnect(nil, nil, connectPacket("", true), opt)
+		if res != enmu.Success || !hd.IsAssignedId || !strings.HasPrefix(hd.ClientId, "srv-") || len(hd.ClientId) != len("srv-")+24 || seen[hd.ClientId] {
+			t.Fatalf("assigned %+v %d", hd, res)
+		}
+		seen[hd.ClientId] = true
+	}
+	if id := (*ClientIdRule)(nil).generateClientId(); !strings.HasPrefix(id, defaultAssignPrefix) {
+		t.Fatalf("default prefix %s", id)
+	}
+}
+
+// connAck5Props    解析MQTT 5 CONNACK的属性,返回Assigned Client Identifier
+func connAck5Props(t *testing.T, body []byte) (string, bool) {
+	t.Helper()
+	length, bs, err := readRemainingLength(bytes.NewReader(body[2:]))
+	n := len(bs)
+	if err != nil || 2+n+length != len(body) {
+		t.Fatalf("connack body %x", body)
+	}
+	props := body[2+n:]
+	if len(props) == 0 {
+		return "", false
+	}
+	if props[0] != assignedClientIdProp || len(props) != 3+int(binary.BigEndian.Uint16(props[1:])) {
+		t.Fatalf("connack properties %x", props)
+	}
+	return string(props[3:]), true
+}
+
+func TestConnAckAssignedClientId(t *testing.T) {
+	bs := connAckBytes(enmu.Success, false, mqtt5Version, "auto-1")
+	if bs[0] != connAckType<<4 || int(bs[1]) != len(bs)-2 {
+		t.Fatalf("connack %x", bs)
+	}
+	if id, ok := connAck5Props(t, bs[2:]); !ok || id != "auto-1" {
+		t.Fatalf("assigned id %q", id)
+	}
+	// 握手失败与3.1.1不带属性
+	if bs = connAckBytes(enmu.IdError, false, mqtt5Version, "auto-1"); !bytes.Equal(bs, []byte{connAckType << 4, 3, 0, 0x85, 0}) {
+		t.Fatalf("rejected connack %x", bs)
+	}
+	if bs = connAckBytes(enmu.Success, true, mqtt311Version, "auto-1"); !bytes.Equal(bs, []byte{connAckType << 4, 2, 1, 0}) {
+		t.Fatalf("3.1.1 connack %x", bs)
+	}
+	// 属性长度超过127时使用多字节变长整数
+	long := strings.Repeat("x", 200)
+	if id, ok := connAck5Props(t, connAckBytes(enmu.Success, false, mqtt5Version, long)[3:]); !ok || id != long {
+		t.Fatalf("long assigned id %q", id)
+	}
+}
+
+// TestMqtt5AssignedClientId    MQTT 5客户端的ClientId由服务端分配或加了后缀时,CONNACK带实际使用的ClientId
+func TestMqtt5AssignedClientId(t *testing.T) {
+	port := freePort(t)
+	m, _, _ := limitManager(t, &ClientManagerOptions{TcpPort: port, TakeoverPolicy: enmu.AllowBothPolicy})
+	connect := func(id string) (string, bool) {
+		c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = c.Close() })
+		if _, err = c.Write(mqtt5Connect(id, "", "", "")); err != nil {
+			t.Fatal(err)
+		}
+		first, body := readMqtt5(t, c)
+		if first != connAckType<<4 || body[1] != 0 {
+			t.Fatalf("%q connack %x %x", id, first, body)
+		}
+		return connAck5Props(t, body)
+	}
+	if _, ok := connect("dev"); ok {
+		t.Fatal("client id is echoed")
+	}
+	if id, ok := connect("dev"); !ok || id != "dev-2" {
+		t.Fatalf("suffixed id %q", id)
+	}
+	id, ok := connect("")
+	if !ok || !strings.HasPrefix(id, defaultAssignPrefix) {
+		t.Fatalf("assigned id %q", id)
+	}
+	if _, err := m.GetOnce(id); err != nil {
+		t.Fatalf("assigned client %s: %v", id, err)
+	}
+}
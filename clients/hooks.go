@@ -0,0 +1,113 @@
+package clients
+
+import (
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+)
+
+/*
+Hooks    客户端生命周期钩子,按注册顺序链式执行
+  - OnConnect      握手校验,可修改ClientId/UserName;返回非enmu.Success即拒绝链接
+  - OnSubscribe    收到SUBSCRIBE,可修改报文;返回错误则丢弃该报文,不再进入PacketCb;将过滤器的Qos置为0x80表示拒绝该过滤器
+  - OnPublish      收到PUBLISH,可修改主题或负载;返回错误则丢弃该报文
+  - OnDeliver      向客户端发送PUBLISH前,可修改报文;返回错误则不发送
+  - OnUnsubscribe  收到UNSUBSCRIBE,可修改报文;返回错误则丢弃该报文
+  - OnDisconnect   客户端断开
+*/
+type Hooks interface {
+	OnConnect(hd *clients_dto.ConnectionHandshakeDatabase) enmu.HandshakeResult
+	OnSubscribe(id string, p *packets.SubscribePacket) error
+	OnPublish(id string, p *packets.PublishPacket) error
+	OnDeliver(id string, p *packets.PublishPacket) error
+	OnUnsubscribe(id string, p *packets.UnSubscribePacket) error
+	OnDisconnect(cd *clients_dto.ConnectionDatabase)
+}
+
+// HooksBase    Hooks的空实现,嵌入后只需实现关心的方法
+type HooksBase struct{}
+
+func (HooksBase) OnConnect(*clients_dto.ConnectionHandshakeDatabase) enmu.HandshakeResult {
+	return enmu.Success
+}
+func (HooksBase) OnSubscribe(string, *packets.SubscribePacket) error     { return nil }
+func (HooksBase) OnPublish(string, *packets.PublishPacket) error         { return nil }
+func (HooksBase) OnDeliver(string, *packets.PublishPacket) error         { return nil }
+func (HooksBase) OnUnsubscribe(string, *packets.UnSubscribePacket) error { return nil }
+func (HooksBase) OnDisconnect(*clients_dto.ConnectionDatabase)           {}
+
+// hooksChain    按注册顺序执行的Hooks,遇到第一个拒绝即停止
+type hooksChain []Hooks
+
+func (hs hooksChain) OnConnect(hd *clients_dto.ConnectionHandshakeDatabase) enmu.HandshakeResult {
+	for _, h := range hs {
+		if res := h.OnConnect(hd); res != enmu.Success {
+			return res
+		}
+	}
+	return enmu.Success
+}
+
+func (hs hooksChain) OnSubscribe(id string, p *packets.SubscribePacket) error {
+	for _, h := range hs {
+		if err := h.OnSubscribe(id, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hs hooksChain) OnPublish(id string, p *packets.PublishPacket) error {
+	for _, h := range hs {
+		if err := h.OnPublish(id, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hs hooksChain) OnDeliver(id string, p *packets.PublishPacket) error {
+	for _, h := range hs {
+		if err := h.OnDeliver(id, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hs hooksChain) OnUnsubscribe(id string, p *packets.UnSubscribePacket) error {
+	for _, h := range hs {
+		if err := h.OnUnsubscribe(id, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (hs hooksChain) OnDisconnect(cd *clients_dto.ConnectionDatabase) {
+	for _, h := range hs {
+		h.OnDisconnect(cd)
+	}
+}
+
+// onPacket     按报文类型执行入站钩子
+func (hs hooksChain) onPacket(id string, p mqtt_packet.ControlPacketInterface) error {
+	switch packet := p.(type) {
+	case *packets.PublishPacket:
+		return hs.OnPublish(id, packet)
+	case *packets.SubscribePacket:
+		return hs.OnSubscribe(id, packet)
+	case *packets.UnSubscribePacket:
+		return hs.OnUnsubscribe(id, packet)
+	}
+	return nil
+}
+
+// onDeliver    出站PUBLISH执行OnDeliver钩子
+func (hs hooksChain) onDeliver(id string, p mqtt_packet.ControlPacketInterface) error {
+	if packet, ok := p.(*packets.PublishPacket); ok {
+		return hs.OnDeliver(id, packet)
+	}
+	return nil
+}
@@ -0,0 +1,206 @@
+package clients
+
+import (
+	"errors"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var vetoError = errors.New("veto")
+
+// recordHook    记录调用顺序,veto为true时拒绝,prefix不为空时给主题、ClientId等加前缀
+type recordHook struct {
+	name   string
+	log    *[]string
+	veto   bool
+	prefix string
+}
+
+func (h recordHook) call(method string) error {
+	*h.log = append(*h.log, h.name+"."+method)
+	if h.veto {
+		return vetoError
+	}
+	return nil
+}
+
+func (h recordHook) OnConnect(hd *clients_dto.ConnectionHandshakeDatabase) enmu.HandshakeResult {
+	hd.ClientId = h.prefix + hd.ClientId
+	if h.call("connect") != nil {
+		return enmu.UserNameOrPasswordError
+	}
+	return enmu.Success
+}
+
+func (h recordHook) OnSubscribe(_ string, p *packets.SubscribePacket) error {
+	p.List[0].Topic = h.prefix + p.List[0].Topic
+	return h.call("subscribe")
+}
+
+func (h recordHook) OnPublish(_ string, p *packets.PublishPacket) error {
+	p.TopicName = h.prefix + p.TopicName
+	return h.call("publish")
+}
+
+func (h recordHook) OnDeliver(_ string, p *packets.PublishPacket) error {
+	p.Payload = append([]byte(h.prefix), p.Payload...)
+	return h.call("deliver")
+}
+
+func (h recordHook) OnUnsubscribe(_ string, p *packets.UnSubscribePacket) error {
+	p.Topics[0] = h.prefix + p.Topics[0]
+	return h.call("unsubscribe")
+}
+
+func (h recordHook) OnDisconnect(*clients_dto.ConnectionDatabase) {
+	_ = h.call("disconnect")
+}
+
+// TestHooksChain    按注册顺序执行,前一个钩子的修改对后一个可见,第一个拒绝后不再执行后续钩子;OnDisconnect不能拒绝
+func TestHooksChain(t *testing.T) {
+	var log []string
+	chain := hooksChain{
+		recordHook{name: "a", log: &log, prefix: "a/"},
+		recordHook{name: "b", log: &log, prefix: "b/", veto: true},
+		recordHook{name: "c", log: &log, prefix: "c/"},
+	}
+	pass := chain[:1]
+	// 修改后的值应为b/a/x,c没有执行
+	check := func(method, got string, err error) {
+		t.Helper()
+		if !errors.Is(err, vetoError) || strings.Join(log, ",") != "a."+method+",b."+method || got != "b/a/x" {
+			t.Fatalf("%s: %v %v %q", method, err, log, got)
+		}
+		log = nil
+	}
+
+	hd := &clients_dto.ConnectionHandshakeDatabase{ClientId: "x"}
+	if res := chain.OnConnect(hd); res != enmu.UserNameOrPasswordError {
+		t.Fatalf("connect result %d", res)
+	}
+	check("connect", hd.ClientId, vetoError)
+	sub := packets.NewSubscribe(nil)
+	sub.List = []*packets.TopicFilter{{Topic: "x"}}
+	check("subscribe", sub.List[0].Topic, chain.onPacket("id", sub))
+	pub := publishPacket("x", "", 0, 0)
+	check("publish", pub.TopicName, chain.onPacket("id", pub))
+	deliver := publishPacket("t", "x", 0, 0)
+	err := chain.onDeliver("id", deliver)
+	check("deliver", string(deliver.Payload), err)
+	unsub := packets.NewUnSubscribe(nil)
+	unsub.Topics = []string{"x"}
+	check("unsubscribe", unsub.Topics[0], chain.onPacket("id", unsub))
+
+	chain.OnDisconnect(&clients_dto.ConnectionDatabase{})
+	if strings.Join(log, ",") != "a.disconnect,b.disconnect,c.disconnect" {
+		t.Fatalf("disconnect %v", log)
+	}
+	log = nil
+
+	// 没有拒绝时全部通过;其他报文不执行钩子
+	if err = pass.onPacket("id", publishPacket("x", "", 0, 0)); err != nil || len(log) != 1 {
+		t.Fatalf("pass %v %v", err, log)
+	}
+	log = nil
+	if err = chain.onPacket("id", packets.NewPingReq(nil)); err != nil || len(log) != 0 {
+		t.Fatalf("pingreq %v %v", err, log)
+	}
+	if err = chain.onDeliver("id", packets.NewPingReq(nil)); err != nil || len(log) != 0 {
+		t.Fatalf("deliver pingreq %v %v", err, log)
+	}
+	if res := (hooksChain)(nil).OnConnect(hd); res != enmu.Success {
+		t.Fatalf("empty chain %d", res)
+	}
+}
+
+// topicHook    OnConnect修改ClientId与用户名,OnPublish改写主题并拒绝指定主题,OnDeliver修改负载
+type topicHook struct {
+	HooksBase
+	mu           sync.Mutex
+	disconnected []string
+}
+
+func (h *topicHook) OnConnect(hd *clients_dto.ConnectionHandshakeDatabase) enmu.HandshakeResult {
+	if hd.ClientId == "banned" {
+		return enmu.UserNameOrPasswordError
+	}
+	hd.ClientId = "tenant-" + hd.ClientId
+	hd.UserName = "hooked"
+	return enmu.Success
+}
+
+func (h *topicHook) OnPublish(_ string, p *packets.PublishPacket) error {
+	if p.TopicName == "deny" {
+		return vetoError
+	}
+	p.TopicName = "tenant/" + p.TopicName
+	return nil
+}
+
+func (h *topicHook) OnDeliver(_ string, p *packets.PublishPacket) error {
+	p.Payload = append([]byte("hooked:"), p.Payload...)
+	return nil
+}
+
+func (h *topicHook) OnDisconnect(cd *clients_dto.ConnectionDatabase) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.disconnected = append(h.disconnected, cd.Id)
+}
+
+// TestHooksThroughManager    钩子的修改与拒绝在管理器中生效
+func TestHooksThroughManager(t *testing.T) {
+	port := freePort(t)
+	hook := &topicHook{}
+	received := make(chan string, 4)
+	m := NewClientManagerInstance(&ClientManagerOptions{
+		TcpPort: port,
+		Hooks:   []Hooks{hook},
+		PacketCb: func(id string, p mqtt_packet.ControlPacketInterface) {
+			if pp, ok := p.(*packets.PublishPacket); ok {
+				received <- id + " " + pp.TopicName
+			}
+		},
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if _, code := dialMqtt(t, port, "banned", ""); code != byte(enmu.UserNameOrPasswordError) {
+		t.Fatalf("banned code %d", code)
+	}
+	c, _ := dialMqtt(t, port, "dev", "")
+	db, err := m.GetOnce("tenant-dev")
+	if err != nil || db.UserName != "hooked" {
+		t.Fatalf("renamed client %+v %v", db, err)
+	}
+	writePacket(t, c, publishPacket("deny", "x", 0, 0))
+	writePacket(t, c, publishPacket("a", "x", 0, 0))
+	select {
+	case got := <-received:
+		if got != "tenant-dev tenant/a" {
+			t.Fatalf("packet %s", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("publish is not received")
+	}
+	if _, err = m.SendPacketOnce("tenant-dev", publishPacket("b", "y", 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	p, err := readPacket(c, 5*time.Second)
+	if pp, ok := p.(*packets.PublishPacket); err != nil || !ok || string(pp.Payload) != "hooked:y" {
+		t.Fatalf("delivered %v %v", p, err)
+	}
+	_ = c.Close()
+	waitFor(t, "OnDisconnect", func() bool {
+		hook.mu.Lock()
+		defer hook.mu.Unlock()
+		return len(hook.disconnected) == 1 && hook.disconnected[0] == "tenant-dev"
+	})
+}
@@ -2,9 +2,14 @@
 package clients
 
 import (
+	"context"
 	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
 	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
 	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"github.com/qdmc/mqtt_single_proxy/rules"
+	"github.com/qdmc/mqtt_single_proxy/schema"
+	"log/slog"
 	"net/http"
 )
 
@@ -17,6 +22,9 @@ type ConnectedCallback func(string)
 // PacketCallbackHandle   报文回调Handle
 type PacketCallbackHandle func(string, mqtt_packet.ControlPacketInterface)
 
+// PacketContextCallback   带追踪上下文的报文回调,ctx中为该报文的span(开启追踪时)
+type PacketContextCallback func(ctx context.Context, id string, p mqtt_packet.ControlPacketInterface)
+
 // DisConnectCallbackHandle  客户端断开回调Handle
 type DisConnectCallbackHandle func(*clients_dto.ConnectionDatabase)
 
@@ -30,21 +38,64 @@ type clientInterface interface {
 	AsyncDoConnection()                             // 异步处理Tcp长链接
 	SetTimeOut(t int64)                             // 设置客户超时
 	SetStatistics(bool)                             // 设置是否开启数据统计
+	SetMaxPacketSize(packetSize, messageSize int)   // 设置报文与websocket消息的最大长度
 	SetPacketHandle(PacketCallbackHandle)           // 配置报文回调
 	SetDisConnectCallback(DisConnectCallbackHandle) // 配置断开回调
 	DisConnect(isNoCb ...bool)                      // 断开链接
+	Shutdown()                                      // 发送DISCONNECT,写完发送队列后断开链接
+	ForceClose()                                    // 立即关闭底层链接
+	Done() <-chan struct{}                          // 读协程退出(含断开回调执行)后关闭
 	GetProtocol() enmu.ClientProtocol
+	SetWriteQueue(size int, policy enmu.QueueFullPolicy, timeout int64) // 设置发送队列长度,队列满策略及写超时(秒)
 	WritePacketOnce(p mqtt_packet.ControlPacketInterface) (int64, error)
+	AsyncWritePacket(p mqtt_packet.ControlPacketInterface) <-chan clients_dto.SendResult
+	GetTags() map[string]string     // 返回标签副本
+	SetTags(tags map[string]string) // 设置标签
+	asyncWriteEncoded(e *encodedPacket) <-chan clients_dto.SendResult
+	enqueueEncoded(e *encodedPacket) <-chan clients_dto.SendResult
+	disConnectWithError(err error)
+	writeConnAck(code enmu.HandshakeResult, sessionPresent bool) error
+	setId(id string)
+	setCapture(cp *capture)                // 开始或停止(nil)抓包
+	connectPacket() *packets.ConnectPacket // 握手时的CONNECT报文(已清除密码)
+	arrivalNano() int64                    // 当前报文首字节到达的时间,只在报文回调中调用
+	userProperties() userProperties        // 当前PUBLISH的MQTT 5用户属性,只在报文回调中调用
+	setWillTopic(topic string)             // 替换遗嘱主题,在加入管理器之前调用
 }
 
 type ClientManagerInterface interface {
-	Len() int                                                    // 返回客户端总数
-	List(start, end int) (int, []clients_dto.ConnectionDatabase) // 返回客户端列表
+	Len() int                                                               // 返回客户端总数
+	List(start, end int) (int, []clients_dto.ConnectionDatabase)            // 返回客户端列表
+	Query(q clients_dto.ClientQuery) (clients_dto.ClientQueryResult, error) // 按条件筛选、排序并游标分页
 	Start() error
 	Stop() error
+	Shutdown(ctx context.Context) error // 优雅关闭,ctx到期后强制关闭剩余链接
 	SetOptions(*ClientManagerOptions)
+	ReloadOptions(*ClientManagerOptions) (clients_dto.ReloadReport, error) // 运行中重新加载配置,不断开已有链接;返回已生效与需要重启的配置项
+	AddHooks(hs ...Hooks)                                                  // 追加生命周期钩子,启动后调用无效
 	CloseOnce(id string) error
 	GetOnce(id string) (*clients_dto.ConnectionDatabase, error)
+	Journal(q clients_dto.JournalQuery) []clients_dto.JournalEvent // 查询链接日志,可按ClientId及时间范围筛选
 	SendPacketOnce(id string, p mqtt_packet.ControlPacketInterface) (int64, error)
+	AsyncSendPacketOnce(id string, p mqtt_packet.ControlPacketInterface) <-chan clients_dto.SendResult
+	AsyncSendPacketContext(ctx context.Context, id string, p mqtt_packet.ControlPacketInterface) <-chan clients_dto.SendResult // 同AsyncSendPacketOnce,ctx中有span时为写入创建子span
+	SendPacketMany(filter ClientFilter, p mqtt_packet.ControlPacketInterface) clients_dto.BroadcastResult                      // 向选中的客户端并发发送,报文只编码一次
+	Broadcast(p mqtt_packet.ControlPacketInterface) clients_dto.BroadcastResult                                                // 向所有客户端发送
+	SetTags(id string, tags map[string]string) error                                                                           // 设置客户端标签
 	ServeHTTP(w http.ResponseWriter, req *http.Request)
+	DispatchStatistics() clients_dto.DispatchStatistics // 返回回调分发统计(队列积压与排队时长)
+	ClusterNodes() []clients_dto.ClusterNode            // 返回集群中已连接的其他节点,未开启集群时为空
+	ReloadRules(rs []rules.Rule) error                  // 热加载规则,任一规则无效时返回错误且保留原规则
+	RuleStatistics() []rules.Statistics                 // 返回各规则的命中计数
+	RegisterSchema(s schema.Schema) error               // 注册负载校验器,同名的校验器被替换
+	UnregisterSchema(name string) error                 // 注销负载校验器
+	SchemaStatistics() []schema.Statistics              // 返回各校验器的校验计数
+	StartCapture(opt CaptureOptions) error              // 开始抓包,记录选中客户端收发的报文
+	StopCapture() (clients_dto.CaptureStatistics, error)
+	CaptureStatistics() (clients_dto.CaptureStatistics, error)
+	SetLogLevel(id string, level slog.Level)                                 // 设置ClientId的日志级别,不受Logger本身级别的限制
+	ResetLogLevel(id string)                                                 // 清除ClientId的日志级别
+	LogLevels() map[string]slog.Level                                        // 返回已设置日志级别的ClientId
+	DelayedMessages(q clients_dto.DelayedQuery) []clients_dto.DelayedMessage // 查询等待中的延迟消息($delayed/<秒>/<主题>)
+	CancelDelayed(id string) error                                           // 取消等待中的延迟消息
 }
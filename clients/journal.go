@@ -0,0 +1,253 @@
+package clients
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"os"
+	"sync"
+	"time"
+)
+
+const defaultJournalSize = 10000
+
+/*
+journal   有界的链接日志,内存中为环形缓冲
+  - 配置文件后以JSON行追加写入,超过两倍容量时压缩
+  - record只在内存中排队,由写协程在锁外写文件;排队超过容量时丢弃并在下次写入时用内存中的事件重写文件
+*/
+type journal struct {
+	mu       sync.Mutex
+	events   []clients_dto.JournalEvent
+	next     int // 下一个写入位置
+	full     bool
+	pending  [][]byte // 等待写入文件的行
+	overflow bool
+	wake     chan struct{}
+	stopChan chan struct{}
+	done     chan struct{}
+	path     string
+	file     *os.File // 只在写协程与open/close中使用
+	written  int      // 文件中的行数
+}
+
+func newJournal(size int) *journal {
+	if size <= 0 {
+		size = defaultJournalSize
+	}
+	return &journal{events: make([]clients_dto.JournalEvent, size), wake: make(chan struct{}, 1)}
+}
+
+// open   以追加方式打开文件并启动写协程;内存中没有事件时加载文件中最近的事件,重复Start不会重复加载
+func (j *journal) open(path string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.stopChan != nil || path == "" {
+		return nil
+	}
+	load := j.next == 0 && !j.full
+	j.written = 0
+	if f, err := os.Open(path); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var e clients_dto.JournalEvent
+			if json.Unmarshal(scanner.Bytes(), &e) == nil {
+				if load {
+					j.append(e)
+				}
+				j.written++
+			}
+		}
+		_ = f.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.path = path
+	j.file = f
+	j.pending, j.overflow = nil, false
+	j.stopChan, j.done = make(chan struct{}), make(chan struct{})
+	go j.run(j.stopChan, j.done)
+	return nil
+}
+
+// close   写完排队的事件后关闭文件
+func (j *journal) close() error {
+	j.mu.Lock()
+	stopChan, done := j.stopChan, j.done
+	j.stopChan, j.done = nil, nil
+	j.mu.Unlock()
+	if stopChan == nil {
+		return nil
+	}
+	close(stopChan)
+	<-done
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+func (j *journal) append(e clients_dto.JournalEvent) {
+	j.events[j.next] = e
+	j.next = (j.next + 1) % len(j.events)
+	if j.next == 0 {
+		j.full = true
+	}
+}
+
+// record    写入内存并为写协程排队,不做文件IO,可在管理器的锁内调用
+func (j *journal) record(e clients_dto.JournalEvent) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.append(e)
+	if j.stopChan == nil {
+		return
+	}
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	if len(j.pending) >= len(j.events) {
+		j.pending, j.overflow = nil, true
+	} else {
+		j.pending = append(j.pending, append(bs, '\n'))
+	}
+	select {
+	case j.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (j *journal) run(stopChan, done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case <-j.wake:
+			j.flush()
+		case <-stopChan:
+			j.flush()
+			return
+		}
+	}
+}
+
+// flush    在锁外写入排队的行;需要压缩时用同一时刻内存中的事件重写文件
+func (j *journal) flush() {
+	j.mu.Lock()
+	lines, overflow := j.pending, j.overflow
+	j.pending, j.overflow = nil, false
+	var list []clients_dto.JournalEvent
+	if overflow || j.written+len(lines) > 2*len(j.events) {
+		list = j.ordered()
+	}
+	j.mu.Unlock()
+	if j.file == nil {
+		return
+	}
+	if list != nil {
+		j.compact(list)
+		return
+	}
+	for _, line := range lines {
+		_, _ = j.file.Write(line)
+	}
+	j.written += len(lines)
+}
+
+// compact    用list重写文件,在写协程中执行
+func (j *journal) compact(list []clients_dto.JournalEvent) {
+	tmp := j.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(f)
+	for _, e := range list {
+		bs, _ := json.Marshal(e)
+		_, _ = w.Write(append(bs, '\n'))
+	}
+	if w.Flush() != nil || f.Close() != nil {
+		_ = os.Remove(tmp)
+		return
+	}
+	if os.Rename(tmp, j.path) != nil {
+		return
+	}
+	_ = j.file.Close()
+	j.file, err = os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		j.file = nil
+	}
+	j.written = len(list)
+}
+
+// ordered   按时间先后返回所有事件,调用方需持有锁
+func (j *journal) ordered() []clients_dto.JournalEvent {
+	if !j.full {
+		return append([]clients_dto.JournalEvent{}, j.events[:j.next]...)
+	}
+	return append(append([]clients_dto.JournalEvent{}, j.events[j.next:]...), j.events[:j.next]...)
+}
+
+// query   按条件查询,结果按时间先后排列
+func (j *journal) query(q clients_dto.JournalQuery) []clients_dto.JournalEvent {
+	j.mu.Lock()
+	list := j.ordered()
+	j.mu.Unlock()
+	var res []clients_dto.JournalEvent
+	for i := len(list) - 1; i >= 0; i-- {
+		e := list[i]
+		if q.Id != "" && e.Id != q.Id {
+			continue
+		}
+		if q.StartNano > 0 && e.Nano < q.StartNano {
+			continue
+		}
+		if q.EndNano > 0 && e.Nano > q.EndNano {
+			continue
+		}
+		res = append(res, e)
+		if q.Limit > 0 && len(res) >= q.Limit {
+			break
+		}
+	}
+	for i, k := 0, len(res)-1; i < k; i, k = i+1, k-1 {
+		res[i], res[k] = res[k], res[i]
+	}
+	return res
+}
+
+// newJournalEvent    根据链接数据生成日志事件
+func newJournalEvent(t enmu.JournalEventType, db clients_dto.ConnectionDatabase) clients_dto.JournalEvent {
+	e := clients_dto.JournalEvent{
+		Type:          t,
+		Id:            db.Id,
+		UserName:      db.UserName,
+		Protocol:      db.Protocol,
+		Nano:          time.Now().UnixNano(),
+		ConnectedNano: db.ConnectedNano,
+	}
+	if db.Addr != nil {
+		e.Addr = db.Addr.String()
+	}
+	if t == enmu.DisconnectEvent {
+		e.CloseNano = db.CloseNano
+		if e.CloseNano == 0 {
+			e.CloseNano = e.Nano
+		}
+		e.DurationNano = e.CloseNano - db.ConnectedNano
+		e.ReadLength = db.ReadLength
+		e.WriteLength = db.WriteLength
+		if db.Err != nil {
+			e.Reason = db.Err.Error()
+		}
+	}
+	return e
+}
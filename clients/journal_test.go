@@ -0,0 +1,87 @@
+package clients
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func journalLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	for scanner := bufio.NewScanner(f); scanner.Scan(); {
+		n++
+	}
+	return n
+}
+
+func journalEvent(i int) clients_dto.JournalEvent {
+	return newJournalEvent(enmu.ConnectEvent, clients_dto.ConnectionDatabase{Id: fmt.Sprintf("c%d", i)})
+}
+
+// TestJournalReopenNoDuplicates    Stop后再次Start不会重复加载文件中的事件
+func TestJournalReopenNoDuplicates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.log")
+	j := newJournal(100)
+	for round := 0; round < 3; round++ {
+		if err := j.open(path); err != nil {
+			t.Fatal(err)
+		}
+		j.record(journalEvent(round))
+		if err := j.close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(j.query(clients_dto.JournalQuery{})); n != 3 {
+		t.Fatalf("journal has %d events after restarts, want 3", n)
+	}
+	if n := journalLines(t, path); n != 3 {
+		t.Fatalf("file has %d lines, want 3", n)
+	}
+	// 新的管理器从文件加载
+	loaded := newJournal(100)
+	if err := loaded.open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.close()
+	if n := len(loaded.query(clients_dto.JournalQuery{})); n != 3 {
+		t.Fatalf("loaded %d events, want 3", n)
+	}
+}
+
+// TestJournalCompacts    文件超过两倍容量时用内存中的事件重写,重新加载后得到最近的事件
+func TestJournalCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.log")
+	const size = 10
+	j := newJournal(size)
+	if err := j.open(path); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50*size; i++ {
+		j.record(journalEvent(i))
+	}
+	if err := j.close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := journalLines(t, path); n > 2*size {
+		t.Fatalf("file has %d lines, want at most %d", n, 2*size)
+	}
+	loaded := newJournal(size)
+	if err := loaded.open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer loaded.close()
+	list := loaded.query(clients_dto.JournalQuery{})
+	if len(list) != size || list[size-1].Id != fmt.Sprintf("c%d", 50*size-1) {
+		t.Fatalf("loaded %+v", list)
+	}
+}
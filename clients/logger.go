@@ -0,0 +1,112 @@
+package clients
+
+import (
+	"context"
+	"errors"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"log/slog"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// logLevels    按ClientId覆盖的日志级别,运行中可修改
+type logLevels struct {
+	mu     sync.RWMutex
+	levels map[string]slog.Level
+}
+
+func newLogLevels() *logLevels {
+	return &logLevels{levels: map[string]slog.Level{}}
+}
+
+func (l *logLevels) level(id string) (slog.Level, bool) {
+	if id == "" {
+		return 0, false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	level, ok := l.levels[id]
+	return level, ok
+}
+
+// SetLogLevel    设置ClientId的日志级别,该客户端的日志按此级别过滤,不受Logger本身级别的限制
+func (m *defaultClientManager) SetLogLevel(id string, level slog.Level) {
+	m.logLevels.mu.Lock()
+	m.logLevels.levels[id] = level
+	m.logLevels.mu.Unlock()
+}
+
+// ResetLogLevel    清除ClientId的日志级别,恢复使用Logger的级别
+func (m *defaultClientManager) ResetLogLevel(id string) {
+	m.logLevels.mu.Lock()
+	delete(m.logLevels.levels, id)
+	m.logLevels.mu.Unlock()
+}
+
+func (m *defaultClientManager) LogLevels() map[string]slog.Level {
+	m.logLevels.mu.RLock()
+	defer m.logLevels.mu.RUnlock()
+	levels := make(map[string]slog.Level, len(m.logLevels.levels))
+	for id, level := range m.logLevels.levels {
+		levels[id] = level
+	}
+	return levels
+}
+
+// log    写入一条日志,id不为空时附带client_id;未设置Logger时不输出
+func (m *defaultClientManager) log(level slog.Level, msg string, id string, attrs ...slog.Attr) {
+	logger := m.options().Logger
+	if logger == nil {
+		return
+	}
+	ctx := context.Background()
+	if min, ok := m.logLevels.level(id); ok {
+		if level < min {
+			return
+		}
+	} else if !logger.Enabled(ctx, level) {
+		return
+	}
+	r := slog.NewRecord(time.Now(), level, msg, 0)
+	if id != "" {
+		r.AddAttrs(slog.String("client_id", id))
+	}
+	r.AddAttrs(attrs...)
+	_ = logger.Handler().Handle(ctx, r)
+}
+
+// logPanic    回调panic,由分发器调用
+func (m *defaultClientManager) logPanic(id string, r any) {
+	m.log(slog.LevelError, "callback panic", id, slog.Any("panic", r), slog.String("stack", string(debug.Stack())))
+}
+
+// logDisconnect    按断开原因选择级别:正常断开与被接管为Info,超时与读写错误为Warn
+func (m *defaultClientManager) logDisconnect(cd *clients_dto.ConnectionDatabase) {
+	attrs := append(connAttrs(cd.Addr, cd.Protocol), slog.Any("err", cd.Err))
+	switch {
+	case cd.Err == nil || errors.Is(cd.Err, enmu.ClientTakeoverError):
+		m.log(slog.LevelInfo, "disconnected", cd.Id, attrs...)
+	case errors.Is(cd.Err, enmu.ClientHeartTimeoutError):
+		m.log(slog.LevelWarn, "client timeout", cd.Id, attrs...)
+	default:
+		m.log(slog.LevelWarn, "connection error", cd.Id, attrs...)
+	}
+}
+
+func connAttrs(addr net.Addr, protocol enmu.ClientProtocol) []slog.Attr {
+	return []slog.Attr{slog.String("remote_addr", addrString(addr)), slog.String("protocol", string(protocol))}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func clientAttrs(db clients_dto.ConnectionDatabase) []slog.Attr {
+	return append(connAttrs(db.Addr, db.Protocol), slog.String("username", db.UserName))
+}
@@ -0,0 +1,170 @@
+package clients
+
+import (
+	"context"
+	"fmt"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// logRecord    记录的日志,属性值统一转为字符串
+type logRecord struct {
+	level slog.Level
+	msg   string
+	attrs map[string]string
+}
+
+// recordHandler    保存级别不低于level的日志
+type recordHandler struct {
+	level   slog.Level
+	mu      sync.Mutex
+	records []logRecord
+}
+
+func (h *recordHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *recordHandler) Handle(_ context.Context, r slog.Record) error {
+	lr := logRecord{level: r.Level, msg: r.Message, attrs: map[string]string{}}
+	r.Attrs(func(a slog.Attr) bool {
+		lr.attrs[a.Key] = a.Value.String()
+		return true
+	})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, lr)
+	return nil
+}
+
+func (h *recordHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+
+func (h *recordHandler) WithGroup(string) slog.Handler { return h }
+
+// find    返回消息为msg且client_id为id的日志
+func (h *recordHandler) find(msg, id string) []logRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var list []logRecord
+	for _, r := range h.records {
+		if r.msg == msg && r.attrs["client_id"] == id {
+			list = append(list, r)
+		}
+	}
+	return list
+}
+
+func (h *recordHandler) waitOne(t *testing.T, msg, id string) logRecord {
+	t.Helper()
+	waitFor(t, msg+" "+id, func() bool { return len(h.find(msg, id)) > 0 })
+	return h.find(msg, id)[0]
+}
+
+// TestLogAttributes    各事件的级别与client_id、remote_addr、protocol等属性
+func TestLogAttributes(t *testing.T) {
+	port := freePort(t)
+	h := &recordHandler{level: slog.LevelInfo}
+	m := NewClientManagerInstance(&ClientManagerOptions{
+		TcpPort: port,
+		Logger:  slog.New(h),
+		Handshake: func(hd clients_dto.ConnectionHandshakeDatabase) enmu.HandshakeResult {
+			if hd.UserName == "bad" {
+				return enmu.UserNameOrPasswordError
+			}
+			return enmu.Success
+		},
+		PacketCb: func(string, mqtt_packet.ControlPacketInterface) { panic("boom") },
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	c, _ := dialMqtt(t, port, "dev", "u")
+	r := h.waitOne(t, "connected", "dev")
+	if r.level != slog.LevelInfo || !strings.HasPrefix(r.attrs["remote_addr"], "127.0.0.1:") || r.attrs["protocol"] != "tcp" ||
+		r.attrs["username"] != "u" || r.attrs["session_present"] != "false" {
+		t.Fatalf("connected %+v", r)
+	}
+	// accept为Debug,低于Logger的级别
+	if len(h.find("accept", "")) != 0 {
+		t.Fatal("debug record is written")
+	}
+
+	writePacket(t, c, publishPacket("a", "x", 0, 0))
+	r = h.waitOne(t, "callback panic", "dev")
+	if r.level != slog.LevelError || r.attrs["panic"] != "boom" || r.attrs["stack"] == "" {
+		t.Fatalf("callback panic %+v", r)
+	}
+
+	dialMqtt(t, port, "dev", "u")
+	r = h.waitOne(t, "takeover", "dev")
+	if r.level != slog.LevelInfo || r.attrs["old_addr"] != c.LocalAddr().String() {
+		t.Fatalf("takeover %+v", r)
+	}
+	r = h.waitOne(t, "disconnected", "dev")
+	if r.level != slog.LevelInfo || r.attrs["err"] != enmu.ClientTakeoverError.Error() {
+		t.Fatalf("disconnected %+v", r)
+	}
+
+	if _, code := dialMqtt(t, port, "other", "bad"); code != byte(enmu.UserNameOrPasswordError) {
+		t.Fatalf("bad code %d", code)
+	}
+	r = h.waitOne(t, "handshake failed", "")
+	if r.level != slog.LevelWarn || r.attrs["protocol"] != "tcp" || r.attrs["remote_addr"] == "" || r.attrs["err"] == "" {
+		t.Fatalf("handshake failed %+v", r)
+	}
+}
+
+// TestSetLogLevel    按ClientId设置的级别优先于Logger的级别,清除后恢复;没有client_id的日志按Logger的级别
+func TestSetLogLevel(t *testing.T) {
+	port := freePort(t)
+	h := &recordHandler{level: slog.LevelWarn}
+	m := NewClientManagerInstance(&ClientManagerOptions{TcpPort: port, Logger: slog.New(h)})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	m.SetLogLevel("loud", slog.LevelDebug)
+	m.SetLogLevel("muted", slog.LevelError)
+	if levels := m.LogLevels(); len(levels) != 2 || levels["loud"] != slog.LevelDebug || levels["muted"] != slog.LevelError {
+		t.Fatalf("levels %v", levels)
+	}
+	dialMqtt(t, port, "loud", "")
+	h.waitOne(t, "connected", "loud")
+
+	dm := m.(*defaultClientManager)
+	cases := []struct {
+		id      string
+		level   slog.Level
+		written bool
+	}{
+		{"quiet", slog.LevelInfo, false},
+		{"quiet", slog.LevelWarn, true},
+		{"loud", slog.LevelDebug, true},
+		{"muted", slog.LevelWarn, false},
+		{"muted", slog.LevelError, true},
+		{"", slog.LevelInfo, false},
+		{"", slog.LevelWarn, true},
+	}
+	for i, c := range cases {
+		msg := fmt.Sprintf("case %d", i)
+		dm.log(c.level, msg, c.id)
+		if got := len(h.find(msg, c.id)) == 1; got != c.written {
+			t.Errorf("%s level %s: written %v", c.id, c.level, got)
+		}
+	}
+	m.ResetLogLevel("loud")
+	dm.log(slog.LevelDebug, "reset", "loud")
+	if len(h.find("reset", "loud")) != 0 {
+		t.Fatal("level is not reset")
+	}
+	if levels := m.LogLevels(); len(levels) != 1 {
+		t.Fatalf("levels after reset %v", levels)
+	}
+}
@@ -1,28 +1,79 @@
 package clients
 
 import (
+	"crypto/tls"
 	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
 	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"github.com/qdmc/mqtt_single_proxy/rules"
+	"github.com/qdmc/mqtt_single_proxy/webhook"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"runtime"
 )
 
 // ClientManagerOptions   client管理器配置项
 type ClientManagerOptions struct {
-	TcpPort          uint16                   // tcp监听端口,默认:1883
-	IsWebsocket      bool                     // 是否开启websocket,默认:false
-	WebsocketPort    uint16                   // websocket监听端口,默认:80
-	WebsocketPath    string                   // websocketPath,默认:/websocket
-	IsUdp            bool                     // 是否开启udp,默认:false
-	UdpPort          uint16                   // udp监听端口,默认:1884
-	IsStatistics     bool                     // 是否开启链接数据统计,默认:false
-	Handshake        HandshakeHandle          // 握手校验
-	ConnectedCb      ConnectedCallback        // 链接回调
-	DisConnectCb     DisConnectCallbackHandle // 断开回调
-	PacketCb         PacketCallbackHandle     // 报文回调
-	WebsocketHandle  WebsocketHandshakeHandle // websocket请求检验
-	MaxHandshakeTime int64                    // 握手最大时长(秒),默认:10
-	ClientTimeOut    int64                    // 客户端超时(秒),默认:60;客户端在时间内没有报文会断开
+	TcpPort           uint16                   // tcp监听端口,默认:1883
+	IsWebsocket       bool                     // 是否开启websocket,默认:false
+	WebsocketPort     uint16                   // websocket监听端口,默认:80
+	WebsocketPath     string                   // websocketPath,默认:/websocket
+	IsUdp             bool                     // 是否开启udp,默认:false
+	UdpPort           uint16                   // udp监听端口,默认:1884
+	IsStatistics      bool                     // 是否统计收发的数据长度,默认:false;按报文类型的收发数量始终统计
+	Handshake         HandshakeHandle          // 握手校验
+	ConnectedCb       ConnectedCallback        // 链接回调
+	DisConnectCb      DisConnectCallbackHandle // 断开回调
+	PacketCb          PacketCallbackHandle     // 报文回调;集群中其他节点转发的PUBLISH也会回调,id为来源节点的发布者,见ClusterOrigin
+	WebsocketHandle   WebsocketHandshakeHandle // websocket请求检验
+	MaxHandshakeTime  int64                    // 握手最大时长(秒),默认:10
+	ClientTimeOut     int64                    // 客户端超时(秒),默认:60;客户端在时间内没有报文会断开
+	MaxPacketSize     int                      // MQTT报文最大长度(字节),默认:1MB;超过的报文在分配内存前被拒绝并断开客户端
+	MaxMessageSize    int                      // websocket消息(含分片重组)最大长度(字节),默认:1MB
+	WriteQueueSize    int                      // 每个客户端发送队列长度,默认:128
+	WriteTimeOut      int64                    // 写超时(秒),默认:10;阻塞策略下也是入队的最长等待时间
+	QueueFullPolicy   enmu.QueueFullPolicy     // 发送队列满时的策略,默认:enmu.BlockPolicy
+	DispatchWorkers   int                      // 回调分发的工作协程(分片)数,默认:CPU核数;同一客户端的回调按顺序执行
+	DispatchQueue     int                      // 每个分发分片的队列长度,默认:1024;队列满时阻塞该客户端的读取
+	Hooks             []Hooks                  // 生命周期钩子,按顺序执行,先于对应的回调;可修改或拒绝报文
+	JournalSize       int                      // 链接日志保留的最大事件数,默认:10000
+	JournalFile       string                   // 链接日志文件,为空时只保存在内存中
+	TakeoverPolicy    enmu.TakeoverPolicy      // ClientId重复时的策略,默认:enmu.KickOldPolicy
+	FlapThreshold     int                      // FlapWindow内同一ClientId被接管的次数达到该值时临时封禁,默认:0,不检测
+	FlapWindow        int64                    // 接管次数统计窗口(秒),默认:60
+	FlapBanTime       int64                    // 封禁时长(秒),默认:300;封禁期间的链接回复ServeError
+	ClientIdRule      *ClientIdRule            // ClientId校验规则,默认:nil,不校验;空ClientId在清理会话时自动分配,否则回复IdError
+	ProxyProtocol     bool                     // tcp与websocket监听是否解析PROXY协议头(v1/v2),默认:false
+	ProxyTrusted      []string                 // 可信的上游网段,如:10.0.0.0/8;只解析来自这些地址的协议头,这些地址的链接没有协议头时断开
+	ForwardedTrusted  []string                 // 可信的http代理网段,只信任来自这些地址的X-Forwarded-For/Forwarded头
+	ClusterNodeId     string                   // 集群节点Id,为空时不开启集群;各节点的Id必须唯一;转发到其他节点的PUBLISH以QoS0投递
+	ClusterPort       uint16                   // 集群节点间通信的监听端口,默认:1885
+	ClusterAdvertise  string                   // 通告给其他节点的地址(host:port),默认:对端看到的IP加ClusterPort
+	ClusterSeeds      []string                 // 种子节点地址(host:port),通过种子发现其余节点并组成全连接
+	ClusterBind       string                   // 集群端口监听的地址(IP),默认:"",监听所有网卡
+	ClusterSecret     string                   // 节点间的共享密钥,握手时以HMAC挑战应答校验对端;与双向认证的ClusterTLS至少配置一个
+	ClusterTLS        *tls.Config              // 节点间链接的TLS配置,用于监听与拨号;未配置ClusterSecret时ClientAuth需为RequireAndVerifyClientCert
+	SessionStore      SessionStore             // 持久会话存储,为nil时不持久化;Start时加载
+	MaxQueuedMessages int                      // 每个离线持久会话的排队消息上限,默认:1000;超过时丢弃最早的
+	SessionExpiry     int64                    // 持久会话离线后的保留时长(秒),默认:0,不过期;过期后删除会话及其排队与飞行中的消息
+	Rules             []rules.Rule             // 规则,Start时加载;运行中通过ReloadRules热加载
+	RuleSinks         map[string]rules.Sink    // 规则SinkAction引用的sink,按名称查找
+	Webhooks          []*webhook.Emitter       // 推送链接与消息事件的webhook,由调用方创建,Stop后Close
+	MaxDelay          int64                    // 延迟发布($delayed/<秒>/<主题>)的最大延迟(秒),默认:4294967;超过时丢弃
+	MaxDelayedCount   int                      // 等待中的延迟消息上限,默认:0,不限制;达到上限时丢弃新的延迟消息
+	TopicMapping      *TopicMapping            // 主题映射与挂载点,默认:nil,不映射;客户端的挂载点在接入时确定
+	Logger            *slog.Logger             // 结构化日志,默认:nil,不输出;可通过SetLogLevel按ClientId调整级别
+	TracerProvider    trace.TracerProvider     // OpenTelemetry追踪,默认:nil,不创建span;追踪握手与PUBLISH的解码、钩子、规则、路由、回调及写入
+	PacketContextCb   PacketContextCallback    // 带追踪上下文的报文回调,在PacketCb之后执行;通过AsyncSendPacketContext发送时写入成为该报文span的子span
+
+	TracePropagator propagation.TextMapPropagator // MQTT 5客户端PUBLISH用户属性中追踪上下文的格式,默认:nil,使用W3C Trace Context(traceparent)
 }
 
+const (
+	defaultMaxPacketSize  = 1 << 20
+	defaultMaxMessageSize = 1 << 20
+)
+
 func (o *ClientManagerOptions) merge(opt *ClientManagerOptions) *ClientManagerOptions {
 	if opt == nil {
 		return o
@@ -41,12 +92,84 @@ func (o *ClientManagerOptions) merge(opt *ClientManagerOptions) *ClientManagerOp
 	if options.PacketCb == nil {
 		options.PacketCb = o.PacketCb
 	}
+	if options.SessionStore == nil {
+		options.SessionStore = o.SessionStore
+	}
+	if options.Rules == nil {
+		options.Rules = o.Rules
+	}
+	if options.RuleSinks == nil {
+		options.RuleSinks = o.RuleSinks
+	}
+	if options.Webhooks == nil {
+		options.Webhooks = o.Webhooks
+	}
+	if options.TracerProvider == nil {
+		options.TracerProvider = o.TracerProvider
+	}
+	if options.PacketContextCb == nil {
+		options.PacketContextCb = o.PacketContextCb
+	}
+	if options.TracePropagator == nil {
+		options.TracePropagator = o.TracePropagator
+	}
+	if options.ClusterTLS == nil {
+		options.ClusterTLS = o.ClusterTLS
+	}
+	if options.TopicMapping == nil {
+		options.TopicMapping = o.TopicMapping
+	}
+	if options.Logger == nil {
+		options.Logger = o.Logger
+	}
+	if options.ClientIdRule == nil {
+		options.ClientIdRule = o.ClientIdRule
+	}
+	if options.Hooks == nil {
+		options.Hooks = o.Hooks
+	}
 	if options.WebsocketHandle == nil {
 		options.WebsocketHandle = o.WebsocketHandle
 	}
 	if options.MaxHandshakeTime <= 0 {
 		options.MaxHandshakeTime = 10
 	}
+	if options.MaxPacketSize <= 0 {
+		options.MaxPacketSize = defaultMaxPacketSize
+	}
+	if options.MaxMessageSize <= 0 {
+		options.MaxMessageSize = defaultMaxMessageSize
+	}
+	if options.WriteQueueSize <= 0 {
+		options.WriteQueueSize = defaultWriteQueueSize
+	}
+	if options.WriteTimeOut <= 0 {
+		options.WriteTimeOut = defaultWriteTimeOut
+	}
+	if options.DispatchWorkers <= 0 {
+		options.DispatchWorkers = runtime.NumCPU()
+	}
+	if options.DispatchQueue <= 0 {
+		options.DispatchQueue = defaultDispatchQueueSize
+	}
+	if options.JournalSize <= 0 {
+		options.JournalSize = defaultJournalSize
+	}
+	if options.FlapWindow <= 0 {
+		options.FlapWindow = defaultFlapWindow
+	}
+	if options.FlapBanTime <= 0 {
+		options.FlapBanTime = defaultFlapBanTime
+	}
+	if options.MaxQueuedMessages <= 0 {
+		options.MaxQueuedMessages = defaultMaxQueuedMessages
+	}
+	if options.MaxDelay <= 0 {
+		options.MaxDelay = defaultMaxDelay
+	}
+	if options.ClusterPort == 0 {
+		options.ClusterPort = defaultClusterPort
+	}
 	return options
 }
 
@@ -62,10 +185,24 @@ func newOptions() *ClientManagerOptions {
 		Handshake: func(database clients_dto.ConnectionHandshakeDatabase) enmu.HandshakeResult {
 			return enmu.Success
 		},
-		ConnectedCb:      nil,
-		DisConnectCb:     nil,
-		PacketCb:         nil,
-		WebsocketHandle:  nil,
-		MaxHandshakeTime: 10,
+		ConnectedCb:       nil,
+		DisConnectCb:      nil,
+		PacketCb:          nil,
+		WebsocketHandle:   nil,
+		MaxHandshakeTime:  10,
+		MaxPacketSize:     defaultMaxPacketSize,
+		MaxMessageSize:    defaultMaxMessageSize,
+		WriteQueueSize:    defaultWriteQueueSize,
+		WriteTimeOut:      defaultWriteTimeOut,
+		QueueFullPolicy:   enmu.BlockPolicy,
+		DispatchWorkers:   runtime.NumCPU(),
+		DispatchQueue:     defaultDispatchQueueSize,
+		JournalSize:       defaultJournalSize,
+		TakeoverPolicy:    enmu.KickOldPolicy,
+		FlapWindow:        defaultFlapWindow,
+		FlapBanTime:       defaultFlapBanTime,
+		ClusterPort:       defaultClusterPort,
+		MaxQueuedMessages: defaultMaxQueuedMessages,
+		MaxDelay:          defaultMaxDelay,
 	}
 }
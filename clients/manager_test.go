@@ -0,0 +1,248 @@
+package clients
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// freePort    返回一个空闲的本地tcp端口
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+func writePacket(t *testing.T, c net.Conn, p mqtt_packet.ControlPacketInterface) {
+	t.Helper()
+	buf := bytes.NewBuffer(nil)
+	if _, err := p.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readPacket    在timeout内读取一个报文
+func readPacket(c net.Conn, timeout time.Duration) (mqtt_packet.ControlPacketInterface, error) {
+	_ = c.SetReadDeadline(time.Now().Add(timeout))
+	p, err := mqtt_packet.ReadOnce(c)
+	return p, err
+}
+
+// dialMqtt    建立链接并完成握手,返回CONNACK的返回码
+func dialMqtt(t *testing.T, port uint16, id, userName string) (net.Conn, byte) {
+	t.Helper()
+	p := connectPacket(id, true)
+	if userName != "" {
+		p.UsernameFlag = true
+		p.Username = userName
+	}
+	return dialConnect(t, port, p)
+}
+
+func connectPacket(id string, clean bool) *packets.ConnectPacket {
+	p := packets.NewConnect(nil)
+	p.ProtocolName = "MQTT"
+	p.ProtocolVersion = 4
+	p.CleanSession = clean
+	p.Keepalive = 30
+	p.ClientIdentifier = id
+	return p
+}
+
+func dialConnect(t *testing.T, port uint16, p *packets.ConnectPacket) (net.Conn, byte) {
+	t.Helper()
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	writePacket(t, c, p)
+	ack, err := readPacket(c, 5*time.Second)
+	if err != nil {
+		t.Fatalf("%s connack: %v", p.ClientIdentifier, err)
+	}
+	return c, ack.(*packets.ConnAckPacket).ReturnCode
+}
+
+func publishPacket(topic string, payload string, qos byte, mid uint16) *packets.PublishPacket {
+	p := packets.NewPublish(nil)
+	p.TopicName = topic
+	p.Payload = []byte(payload)
+	p.MessageID = mid
+	p.GetFixedHead().Qos = qos
+	return p
+}
+
+// TestDispatchFullShardNoDeadlock    分片队列满时,回调中调用需要管理器锁的方法不会与握手死锁
+func TestDispatchFullShardNoDeadlock(t *testing.T) {
+	port := freePort(t)
+	var m ClientManagerInterface
+	m = NewClientManagerInstance(&ClientManagerOptions{
+		TcpPort:         port,
+		DispatchWorkers: 1,
+		DispatchQueue:   1,
+		ConnectedCb: func(id string) {
+			time.Sleep(5 * time.Millisecond)
+			_, _ = m.GetOnce(id)
+		},
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, code := dialMqtt(t, port, fmt.Sprintf("c%d", i), "")
+			if code != 0 {
+				t.Errorf("c%d connack %d", i, code)
+			}
+			_ = c.Close()
+		}(i)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("handshakes are stuck behind a full dispatch shard")
+	}
+}
+
+// TestShutdownSlowClientsHonorsDeadline    阻塞策略下多个不读取的客户端不会使Shutdown超过ctx的期限
+func TestShutdownSlowClientsHonorsDeadline(t *testing.T) {
+	port := freePort(t)
+	m := NewClientManagerInstance(&ClientManagerOptions{
+		TcpPort:        port,
+		WriteQueueSize: 1,
+		WriteTimeOut:   30,
+		MaxPacketSize:  8 << 20,
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	const slow = 4
+	payload := string(make([]byte, 4<<20))
+	for i := 0; i < slow; i++ {
+		id := fmt.Sprintf("slow%d", i)
+		dialMqtt(t, port, id, "")
+		// 填满socket缓冲与发送队列,之后的入队会阻塞
+		for j := 0; j < 4; j++ {
+			go m.AsyncSendPacketOnce(id, publishPacket("big", payload, 0, 0))
+		}
+	}
+	time.Sleep(500 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_ = m.Shutdown(ctx)
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("shutdown took %v with a 500ms deadline", elapsed)
+	}
+}
+
+// TestStopStopsDispatcher    Stop后分发协程退出,再次Start时重新创建
+func TestStopStopsDispatcher(t *testing.T) {
+	port := freePort(t)
+	m := newClientManager(&ClientManagerOptions{TcpPort: port})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	d := m.dispatcher
+	if err := m.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if !d.stopped() {
+		t.Fatal("dispatcher is still running after Stop")
+	}
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	if m.dispatcher == d || m.dispatcher.stopped() {
+		t.Fatal("Start does not create a new dispatcher")
+	}
+}
+
+// TestConnectedCbBeforePacketCb    链接回调入队前不读取报文,报文回调总在链接回调之后
+func TestConnectedCbBeforePacketCb(t *testing.T) {
+	port := freePort(t)
+	events := make(chan string, 4)
+	m := newClientManager(&ClientManagerOptions{
+		TcpPort:         port,
+		DispatchWorkers: 1,
+		ConnectedCb:     func(string) { events <- "connected" },
+		PacketCb:        func(string, mqtt_packet.ControlPacketInterface) { events <- "packet" },
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	// 模拟前一批任务尚未投递完成,链接回调在锁外等待
+	ticket := m.sequencer.take()
+	c, _ := dialMqtt(t, port, "c1", "")
+	writePacket(t, c, publishPacket("news", "hello", 0, 0))
+	time.Sleep(100 * time.Millisecond)
+	m.sequencer.run(ticket, func() {})
+	for _, want := range []string{"connected", "packet"} {
+		select {
+		case got := <-events:
+			if got != want {
+				t.Fatalf("got %s, want %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for %s", want)
+		}
+	}
+}
+
+// TestClientStateConcurrentAccess    其他协程读取状态、发送与断开时,与读协程之间没有数据竞争(go test -race)
+func TestClientStateConcurrentAccess(t *testing.T) {
+	port := freePort(t)
+	m := NewClientManagerInstance(&ClientManagerOptions{TcpPort: port})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	for i := 0; i < 8; i++ {
+		c, _ := dialMqtt(t, port, fmt.Sprintf("c%d", i), "")
+		id := fmt.Sprintf("c%d", i)
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				_, _ = m.GetOnce(id)
+				_, _ = m.List(0, 10)
+				<-m.AsyncSendPacketOnce(id, publishPacket("a", "b", 0, 0))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if i%2 == 0 {
+				_ = c.Close()
+			} else {
+				_ = m.CloseOnce(id)
+			}
+		}()
+		wg.Wait()
+	}
+}
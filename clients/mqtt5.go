@@ -0,0 +1,377 @@
+package clients
+
+import (
+	"encoding/binary"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"sync"
+)
+
+// 报文类型
+const (
+	connectType     = 1
+	connAckType     = 2
+	publishType     = 3
+	pubAckType      = 4
+	pubRecType      = 5
+	pubRelType      = 6
+	pubCompType     = 7
+	subscribeType   = 8
+	subAckType      = 9
+	unsubscribeType = 10
+	unsubAckType    = 11
+	disconnectType  = 14
+	authType        = 15
+)
+
+const (
+	mqtt311Version       = 4
+	mqtt5Version         = 5
+	userPropertyId       = 0x26
+	assignedClientIdProp = 0x12 // CONNACK中的Assigned Client Identifier
+	unsubscribeSuccess5  = 0x00
+	subscribeOptionsMask = 0x03 // 订阅选项中的QoS,其余位(No Local等)在3.1.1中没有对应
+)
+
+// mqtt5PropertySize    属性值的长度类型:1、2、4字节整数,-1变长整数,-2字符串或二进制,-3字符串对
+var mqtt5PropertySize = map[byte]int{
+	0x01: 1, 0x17: 1, 0x19: 1, 0x24: 1, 0x25: 1, 0x28: 1, 0x29: 1, 0x2A: 1,
+	0x13: 2, 0x21: 2, 0x22: 2, 0x23: 2,
+	0x02: 4, 0x11: 4, 0x18: 4, 0x27: 4,
+	0x0B: -1,
+	0x03: -2, 0x08: -2, 0x09: -2, 0x12: -2, 0x15: -2, 0x16: -2, 0x1A: -2, 0x1C: -2, 0x1F: -2,
+	userPropertyId: -3,
+}
+
+// userProperty    MQTT 5用户属性
+type userProperty struct {
+	key   string
+	value string
+}
+
+// userProperties    用户属性,实现propagation.TextMapCarrier
+type userProperties []userProperty
+
+func (u *userProperties) Get(key string) string {
+	for _, p := range *u {
+		if p.key == key {
+			return p.value
+		}
+	}
+	return ""
+}
+
+func (u *userProperties) Set(key, value string) {
+	*u = append(*u, userProperty{key: key, value: value})
+}
+
+func (u *userProperties) Keys() []string {
+	keys := make([]string, 0, len(*u))
+	for _, p := range *u {
+		keys = append(keys, p.key)
+	}
+	return keys
+}
+
+/*
+mqtt5Conn    MQTT 5客户端的报文转换,管理器内部只处理3.1.1报文
+  - 读取时去掉属性,订阅选项只保留QoS,确认报文只保留MessageID;PUBLISH的用户属性保留到报文回调,用于提取追踪上下文
+  - 写入时补充空属性与UNSUBACK的原因码,PUBLISH带上写入时注入的用户属性
+  - CONNACK中没有属性,即主题别名最大值为0,客户端不能使用主题别名;不支持AUTH报文
+*/
+type mqtt5Conn struct {
+	pending []userProperties // 已读取、未回调的PUBLISH的用户属性,只在读协程中使用
+	current userProperties   // 当前回调的PUBLISH的用户属性
+	mu      sync.Mutex
+	unsubs  map[uint16]int // UNSUBSCRIBE的MessageID -> 过滤器数量
+}
+
+func newMqtt5Conn(version byte) *mqtt5Conn {
+	if version != mqtt5Version {
+		return nil
+	}
+	return &mqtt5Conn{unsubs: map[uint16]int{}}
+}
+
+// next    开始回调一个报文,只在读协程中调用
+func (c *mqtt5Conn) next(isPublish bool) {
+	if c == nil {
+		return
+	}
+	c.current = nil
+	if isPublish && len(c.pending) > 0 {
+		c.current, c.pending = c.pending[0], c.pending[1:]
+	}
+}
+
+// userProperties    当前回调的PUBLISH的用户属性
+func (c *mqtt5Conn) userProperties() userProperties {
+	if c == nil {
+		return nil
+	}
+	return c.current
+}
+
+// inbound    把MQTT 5报文的剩余部分转换为3.1.1格式
+func (c *mqtt5Conn) inbound(first byte, body []byte) ([]byte, error) {
+	switch first >> 4 {
+	case publishType:
+		n, err := publishHeaderLength(first, body)
+		if err != nil {
+			return nil, err
+		}
+		props, rest, err := readProperties(body[n:])
+		if err != nil {
+			return nil, err
+		}
+		c.pending = append(c.pending, props)
+		return append(body[:n:n], rest...), nil
+	case subscribeType, unsubscribeType:
+		if len(body) < 2 {
+			return nil, enmu.Mqtt5PacketError
+		}
+		_, rest, err := readProperties(body[2:])
+		if err != nil {
+			return nil, err
+		}
+		out := append(body[:2:2], rest...)
+		if first>>4 == subscribeType {
+			return maskSubscribeOptions(out)
+		}
+		c.mu.Lock()
+		c.unsubs[binary.BigEndian.Uint16(body)] = countStrings(rest)
+		c.mu.Unlock()
+		return out, nil
+	case pubAckType, pubRecType, pubRelType, pubCompType:
+		if len(body) < 2 {
+			return nil, enmu.Mqtt5PacketError
+		}
+		return body[:2], nil
+	case disconnectType:
+		return nil, nil
+	case authType:
+		return nil, enmu.Mqtt5PacketError
+	}
+	return body, nil
+}
+
+// outbound    把3.1.1报文转换为MQTT 5报文
+func (c *mqtt5Conn) outbound(e *encodedPacket) []byte {
+	if c == nil || len(e.raw) < 2 {
+		return e.raw
+	}
+	first := e.raw[0]
+	length, n, err := readVarint(e.raw[1:])
+	if err != nil || 1+n+length > len(e.raw) {
+		return e.raw
+	}
+	body := e.raw[1+n : 1+n+length]
+	var out []byte
+	switch first >> 4 {
+	case publishType:
+		h, err := publishHeaderLength(first, body)
+		if err != nil {
+			return e.raw
+		}
+		out = append(out, body[:h]...)
+		out = appendProperties(out, e.userProperties)
+		out = append(out, body[h:]...)
+	case subAckType:
+		if len(body) < 2 {
+			return e.raw
+		}
+		out = append(append(out, body[:2]...), 0)
+		out = append(out, body[2:]...)
+	case unsubAckType:
+		if len(body) < 2 {
+			return e.raw
+		}
+		mid := binary.BigEndian.Uint16(body)
+		c.mu.Lock()
+		count, ok := c.unsubs[mid]
+		delete(c.unsubs, mid)
+		c.mu.Unlock()
+		if !ok {
+			count = 1
+		}
+		out = append(append(out, body[:2]...), 0)
+		for i := 0; i < count; i++ {
+			out = append(out, unsubscribeSuccess5)
+		}
+	default:
+		return e.raw
+	}
+	return append(appendVarint([]byte{first}, len(out)), out...)
+}
+
+// connectBody    把MQTT 5 CONNECT的剩余部分转换为3.1.1格式,去掉链接属性与遗嘱属性;协议版本保持为5
+func connectBody(body []byte) ([]byte, error) {
+	n, err := stringLength(body, 0)
+	if err != nil || len(body) < n+4 || body[n] != mqtt5Version {
+		return body, nil
+	}
+	flags := body[n+1]
+	header := n + 4 // 协议名、版本、标志与保持连接时间
+	_, rest, err := readProperties(body[header:])
+	if err != nil {
+		return nil, err
+	}
+	out := append(body[:header:header], rest...)
+	if flags&0x04 == 0 {
+		return out, nil
+	}
+	id, err := stringLength(rest, 0)
+	if err != nil {
+		return nil, err
+	}
+	_, will, err := readProperties(rest[id:])
+	if err != nil {
+		return nil, err
+	}
+	return append(out[:header+id], will...), nil
+}
+
+// connAck5    MQTT 5的CONNACK原因码
+func connAck5(code enmu.HandshakeResult) byte {
+	switch code {
+	case enmu.Success:
+		return 0x00
+	case enmu.ProtocolError:
+		return 0x84
+	case enmu.IdError:
+		return 0x85
+	case enmu.ServeError:
+		return 0x88
+	case enmu.UserNameOrPasswordError:
+		return 0x86
+	default:
+		return 0x87
+	}
+}
+
+// publishHeaderLength    PUBLISH中主题与MessageID的长度
+func publishHeaderLength(first byte, body []byte) (int, error) {
+	n, err := stringLength(body, 0)
+	if err != nil || n == 2 {
+		return 0, enmu.Mqtt5PacketError // 主题为空时使用了主题别名,CONNACK中没有授予
+	}
+	if (first>>1)&0x03 > 0 {
+		n += 2
+	}
+	if n > len(body) {
+		return 0, enmu.Mqtt5PacketError
+	}
+	return n, nil
+}
+
+// stringLength    offset处长度前缀字符串(或二进制)的总长度
+func stringLength(bs []byte, offset int) (int, error) {
+	if len(bs) < offset+2 {
+		return 0, enmu.Mqtt5PacketError
+	}
+	n := 2 + int(binary.BigEndian.Uint16(bs[offset:]))
+	if len(bs) < offset+n {
+		return 0, enmu.Mqtt5PacketError
+	}
+	return n, nil
+}
+
+// readProperties    读取属性,返回其中的用户属性与属性之后的内容
+func readProperties(bs []byte) (userProperties, []byte, error) {
+	length, n, err := readVarint(bs)
+	if err != nil || len(bs) < n+length {
+		return nil, nil, enmu.Mqtt5PacketError
+	}
+	props, rest := bs[n:n+length], bs[n+length:]
+	var users userProperties
+	for len(props) > 0 {
+		id := props[0]
+		size, ok := mqtt5PropertySize[id]
+		if !ok {
+			return nil, nil, enmu.Mqtt5PacketError
+		}
+		props = props[1:]
+		switch size {
+		case -1:
+			_, size, err = readVarint(props)
+		case -2:
+			size, err = stringLength(props, 0)
+		case -3:
+			var key, value int
+			if key, err = stringLength(props, 0); err == nil {
+				if value, err = stringLength(props, key); err == nil {
+					users = append(users, userProperty{key: string(props[2:key]), value: string(props[key+2 : key+value])})
+					size = key + value
+				}
+			}
+		}
+		if err != nil || size > len(props) {
+			return nil, nil, enmu.Mqtt5PacketError
+		}
+		props = props[size:]
+	}
+	return users, rest, nil
+}
+
+func appendProperties(dst []byte, users userProperties) []byte {
+	var props []byte
+	for _, p := range users {
+		props = append(props, userPropertyId)
+		props = binary.BigEndian.AppendUint16(props, uint16(len(p.key)))
+		props = append(props, p.key...)
+		props = binary.BigEndian.AppendUint16(props, uint16(len(p.value)))
+		props = append(props, p.value...)
+	}
+	return append(appendVarint(dst, len(props)), props...)
+}
+
+// maskSubscribeOptions    订阅选项只保留QoS
+func maskSubscribeOptions(body []byte) ([]byte, error) {
+	for offset := 2; offset < len(body); {
+		n, err := stringLength(body, offset)
+		if err != nil || offset+n >= len(body) {
+			return nil, enmu.Mqtt5PacketError
+		}
+		offset += n
+		body[offset] &= subscribeOptionsMask
+		offset++
+	}
+	return body, nil
+}
+
+// countStrings    UNSUBSCRIBE中主题过滤器的数量
+func countStrings(bs []byte) int {
+	count := 0
+	for offset := 0; offset < len(bs); count++ {
+		n, err := stringLength(bs, offset)
+		if err != nil {
+			break
+		}
+		offset += n
+	}
+	return count
+}
+
+func readVarint(bs []byte) (int, int, error) {
+	var value int
+	for i := 0; i < 4 && i < len(bs); i++ {
+		value |= int(bs[i]&0x7F) << (7 * i)
+		if bs[i]&0x80 == 0 {
+			return value, i + 1, nil
+		}
+	}
+	return 0, 0, enmu.Mqtt5PacketError
+}
+
+func appendVarint(dst []byte, v int) []byte {
+	for {
+		b := byte(v & 0x7F)
+		v >>= 7
+		if v > 0 {
+			b |= 0x80
+		}
+		dst = append(dst, b)
+		if v == 0 {
+			return dst
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package clients
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func mqtt5String(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+func mqtt5Packet(first byte, body []byte) []byte {
+	return append(appendVarint([]byte{first}, len(body)), body...)
+}
+
+// mqtt5Props    属性长度加属性内容
+func mqtt5Props(props ...[]byte) []byte {
+	all := bytes.Join(props, nil)
+	return append(appendVarint(nil, len(all)), all...)
+}
+
+func mqtt5UserProperty(key, value string) []byte {
+	return append(append([]byte{userPropertyId}, mqtt5String(key)...), mqtt5String(value)...)
+}
+
+// mqtt5Connect    MQTT 5 CONNECT:带会话过期、接收最大值与用户属性;will不为空时带遗嘱及遗嘱属性
+func mqtt5Connect(id, user, password, willTopic string) []byte {
+	var flags byte = 0x02
+	if willTopic != "" {
+		flags |= 0x04 | 0x08 // 遗嘱,QoS 1
+	}
+	if user != "" {
+		flags |= 0x80 | 0x40
+	}
+	body := append(mqtt5String("MQTT"), mqtt5Version, flags, 0, 30)
+	body = append(body, mqtt5Props([]byte{0x11, 0, 0, 0, 60}, []byte{0x21, 0, 10}, mqtt5UserProperty("region", "eu"))...)
+	body = append(body, mqtt5String(id)...)
+	if willTopic != "" {
+		body = append(body, mqtt5Props([]byte{0x18, 0, 0, 0, 5}, append([]byte{0x03}, mqtt5String("text/plain")...))...)
+		body = append(append(body, mqtt5String(willTopic)...), mqtt5String("bye")...)
+	}
+	if user != "" {
+		body = append(append(body, mqtt5String(user)...), mqtt5String(password)...)
+	}
+	return mqtt5Packet(connectType<<4, body)
+}
+
+// readMqtt5    读取一个报文的首字节与剩余部分
+func readMqtt5(t *testing.T, c net.Conn) (byte, []byte) {
+	t.Helper()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	head := make([]byte, 1)
+	if _, err := io.ReadFull(c, head); err != nil {
+		t.Fatal(err)
+	}
+	length, _, err := readRemainingLength(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, length)
+	if _, err = io.ReadFull(c, body); err != nil {
+		t.Fatal(err)
+	}
+	return head[0], body
+}
+
+// dialMqtt5    以MQTT 5建立链接并检查CONNACK
+func dialMqtt5(t *testing.T, port uint16, id string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	if _, err = c.Write(mqtt5Connect(id, "", "", "")); err != nil {
+		t.Fatal(err)
+	}
+	first, ack := readMqtt5(t, c)
+	if first != connAckType<<4 || !bytes.Equal(ack, []byte{0, 0, 0}) {
+		t.Fatalf("%s connack %x %x", id, first, ack)
+	}
+	return c
+}
+
+func TestMqtt5ConnectBody(t *testing.T) {
+	raw := mqtt5Connect("dev-1", "alice", "secret", "dev/will")
+	_, p, err := readPacketWithLimit(bytes.NewReader(raw), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := p.(*packets.ConnectPacket)
+	if cp.ProtocolVersion != mqtt5Version || cp.Keepalive != 30 || !cp.CleanSession || cp.ClientIdentifier != "dev-1" {
+		t.Fatalf("connect %+v", cp)
+	}
+	if !cp.WillFlag || cp.WillQos != 1 || cp.WillTopic != "dev/will" || string(cp.WillMessage) != "bye" {
+		t.Fatalf("will %+v", cp)
+	}
+	if cp.Username != "alice" || string(cp.Password) != "secret" {
+		t.Fatalf("credentials %q %q", cp.Username, cp.Password)
+	}
+}
+
+// TestMqtt5PublishRoundTrip    PUBLISH读取时去掉属性,写回MQTT 5客户端时补充属性,主题、MessageID与负载不变
+func TestMqtt5PublishRoundTrip(t *testing.T) {
+	c := newMqtt5Conn(mqtt5Version)
+	props := mqtt5Props(
+		[]byte{0x01, 1},          // 负载格式
+		[]byte{0x02, 0, 0, 0, 9}, // 消息过期时间
+		append([]byte{0x08}, mqtt5String("reply/to")...),
+		[]byte{0x0B, 0x80, 0x01}, // 订阅标识符(变长整数)
+		mqtt5UserProperty("k", "v"),
+	)
+	body := append(append(mqtt5String("a/b"), 0, 7), props...)
+	raw := mqtt5Packet(publishType<<4|0x02, append(body, "hello"...))
+	_, p, err := readPacketWithLimit(bytes.NewReader(raw), 0, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pp := p.(*packets.PublishPacket)
+	if pp.TopicName != "a/b" || pp.MessageID != 7 || pp.Qos() != 1 || string(pp.Payload) != "hello" {
+		t.Fatalf("publish %+v", pp)
+	}
+	e, err := encodePacket(pp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := mqtt5Packet(publishType<<4|0x02, append(append(mqtt5String("a/b"), 0, 7, 0), "hello"...))
+	if got := c.outbound(e); !bytes.Equal(got, want) {
+		t.Fatalf("outbound %x, want %x", got, want)
+	}
+}
+
+func TestMqtt5Conversion(t *testing.T) {
+	c := newMqtt5Conn(mqtt5Version)
+	// SUBSCRIBE:去掉订阅标识符属性,订阅选项只保留QoS
+	sub := append([]byte{0, 1, 2, 0x0B, 7}, mqtt5String("a/#")...)
+	sub = append(sub, 0x2D)
+	got, err := c.inbound(subscribeType<<4|2, sub)
+	if want := append(append([]byte{0, 1}, mqtt5String("a/#")...), 1); err != nil || !bytes.Equal(got, want) {
+		t.Fatalf("subscribe %x, %v", got, err)
+	}
+	unsub := append(append([]byte{0, 2, 0}, mqtt5String("a")...), mqtt5String("b")...)
+	if _, err = c.inbound(unsubscribeType<<4|2, unsub); err != nil {
+		t.Fatal(err)
+	}
+	// 确认报文与DISCONNECT去掉原因码与属性
+	if got, err = c.inbound(pubAckType<<4, []byte{0, 3, 0x10, 0}); err != nil || !bytes.Equal(got, []byte{0, 3}) {
+		t.Fatalf("puback %x, %v", got, err)
+	}
+	if got, err = c.inbound(disconnectType<<4, []byte{0x04, 0}); err != nil || len(got) != 0 {
+		t.Fatalf("disconnect %x, %v", got, err)
+	}
+	encode := func(p mqtt_packet.ControlPacketInterface) []byte {
+		e, err := encodePacket(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c.outbound(e)
+	}
+	subAck := packets.NewSubAck(nil)
+	subAck.MessageID = 1
+	subAck.ReturnCodes = []byte{1}
+	if got = encode(subAck); !bytes.Equal(got, []byte{subAckType << 4, 4, 0, 1, 0, 1}) {
+		t.Fatalf("suback %x", got)
+	}
+	unsubAck := packets.NewUnSubAck(nil)
+	unsubAck.MessageID = 2
+	if got = encode(unsubAck); !bytes.Equal(got, []byte{unsubAckType << 4, 5, 0, 2, 0, 0, 0}) {
+		t.Fatalf("unsuback %x", got)
+	}
+}
+
+// TestMqtt5Malformed    属性长度越界、未知属性、截断的字符串与变长整数都返回Mqtt5PacketError
+func TestMqtt5Malformed(t *testing.T) {
+	topic := mqtt5String("a/b")
+	topic = topic[:len(topic):len(topic)] // 每个用例追加时复制
+	cases := []struct {
+		name  string
+		first byte
+		body  []byte
+	}{
+		{"property length beyond body", publishType << 4, append(append(topic, 10), 0x01, 1)},
+		{"unknown property", publishType << 4, append(append(topic, 2), 0x7F, 1)},
+		{"truncated string property", publishType << 4, append(append(topic, 4), 0x03, 0, 9, 'a')},
+		{"truncated user property value", publishType << 4, append(append(topic, 6), userPropertyId, 0, 1, 'k', 0, 5)},
+		{"fixed size property cut short", publishType << 4, append(append(topic, 3), 0x02, 0, 0)},
+		{"varint longer than 4 bytes", publishType << 4, append(topic, 0x80, 0x80, 0x80, 0x80, 0x01)},
+		{"topic alias without topic", publishType << 4, []byte{0, 0, 3, 0x23, 0, 1}},
+		{"topic longer than body", publishType << 4, []byte{0, 9, 'a'}},
+		{"qos 1 without message id", publishType<<4 | 0x02, append(topic, 0)},
+		{"subscribe without options", subscribeType<<4 | 2, append([]byte{0, 1, 0}, mqtt5String("a")...)},
+		{"subscribe without properties", subscribeType<<4 | 2, []byte{0, 1}},
+		{"puback without message id", pubAckType << 4, []byte{0}},
+		{"auth", authType << 4, []byte{0}},
+	}
+	for _, tc := range cases {
+		c := newMqtt5Conn(mqtt5Version)
+		if _, err := c.inbound(tc.first, tc.body); err != enmu.Mqtt5PacketError {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+	bad := append(mqtt5String("MQTT"), mqtt5Version, 0x02, 0, 30, 5, 0x11, 0)
+	if _, err := connectBody(bad); err != enmu.Mqtt5PacketError {
+		t.Errorf("connect properties beyond body: %v", err)
+	}
+	if _, _, err := readPacketWithLimit(bytes.NewReader(mqtt5Packet(connectType<<4, bad)), 0, nil); err != enmu.Mqtt5PacketError {
+		t.Errorf("read malformed connect: %v", err)
+	}
+}
+
+// TestMqtt5V3Unaffected    3.1.1客户端的报文读写不经过转换
+func TestMqtt5V3Unaffected(t *testing.T) {
+	if newMqtt5Conn(mqtt311Version) != nil {
+		t.Fatal("3.1.1 client has a converter")
+	}
+	connect := connectPacket("dev", true)
+	connect.UsernameFlag = true
+	connect.Username = "alice"
+	e, err := encodePacket(connect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, p, err := readPacketWithLimit(bytes.NewReader(e.raw), 0, nil)
+	if err != nil || n != int64(len(e.raw)) {
+		t.Fatalf("read %d, %v", n, err)
+	}
+	if again, _ := encodePacket(p); !bytes.Equal(again.raw, e.raw) {
+		t.Fatalf("connect changed: %x, want %x", again.raw, e.raw)
+	}
+	// 3.1.1的PUBLISH主题之后直接是负载,不能当作属性解析
+	pub := publishPacket("a/b", "\x05payload", 1, 3)
+	e, _ = encodePacket(pub)
+	_, p, err = readPacketWithLimit(bytes.NewReader(e.raw), 0, nil)
+	if err != nil || string(p.(*packets.PublishPacket).Payload) != "\x05payload" {
+		t.Fatalf("publish %v, %v", p, err)
+	}
+	var v3 *mqtt5Conn
+	if got := v3.outbound(e); !bytes.Equal(got, e.raw) {
+		t.Fatalf("outbound %x", got)
+	}
+	ack := connAckBytes(enmu.Success, true, mqtt311Version, "")
+	if !bytes.Equal(ack, []byte{connAckType << 4, 2, 1, 0}) {
+		t.Fatalf("connack %x", ack)
+	}
+}
+
+// TestMqtt5Session    MQTT 5客户端经过管理器完成链接、订阅、发布、取消订阅与断开
+func TestMqtt5Session(t *testing.T) {
+	port := freePort(t)
+	got := make(chan mqtt_packet.ControlPacketInterface, 10)
+	var hd clients_dto.ConnectionHandshakeDatabase
+	var m ClientManagerInterface
+	m = NewClientManagerInstance(&ClientManagerOptions{
+		TcpPort: port,
+		Handshake: func(db clients_dto.ConnectionHandshakeDatabase) enmu.HandshakeResult {
+			hd = db
+			return enmu.Success
+		},
+		PacketCb: func(id string, p mqtt_packet.ControlPacketInterface) {
+			got <- p
+			switch sp := p.(type) {
+			case *packets.SubscribePacket:
+				ack := packets.NewSubAck(nil)
+				ack.MessageID = sp.MessageID
+				ack.ReturnCodes = []byte{sp.List[0].Qos}
+				_, _ = m.SendPacketOnce(id, ack)
+			case *packets.UnSubscribePacket:
+				ack := packets.NewUnSubAck(nil)
+				ack.MessageID = sp.MessageID
+				_, _ = m.SendPacketOnce(id, ack)
+			case *packets.PublishPacket:
+				_, _ = m.SendPacketOnce(id, publishPacket("echo/"+sp.TopicName, string(sp.Payload), 0, 0))
+			}
+		},
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	c, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Write(mqtt5Connect("dev", "alice", "secret", "dev/will")); err != nil {
+		t.Fatal(err)
+	}
+	if first, ack := readMqtt5(t, c); first != connAckType<<4 || !bytes.Equal(ack, []byte{0, 0, 0}) {
+		t.Fatalf("connack %x %x", first, ack)
+	}
+	if hd.ClientId != "dev" || hd.UserName != "alice" || hd.Password != "secret" {
+		t.Fatalf("handshake %+v", hd)
+	}
+	if _, db := m.List(0, 1); len(db) != 1 || db[0].ProtocolVersion != mqtt5Version || !db[0].HasWill {
+		t.Fatalf("database %+v", db)
+	}
+	sub := append([]byte{0, 1}, mqtt5Props([]byte{0x0B, 3})...)
+	sub = append(append(sub, mqtt5String("a/#")...), 0x2D)
+	if _, err = c.Write(mqtt5Packet(subscribeType<<4|2, sub)); err != nil {
+		t.Fatal(err)
+	}
+	if sp := (<-got).(*packets.SubscribePacket); sp.List[0].Topic != "a/#" || sp.List[0].Qos != 1 {
+		t.Fatalf("subscribe %+v", sp.List[0])
+	}
+	if first, ack := readMqtt5(t, c); first != subAckType<<4 || !bytes.Equal(ack, []byte{0, 1, 0, 1}) {
+		t.Fatalf("suback %x %x", first, ack)
+	}
+	unsub := append(append([]byte{0, 2, 0}, mqtt5String("a/#")...), mqtt5String("b")...)
+	if _, err = c.Write(mqtt5Packet(unsubscribeType<<4|2, unsub)); err != nil {
+		t.Fatal(err)
+	}
+	if up := (<-got).(*packets.UnSubscribePacket); len(up.Topics) != 2 {
+		t.Fatalf("unsubscribe %+v", up)
+	}
+	if first, ack := readMqtt5(t, c); first != unsubAckType<<4 || !bytes.Equal(ack, []byte{0, 2, 0, 0, 0}) {
+		t.Fatalf("unsuback %x %x", first, ack)
+	}
+	pub := append(mqtt5String("a/b"), mqtt5Props(mqtt5UserProperty("k", "v"))...)
+	if _, err = c.Write(mqtt5Packet(publishType<<4, append(pub, "hi"...))); err != nil {
+		t.Fatal(err)
+	}
+	if pp := (<-got).(*packets.PublishPacket); pp.TopicName != "a/b" || string(pp.Payload) != "hi" {
+		t.Fatalf("publish %+v", pp)
+	}
+	first, echo := readMqtt5(t, c)
+	if want := append(append(mqtt5String("echo/a/b"), 0), "hi"...); first != publishType<<4 || !bytes.Equal(echo, want) {
+		t.Fatalf("echo %x %x", first, echo)
+	}
+	// 带原因码与属性的DISCONNECT正常断开
+	if _, err = c.Write(mqtt5Packet(disconnectType<<4, []byte{0x00, 0})); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := (<-got).(*packets.DisconnectPacket); !ok {
+		t.Fatal("disconnect is not delivered")
+	}
+}
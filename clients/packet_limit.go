@@ -0,0 +1,194 @@
+package clients
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"github.com/qdmc/websocket_packet/frame"
+	"io"
+	"time"
+)
+
+// arrivalReader    记录报文首字节到达的时间,用于追踪报文解码;只在读协程中使用
+type arrivalReader struct {
+	r     io.Reader
+	nano  int64
+	armed bool
+}
+
+func (a *arrivalReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 && a.armed {
+		a.nano = time.Now().UnixNano()
+		a.armed = false
+	}
+	return n, err
+}
+
+// next    开始读取下一个报文
+func (a *arrivalReader) next() {
+	a.armed = true
+}
+
+// readPacketWithLimit   读取一个MQTT报文;先解析固定报头,剩余长度超过maxSize时在分配内存前返回错误。
+// MQTT 5的CONNECT与v5不为nil时的其他报文先转换为3.1.1格式再解码,3.1.1报文不做修改
+func readPacketWithLimit(r io.Reader, maxSize int, v5 *mqtt5Conn) (int64, mqtt_packet.ControlPacketInterface, error) {
+	head := make([]byte, 1, 5)
+	_, err := io.ReadFull(r, head)
+	if err != nil {
+		return 0, nil, err
+	}
+	remainingLength, lengthBytes, err := readRemainingLength(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	head = append(head, lengthBytes...)
+	total := len(head) + remainingLength
+	if maxSize > 0 && total > maxSize {
+		return 0, nil, enmu.PacketTooLargeError
+	}
+	body := make([]byte, remainingLength)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if head[0]>>4 == connectType {
+		body, err = connectBody(body)
+	} else if v5 != nil {
+		body, err = v5.inbound(head[0], body)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(body) != remainingLength {
+		head = appendVarint(head[:1], len(body))
+	}
+	p, err := mqtt_packet.ReadOnce(bytes.NewBuffer(append(head, body...)))
+	if err != nil {
+		return 0, nil, err
+	}
+	return int64(total), p, nil
+}
+
+// readRemainingLength    读取固定报头中的剩余长度(变长编码,最多4字节)
+func readRemainingLength(r io.Reader) (int, []byte, error) {
+	var length int
+	var bs []byte
+	b := make([]byte, 1)
+	for i := 0; i < 4; i++ {
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return 0, nil, err
+		}
+		bs = append(bs, b[0])
+		length |= int(b[0]&0x7F) << (7 * i)
+		if b[0]&0x80 == 0 {
+			return length, bs, nil
+		}
+	}
+	return 0, nil, enmu.PacketRemainingLengthError
+}
+
+// streamBufferKeep    报文读完后保留缓冲区的最大容量,更大的缓冲区释放
+const streamBufferKeep = 4096
+
+// packetStream    从websocket消息中逐步读取MQTT报文,只在读协程中使用。
+// 固定报头只解析一次,报文内容随数据到达追加到同一个缓冲区,不按声明的剩余长度预先分配
+type packetStream struct {
+	buf   []byte // 当前报文已到达的字节
+	total int    // 当前报文的总长度,固定报头未读完时为0
+}
+
+// feed    追加数据并返回已读完的报文;报文超过maxSize时在读取内容前返回PacketTooLargeError
+func (s *packetStream) feed(bs []byte, maxSize int, v5 *mqtt5Conn) ([]mqtt_packet.ControlPacketInterface, error) {
+	var list []mqtt_packet.ControlPacketInterface
+	for len(bs) > 0 {
+		if s.total == 0 {
+			s.buf = append(s.buf, bs[0])
+			bs = bs[1:]
+			total, err := packetTotalLength(s.buf)
+			if err != nil {
+				return list, err
+			}
+			if total == 0 {
+				continue
+			}
+			if maxSize > 0 && total > maxSize {
+				return list, enmu.PacketTooLargeError
+			}
+			s.total = total
+		}
+		n := s.total - len(s.buf)
+		if n > len(bs) {
+			n = len(bs)
+		}
+		s.buf = append(s.buf, bs[:n]...)
+		bs = bs[n:]
+		if len(s.buf) < s.total {
+			break
+		}
+		_, p, err := readPacketWithLimit(bytes.NewReader(s.buf), 0, v5)
+		if err != nil {
+			return list, err
+		}
+		list = append(list, p)
+		s.total = 0
+		if cap(s.buf) > streamBufferKeep {
+			s.buf = nil
+		} else {
+			s.buf = s.buf[:0]
+		}
+	}
+	return list, nil
+}
+
+// packetTotalLength    由已到达的固定报头计算报文总长度,报头未读完时返回0
+func packetTotalLength(head []byte) (int, error) {
+	if len(head) < 2 {
+		return 0, nil
+	}
+	var length int
+	for i, b := range head[1:] {
+		length |= int(b&0x7F) << (7 * i)
+		if b&0x80 == 0 {
+			return i + 2 + length, nil
+		}
+		if i == 3 {
+			return 0, enmu.PacketRemainingLengthError
+		}
+	}
+	return 0, nil
+}
+
+// readFrameWithLimit    读取一个websocket帧;负载长度超过maxSize时在分配内存前返回CloseMessageTooBig
+func readFrameWithLimit(r io.Reader, maxSize int) (int, *frame.Frame, frame.CloseStatus) {
+	head := make([]byte, 2, 14)
+	_, err := io.ReadFull(r, head)
+	if err != nil {
+		return 0, nil, frame.CloseGoingAway
+	}
+	var payloadLength uint64
+	var extended []byte
+	switch head[1] & 0x7F {
+	case 0x7E:
+		extended = make([]byte, 2)
+		if _, err = io.ReadFull(r, extended); err != nil {
+			return len(head), nil, frame.CloseGoingAway
+		}
+		payloadLength = uint64(binary.BigEndian.Uint16(extended))
+	case 0x7F:
+		extended = make([]byte, 8)
+		if _, err = io.ReadFull(r, extended); err != nil {
+			return len(head), nil, frame.CloseGoingAway
+		}
+		payloadLength = binary.BigEndian.Uint64(extended)
+	default:
+		payloadLength = uint64(head[1] & 0x7F)
+	}
+	if maxSize > 0 && payloadLength > uint64(maxSize) {
+		return len(head) + len(extended), nil, frame.CloseMessageTooBig
+	}
+	head = append(head, extended...)
+	return frame.ReadOnceFrame(io.MultiReader(bytes.NewBuffer(head), r))
+}
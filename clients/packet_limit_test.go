@@ -0,0 +1,130 @@
+package clients
+
+import (
+	"bytes"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"io"
+	"strings"
+	"testing"
+)
+
+// countingReader    记录已读取的字节数
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// TestReadPacketWithLimitRejectsBeforeAllocation    剩余长度超过上限时只读取固定报头
+func TestReadPacketWithLimitRejectsBeforeAllocation(t *testing.T) {
+	// 声明约256MB的PUBLISH,之后的内容不应被读取
+	r := &countingReader{r: io.MultiReader(bytes.NewReader([]byte{0x30, 0xFF, 0xFF, 0xFF, 0x7F}), strings.NewReader(strings.Repeat("x", 4096)))}
+	if _, _, err := readPacketWithLimit(r, 1024, nil); err != enmu.PacketTooLargeError {
+		t.Fatalf("err %v", err)
+	}
+	if r.n != 5 {
+		t.Fatalf("read %d bytes, want only the 5 byte fixed header", r.n)
+	}
+	if _, _, err := readPacketWithLimit(bytes.NewReader([]byte{0x30, 0xFF, 0xFF, 0xFF, 0xFF, 0x01}), 0, nil); err != enmu.PacketRemainingLengthError {
+		t.Fatalf("5 byte remaining length: %v", err)
+	}
+	// 总长度恰好等于上限时接受
+	e, _ := encodePacket(publishPacket("a", "12345", 0, 0))
+	if _, _, err := readPacketWithLimit(bytes.NewReader(e.raw), len(e.raw), nil); err != nil {
+		t.Fatalf("packet of exactly max size: %v", err)
+	}
+	if _, _, err := readPacketWithLimit(bytes.NewReader(e.raw), len(e.raw)-1, nil); err != enmu.PacketTooLargeError {
+		t.Fatalf("packet one byte over max size: %v", err)
+	}
+}
+
+func streamBytes(t *testing.T, ps ...mqtt_packet.ControlPacketInterface) []byte {
+	t.Helper()
+	var all []byte
+	for _, p := range ps {
+		e, err := encodePacket(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, e.raw...)
+	}
+	return all
+}
+
+// TestPacketStreamChunks    报文按任意分片到达时都能完整读出
+func TestPacketStreamChunks(t *testing.T) {
+	all := streamBytes(t,
+		publishPacket("a/b", strings.Repeat("p", 300), 1, 1), // 剩余长度为2字节
+		packets.NewPingReq(nil),
+		publishPacket("c", "", 0, 0),
+	)
+	for _, chunk := range []int{1, 2, 3, 7, 64, len(all)} {
+		var s packetStream
+		var got []mqtt_packet.ControlPacketInterface
+		for i := 0; i < len(all); i += chunk {
+			end := i + chunk
+			if end > len(all) {
+				end = len(all)
+			}
+			list, err := s.feed(all[i:end], 1024, nil)
+			if err != nil {
+				t.Fatalf("chunk %d: %v", chunk, err)
+			}
+			got = append(got, list...)
+		}
+		if len(got) != 3 || len(s.buf) != 0 || s.total != 0 {
+			t.Fatalf("chunk %d: %d packets, %d bytes left", chunk, len(got), len(s.buf))
+		}
+		if p := got[0].(*packets.PublishPacket); p.TopicName != "a/b" || len(p.Payload) != 300 || p.MessageID != 1 {
+			t.Fatalf("chunk %d: first packet %v", chunk, p)
+		}
+		if _, ok := got[1].(*packets.PingReqPacket); !ok {
+			t.Fatalf("chunk %d: second packet %v", chunk, got[1])
+		}
+	}
+}
+
+// TestPacketStreamBoundedMemory    缓冲区随实际到达的数据增长,不按声明的剩余长度分配;超过上限时读取内容前返回错误
+func TestPacketStreamBoundedMemory(t *testing.T) {
+	var s packetStream
+	// 声明接近上限的报文,只发送100字节
+	head := appendVarint([]byte{0x30}, 1<<20-10)
+	if _, err := s.feed(append(head, make([]byte, 100)...), 1<<20, nil); err != nil {
+		t.Fatal(err)
+	}
+	if cap(s.buf) > 1024 {
+		t.Fatalf("buffer capacity %d after 100 bytes", cap(s.buf))
+	}
+	s = packetStream{}
+	if _, err := s.feed(appendVarint([]byte{0x30}, 2048), 1024, nil); err != enmu.PacketTooLargeError {
+		t.Fatalf("too large: %v", err)
+	}
+	s = packetStream{}
+	if _, err := s.feed([]byte{0x30, 0x80, 0x80, 0x80, 0x80}, 0, nil); err != enmu.PacketRemainingLengthError {
+		t.Fatalf("malformed remaining length: %v", err)
+	}
+}
+
+// TestPacketStreamOneByteFrames    逐字节到达的大报文只需要对数次数的分配,不会每次分配整个报文
+func TestPacketStreamOneByteFrames(t *testing.T) {
+	all := streamBytes(t, publishPacket("big", strings.Repeat("x", 64<<10), 0, 0))
+	allocs := testing.AllocsPerRun(1, func() {
+		var s packetStream
+		for i := range all {
+			list, err := s.feed(all[i:i+1], 1<<20, nil)
+			if err != nil || (i < len(all)-1 && len(list) != 0) || (i == len(all)-1 && len(list) != 1) {
+				t.Fatalf("byte %d: %d packets, %v", i, len(list), err)
+			}
+		}
+	})
+	if allocs > 200 {
+		t.Fatalf("%v allocations for a %d byte packet fed one byte at a time", allocs, len(all))
+	}
+}
@@ -0,0 +1,222 @@
+package clients
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const proxyV1MaxLength = 107
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocol    PROXY协议(v1/v2)解析配置,只解析来自可信上游的协议头;可信上游的链接必须带有协议头
+type proxyProtocol struct {
+	trusted []*net.IPNet
+	timeout time.Duration // 读取协议头的期限
+}
+
+func newProxyProtocol(cidrs []string, timeout time.Duration) (*proxyProtocol, error) {
+	trusted, err := parseCidrs(cidrs)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocol{trusted: trusted, timeout: timeout}, nil
+}
+
+func (pp *proxyProtocol) isTrusted(addr net.Addr) bool {
+	return containsIP(pp.trusted, addrIP(addr))
+}
+
+// wrap    可信上游的链接在首次读取或获取地址时解析协议头,其余链接原样返回
+func (pp *proxyProtocol) wrap(conn net.Conn) net.Conn {
+	if pp == nil || !pp.isTrusted(conn.RemoteAddr()) {
+		return conn
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn), timeout: pp.timeout}
+}
+
+// proxyListener    websocket监听使用,Accept返回的链接按PROXY协议解析
+type proxyListener struct {
+	net.Listener
+	pp *proxyProtocol
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.pp.wrap(conn), nil
+}
+
+// proxyConn    还原了真实地址的链接;没有协议头或协议头无效时Read返回错误,地址为原链接的地址
+type proxyConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	timeout    time.Duration
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	mu         sync.Mutex
+	deadline   time.Time // 调用方设置的读取期限,读取协议头之后恢复
+}
+
+// init    在期限内读取协议头;http.Server在设置期限之前获取地址,因此期限不能依赖调用方
+func (c *proxyConn) init() {
+	c.once.Do(func() {
+		if c.timeout > 0 {
+			_ = c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		}
+		c.remoteAddr, c.localAddr, c.err = readProxyHeader(c.reader)
+		if c.timeout > 0 {
+			c.mu.Lock()
+			_ = c.Conn.SetReadDeadline(c.deadline)
+			c.mu.Unlock()
+		}
+	})
+}
+
+func (c *proxyConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *proxyConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	c.init()
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader   读取PROXY协议头,返回源地址与目标地址;为LOCAL/UNKNOWN时地址为nil,没有协议头时返回ProxyProtocolMissingError
+func readProxyHeader(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch first[0] {
+	case 'P':
+		if sig, err := r.Peek(6); err == nil && string(sig) == "PROXY " {
+			return readProxyV1(r)
+		}
+	case '\r':
+		if sig, err := r.Peek(len(proxyV2Signature)); err == nil && bytes.Equal(sig, proxyV2Signature) {
+			return readProxyV2(r)
+		}
+	}
+	return nil, nil, enmu.ProxyProtocolMissingError
+}
+
+// readProxyV1   PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	var line []byte
+	for len(line) < proxyV1MaxLength {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, enmu.ProxyProtocolError
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, enmu.ProxyProtocolError
+	}
+	src, err := parseProxyAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+func parseProxyAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, enmu.ProxyProtocolError
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyV2   二进制协议头:12字节签名,版本与命令,地址族,长度,地址
+func readProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	head := make([]byte, 16)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, nil, err
+	}
+	if head[12]>>4 != 2 {
+		return nil, nil, enmu.ProxyProtocolError
+	}
+	body := make([]byte, binary.BigEndian.Uint16(head[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	// LOCAL命令为上游自身的健康检查,按直连处理
+	if head[12]&0x0F == 0 {
+		return nil, nil, nil
+	}
+	switch head[13] {
+	case 0x11: // TCP over IPv4
+		if len(body) < 12 {
+			return nil, nil, enmu.ProxyProtocolError
+		}
+		src := &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+		dst := &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:12]))}
+		return src, dst, nil
+	case 0x21: // TCP over IPv6
+		if len(body) < 36 {
+			return nil, nil, enmu.ProxyProtocolError
+		}
+		src := &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+		dst := &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:36]))}
+		return src, dst, nil
+	}
+	return nil, nil, nil
+}
@@ -0,0 +1,174 @@
+package clients
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header    v2协议头,command为0(LOCAL)或1(PROXY)
+func proxyV2Header(command, family byte, addrs []byte) []byte {
+	bs := append([]byte{}, proxyV2Signature...)
+	bs = append(bs, 0x20|command, family)
+	bs = binary.BigEndian.AppendUint16(bs, uint16(len(addrs)))
+	return append(bs, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{192, 168, 0, 1, 10, 0, 0, 1, 0xDC, 0x04, 0x07, 0x5B}
+	v6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x30, 0x39, 0x07, 0x5B)
+	cases := []struct {
+		name    string
+		input   []byte
+		src     string // 为空时地址为nil
+		dst     string
+		err     error // 为nil时要求无错误,io.ErrUnexpectedEOF表示任意读取错误
+		payload string
+	}{
+		{name: "v1 tcp4", input: []byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 1883\r\nMQTT"), src: "192.168.0.1:56324", dst: "10.0.0.1:1883", payload: "MQTT"},
+		{name: "v1 tcp6", input: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 1883\r\n"), src: "[2001:db8::1]:12345", dst: "[2001:db8::2]:1883"},
+		{name: "v1 unknown", input: []byte("PROXY UNKNOWN\r\nMQTT"), payload: "MQTT"},
+		{name: "v1 truncated", input: []byte("PROXY TCP4 192.168.0.1 10.0.0.1"), err: io.ErrUnexpectedEOF},
+		{name: "v1 no crlf", input: []byte("PROXY TCP4 192.168.0.1 10.0.0.1 1 2\n"), err: enmu.ProxyProtocolError},
+		{name: "v1 too long", input: []byte("PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLength) + "\r\n"), err: enmu.ProxyProtocolError},
+		{name: "v1 bad address", input: []byte("PROXY TCP4 host 10.0.0.1 1 2\r\n"), err: enmu.ProxyProtocolError},
+		{name: "v1 bad port", input: []byte("PROXY TCP4 192.168.0.1 10.0.0.1 70000 2\r\n"), err: enmu.ProxyProtocolError},
+		{name: "v1 bad protocol", input: []byte("PROXY UDP4 192.168.0.1 10.0.0.1 1 2\r\n"), err: enmu.ProxyProtocolError},
+		{name: "v2 tcp4", input: append(proxyV2Header(1, 0x11, v4), "MQTT"...), src: "192.168.0.1:56324", dst: "10.0.0.1:1883", payload: "MQTT"},
+		{name: "v2 tcp6", input: proxyV2Header(1, 0x21, v6), src: "[2001:db8::1]:12345", dst: "[2001:db8::2]:1883"},
+		{name: "v2 tlv after addresses", input: proxyV2Header(1, 0x11, append(append([]byte{}, v4...), 0x04, 0x00, 0x00)), src: "192.168.0.1:56324", dst: "10.0.0.1:1883"},
+		{name: "v2 local", input: append(proxyV2Header(0, 0x11, v4), "MQTT"...), payload: "MQTT"},
+		{name: "v2 unspecified family", input: proxyV2Header(1, 0x00, nil)},
+		{name: "v2 truncated head", input: proxyV2Header(1, 0x11, v4)[:14], err: io.ErrUnexpectedEOF},
+		{name: "v2 truncated addresses", input: proxyV2Header(1, 0x11, v4)[:20], err: io.ErrUnexpectedEOF},
+		{name: "v2 short tcp4", input: proxyV2Header(1, 0x11, v4[:8]), err: enmu.ProxyProtocolError},
+		{name: "v2 short tcp6", input: proxyV2Header(1, 0x21, v6[:20]), err: enmu.ProxyProtocolError},
+		{name: "v2 bad version", input: append(append([]byte{}, proxyV2Signature...), 0x11, 0x11, 0, 0), err: enmu.ProxyProtocolError},
+		{name: "missing", input: []byte{0x10, 0x0c}, err: enmu.ProxyProtocolMissingError},
+		{name: "missing, similar prefix", input: []byte("PROXX TCP4\r\n"), err: enmu.ProxyProtocolMissingError},
+		{name: "empty", input: nil, err: io.ErrUnexpectedEOF},
+	}
+	for _, c := range cases {
+		r := bufio.NewReader(bytes.NewReader(c.input))
+		src, dst, err := readProxyHeader(r)
+		switch {
+		case c.err == io.ErrUnexpectedEOF:
+			if err == nil {
+				t.Errorf("%s: no error", c.name)
+			}
+			continue
+		case !errors.Is(err, c.err):
+			t.Errorf("%s: err %v, want %v", c.name, err, c.err)
+			continue
+		case c.err != nil:
+			continue
+		}
+		if addrString(src) != c.src || addrString(dst) != c.dst {
+			t.Errorf("%s: %v %v", c.name, src, dst)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != c.payload {
+			t.Errorf("%s: remaining %q", c.name, rest)
+		}
+	}
+}
+
+// TestProxyConnHeaderTimeout    不发送协议头的可信上游在期限后返回错误;读取协议头后恢复调用方的期限
+func TestProxyConnHeaderTimeout(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	c := &proxyConn{Conn: server, reader: bufio.NewReader(server), timeout: 50 * time.Millisecond}
+	start := time.Now()
+	_ = c.RemoteAddr()
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("RemoteAddr blocked for %v", d)
+	}
+	if _, err := c.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read %v", err)
+	}
+
+	server, client = net.Pipe()
+	defer client.Close()
+	c = &proxyConn{Conn: server, reader: bufio.NewReader(server), timeout: 50 * time.Millisecond}
+	go func() {
+		_, _ = client.Write([]byte("PROXY TCP4 192.168.0.1 10.0.0.1 56324 1883\r\n"))
+		time.Sleep(200 * time.Millisecond)
+		_, _ = client.Write([]byte("x"))
+	}()
+	if addr := addrString(c.RemoteAddr()); addr != "192.168.0.1:56324" {
+		t.Fatalf("remote addr %s", addr)
+	}
+	// 协议头的期限已经过去,之后的读取不受影响
+	if _, err := c.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("read after header: %v", err)
+	}
+}
+
+// dialProxy    发送协议头与CONNECT,返回CONNACK的返回码;链接被关闭时返回错误
+func dialProxy(t *testing.T, port uint16, header, id string) (byte, error) {
+	t.Helper()
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	e, _ := encodePacket(connectPacket(id, true))
+	if _, err = c.Write(append([]byte(header), e.raw...)); err != nil {
+		return 0, err
+	}
+	p, err := readPacket(c, 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	return p.(*packets.ConnAckPacket).ReturnCode, nil
+}
+
+func TestProxyProtocolManager(t *testing.T) {
+	trusted := freePort(t)
+	m, _, _ := limitManager(t, &ClientManagerOptions{TcpPort: trusted, ProxyProtocol: true, ProxyTrusted: []string{"127.0.0.0/8"}, MaxHandshakeTime: 1})
+	if code, err := dialProxy(t, trusted, "PROXY TCP4 203.0.113.7 10.0.0.1 40000 1883\r\n", "behind"); err != nil || code != 0 {
+		t.Fatalf("trusted with header: %d %v", code, err)
+	}
+	if db, err := m.GetOnce("behind"); err != nil || addrString(db.Addr) != "203.0.113.7:40000" {
+		t.Fatalf("address %v %v", db, err)
+	}
+	// 可信上游没有协议头时断开,不按直连处理
+	if _, err := dialProxy(t, trusted, "", "direct"); err == nil {
+		t.Fatal("trusted upstream without header is accepted")
+	}
+
+	untrusted := freePort(t)
+	limitManager(t, &ClientManagerOptions{TcpPort: untrusted, ProxyProtocol: true, ProxyTrusted: []string{"10.0.0.0/8"}, MaxHandshakeTime: 1})
+	if code, err := dialProxy(t, untrusted, "", "direct"); err != nil || code != 0 {
+		t.Fatalf("untrusted direct: %d %v", code, err)
+	}
+	// 不可信来源的协议头不解析,作为MQTT数据时握手失败
+	if _, err := dialProxy(t, untrusted, "PROXY TCP4 203.0.113.7 10.0.0.1 40000 1883\r\n", "spoofed"); err == nil {
+		t.Fatal("header from an untrusted source is parsed")
+	}
+}
+
+// TestProxyProtocolWebsocketTimeout    websocket监听的可信上游不发送任何数据时,在握手期限后断开
+func TestProxyProtocolWebsocketTimeout(t *testing.T) {
+	port := freePort(t)
+	limitManager(t, &ClientManagerOptions{TcpPort: freePort(t), IsWebsocket: true, WebsocketPort: port,
+		ProxyProtocol: true, ProxyTrusted: []string{"127.0.0.0/8"}, MaxHandshakeTime: 1})
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = c.Read(make([]byte, 1)); errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("connection is not closed after the handshake time")
+	}
+}
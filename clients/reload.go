@@ -0,0 +1,231 @@
+package clients
+
+import (
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/rules"
+	"net"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// restartFields    只在Start时读取的配置项,运行中修改后保持原值
+var restartFields = []string{
+	"DispatchWorkers", "DispatchQueue", "JournalSize", "JournalFile", "SessionStore", "SessionExpiry",
+	"ClusterNodeId", "ClusterPort", "ClusterAdvertise", "ClusterSeeds", "ClusterBind", "ClusterSecret",
+	"ClusterTLS", "IsUdp", "UdpPort",
+}
+
+// ReloadOptions    运行中重新加载配置,不断开已有链接;未启动时等同SetOptions。
+// 所有配置先校验,任一无效时返回错误且保持原配置;握手、钩子、回调、规则与webhook立即生效,
+// 超时与长度限制对之后的链接生效,监听配置变化时重新监听,restartFields中的配置项需要重启
+func (m *defaultClientManager) ReloadOptions(options *ClientManagerOptions) (clients_dto.ReloadReport, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cur := m.options()
+	newOpt := cur.merge(options)
+	report := clients_dto.ReloadReport{}
+	changed := changedOptions(cur, newOpt)
+	if !m.isStart {
+		m.setOptions(options)
+		report.Applied = changed
+		return report, nil
+	}
+	if len(changed) == 0 {
+		return report, nil
+	}
+	err := newOpt.ClientIdRule.compile()
+	if err != nil {
+		return report, err
+	}
+	if err = newOpt.TopicMapping.compile(); err != nil {
+		return report, err
+	}
+	var pp *proxyProtocol
+	if newOpt.ProxyProtocol {
+		pp, err = newProxyProtocol(newOpt.ProxyTrusted, time.Duration(newOpt.MaxHandshakeTime)*time.Second)
+		if err != nil {
+			return report, err
+		}
+	}
+	forwarded, err := parseCidrs(newOpt.ForwardedTrusted)
+	if err != nil {
+		return report, err
+	}
+	if slices.Contains(changed, "Rules") {
+		if err = rules.NewEngine().Load(newOpt.Rules); err != nil {
+			return report, err
+		}
+	}
+	newValue, curValue := reflect.ValueOf(newOpt).Elem(), reflect.ValueOf(cur).Elem()
+	for _, name := range restartFields {
+		newValue.FieldByName(name).Set(curValue.FieldByName(name))
+	}
+	if err = m.reloadListeners(cur, newOpt, pp); err != nil {
+		return report, err
+	}
+	if slices.Contains(changed, "Rules") {
+		_ = m.rules.Load(newOpt.Rules)
+	}
+	m.forwarded = forwarded
+	m.opts.Store(newOpt)
+	for _, name := range changed {
+		if slices.Contains(restartFields, name) {
+			report.RestartRequired = append(report.RestartRequired, name)
+		} else {
+			report.Applied = append(report.Applied, name)
+		}
+	}
+	return report, nil
+}
+
+// reloadListeners    按新配置重新监听tcp与websocket,已建立的链接不受影响;失败时恢复原监听,调用方需持有锁
+func (m *defaultClientManager) reloadListeners(cur, newOpt *ClientManagerOptions, pp *proxyProtocol) error {
+	proxyChanged := cur.ProxyProtocol != newOpt.ProxyProtocol || !slices.Equal(cur.ProxyTrusted, newOpt.ProxyTrusted) ||
+		(newOpt.ProxyProtocol && cur.MaxHandshakeTime != newOpt.MaxHandshakeTime)
+	if proxyChanged || cur.TcpPort != newOpt.TcpPort {
+		if err := m.replaceTcp(cur.TcpPort == newOpt.TcpPort, newOpt, pp); err != nil {
+			m.restoreListeners(cur)
+			return err
+		}
+	}
+	if proxyChanged || cur.IsWebsocket != newOpt.IsWebsocket || cur.WebsocketPort != newOpt.WebsocketPort ||
+		cur.WebsocketPath != newOpt.WebsocketPath || cur.MaxHandshakeTime != newOpt.MaxHandshakeTime {
+		samePort := cur.IsWebsocket && cur.WebsocketPort == newOpt.WebsocketPort
+		if err := m.replaceWebsocket(samePort, newOpt, pp); err != nil {
+			m.restoreListeners(cur)
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceTcp    同一端口时先关闭原监听,否则新监听成功后再关闭原监听
+func (m *defaultClientManager) replaceTcp(samePort bool, opt *ClientManagerOptions, pp *proxyProtocol) error {
+	if samePort && m.tcpListener != nil {
+		_ = m.tcpListener.Close()
+		m.tcpListener = nil
+	}
+	l, err := m.listenTcp(opt, pp)
+	if err != nil {
+		return err
+	}
+	if m.tcpListener != nil {
+		_ = m.tcpListener.Close()
+	}
+	m.tcpListener = l
+	return nil
+}
+
+// replaceWebsocket    关闭http服务不影响已升级的websocket链接
+func (m *defaultClientManager) replaceWebsocket(samePort bool, opt *ClientManagerOptions, pp *proxyProtocol) error {
+	if samePort || !opt.IsWebsocket {
+		m.closeWebsocket()
+	}
+	if !opt.IsWebsocket {
+		return nil
+	}
+	l, server, err := m.listenWebsocket(opt, pp)
+	if err != nil {
+		return err
+	}
+	m.closeWebsocket()
+	m.webListener, m.httpServer = l, server
+	return nil
+}
+
+// restoreListeners    重新加载失败时按原配置恢复监听
+func (m *defaultClientManager) restoreListeners(cur *ClientManagerOptions) {
+	pp := m.proxyProtocolOf(cur)
+	if m.tcpListener == nil || m.tcpListener.Addr().(*net.TCPAddr).Port != int(cur.TcpPort) {
+		if m.tcpListener != nil {
+			_ = m.tcpListener.Close()
+			m.tcpListener = nil
+		}
+		m.tcpListener, _ = m.listenTcp(cur, pp)
+	}
+	m.closeWebsocket()
+	if cur.IsWebsocket {
+		m.webListener, m.httpServer, _ = m.listenWebsocket(cur, pp)
+	}
+}
+
+// proxyProtocolOf    按配置创建PROXY协议解析,配置已校验过
+func (m *defaultClientManager) proxyProtocolOf(opt *ClientManagerOptions) *proxyProtocol {
+	if !opt.ProxyProtocol {
+		return nil
+	}
+	pp, _ := newProxyProtocol(opt.ProxyTrusted, time.Duration(opt.MaxHandshakeTime)*time.Second)
+	return pp
+}
+
+// changedOptions    返回值不同的配置项名称;函数、接口与指针按引用比较,ClientIdRule按内容比较
+func changedOptions(a, b *ClientManagerOptions) []string {
+	var names []string
+	av, bv := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	for i := 0; i < av.NumField(); i++ {
+		name := av.Type().Field(i).Name
+		if name == "ClientIdRule" {
+			if !a.ClientIdRule.equal(b.ClientIdRule) {
+				names = append(names, name)
+			}
+			continue
+		}
+		if !sameValue(av.Field(i), bv.Field(i)) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func sameValue(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Func, reflect.Pointer, reflect.Chan, reflect.UnsafePointer:
+		return a.Pointer() == b.Pointer()
+	case reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return a.Elem().Type() == b.Elem().Type() && sameValue(a.Elem(), b.Elem())
+	case reflect.Slice:
+		if a.Len() != b.Len() || a.IsNil() != b.IsNil() {
+			return false
+		}
+		for i := 0; i < a.Len(); i++ {
+			if !sameValue(a.Index(i), b.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Map:
+		if a.Len() != b.Len() || a.IsNil() != b.IsNil() {
+			return false
+		}
+		iter := a.MapRange()
+		for iter.Next() {
+			v := b.MapIndex(iter.Key())
+			if !v.IsValid() || !sameValue(iter.Value(), v) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if !sameValue(a.Field(i), b.Field(i)) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a.Equal(b)
+	}
+}
+
+// equal    比较导出字段,忽略编译后的正则
+func (r *ClientIdRule) equal(o *ClientIdRule) bool {
+	if r == nil || o == nil {
+		return r == o
+	}
+	return r.MinLength == o.MinLength && r.MaxLength == o.MaxLength && r.Charset == o.Charset &&
+		r.Pattern == o.Pattern && slices.Equal(r.ReservedPrefixes, o.ReservedPrefixes) && r.AssignPrefix == o.AssignPrefix
+}
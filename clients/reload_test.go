@@ -0,0 +1,122 @@
+package clients
+
+import (
+	"fmt"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestReloadOptions    握手与监听立即生效且不断开已有链接,restartFields中的配置项保持原值并报告需要重启
+func TestReloadOptions(t *testing.T) {
+	port, newPort := freePort(t), freePort(t)
+	opt := &ClientManagerOptions{TcpPort: port, DispatchWorkers: 2}
+	m, _, received := limitManager(t, opt)
+	dm := m.(*defaultClientManager)
+	c, _ := dialMqtt(t, port, "dev", "")
+
+	reload := *opt
+	reload.TcpPort = newPort
+	reload.DispatchWorkers = 4
+	reload.Handshake = func(hd clients_dto.ConnectionHandshakeDatabase) enmu.HandshakeResult {
+		if hd.UserName == "bad" {
+			return enmu.UserNameOrPasswordError
+		}
+		return enmu.Success
+	}
+	report, err := m.ReloadOptions(&reload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(report.Applied)
+	if !slices.Equal(report.Applied, []string{"Handshake", "TcpPort"}) || !slices.Equal(report.RestartRequired, []string{"DispatchWorkers"}) {
+		t.Fatalf("report %+v", report)
+	}
+	if got := dm.options(); got.DispatchWorkers != 2 || got.TcpPort != newPort {
+		t.Fatalf("options DispatchWorkers %d TcpPort %d", got.DispatchWorkers, got.TcpPort)
+	}
+	// 已有链接不受影响
+	writePacket(t, c, publishPacket("a", "x", 0, 0))
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("existing connection is dropped")
+	}
+	if _, err = net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", port), time.Second); err == nil {
+		t.Fatal("old port is still listening")
+	}
+	if _, code := dialMqtt(t, newPort, "other", "bad"); code != byte(enmu.UserNameOrPasswordError) {
+		t.Fatalf("new handshake code %d", code)
+	}
+	if _, code := dialMqtt(t, newPort, "other", "good"); code != 0 {
+		t.Fatalf("new port code %d", code)
+	}
+
+	// 再次加载相同配置时没有新生效的配置项,未生效的仍报告需要重启
+	same := reload
+	if report, err = m.ReloadOptions(&same); err != nil || len(report.Applied) != 0 || !slices.Equal(report.RestartRequired, []string{"DispatchWorkers"}) {
+		t.Fatalf("same options %+v %v", report, err)
+	}
+	same.DispatchWorkers = 2
+	if report, err = m.ReloadOptions(&same); err != nil || len(report.Applied)+len(report.RestartRequired) != 0 {
+		t.Fatalf("unchanged %+v %v", report, err)
+	}
+}
+
+// TestReloadOptionsRejected    任一配置无效或新端口无法监听时返回错误,保持原配置与原监听
+func TestReloadOptionsRejected(t *testing.T) {
+	port := freePort(t)
+	opt := &ClientManagerOptions{TcpPort: port}
+	m, _, _ := limitManager(t, opt)
+	dm := m.(*defaultClientManager)
+	before := dm.options()
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	cases := map[string]func(o *ClientManagerOptions){
+		"forwarded cidr": func(o *ClientManagerOptions) { o.ForwardedTrusted = []string{"not-a-cidr"} },
+		"proxy cidr":     func(o *ClientManagerOptions) { o.ProxyProtocol, o.ProxyTrusted = true, []string{"10.0.0.0/33"} },
+		"client id rule": func(o *ClientManagerOptions) { o.ClientIdRule = &ClientIdRule{Pattern: "("} },
+		"topic mapping":  func(o *ClientManagerOptions) { o.TopicMapping = &TopicMapping{MountPoint: "tenants"} },
+		"busy port":      func(o *ClientManagerOptions) { o.TcpPort = uint16(busy.Addr().(*net.TCPAddr).Port) },
+		"busy websocket": func(o *ClientManagerOptions) {
+			o.IsWebsocket, o.WebsocketPort = true, uint16(busy.Addr().(*net.TCPAddr).Port)
+		},
+	}
+	for name, change := range cases {
+		reload := *opt
+		change(&reload)
+		if _, err = m.ReloadOptions(&reload); err == nil {
+			t.Fatalf("%s: reload is accepted", name)
+		}
+		if after := dm.options(); after != before {
+			t.Fatalf("%s: options are replaced, changed %v", name, changedOptions(before, after))
+		}
+		if _, code := dialMqtt(t, port, "dev-"+name, ""); code != 0 {
+			t.Fatalf("%s: listener is not restored, code %d", name, code)
+		}
+	}
+}
+
+// TestReloadOptionsNotStarted    未启动时等同SetOptions,全部配置项都生效
+func TestReloadOptionsNotStarted(t *testing.T) {
+	m := NewClientManagerInstance(&ClientManagerOptions{TcpPort: 1, DispatchWorkers: 2})
+	defer m.Stop()
+	report, err := m.ReloadOptions(&ClientManagerOptions{TcpPort: 2, DispatchWorkers: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(report.Applied)
+	if !slices.Equal(report.Applied, []string{"DispatchWorkers", "TcpPort"}) || len(report.RestartRequired) != 0 {
+		t.Fatalf("report %+v", report)
+	}
+	dm := m.(*defaultClientManager)
+	if dm.options().DispatchWorkers != 3 || dm.dispatcher.workers() != 3 {
+		t.Fatalf("DispatchWorkers %d, dispatcher %d", dm.options().DispatchWorkers, dm.dispatcher.workers())
+	}
+}
@@ -0,0 +1,77 @@
+package clients
+
+import (
+	"context"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"github.com/qdmc/mqtt_single_proxy/rules"
+	"go.opentelemetry.io/otel/attribute"
+	"time"
+)
+
+// ReloadRules    热加载规则,任一规则无效时返回错误且保留原规则;相同Id的规则保留命中计数
+func (m *defaultClientManager) ReloadRules(rs []rules.Rule) error {
+	if err := m.rules.Load(rs); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	opt := *m.options()
+	opt.Rules = rs
+	m.opts.Store(&opt)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *defaultClientManager) RuleStatistics() []rules.Statistics {
+	return m.rules.Statistics()
+}
+
+// applyRules    对客户端发布的消息执行规则;返回是否被DropAction丢弃,在钩子之后、分发分片中执行
+func (m *defaultClientManager) applyRules(ctx context.Context, id string, p *packets.PublishPacket) bool {
+	if m.rules.Len() == 0 {
+		return false
+	}
+	ctx, span := m.startSpan(ctx, "mqtt.rules")
+	defer span.End()
+	m.mu.RLock()
+	client, ok := m.clientMap[id]
+	sinks := m.options().RuleSinks
+	m.mu.RUnlock()
+	msg := rules.Message{
+		ClientId: id,
+		Topic:    p.TopicName,
+		Qos:      p.Qos(),
+		Retain:   p.GetFixedHead().Retain,
+		Payload:  p.Payload,
+		Nano:     time.Now().UnixNano(),
+	}
+	if ok {
+		msg.UserName = client.GetDataBase().UserName
+	}
+	dropped := false
+	for _, out := range m.rules.Evaluate(msg) {
+		switch out.Action.Type {
+		case enmu.DropAction:
+			dropped = true
+		case enmu.RepublishAction:
+			m.republish(ctx, id, out)
+		case enmu.SinkAction:
+			sink, found := sinks[out.Action.Sink]
+			if !found || sink.Send(out) != nil {
+				m.rules.Failed(out.RuleId)
+			}
+		}
+	}
+	span.SetAttributes(attribute.Bool("mqtt.dropped", dropped))
+	return dropped
+}
+
+// republish    以原客户端的身份发布规则输出;不再经过钩子与规则,避免循环。
+// 原客户端不知道这条消息,QoS1/2的确认无处可回,因此总是以QoS0发布
+func (m *defaultClientManager) republish(ctx context.Context, id string, out rules.Output) {
+	rp := packets.NewPublish(nil)
+	rp.TopicName = out.Topic
+	rp.Payload = out.Payload
+	rp.GetFixedHead().Retain = out.Action.Retain
+	m.routePacket(ctx, id, rp)
+}
@@ -0,0 +1,77 @@
+package clients
+
+import (
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"github.com/qdmc/mqtt_single_proxy/rules"
+	"testing"
+	"time"
+)
+
+type sinkFunc func(out rules.Output) error
+
+func (f sinkFunc) Send(out rules.Output) error {
+	return f(out)
+}
+
+// TestRulesThroughManager    重新发布以QoS0路由;DropAction的消息不进入PacketCb;sink收到输出;通配符主题的重新发布被拒绝
+func TestRulesThroughManager(t *testing.T) {
+	port := freePort(t)
+	sunk := make(chan rules.Output, 4)
+	_, _, received := limitManager(t, &ClientManagerOptions{
+		TcpPort: port,
+		Rules: []rules.Rule{
+			{Id: "alert", Sql: "SELECT payload.temp AS t FROM 'in/+' WHERE payload.temp > 50", Actions: []rules.Action{
+				{Type: enmu.RepublishAction, Topic: "alerts/${clientid}", Qos: 2},
+				{Type: enmu.SinkAction, Sink: "db"},
+			}},
+			{Id: "drop", Sql: "SELECT * FROM 'noise/#'", Actions: []rules.Action{{Type: enmu.DropAction}}},
+		},
+		RuleSinks: map[string]rules.Sink{"db": sinkFunc(func(out rules.Output) error {
+			sunk <- out
+			return nil
+		})},
+	})
+	c, _ := dialMqtt(t, port, "dev+1", "")
+	writePacket(t, c, publishPacket("noise/x", "{}", 0, 0))
+	writePacket(t, c, publishPacket("in/a", `{"temp":60}`, 1, 7))
+	// 原消息在前,重新发布的主题含有通配符被拒绝
+	select {
+	case p := <-received:
+		if pp, ok := p.(*packets.PublishPacket); !ok || pp.TopicName != "in/a" || pp.MessageID != 7 {
+			t.Fatalf("first packet %v", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("original publish is not received")
+	}
+	select {
+	case out := <-sunk:
+		if out.RuleId != "alert" || out.Data["t"] != 60.0 {
+			t.Fatalf("sink output %+v", out)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("sink output is not received")
+	}
+
+	c2, _ := dialMqtt(t, port, "dev2", "")
+	writePacket(t, c2, publishPacket("in/b", `{"temp":70}`, 1, 9))
+	var republished *packets.PublishPacket
+	for i := 0; i < 2; i++ {
+		select {
+		case p := <-received:
+			if pp, ok := p.(*packets.PublishPacket); ok && pp.TopicName == "alerts/dev2" {
+				republished = pp
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("publish is not received")
+		}
+	}
+	if republished == nil || republished.Qos() != 0 || republished.MessageID != 0 || string(republished.Payload) != `{"t":70}` {
+		t.Fatalf("republished %v", republished)
+	}
+	select {
+	case p := <-received:
+		t.Fatalf("unexpected packet %v", p)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
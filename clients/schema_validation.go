@@ -0,0 +1,77 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"github.com/qdmc/mqtt_single_proxy/schema"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
+	"time"
+)
+
+type schemaErrorKey struct{}
+
+// SchemaErrorFromContext    TagSchema策略下,PacketContextCb的ctx中携带的校验错误;校验通过时返回nil
+func SchemaErrorFromContext(ctx context.Context) error {
+	err, _ := ctx.Value(schemaErrorKey{}).(error)
+	return err
+}
+
+// RegisterSchema    注册负载校验器,同名的校验器被替换;过滤器匹配的是钩子(含主题映射)之后的主题
+func (m *defaultClientManager) RegisterSchema(s schema.Schema) error {
+	return m.schemas.Register(s)
+}
+
+func (m *defaultClientManager) UnregisterSchema(name string) error {
+	return m.schemas.Unregister(name)
+}
+
+func (m *defaultClientManager) SchemaStatistics() []schema.Statistics {
+	return m.schemas.Statistics()
+}
+
+// applySchemas    校验客户端发布的消息,在钩子之后、规则之前执行;返回的ctx在TagSchema时携带校验错误,bool表示原消息是否被丢弃
+func (m *defaultClientManager) applySchemas(ctx context.Context, id string, p *packets.PublishPacket) (context.Context, bool) {
+	if m.schemas.Len() == 0 {
+		return ctx, false
+	}
+	sctx, span := m.startSpan(ctx, "mqtt.schema")
+	defer span.End()
+	f := m.schemas.Validate(p.TopicName, p.Payload)
+	if f == nil {
+		return ctx, false
+	}
+	span.SetAttributes(attribute.String("mqtt.schema", f.Schema.Name), attribute.String("mqtt.schema.policy", string(f.Schema.Policy)))
+	span.RecordError(f.Err)
+	m.log(slog.LevelWarn, "schema validation failed", id, slog.String("topic", p.TopicName), slog.String("schema", f.Schema.Name),
+		slog.String("policy", string(f.Schema.Policy)), slog.Any("err", f.Err))
+	switch f.Schema.Policy {
+	case enmu.TagSchema:
+		return context.WithValue(ctx, schemaErrorKey{}, f.Err), false
+	case enmu.DeadLetterSchema:
+		m.deadLetter(sctx, id, p, f)
+	}
+	return ctx, true
+}
+
+// deadLetter    以原客户端的身份把校验失败的消息发布到死信主题;不再经过钩子、校验与规则
+func (m *defaultClientManager) deadLetter(ctx context.Context, id string, p *packets.PublishPacket, f *schema.Failure) {
+	payload, _ := json.Marshal(clients_dto.SchemaDeadLetter{
+		Topic:    p.TopicName,
+		ClientId: id,
+		Schema:   f.Schema.Name,
+		Error:    f.Err.Error(),
+		Qos:      p.Qos(),
+		Retain:   p.GetFixedHead().Retain,
+		Payload:  p.Payload,
+		Nano:     time.Now().UnixNano(),
+	})
+	dp := packets.NewPublish(nil)
+	dp.TopicName = f.DeadLetterTopic(p.TopicName, id)
+	dp.Payload = payload
+	dp.GetFixedHead().Qos = p.Qos()
+	m.routePacket(ctx, id, dp)
+}
@@ -0,0 +1,106 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"github.com/qdmc/mqtt_single_proxy/schema"
+	"testing"
+	"time"
+)
+
+type schemaPacket struct {
+	topic   string
+	payload []byte
+	err     error
+}
+
+// TestSchemaPolicies    reject丢弃消息,dead_letter以死信主题重新发布,tag照常处理并在ctx中携带校验错误
+func TestSchemaPolicies(t *testing.T) {
+	port := freePort(t)
+	received := make(chan schemaPacket, 8)
+	m := NewClientManagerInstance(&ClientManagerOptions{
+		TcpPort: port,
+		PacketContextCb: func(ctx context.Context, _ string, p mqtt_packet.ControlPacketInterface) {
+			if pp, ok := p.(*packets.PublishPacket); ok {
+				received <- schemaPacket{topic: pp.TopicName, payload: pp.Payload, err: SchemaErrorFromContext(ctx)}
+			}
+		},
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	v, err := schema.NewJsonSchema([]byte(`{"type": "object", "required": ["value"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []schema.Schema{
+		{Name: "reject", Filter: "r/#", Validator: v},
+		{Name: "dead", Filter: "d/+", Validator: v, Policy: enmu.DeadLetterSchema, DeadLetterTopic: "dead/${schema}/${topic}"},
+		{Name: "tag", Filter: "t", Validator: v, Policy: enmu.TagSchema},
+	} {
+		if err = m.RegisterSchema(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = m.RegisterSchema(schema.Schema{Name: "bad", Filter: "a/#/b", Validator: v}); !errors.Is(err, enmu.SchemaFilterError) {
+		t.Fatalf("bad filter %v", err)
+	}
+
+	c, _ := dialMqtt(t, port, "dev", "")
+	for _, p := range []*packets.PublishPacket{
+		publishPacket("r/a", "{}", 0, 0),
+		publishPacket("r/a", `{"value": 1}`, 0, 0),
+		publishPacket("d/a", "not json", 0, 0),
+		publishPacket("t", "[]", 0, 0),
+		publishPacket("other", "not json", 0, 0),
+	} {
+		writePacket(t, c, p)
+	}
+	next := func() schemaPacket {
+		t.Helper()
+		select {
+		case sp := <-received:
+			return sp
+		case <-time.After(5 * time.Second):
+			t.Fatal("publish is not received")
+		}
+		return schemaPacket{}
+	}
+	if sp := next(); sp.topic != "r/a" || string(sp.payload) != `{"value": 1}` || sp.err != nil {
+		t.Fatalf("valid %+v", sp)
+	}
+	sp := next()
+	var dl clients_dto.SchemaDeadLetter
+	if err = json.Unmarshal(sp.payload, &dl); err != nil || sp.topic != "dead/dead/d/a" || sp.err != nil {
+		t.Fatalf("dead letter %+v %v", sp, err)
+	}
+	if dl.Topic != "d/a" || dl.ClientId != "dev" || dl.Schema != "dead" || string(dl.Payload) != "not json" || dl.Error == "" {
+		t.Fatalf("dead letter payload %+v", dl)
+	}
+	if sp = next(); sp.topic != "t" || !errors.Is(sp.err, enmu.SchemaMismatchError) {
+		t.Fatalf("tagged %+v", sp)
+	}
+	if sp = next(); sp.topic != "other" || sp.err != nil {
+		t.Fatalf("unmatched %+v", sp)
+	}
+
+	want := map[string][2]uint64{"reject": {2, 1}, "dead": {1, 1}, "tag": {1, 1}}
+	for _, st := range m.SchemaStatistics() {
+		if w := want[st.Name]; st.Checked != w[0] || st.Failed != w[1] {
+			t.Fatalf("%s statistics %+v, want %v", st.Name, st, w)
+		}
+	}
+	if err = m.UnregisterSchema("reject"); err != nil {
+		t.Fatal(err)
+	}
+	writePacket(t, c, publishPacket("r/a", "{}", 0, 0))
+	if sp = next(); sp.topic != "r/a" || sp.err != nil {
+		t.Fatalf("after unregister %+v", sp)
+	}
+}
@@ -0,0 +1,356 @@
+package clients
+
+import (
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"log/slog"
+	"maps"
+	"time"
+)
+
+const (
+	defaultMaxQueuedMessages = 1000
+	sessionExpiryInterval    = time.Minute // 检查过期会话的最长间隔
+)
+
+// SessionStore   持久会话存储:会话及订阅、离线排队消息、飞行中消息与保留消息;实现需并发安全,内置实现见store.FileStore
+type SessionStore interface {
+	Sessions() ([]clients_dto.Session, error)                // 返回全部会话,Start时加载
+	SaveSession(s clients_dto.Session) error                 // 新建或覆盖会话
+	DeleteSession(id string) error                           // 删除会话及其排队与飞行中消息
+	Enqueue(m clients_dto.StoredMessage, max int) error      // 为离线客户端排队消息,超过max条时丢弃最早的
+	Dequeue(id string) ([]clients_dto.StoredMessage, error)  // 取出并清空客户端的排队消息
+	SaveInflight(m clients_dto.StoredMessage) error          // 保存已发送未确认的QoS1/2消息,相同报文标识覆盖
+	DeleteInflight(id string, messageId uint16) error        // 收到PUBACK/PUBCOMP后删除
+	Inflight(id string) ([]clients_dto.StoredMessage, error) // 按写入顺序返回客户端飞行中的消息
+	SaveRetained(m clients_dto.StoredMessage) error          // 保存保留消息,负载为空时删除该主题的保留消息
+	Retained() ([]clients_dto.StoredMessage, error)          // 返回全部保留消息
+	Close() error
+}
+
+// sessionState    内存中的持久会话与保留消息,与SessionStore保持一致
+type sessionState struct {
+	sessions map[string]*clients_dto.Session
+	retained map[string]clients_dto.StoredMessage
+}
+
+// loadSessions    Start时从SessionStore加载会话与保留消息,调用方需持有锁;上次运行时在线的会话从此时开始计算过期
+func (m *defaultClientManager) loadSessions() error {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+	m.session = sessionState{
+		sessions: map[string]*clients_dto.Session{},
+		retained: map[string]clients_dto.StoredMessage{},
+	}
+	st := m.options().SessionStore
+	if st == nil {
+		return nil
+	}
+	sessions, err := st.Sessions()
+	if err != nil {
+		return err
+	}
+	for i := range sessions {
+		if sessions[i].Subscriptions == nil {
+			sessions[i].Subscriptions = map[string]byte{}
+		}
+		if sessions[i].DisconnectedNano == 0 {
+			sessions[i].DisconnectedNano = time.Now().UnixNano()
+		}
+		m.session.sessions[sessions[i].ClientId] = &sessions[i]
+	}
+	retained, err := st.Retained()
+	if err != nil {
+		return err
+	}
+	for _, msg := range retained {
+		m.session.retained[msg.Topic] = msg
+	}
+	return nil
+}
+
+// openSession    清理会话的客户端删除旧会话,持久会话的客户端恢复或新建会话;返回CONNACK的SessionPresent,调用方需持有锁。
+// 只修改内存,存储的写入加入tasks,在锁外于该客户端的分发分片中执行
+func (m *defaultClientManager) openSession(client clientInterface, tasks *dispatchBatch) bool {
+	if m.options().SessionStore == nil {
+		return false
+	}
+	id := client.GetId()
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+	s, present := m.session.sessions[id]
+	switch {
+	case client.GetDataBase().CleanSession:
+		if !present {
+			return false
+		}
+		delete(m.session.sessions, id)
+	case present:
+		s.DisconnectedNano = 0
+	default:
+		m.session.sessions[id] = &clients_dto.Session{ClientId: id, Subscriptions: map[string]byte{}, CreatedNano: time.Now().UnixNano()}
+	}
+	tasks.add(id, func() { m.persistSession(id) })
+	return present && !client.GetDataBase().CleanSession
+}
+
+// closeSession    记录持久会话的断开时间,用于计算过期;调用方需持有锁
+func (m *defaultClientManager) closeSession(id string, tasks *dispatchBatch) {
+	if m.options().SessionStore == nil {
+		return
+	}
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+	if s, ok := m.session.sessions[id]; ok {
+		s.DisconnectedNano = time.Now().UnixNano()
+		tasks.add(id, func() { m.persistSession(id) })
+	}
+}
+
+// persistSession    把内存中的会话写入存储,会话已删除时从存储中删除;在该客户端的分发分片中执行,与同一客户端的其他存储写入保持顺序
+func (m *defaultClientManager) persistSession(id string) {
+	st := m.options().SessionStore
+	m.sessionMu.Lock()
+	s, ok := m.session.sessions[id]
+	var cp clients_dto.Session
+	if ok {
+		cp = *s
+		cp.Subscriptions = maps.Clone(s.Subscriptions)
+	}
+	m.sessionMu.Unlock()
+	if ok {
+		_ = st.SaveSession(cp)
+	} else {
+		_ = st.DeleteSession(id)
+	}
+}
+
+// startSessionExpiry    配置了SessionExpiry时启动过期检查,调用方需持有锁
+func (m *defaultClientManager) startSessionExpiry() {
+	opt := m.options()
+	if opt.SessionStore == nil || opt.SessionExpiry <= 0 {
+		return
+	}
+	m.expiryStop, m.expiryDone = make(chan struct{}), make(chan struct{})
+	go m.expireSessions(time.Duration(opt.SessionExpiry)*time.Second, m.expiryStop, m.expiryDone)
+}
+
+// stopSessionExpiry    通知过期检查退出,调用方需持有锁;返回的chan在检查协程退出后关闭,需在锁外等待
+func (m *defaultClientManager) stopSessionExpiry() chan struct{} {
+	if m.expiryStop == nil {
+		return nil
+	}
+	done := m.expiryDone
+	close(m.expiryStop)
+	m.expiryStop, m.expiryDone = nil, nil
+	return done
+}
+
+// expireSessions    定时删除离线超过SessionExpiry的持久会话,直到stopChan关闭
+func (m *defaultClientManager) expireSessions(expiry time.Duration, stopChan, done chan struct{}) {
+	defer close(done)
+	interval := min(expiry, sessionExpiryInterval)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-t.C:
+		}
+		deadline := time.Now().Add(-expiry).UnixNano()
+		var expired []string
+		m.sessionMu.Lock()
+		for id, s := range m.session.sessions {
+			if s.DisconnectedNano > 0 && s.DisconnectedNano <= deadline {
+				expired = append(expired, id)
+			}
+		}
+		m.sessionMu.Unlock()
+		m.mu.RLock()
+		d := m.dispatcher
+		m.mu.RUnlock()
+		for _, id := range expired {
+			d.dispatch(id, func() { m.expireSession(id, deadline) })
+		}
+	}
+}
+
+// expireSession    再次确认会话仍离线且已过期后删除;在该客户端的分发分片中执行
+func (m *defaultClientManager) expireSession(id string, deadline int64) {
+	m.sessionMu.Lock()
+	s, ok := m.session.sessions[id]
+	ok = ok && s.DisconnectedNano > 0 && s.DisconnectedNano <= deadline
+	if ok {
+		delete(m.session.sessions, id)
+	}
+	m.sessionMu.Unlock()
+	if !ok {
+		return
+	}
+	_ = m.options().SessionStore.DeleteSession(id)
+	m.log(slog.LevelInfo, "session expired", id)
+}
+
+// hasSession    id是否有持久会话
+func (m *defaultClientManager) hasSession(id string) bool {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+	_, ok := m.session.sessions[id]
+	return ok
+}
+
+// restoreSession    重发飞行中的消息(DUP),再发送离线期间排队的消息;在客户端的分发分片中执行
+func (m *defaultClientManager) restoreSession(client clientInterface) {
+	st := m.options().SessionStore
+	id := client.GetId()
+	m.sessionMu.Lock()
+	s, ok := m.session.sessions[id]
+	var filters []string
+	if ok {
+		for filter := range s.Subscriptions {
+			filters = append(filters, filter)
+		}
+	}
+	m.sessionMu.Unlock()
+	if !ok {
+		return
+	}
+	if cl := m.cluster; cl != nil && len(filters) > 0 {
+		cl.subscribe(id, filters)
+	}
+	inflight, _ := st.Inflight(id)
+	for _, msg := range inflight {
+		p := storedPublish(msg)
+		p.GetFixedHead().Dup = true
+		m.writeStored(client, p)
+	}
+	queued, _ := st.Dequeue(id)
+	hooks := m.hooks()
+	for _, msg := range queued {
+		// 排队时客户端离线,OnDeliver钩子在此执行;飞行中的消息已执行过
+		p := storedPublish(msg)
+		if hooks.OnDeliver(id, p) != nil {
+			continue
+		}
+		if msg.Qos > 0 {
+			msg.Topic, msg.Payload = p.TopicName, p.Payload
+			_ = st.SaveInflight(msg)
+		}
+		m.writeStored(client, p)
+	}
+}
+
+func (m *defaultClientManager) writeStored(client clientInterface, p *packets.PublishPacket) {
+	if e, err := encodePacket(p); err == nil {
+		client.enqueueEncoded(e)
+	}
+}
+
+// onSessionPacket    持久化订阅变更、保留消息及发送确认;在钩子之后执行
+func (m *defaultClientManager) onSessionPacket(id string, p mqtt_packet.ControlPacketInterface) {
+	st := m.options().SessionStore
+	switch packet := p.(type) {
+	case *packets.PublishPacket:
+		if !packet.GetFixedHead().Retain {
+			return
+		}
+		msg := clients_dto.StoredMessage{Topic: packet.TopicName, Payload: packet.Payload, Qos: packet.Qos(), Retain: true, Nano: time.Now().UnixNano()}
+		m.sessionMu.Lock()
+		if len(msg.Payload) == 0 {
+			delete(m.session.retained, msg.Topic)
+		} else {
+			m.session.retained[msg.Topic] = msg
+		}
+		_ = st.SaveRetained(msg)
+		m.sessionMu.Unlock()
+	case *packets.SubscribePacket:
+		m.sessionMu.Lock()
+		if s, ok := m.session.sessions[id]; ok {
+			for _, tf := range packet.List {
+				if tf != nil && tf.Qos <= 2 {
+					s.Subscriptions[tf.Topic] = tf.Qos
+				}
+			}
+			_ = st.SaveSession(*s)
+		}
+		m.sessionMu.Unlock()
+	case *packets.UnSubscribePacket:
+		m.sessionMu.Lock()
+		if s, ok := m.session.sessions[id]; ok {
+			for _, topic := range packet.Topics {
+				delete(s.Subscriptions, topic)
+			}
+			_ = st.SaveSession(*s)
+		}
+		m.sessionMu.Unlock()
+	case *packets.PubAckPacket:
+		_ = st.DeleteInflight(id, packet.MessageID)
+	case *packets.PubCompPacket:
+		_ = st.DeleteInflight(id, packet.MessageID)
+	}
+}
+
+// deliverRetained    订阅后按QoS0下发匹配的保留消息;在PacketCb之后执行,保证在SUBACK之后发送
+func (m *defaultClientManager) deliverRetained(id string, p *packets.SubscribePacket) {
+	m.sessionMu.Lock()
+	var list []clients_dto.StoredMessage
+	for _, msg := range m.session.retained {
+		for _, tf := range p.List {
+			if tf != nil && topicMatch(tf.Topic, msg.Topic) {
+				list = append(list, msg)
+				break
+			}
+		}
+	}
+	m.sessionMu.Unlock()
+	if len(list) == 0 {
+		return
+	}
+	m.mu.RLock()
+	client, ok := m.clientMap[id]
+	hooks := m.hooks()
+	m.mu.RUnlock()
+	if !ok {
+		return
+	}
+	for _, msg := range list {
+		rp := packets.NewPublish(nil)
+		rp.TopicName = msg.Topic
+		rp.Payload = msg.Payload
+		rp.GetFixedHead().Retain = true
+		m.deliverOnce(hooks, client, rp)
+	}
+}
+
+// storeOutgoing    发送给持久会话的QoS1/2消息:在线时记为飞行中,离线时排队;返回是否已排队
+func (m *defaultClientManager) storeOutgoing(id string, p mqtt_packet.ControlPacketInterface, online bool) bool {
+	st := m.options().SessionStore
+	packet, ok := p.(*packets.PublishPacket)
+	if st == nil || !ok || packet.Qos() == 0 || !m.hasSession(id) {
+		return false
+	}
+	msg := clients_dto.StoredMessage{
+		ClientId:  id,
+		Topic:     packet.TopicName,
+		Payload:   packet.Payload,
+		Qos:       packet.Qos(),
+		MessageId: packet.MessageID,
+		Nano:      time.Now().UnixNano(),
+	}
+	if online {
+		_ = st.SaveInflight(msg)
+		return false
+	}
+	return st.Enqueue(msg, m.options().MaxQueuedMessages) == nil
+}
+
+func storedPublish(msg clients_dto.StoredMessage) *packets.PublishPacket {
+	p := packets.NewPublish(nil)
+	p.TopicName = msg.Topic
+	p.Payload = msg.Payload
+	p.MessageID = msg.MessageId
+	p.GetFixedHead().Qos = msg.Qos
+	return p
+}
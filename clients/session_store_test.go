@@ -0,0 +1,94 @@
+package clients
+
+import (
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/store"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// slowStore    SaveSession阻塞直到release关闭
+type slowStore struct {
+	*store.FileStore
+	release chan struct{}
+}
+
+func (s *slowStore) SaveSession(session clients_dto.Session) error {
+	<-s.release
+	return s.FileStore.SaveSession(session)
+}
+
+func newTestStore(t *testing.T) *store.FileStore {
+	t.Helper()
+	st, err := store.NewFileStore(filepath.Join(t.TempDir(), "session.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = st.Close() })
+	return st
+}
+
+func storedSession(t *testing.T, st SessionStore, id string) (clients_dto.Session, bool) {
+	t.Helper()
+	list, err := st.Sessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range list {
+		if s.ClientId == id {
+			return s, true
+		}
+	}
+	return clients_dto.Session{}, false
+}
+
+// TestSessionStoreOutsideLock    存储写入缓慢时不阻塞管理器的锁
+func TestSessionStoreOutsideLock(t *testing.T) {
+	port := freePort(t)
+	st := &slowStore{FileStore: newTestStore(t), release: make(chan struct{})}
+	m := newClientManager(&ClientManagerOptions{TcpPort: port, SessionStore: st})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	defer close(st.release)
+	if _, code := dialConnect(t, port, connectPacket("s1", false)); code != 0 {
+		t.Fatalf("connack %d", code)
+	}
+	done := make(chan int)
+	go func() { done <- m.Len() }()
+	select {
+	case n := <-done:
+		if n != 1 {
+			t.Fatalf("len %d", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("manager lock is held while the session is saved")
+	}
+}
+
+// TestSessionExpiry    离线超过SessionExpiry的会话被删除,在线的会话保留
+func TestSessionExpiry(t *testing.T) {
+	port := freePort(t)
+	st := newTestStore(t)
+	m := newClientManager(&ClientManagerOptions{TcpPort: port, SessionStore: st, SessionExpiry: 1})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+	offline, _ := dialConnect(t, port, connectPacket("offline", false))
+	dialConnect(t, port, connectPacket("online", false))
+	_ = offline.Close()
+	waitFor(t, "disconnect to be persisted", func() bool {
+		s, ok := storedSession(t, st, "offline")
+		return ok && s.DisconnectedNano > 0
+	})
+	waitFor(t, "session to expire", func() bool {
+		_, ok := storedSession(t, st, "offline")
+		return !ok && !m.hasSession("offline")
+	})
+	if _, ok := storedSession(t, st, "online"); !ok || !m.hasSession("online") {
+		t.Fatal("online session is expired")
+	}
+}
@@ -0,0 +1,71 @@
+package clients
+
+import (
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"sync/atomic"
+)
+
+// connectInfo   握手时CONNECT报文中的链接参数
+type connectInfo struct {
+	protocolVersion byte
+	keepalive       uint16
+	cleanSession    bool
+	hasWill         bool
+	will            *clients_dto.StoredMessage
+	connect         *packets.ConnectPacket // 客户端发送的CONNECT报文(已清除密码),用于抓包
+}
+
+func newConnectInfo(p *packets.ConnectPacket) connectInfo {
+	return connectInfo{
+		protocolVersion: p.ProtocolVersion,
+		keepalive:       p.Keepalive,
+		cleanSession:    p.CleanSession,
+		hasWill:         p.WillFlag,
+		will:            willMessage(p),
+		connect:         withoutPassword(p),
+	}
+}
+
+func willMessage(p *packets.ConnectPacket) *clients_dto.StoredMessage {
+	if !p.WillFlag {
+		return nil
+	}
+	return &clients_dto.StoredMessage{
+		Topic:   p.WillTopic,
+		Payload: p.WillMessage,
+		Qos:     p.WillQos,
+		Retain:  p.WillRetain,
+	}
+}
+
+// withWillTopic    替换遗嘱主题,在客户端加入管理器之前调用
+func (ci *connectInfo) withWillTopic(topic string) {
+	if ci.will != nil {
+		w := *ci.will
+		w.Topic = topic
+		ci.will = &w
+	}
+}
+
+// packetCounter   按报文类型统计收发数量,下标为报文类型
+type packetCounter struct {
+	read  [16]uint64
+	write [16]uint64
+}
+
+func (pc *packetCounter) addRead(messageType byte) {
+	atomic.AddUint64(&pc.read[messageType&0x0F], 1)
+}
+
+func (pc *packetCounter) addWrite(messageType byte) {
+	atomic.AddUint64(&pc.write[messageType&0x0F], 1)
+}
+
+func (pc *packetCounter) load() (read, write [16]uint64) {
+	for i := range pc.read {
+		read[i] = atomic.LoadUint64(&pc.read[i])
+		write[i] = atomic.LoadUint64(&pc.write[i])
+	}
+	return
+}
@@ -0,0 +1,55 @@
+package clients
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestPacketCounters    按报文类型的收发数量始终统计,收发长度只在开启IsStatistics时统计
+func TestPacketCounters(t *testing.T) {
+	for _, statistics := range []bool{false, true} {
+		for _, websocket := range []bool{false, true} {
+			port, wsPort := freePort(t), freePort(t)
+			m, _, received := limitManager(t, &ClientManagerOptions{TcpPort: port, IsWebsocket: websocket, WebsocketPort: wsPort, IsStatistics: statistics})
+			var c net.Conn
+			if websocket {
+				var r *bufio.Reader
+				c, r = dialWebsocket(t, wsPort, nil)
+				wsConnect(t, c, r, "dev")
+			} else {
+				c, _ = dialMqtt(t, port, "dev", "")
+			}
+			for i := 0; i < 2; i++ {
+				e, _ := encodePacket(publishPacket("a", "x", 0, 0))
+				raw := e.raw
+				if websocket {
+					raw = wsFrame(true, 2, raw)
+				}
+				if _, err := c.Write(raw); err != nil {
+					t.Fatal(err)
+				}
+				select {
+				case <-received:
+				case <-time.After(5 * time.Second):
+					t.Fatal("publish is not received")
+				}
+			}
+			if _, err := m.SendPacketOnce("dev", publishPacket("b", "y", 0, 0)); err != nil {
+				t.Fatal(err)
+			}
+			db, err := m.GetOnce("dev")
+			if err != nil {
+				t.Fatal(err)
+			}
+			name := map[bool]string{false: "tcp", true: "websocket"}[websocket]
+			if db.ReadPackets[publishType] != 2 || db.WritePackets[publishType] != 1 {
+				t.Errorf("%s statistics %v: read %v, write %v", name, statistics, db.ReadPackets, db.WritePackets)
+			}
+			if (db.ReadLength > 0) != statistics || (db.WriteLength > 0) != statistics || db.IsStatistics != statistics {
+				t.Errorf("%s statistics %v: read length %d, write length %d", name, statistics, db.ReadLength, db.WriteLength)
+			}
+		}
+	}
+}
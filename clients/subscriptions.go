@@ -0,0 +1,126 @@
+package clients
+
+import (
+	"strings"
+)
+
+// subscriptions    本地客户端的订阅表,由cluster加锁访问
+type subscriptions struct {
+	clients map[string]map[string]struct{} // ClientId -> 主题过滤器
+	counts  map[string]int                 // 主题过滤器 -> 订阅的客户端数
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{
+		clients: map[string]map[string]struct{}{},
+		counts:  map[string]int{},
+	}
+}
+
+// add    添加订阅,返回新出现的主题过滤器
+func (s *subscriptions) add(id string, filters []string) []string {
+	var added []string
+	fs, ok := s.clients[id]
+	if !ok {
+		fs = map[string]struct{}{}
+		s.clients[id] = fs
+	}
+	for _, filter := range filters {
+		if _, ok := fs[filter]; ok || filter == "" {
+			continue
+		}
+		fs[filter] = struct{}{}
+		if s.counts[filter]++; s.counts[filter] == 1 {
+			added = append(added, filter)
+		}
+	}
+	return added
+}
+
+// remove    取消订阅,返回不再有订阅者的主题过滤器
+func (s *subscriptions) remove(id string, filters []string) []string {
+	var removed []string
+	fs, ok := s.clients[id]
+	if !ok {
+		return nil
+	}
+	for _, filter := range filters {
+		if _, ok := fs[filter]; !ok {
+			continue
+		}
+		delete(fs, filter)
+		if s.counts[filter]--; s.counts[filter] <= 0 {
+			delete(s.counts, filter)
+			removed = append(removed, filter)
+		}
+	}
+	if len(fs) == 0 {
+		delete(s.clients, id)
+	}
+	return removed
+}
+
+// removeClient    移除客户端的全部订阅
+func (s *subscriptions) removeClient(id string) []string {
+	var filters []string
+	for filter := range s.clients[id] {
+		filters = append(filters, filter)
+	}
+	return s.remove(id, filters)
+}
+
+// match    返回订阅了topic的ClientId
+func (s *subscriptions) match(topic string) []string {
+	var ids []string
+	for id, fs := range s.clients {
+		for filter := range fs {
+			if topicMatch(filter, topic) {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	return ids
+}
+
+func (s *subscriptions) filters() []string {
+	filters := make([]string, 0, len(s.counts))
+	for filter := range s.counts {
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+// topicMatch    主题过滤器匹配,支持+与#通配符;通配符不匹配以$开头的主题
+func topicMatch(filter, topic string) bool {
+	if filter == topic {
+		return true
+	}
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return i == len(fs)-1
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
+
+// matchAny    任一主题过滤器匹配topic
+func matchAny(filters map[string]struct{}, topic string) bool {
+	for filter := range filters {
+		if topicMatch(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
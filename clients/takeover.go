@@ -0,0 +1,102 @@
+package clients
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFlapWindow  = 60
+	defaultFlapBanTime = 300
+	flapSweepSize      = 10000 // 记录数超过该值时清理过期记录
+)
+
+// flapDetector   接管抖动检测:同一ClientId在窗口内被接管次数过多时临时封禁
+type flapDetector struct {
+	mu   sync.Mutex
+	hits map[string][]int64 // 接管时间
+	bans map[string]int64   // 封禁截止时间
+}
+
+func newFlapDetector() *flapDetector {
+	return &flapDetector{
+		hits: map[string][]int64{},
+		bans: map[string]int64{},
+	}
+}
+
+// isBanned    id是否处于封禁期
+func (f *flapDetector) isBanned(id string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	until, ok := f.bans[id]
+	if !ok {
+		return false
+	}
+	if time.Now().UnixNano() >= until {
+		delete(f.bans, id)
+		return false
+	}
+	return true
+}
+
+// takeover    记录一次接管,达到阈值时封禁并返回true
+func (f *flapDetector) takeover(id string, threshold int, window, banTime time.Duration) bool {
+	if threshold <= 0 {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now().UnixNano()
+	hits := pruneHits(f.hits[id], now-int64(window))
+	hits = append(hits, now)
+	if len(hits) >= threshold {
+		delete(f.hits, id)
+		f.bans[id] = now + int64(banTime)
+		return true
+	}
+	f.hits[id] = hits
+	if len(f.hits) > flapSweepSize {
+		f.sweep(now, int64(window))
+	}
+	return false
+}
+
+// sweep    清理过期的接管记录与封禁,调用方需持有锁
+func (f *flapDetector) sweep(now, window int64) {
+	for id, hits := range f.hits {
+		if hits = pruneHits(hits, now-window); len(hits) == 0 {
+			delete(f.hits, id)
+		} else {
+			f.hits[id] = hits
+		}
+	}
+	for id, until := range f.bans {
+		if now >= until {
+			delete(f.bans, id)
+		}
+	}
+}
+
+func pruneHits(hits []int64, since int64) []int64 {
+	i := 0
+	for i < len(hits) && hits[i] < since {
+		i++
+	}
+	return hits[i:]
+}
+
+// suffixId    AllowBothPolicy下为重复的ClientId加上"-n"后缀,生成本节点与集群中都未被占用的ClientId;
+// 后缀后的ClientId不符合ClientIdRule时返回错误,调用方需持有锁
+func (m *defaultClientManager) suffixId(id string) (string, error) {
+	for n := 2; ; n++ {
+		newId := id + "-" + strconv.Itoa(n)
+		if err := m.options().ClientIdRule.check(newId); err != nil {
+			return "", err
+		}
+		if _, ok := m.clientMap[newId]; !ok && m.cluster.owner(newId) == "" {
+			return newId, nil
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package clients
+
+import (
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"testing"
+	"time"
+)
+
+func TestTakeoverKickOld(t *testing.T) {
+	port := freePort(t)
+	m, disconnected, _ := limitManager(t, &ClientManagerOptions{TcpPort: port})
+	old, _ := dialMqtt(t, port, "dev", "")
+	if _, code := dialMqtt(t, port, "dev", ""); code != 0 {
+		t.Fatalf("new client code %d", code)
+	}
+	waitDisconnect(t, disconnected, enmu.ClientTakeoverError)
+	if _, err := readPacket(old, 5*time.Second); err == nil {
+		t.Fatal("old connection is not closed")
+	}
+	if n := m.Len(); n != 1 {
+		t.Fatalf("clients %d", n)
+	}
+}
+
+func TestTakeoverRejectNew(t *testing.T) {
+	port := freePort(t)
+	m, _, _ := limitManager(t, &ClientManagerOptions{TcpPort: port, TakeoverPolicy: enmu.RejectNewPolicy})
+	dialMqtt(t, port, "dev", "")
+	if _, code := dialMqtt(t, port, "dev", ""); code != byte(enmu.IdError) {
+		t.Fatalf("new client code %d", code)
+	}
+	if n := m.Len(); n != 1 {
+		t.Fatalf("clients %d", n)
+	}
+}
+
+// TestTakeoverAllowBoth    重复的ClientId依次加上-2,-3后缀;加后缀后不符合ClientIdRule时拒绝
+func TestTakeoverAllowBoth(t *testing.T) {
+	port := freePort(t)
+	m, _, _ := limitManager(t, &ClientManagerOptions{TcpPort: port, TakeoverPolicy: enmu.AllowBothPolicy})
+	for i := 0; i < 3; i++ {
+		if _, code := dialMqtt(t, port, "dev", ""); code != 0 {
+			t.Fatalf("client %d code %d", i, code)
+		}
+	}
+	for _, id := range []string{"dev", "dev-2", "dev-3"} {
+		if _, err := m.GetOnce(id); err != nil {
+			t.Fatalf("%s: %v", id, err)
+		}
+	}
+
+	cases := []struct {
+		name string
+		rule ClientIdRule
+	}{
+		{"charset", ClientIdRule{Charset: "abcdefghijklmnopqrstuvwxyz0123456789"}},
+		{"max length", ClientIdRule{MaxLength: 3}},
+		{"pattern", ClientIdRule{Pattern: "^[a-z]+$"}},
+	}
+	for _, c := range cases {
+		port = freePort(t)
+		rule := c.rule
+		m, _, _ = limitManager(t, &ClientManagerOptions{TcpPort: port, TakeoverPolicy: enmu.AllowBothPolicy, ClientIdRule: &rule})
+		if _, code := dialMqtt(t, port, "dev", ""); code != 0 {
+			t.Fatalf("%s: first client code %d", c.name, code)
+		}
+		if _, code := dialMqtt(t, port, "dev", ""); code != byte(enmu.IdError) {
+			t.Fatalf("%s: suffixed client code %d", c.name, code)
+		}
+		if n := m.Len(); n != 1 {
+			t.Fatalf("%s: clients %d", c.name, n)
+		}
+	}
+}
+
+// TestTakeoverFlapBan    窗口内接管次数达到FlapThreshold时封禁,封禁期间的链接回复ServeError,其他ClientId不受影响
+func TestTakeoverFlapBan(t *testing.T) {
+	port := freePort(t)
+	limitManager(t, &ClientManagerOptions{TcpPort: port, FlapThreshold: 3})
+	for i := 0; i < 3; i++ {
+		if _, code := dialMqtt(t, port, "dev", ""); code != 0 {
+			t.Fatalf("connection %d code %d", i, code)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, code := dialMqtt(t, port, "dev", ""); code != byte(enmu.ServeError) {
+			t.Fatalf("banned connection %d code %d", i, code)
+		}
+	}
+	if _, code := dialMqtt(t, port, "other", ""); code != 0 {
+		t.Fatalf("other client code %d", code)
+	}
+}
+
+func TestFlapDetector(t *testing.T) {
+	f := newFlapDetector()
+	if f.takeover("a", 0, time.Minute, time.Minute) || f.takeover("a", 0, time.Minute, time.Minute) {
+		t.Fatal("threshold 0 bans")
+	}
+	// 窗口外的接管不计数
+	if f.takeover("a", 2, time.Millisecond, time.Minute) {
+		t.Fatal("first takeover bans")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if f.takeover("a", 2, time.Millisecond, time.Minute) || f.isBanned("a") {
+		t.Fatal("takeover outside the window is counted")
+	}
+	if !f.takeover("a", 2, time.Minute, 20*time.Millisecond) || !f.isBanned("a") {
+		t.Fatal("not banned at threshold")
+	}
+	if f.isBanned("b") {
+		t.Fatal("other id is banned")
+	}
+	time.Sleep(30 * time.Millisecond)
+	if f.isBanned("a") {
+		t.Fatal("ban does not expire")
+	}
+}
+
+// TestClusterTakeoverOrder    两个节点同时接入相同ClientId时,接入时间较晚者保留,时间相同时节点Id较大者保留
+func TestClusterTakeoverOrder(t *testing.T) {
+	m, port, _ := clusterNode(t, "b", secretAuth)
+	dialMqtt(t, port, "dev", "")
+	cases := []struct {
+		node  string
+		delta int64 // 对端接入时间与本地接入时间之差
+		kick  bool
+	}{
+		{"a", -1, false},
+		{"c", -1, false},
+		{"a", 0, false},
+		{"c", 0, true},
+		{"a", 1, true},
+	}
+	for _, c := range cases {
+		db, err := m.GetOnce("dev")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kicked := m.clusterTakeover("dev", c.node, db.ConnectedNano+c.delta); kicked != c.kick {
+			t.Fatalf("%s at %+d: kicked %v, want %v", c.node, c.delta, kicked, c.kick)
+		}
+		if _, err = m.GetOnce("dev"); (err != nil) != c.kick {
+			t.Fatalf("%s at %+d: local client %v", c.node, c.delta, err)
+		}
+		if c.kick {
+			dialMqtt(t, port, "dev", "")
+		}
+	}
+	// 对端未带接入时间时按对端较新处理
+	if !m.clusterTakeover("dev", "a", 0) {
+		t.Fatal("claim without connect time is ignored")
+	}
+}
@@ -6,26 +6,41 @@ import (
 	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
 	"github.com/qdmc/mqtt_single_proxy/enmu"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type tcpClient struct {
-	id            string
-	status        bool
-	disConnectCb  DisConnectCallbackHandle
-	packetCb      PacketCallbackHandle
-	connectedNano int64   // 链接开始时间
-	closeNano     int64   // 链接断开时间
-	writeLength   *uint64 // 发送的数据长度
-	readLength    *uint64 // 接收的数据长度
-	isStatistics  bool    // 是否开启流量统计,默认为false
-	e             error
-	isNoCb        bool
-	conn          net.Conn
-	stopChan      chan struct{}
-	tr            *time.Timer
-	t             time.Duration
+	id             string
+	status         atomic.Bool
+	disConnectCb   DisConnectCallbackHandle
+	packetCb       PacketCallbackHandle
+	connectedNano  int64   // 链接开始时间
+	closeNano      int64   // 链接断开时间
+	writeLength    *uint64 // 发送的数据长度
+	readLength     *uint64 // 接收的数据长度
+	isStatistics   bool    // 是否开启流量统计,默认为false
+	errMu          sync.Mutex
+	e              error // 断开原因,读协程与断开时写入、其他协程读取,由errMu保护
+	isNoCb         atomic.Bool
+	conn           net.Conn
+	stopChan       chan struct{}
+	tr             *time.Timer
+	t              time.Duration
+	maxPacketSize  int // 报文最大长度
+	wq             *writeQueue
+	closeOnce      sync.Once
+	doneChan       chan struct{} // 读协程退出后关闭
+	userName       string
+	tagsMu         sync.RWMutex
+	tags           map[string]string
+	info           connectInfo
+	counter        packetCounter
+	lastActiveNano int64
+	tap            atomic.Pointer[capture] // 抓包,未抓包时为nil
+	arrival        arrivalReader           // 读取报文并记录首字节到达时间
+	v5             *mqtt5Conn              // MQTT 5报文转换,3.1.1客户端为nil
 }
 
 func (c *tcpClient) GetId() string {
@@ -33,27 +48,64 @@ func (c *tcpClient) GetId() string {
 }
 
 func (c *tcpClient) GetDataBase() clients_dto.ConnectionDatabase {
+	read, write := c.counter.load()
 	return clients_dto.ConnectionDatabase{
-		Id:            c.id,
-		Protocol:      c.GetProtocol(),
-		ConnectedNano: c.connectedNano,
-		CloseNano:     c.closeNano,
-		WriteLength:   atomic.LoadUint64(c.writeLength),
-		ReadLength:    atomic.LoadUint64(c.readLength),
-		Status:        c.status,
-		IsStatistics:  c.isStatistics,
-		Err:           c.e,
+		Id:              c.id,
+		Protocol:        c.GetProtocol(),
+		ConnectedNano:   c.connectedNano,
+		CloseNano:       atomic.LoadInt64(&c.closeNano),
+		WriteLength:     atomic.LoadUint64(c.writeLength),
+		ReadLength:      atomic.LoadUint64(c.readLength),
+		Status:          c.status.Load(),
+		IsStatistics:    c.isStatistics,
+		Err:             c.getErr(),
+		UserName:        c.userName,
+		Addr:            c.conn.RemoteAddr(),
+		Tags:            c.GetTags(),
+		ProtocolVersion: c.info.protocolVersion,
+		Keepalive:       c.info.keepalive,
+		CleanSession:    c.info.cleanSession,
+		HasWill:         c.info.hasWill,
+		Will:            c.info.will,
+		Subprotocol:     "",
+		LastActiveNano:  atomic.LoadInt64(&c.lastActiveNano),
+		ReadPackets:     read,
+		WritePackets:    write,
+	}
+}
+
+func (c *tcpClient) GetTags() map[string]string {
+	c.tagsMu.RLock()
+	defer c.tagsMu.RUnlock()
+	if c.tags == nil {
+		return nil
+	}
+	tags := make(map[string]string, len(c.tags))
+	for k, v := range c.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+func (c *tcpClient) SetTags(tags map[string]string) {
+	c.tagsMu.Lock()
+	defer c.tagsMu.Unlock()
+	c.tags = make(map[string]string, len(tags))
+	for k, v := range tags {
+		c.tags[k] = v
 	}
 }
 
 func (c *tcpClient) AsyncDoConnection() {
-	c.status = true
+	c.status.Store(true)
 	var err error
 	defer func() {
-		c.status = false
-		c.closeNano = time.Now().UnixNano()
+		c.status.Store(false)
+		atomic.StoreInt64(&c.closeNano, time.Now().UnixNano())
 		c.doDisconnect(err)
+		close(c.doneChan)
 	}()
+	c.wq.start()
 	c.tr = time.NewTimer(c.t)
 	for {
 		select {
@@ -64,89 +116,230 @@ func (c *tcpClient) AsyncDoConnection() {
 			err = enmu.ClientHeartTimeoutError
 			return
 		default:
-			readLen, p, readErr := mqtt_packet.ReadOnce(c.conn)
+			c.arrival.next()
+			readLen, p, readErr := readPacketWithLimit(&c.arrival, c.maxPacketSize, c.v5)
 			if readErr != nil {
-				err = enmu.ClientReadConnectionError
+				if readErr == enmu.PacketTooLargeError || readErr == enmu.PacketRemainingLengthError {
+					err = readErr
+				} else if !c.isStopped() {
+					err = enmu.ClientReadConnectionError
+				}
 				return
 			}
 			c.tr.Reset(c.t)
+			atomic.StoreInt64(&c.lastActiveNano, time.Now().UnixNano())
 			if c.isStatistics {
 				atomic.AddUint64(c.readLength, uint64(readLen))
 			}
-			go c.doPacket(p)
+			c.doPacket(p)
 			continue
 		}
 	}
 }
 func (c *tcpClient) SetTimeOut(t int64) {
-	if !c.status {
+	if !c.status.Load() {
 		if t >= 10 && t <= 300 {
 			c.t = time.Duration(t) * time.Second
 		}
 	}
 }
 func (c *tcpClient) SetStatistics(b bool) {
-	if !c.status {
+	if !c.status.Load() {
 		c.isStatistics = b
 	}
 }
 
+func (c *tcpClient) SetMaxPacketSize(packetSize, _ int) {
+	if !c.status.Load() && packetSize > 0 {
+		c.maxPacketSize = packetSize
+	}
+}
+
 func (c *tcpClient) SetPacketHandle(handle PacketCallbackHandle) {
-	if !c.status {
+	if !c.status.Load() {
 		c.packetCb = handle
 	}
 }
 
 func (c *tcpClient) SetDisConnectCallback(handle DisConnectCallbackHandle) {
-	if !c.status {
+	if !c.status.Load() {
 		c.disConnectCb = handle
 	}
 }
 
 func (c *tcpClient) DisConnect(isNoCb ...bool) {
 	if isNoCb != nil && len(isNoCb) == 1 && isNoCb[0] {
-		c.isNoCb = true
+		c.isNoCb.Store(true)
 	}
-	close(c.stopChan)
+	c.closeOnce.Do(func() {
+		close(c.stopChan)
+		// 中断阻塞中的读取
+		_ = c.conn.SetReadDeadline(time.Now())
+	})
+}
+
+func (c *tcpClient) setErr(err error) {
+	c.errMu.Lock()
+	c.e = err
+	c.errMu.Unlock()
+}
+
+func (c *tcpClient) getErr() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.e
+}
+
+// disConnectWithError    记录错误后断开链接
+func (c *tcpClient) disConnectWithError(err error) {
+	c.closeOnce.Do(func() {
+		c.setErr(err)
+		close(c.stopChan)
+		_ = c.conn.SetReadDeadline(time.Now())
+	})
+}
+
+func (c *tcpClient) Shutdown() {
+	c.wq.setFlush()
+	c.AsyncWritePacket(packets.NewDisconnect(nil))
+	c.DisConnect()
+}
+
+func (c *tcpClient) ForceClose() {
+	c.DisConnect()
+	_ = c.conn.Close()
+}
+
+func (c *tcpClient) Done() <-chan struct{} {
+	return c.doneChan
+}
+
+// writeConnAck    回复CONNACK,需在AsyncDoConnection之前调用
+func (c *tcpClient) writeConnAck(code enmu.HandshakeResult, sessionPresent bool) error {
+	if cp := c.tap.Load(); cp != nil {
+		cp.record(c.id, enmu.OutboundCapture, connAckBytes(code, sessionPresent, mqtt311Version, ""))
+	}
+	return writeHandshakeBytes(c.conn, connAckBytes(code, sessionPresent, c.info.protocolVersion, assignedClientId(c.id, c.info)))
+}
+
+// setId    修改ClientId,需在AsyncDoConnection之前调用
+func (c *tcpClient) setId(id string) {
+	if !c.status.Load() {
+		c.id = id
+	}
+}
+
+func (c *tcpClient) setCapture(cp *capture) {
+	c.tap.Store(cp)
+}
+
+func (c *tcpClient) connectPacket() *packets.ConnectPacket {
+	return c.info.connect
+}
+
+func (c *tcpClient) userProperties() userProperties {
+	return c.v5.userProperties()
+}
+
+func (c *tcpClient) arrivalNano() int64 {
+	return c.arrival.nano
+}
+
+func (c *tcpClient) setWillTopic(topic string) {
+	c.info.withWillTopic(topic)
+}
+
+func (c *tcpClient) isStopped() bool {
+	select {
+	case <-c.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *tcpClient) SetWriteQueue(size int, policy enmu.QueueFullPolicy, timeout int64) {
+	if !c.status.Load() {
+		if timeout <= 0 {
+			timeout = defaultWriteTimeOut
+		}
+		c.wq = newWriteQueue(c.conn, size, policy, time.Duration(timeout)*time.Second)
+		c.initWriteQueue()
+	}
+}
+
+func (c *tcpClient) initWriteQueue() {
+	c.wq.onWrite = func(n int, messageType byte) {
+		if c.isStatistics {
+			atomic.AddUint64(c.writeLength, uint64(n))
+		}
+		if messageType != 0 {
+			c.counter.addWrite(messageType)
+		}
+	}
+	c.wq.onError = c.disConnectWithError
 }
 
 func (c *tcpClient) GetProtocol() enmu.ClientProtocol {
 	return enmu.TcpProtocol
 }
 func (c *tcpClient) WritePacketOnce(p mqtt_packet.ControlPacketInterface) (int64, error) {
+	res := <-c.AsyncWritePacket(p)
+	return res.Length, res.Err
+}
+
+func (c *tcpClient) AsyncWritePacket(p mqtt_packet.ControlPacketInterface) <-chan clients_dto.SendResult {
 	if p == nil {
-		return 0, enmu.PacketEmptyError
+		return sendResultChan(0, enmu.PacketEmptyError)
 	}
-	if c.status {
-		length, err := p.Write(c.conn)
-		if err != nil {
-			return 0, err
-		}
-		if c.isStatistics {
-			atomic.AddUint64(c.writeLength, uint64(length))
-		}
-		return length, nil
-	} else {
-		return 0, enmu.ClientDisconnectError
+	e, err := encodePacket(p)
+	if err != nil {
+		return sendResultChan(0, err)
 	}
+	return c.asyncWriteEncoded(e)
+}
+
+func (c *tcpClient) asyncWriteEncoded(e *encodedPacket) <-chan clients_dto.SendResult {
+	if !c.status.Load() {
+		return sendResultChan(0, enmu.ClientDisconnectError)
+	}
+	return c.enqueueEncoded(e)
+}
+
+// enqueueEncoded    不检查链接状态直接入队,用于链接开始前恢复会话消息
+func (c *tcpClient) enqueueEncoded(e *encodedPacket) <-chan clients_dto.SendResult {
+	if cp := c.tap.Load(); cp != nil {
+		cp.record(c.id, enmu.OutboundCapture, e.raw)
+	}
+	return c.wq.push(c.v5.outbound(e), e.raw[0]>>4)
 }
 func (c *tcpClient) doPacket(p mqtt_packet.ControlPacketInterface) {
+	_, isPublish := p.(*packets.PublishPacket)
+	c.v5.next(isPublish)
+	if p != nil {
+		c.counter.addRead(byte(p.MessageType()))
+	}
+	if cp := c.tap.Load(); cp != nil && p != nil {
+		cp.recordPacket(c.id, enmu.InboundCapture, p)
+	}
 	if p == nil || c.packetCb == nil {
 		return
 	}
-	go c.packetCb(c.id, p)
+	c.packetCb(c.id, p)
 }
 
 func (c *tcpClient) doDisconnect(err error) {
 	if err != nil {
-		c.e = err
+		c.setErr(err)
 	}
 	if c.tr != nil {
 		c.tr.Stop()
 	}
-	if !c.isNoCb && c.disConnectCb != nil {
+	c.wq.stop()
+	_ = c.conn.Close()
+	if !c.isNoCb.Load() && c.disConnectCb != nil {
 		db := c.GetDataBase()
-		go c.disConnectCb(&db)
+		c.disConnectCb(&db)
 	}
 }
 
@@ -156,23 +349,30 @@ func newTcpClient(id string, conn net.Conn, statistics ...bool) *tcpClient {
 		isStatistics = true
 	}
 	var rl, wl uint64
-	return &tcpClient{
-		id:            id,
-		status:        false,
-		disConnectCb:  nil,
-		packetCb:      nil,
-		connectedNano: time.Now().UnixNano(),
-		closeNano:     0,
-		writeLength:   &wl,
-		readLength:    &rl,
-		isStatistics:  isStatistics,
-		conn:          conn,
-		stopChan:      make(chan struct{}, 1),
-		t:             time.Duration(60) * time.Second,
-	}
-}
-func handshakeTcp(c net.Conn, handle HandshakeHandle, handshakeTime int64) (*tcpClient, error) {
+	c := &tcpClient{
+		id:             id,
+		disConnectCb:   nil,
+		packetCb:       nil,
+		connectedNano:  time.Now().UnixNano(),
+		lastActiveNano: time.Now().UnixNano(),
+		closeNano:      0,
+		writeLength:    &wl,
+		readLength:     &rl,
+		isStatistics:   isStatistics,
+		conn:           conn,
+		stopChan:       make(chan struct{}, 1),
+		doneChan:       make(chan struct{}),
+		t:              time.Duration(60) * time.Second,
+		maxPacketSize:  defaultMaxPacketSize,
+	}
+	c.arrival.r = conn
+	c.wq = newWriteQueue(conn, defaultWriteQueueSize, enmu.BlockPolicy, defaultWriteTimeOut*time.Second)
+	c.initWriteQueue()
+	return c
+}
+func handshakeTcp(c net.Conn, opt *ClientManagerOptions) (*tcpClient, error) {
 	var err error
+	handshakeTime := opt.MaxHandshakeTime
 	if handshakeTime <= 0 {
 		handshakeTime = 10
 	}
@@ -180,7 +380,7 @@ func handshakeTcp(c net.Conn, handle HandshakeHandle, handshakeTime int64) (*tcp
 	if err != nil {
 		return nil, err
 	}
-	_, p, err := mqtt_packet.ReadOnce(c)
+	_, p, err := readPacketWithLimit(c, opt.MaxPacketSize, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -188,21 +388,20 @@ func handshakeTcp(c net.Conn, handle HandshakeHandle, handshakeTime int64) (*tcp
 	if !ok {
 		return nil, enmu.NotConnectPacketError
 	}
-	if handle != nil {
-		hd := clients_dto.ConnectionHandshakeDatabase{
-			ClientId: packet.ClientIdentifier,
-			UserName: packet.Username,
-			Password: string(packet.Password),
-			Addr:     c.RemoteAddr(),
-		}
-		res := handle(hd)
-		if res != enmu.Success {
-			return nil, enmu.ClienthHandshakeFaild
-		}
+	hd, res := checkConnect(c.RemoteAddr(), nil, packet, opt)
+	if res != enmu.Success {
+		_ = writeHandshakeBytes(c, connAckBytes(res, false, packet.ProtocolVersion, ""))
+		return nil, enmu.ClienthHandshakeFaild
 	}
 	err = c.SetDeadline(time.Time{})
 	if err != nil {
 		return nil, err
 	}
-	return newTcpClient(packet.ClientIdentifier, c), nil
+	client := newTcpClient(hd.ClientId, c)
+	client.userName = hd.UserName
+	client.info = newConnectInfo(packet)
+	client.v5 = newMqtt5Conn(packet.ProtocolVersion)
+	client.SetMaxPacketSize(opt.MaxPacketSize, opt.MaxMessageSize)
+	client.SetWriteQueue(opt.WriteQueueSize, opt.QueueFullPolicy, opt.WriteTimeOut)
+	return client, nil
 }
@@ -0,0 +1,195 @@
+package clients
+
+import (
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"github.com/qdmc/mqtt_single_proxy/rules"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// TopicMapping    主题映射:入站时先按Rewrites改写再加上挂载点,出站时去掉挂载点再改写。
+// 钩子、规则、会话、集群与回调看到的都是加上挂载点后的主题;不在客户端挂载点下的消息不下发给该客户端,
+// 因此不同挂载点的客户端(含通配符订阅、保留消息与遗嘱)相互隔离
+type TopicMapping struct {
+	MountPoint string         // 挂载点模板,如:tenants/${username}/;需以/结尾,支持${username}与${clientid},为空时不挂载;变量为空或含有/、+、#时拒绝链接
+	Rewrites   []TopicRewrite // 改写规则,同一方向按顺序匹配,第一条匹配的规则生效
+}
+
+// TopicRewrite    正则改写规则,作用于客户端看到的主题与订阅过滤器(挂载点之外的部分)
+type TopicRewrite struct {
+	Direction enmu.TopicDirection // 改写方向,默认:enmu.BothTopic
+	Filter    string              // 只改写匹配该过滤器的主题,为空时不限制
+	Pattern   string              // 正则表达式,需完整匹配
+	Replace   string              // 替换内容,支持$1等分组引用
+	pattern   *regexp.Regexp
+}
+
+// compile   校验挂载点并编译正则,在Start与ReloadOptions时调用;
+// 挂载点不以/结尾时一个挂载点可能是另一个的前缀(如alice与alice2),因此拒绝
+func (t *TopicMapping) compile() error {
+	if t == nil {
+		return nil
+	}
+	if t.MountPoint != "" && (!strings.HasSuffix(t.MountPoint, "/") || strings.ContainsAny(t.MountPoint, "+#")) {
+		return enmu.TopicMountPointError
+	}
+	for i := range t.Rewrites {
+		r := &t.Rewrites[i]
+		pattern, err := regexp.Compile("^(?:" + r.Pattern + ")$")
+		if err != nil {
+			return err
+		}
+		r.pattern = pattern
+	}
+	return nil
+}
+
+// mountPoint    按模板生成客户端的挂载点;模板中的变量为空或含有/、+、#时返回false,避免挂载点之间相互包含
+func (t *TopicMapping) mountPoint(id, userName string) (string, bool) {
+	if t == nil || t.MountPoint == "" {
+		return "", true
+	}
+	if (strings.Contains(t.MountPoint, "${username}") && !mountable(userName)) || (strings.Contains(t.MountPoint, "${clientid}") && !mountable(id)) {
+		return "", false
+	}
+	return strings.NewReplacer("${username}", userName, "${clientid}", id).Replace(t.MountPoint), true
+}
+
+func (t *TopicMapping) rewrite(direction enmu.TopicDirection, topic string) string {
+	for _, r := range t.Rewrites {
+		if r.Direction != "" && r.Direction != enmu.BothTopic && r.Direction != direction {
+			continue
+		}
+		if r.pattern == nil || (r.Filter != "" && !rules.MatchTopic(r.Filter, topic)) || !r.pattern.MatchString(topic) {
+			continue
+		}
+		return r.pattern.ReplaceAllString(topic, r.Replace)
+	}
+	return topic
+}
+
+func mountable(s string) bool {
+	return s != "" && !strings.ContainsAny(s, "/+#")
+}
+
+// ingress    客户端主题 -> 内部主题
+func (t *TopicMapping) ingress(mount, topic string) string {
+	return mount + t.rewrite(enmu.IngressTopic, topic)
+}
+
+// egress    内部主题 -> 客户端主题;不在挂载点下时返回false
+func (t *TopicMapping) egress(mount, topic string) (string, bool) {
+	if !strings.HasPrefix(topic, mount) {
+		return "", false
+	}
+	return t.rewrite(enmu.EgressTopic, topic[len(mount):]), true
+}
+
+// topicMounts    在线客户端的挂载点,ClientId -> 挂载点;单独加锁,钩子中不需要管理器的锁
+type topicMounts struct {
+	mu     sync.RWMutex
+	mounts map[string]string
+}
+
+func newTopicMounts() *topicMounts {
+	return &topicMounts{mounts: map[string]string{}}
+}
+
+func (tm *topicMounts) get(id string) string {
+	tm.mu.RLock()
+	defer tm.mu.RUnlock()
+	return tm.mounts[id]
+}
+
+func (tm *topicMounts) set(id, mount string) {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	if mount == "" {
+		delete(tm.mounts, id)
+		return
+	}
+	tm.mounts[id] = mount
+}
+
+// mountPointOf    客户端的挂载点;无法生成挂载点时返回false
+func (m *defaultClientManager) mountPointOf(client clientInterface) (string, bool) {
+	db := client.GetDataBase()
+	return m.options().TopicMapping.mountPoint(db.Id, db.UserName)
+}
+
+// mountClient    记录客户端的挂载点并映射遗嘱主题,在客户端加入管理器之前调用
+func (m *defaultClientManager) mountClient(client clientInterface, mount string) {
+	mapping := m.options().TopicMapping
+	m.mounts.set(client.GetId(), mount)
+	if will := client.GetDataBase().Will; mapping != nil && will != nil {
+		client.setWillTopic(mapping.ingress(mount, will.Topic))
+	}
+}
+
+// hooks    生命周期钩子;配置了TopicMapping时入站映射在用户钩子之前,出站映射在用户钩子之后
+func (m *defaultClientManager) hooks() hooksChain {
+	opt := m.options()
+	if opt.TopicMapping == nil {
+		return hooksChain(opt.Hooks)
+	}
+	hs := make(hooksChain, 0, len(opt.Hooks)+2)
+	hs = append(hs, topicIngressHooks{m: m})
+	hs = append(hs, opt.Hooks...)
+	return append(hs, topicEgressHooks{m: m})
+}
+
+// topicIngressHooks    把客户端的主题与过滤器映射为内部主题
+type topicIngressHooks struct {
+	HooksBase
+	m *defaultClientManager
+}
+
+func (h topicIngressHooks) OnPublish(id string, p *packets.PublishPacket) error {
+	if mapping := h.m.options().TopicMapping; mapping != nil {
+		p.TopicName = mapping.ingress(h.m.mounts.get(id), p.TopicName)
+	}
+	return nil
+}
+
+func (h topicIngressHooks) OnSubscribe(id string, p *packets.SubscribePacket) error {
+	if mapping := h.m.options().TopicMapping; mapping != nil {
+		mount := h.m.mounts.get(id)
+		for _, tf := range p.List {
+			if tf != nil {
+				tf.Topic = mapping.ingress(mount, tf.Topic)
+			}
+		}
+	}
+	return nil
+}
+
+func (h topicIngressHooks) OnUnsubscribe(id string, p *packets.UnSubscribePacket) error {
+	if mapping := h.m.options().TopicMapping; mapping != nil {
+		mount := h.m.mounts.get(id)
+		for i, topic := range p.Topics {
+			p.Topics[i] = mapping.ingress(mount, topic)
+		}
+	}
+	return nil
+}
+
+// topicEgressHooks    把内部主题映射回客户端的主题,不在挂载点下的消息返回enmu.TopicMountError
+type topicEgressHooks struct {
+	HooksBase
+	m *defaultClientManager
+}
+
+func (h topicEgressHooks) OnDeliver(id string, p *packets.PublishPacket) error {
+	mapping := h.m.options().TopicMapping
+	if mapping == nil {
+		return nil
+	}
+	topic, ok := mapping.egress(h.m.mounts.get(id), p.TopicName)
+	if !ok {
+		return enmu.TopicMountError
+	}
+	p.TopicName = topic
+	return nil
+}
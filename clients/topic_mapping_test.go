@@ -0,0 +1,38 @@
+package clients
+
+import (
+	"errors"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"testing"
+)
+
+func TestTopicMappingRejectsMountPoint(t *testing.T) {
+	for _, mount := range []string{"tenants/${username}", "${clientid}", "tenants/+/${username}/", "a/#/"} {
+		mapping := &TopicMapping{MountPoint: mount}
+		if err := mapping.compile(); !errors.Is(err, enmu.TopicMountPointError) {
+			t.Fatalf("mount point %q: compile returned %v", mount, err)
+		}
+	}
+	for _, mount := range []string{"", "tenants/${username}/", "${clientid}/"} {
+		mapping := &TopicMapping{MountPoint: mount}
+		if err := mapping.compile(); err != nil {
+			t.Fatalf("mount point %q: compile returned %v", mount, err)
+		}
+	}
+}
+
+func TestTopicMappingIsolatesPrefixMounts(t *testing.T) {
+	mapping := &TopicMapping{MountPoint: "tenants/${username}/"}
+	if err := mapping.compile(); err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := mapping.mountPoint("c1", "alice")
+	alice2, _ := mapping.mountPoint("c2", "alice2")
+	internal := mapping.ingress(alice2, "secret")
+	if topic, ok := mapping.egress(alice, internal); ok {
+		t.Fatalf("alice receives %q of alice2 as %q", internal, topic)
+	}
+	if topic, ok := mapping.egress(alice2, internal); !ok || topic != "secret" {
+		t.Fatalf("alice2 receives %q, %v", topic, ok)
+	}
+}
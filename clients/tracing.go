@@ -0,0 +1,111 @@
+package clients
+
+import (
+	"context"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"time"
+)
+
+const tracerName = "github.com/qdmc/mqtt_single_proxy/clients"
+
+// rootSpan    开始一个根span;未配置TracerProvider时返回不记录的span
+func (m *defaultClientManager) rootSpan(name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	tp := m.options().TracerProvider
+	if tp == nil {
+		return context.Background(), noop.Span{}
+	}
+	return tp.Tracer(tracerName).Start(context.Background(), name, opts...)
+}
+
+// startSpan    开始一个子span;ctx中没有span(如非PUBLISH报文)时返回不记录的span
+func (m *defaultClientManager) startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	tp := m.options().TracerProvider
+	if tp == nil || !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, noop.Span{}
+	}
+	return tp.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// endSpan    结束span,err不为nil时记录错误
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// propagator    MQTT 5用户属性中追踪上下文的格式
+func (m *defaultClientManager) propagator() propagation.TextMapPropagator {
+	if p := m.options().TracePropagator; p != nil {
+		return p
+	}
+	return propagation.TraceContext{}
+}
+
+// tracePublish    为客户端发布的消息开始mqtt.publish span,从报文首字节到达时开始,并记录mqtt.decode子span。
+// MQTT 5客户端的PUBLISH用户属性中带有追踪上下文时,mqtt.publish为其子span;3.1.1报文中没有用户属性,总是开始根span
+func (m *defaultClientManager) tracePublish(client clientInterface, id string, p *packets.PublishPacket) (context.Context, trace.Span) {
+	tp := m.options().TracerProvider
+	if tp == nil {
+		return context.Background(), noop.Span{}
+	}
+	arrival := time.Now()
+	if nano := client.arrivalNano(); nano > 0 {
+		arrival = time.Unix(0, nano)
+	}
+	parent := context.Background()
+	if props := client.userProperties(); len(props) > 0 {
+		parent = m.propagator().Extract(parent, &props)
+	}
+	ctx, span := tp.Tracer(tracerName).Start(parent, "mqtt.publish",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithTimestamp(arrival),
+		trace.WithAttributes(publishAttrs(id, p)...),
+	)
+	_, decode := m.startSpan(ctx, "mqtt.decode", trace.WithTimestamp(arrival))
+	decode.End()
+	return ctx, span
+}
+
+func publishAttrs(id string, p *packets.PublishPacket) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("messaging.system", "mqtt"),
+		attribute.String("messaging.client_id", id),
+		attribute.String("messaging.destination.name", p.TopicName),
+		attribute.Int("messaging.message.body.size", len(p.Payload)),
+		attribute.Int("mqtt.qos", int(p.Qos())),
+		attribute.Bool("mqtt.retain", p.GetFixedHead().Retain),
+	}
+}
+
+// AsyncSendPacketContext    同AsyncSendPacketOnce;ctx中有span时为本次写入创建mqtt.write子span,写入结果返回时结束。
+// 发送给MQTT 5客户端的PUBLISH在用户属性中带上mqtt.write的追踪上下文
+func (m *defaultClientManager) AsyncSendPacketContext(ctx context.Context, id string, p mqtt_packet.ControlPacketInterface) <-chan clients_dto.SendResult {
+	writeCtx, span := m.startSpan(ctx, "mqtt.write", trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("messaging.client_id", id)))
+	if !span.IsRecording() {
+		span.End()
+		return m.AsyncSendPacketOnce(id, p)
+	}
+	var props userProperties
+	if _, ok := p.(*packets.PublishPacket); ok {
+		m.propagator().Inject(writeCtx, &props)
+	}
+	ch := m.sendPacket(id, p, props)
+	out := make(chan clients_dto.SendResult, 1)
+	go func() {
+		res := <-ch
+		span.SetAttributes(attribute.Int64("mqtt.write.length", res.Length), attribute.Bool("mqtt.write.queued", res.Queued))
+		endSpan(span, res.Err)
+		out <- res
+	}()
+	return out
+}
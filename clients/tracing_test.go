@@ -0,0 +1,152 @@
+package clients
+
+import (
+	"context"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"testing"
+	"time"
+)
+
+// newTracedManager    开启追踪的管理器,PacketContextCb把PUBLISH通过AsyncSendPacketContext转发给订阅者sub
+func newTracedManager(t *testing.T, port uint16) *tracetest.SpanRecorder {
+	t.Helper()
+	rec := tracetest.NewSpanRecorder()
+	var m ClientManagerInterface
+	m = NewClientManagerInstance(&ClientManagerOptions{
+		TcpPort:        port,
+		TracerProvider: sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)),
+		Hooks:          []Hooks{HooksBase{}},
+		PacketContextCb: func(ctx context.Context, id string, p mqtt_packet.ControlPacketInterface) {
+			if pp, ok := p.(*packets.PublishPacket); ok && id != "sub" {
+				m.AsyncSendPacketContext(ctx, "sub", publishPacket(pp.TopicName, string(pp.Payload), 0, 0))
+			}
+		},
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = m.Stop() })
+	return rec
+}
+
+// endedSpans    等待名为name的span结束后返回所有已结束的span,按名称索引
+func endedSpans(t *testing.T, rec *tracetest.SpanRecorder, name string) map[string][]sdktrace.ReadOnlySpan {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		spans := map[string][]sdktrace.ReadOnlySpan{}
+		for _, s := range rec.Ended() {
+			spans[s.Name()] = append(spans[s.Name()], s)
+		}
+		if len(spans[name]) > 0 {
+			return spans
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("span %s is not ended, got %v", name, spans)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func spanAttr(s sdktrace.ReadOnlySpan, key string) string {
+	for _, kv := range s.Attributes() {
+		if string(kv.Key) == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+// TestTracingPublishSpans    握手、解码、分发、钩子、路由、回调与每个订阅者的写入都记录span
+func TestTracingPublishSpans(t *testing.T) {
+	port := freePort(t)
+	rec := newTracedManager(t, port)
+	sub, _ := dialMqtt(t, port, "sub", "")
+	pub, _ := dialMqtt(t, port, "pub", "")
+	writePacket(t, pub, publishPacket("a/b", "hello", 0, 0))
+	p, err := readPacket(sub, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pp, ok := p.(*packets.PublishPacket); !ok || pp.TopicName != "a/b" {
+		t.Fatalf("subscriber got %v", p)
+	}
+	spans := endedSpans(t, rec, "mqtt.write")
+	handshakes := spans["mqtt.handshake"]
+	if len(handshakes) != 2 {
+		t.Fatalf("%d handshake spans, want 2", len(handshakes))
+	}
+	for _, s := range handshakes {
+		if spanAttr(s, "network.peer.address") == "" || spanAttr(s, "messaging.client_id") == "" {
+			t.Fatalf("handshake attributes %v", s.Attributes())
+		}
+	}
+	publish := spans["mqtt.publish"]
+	if len(publish) != 1 || spanAttr(publish[0], "messaging.destination.name") != "a/b" || spanAttr(publish[0], "messaging.client_id") != "pub" {
+		t.Fatalf("publish spans %v", publish)
+	}
+	root := publish[0].SpanContext()
+	parents := map[string]string{
+		"mqtt.decode":   "mqtt.publish",
+		"mqtt.dispatch": "mqtt.publish",
+		"mqtt.hooks":    "mqtt.publish",
+		"mqtt.route":    "mqtt.publish",
+		"mqtt.callback": "mqtt.route",
+		"mqtt.write":    "mqtt.callback",
+	}
+	for name, parent := range parents {
+		list := spans[name]
+		if len(list) != 1 {
+			t.Fatalf("%d %s spans, want 1", len(list), name)
+		}
+		if list[0].SpanContext().TraceID() != root.TraceID() {
+			t.Fatalf("%s is not in the trace of mqtt.publish", name)
+		}
+		if list[0].Parent().SpanID() != spans[parent][0].SpanContext().SpanID() {
+			t.Fatalf("parent of %s is not %s", name, parent)
+		}
+	}
+	if w := spans["mqtt.write"][0]; spanAttr(w, "messaging.client_id") != "sub" || w.SpanKind() != trace.SpanKindProducer {
+		t.Fatalf("write span %v %v", w.Attributes(), w.SpanKind())
+	}
+}
+
+// TestTracePropagationMqtt5    MQTT 5客户端PUBLISH用户属性中的traceparent成为mqtt.publish的父span,写入时注入mqtt.write的上下文
+func TestTracePropagationMqtt5(t *testing.T) {
+	port := freePort(t)
+	rec := newTracedManager(t, port)
+	sub := dialMqtt5(t, port, "sub")
+	pub := dialMqtt5(t, port, "pub")
+	const traceId, spanId = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	props := append([]byte{0x03}, mqtt5String("text/plain")...)
+	props = append(props, userPropertyId)
+	props = append(append(props, mqtt5String("traceparent")...), mqtt5String("00-"+traceId+"-"+spanId+"-01")...)
+	body := mqtt5String("a/b")
+	body = append(appendVarint(body, len(props)), props...)
+	body = append(body, "hello"...)
+	if _, err := pub.Write(mqtt5Packet(publishType<<4, body)); err != nil {
+		t.Fatal(err)
+	}
+	first, out := readMqtt5(t, sub)
+	if first>>4 != publishType {
+		t.Fatalf("subscriber got packet type %d", first>>4)
+	}
+	n, _ := stringLength(out, 0)
+	users, payload, err := readProperties(out[n:])
+	if err != nil || string(out[2:n]) != "a/b" || string(payload) != "hello" {
+		t.Fatalf("publish %q %q %v", out[2:n], payload, err)
+	}
+	spans := endedSpans(t, rec, "mqtt.write")
+	publish := spans["mqtt.publish"][0]
+	if publish.Parent().TraceID().String() != traceId || publish.Parent().SpanID().String() != spanId || !publish.Parent().IsRemote() {
+		t.Fatalf("parent of mqtt.publish %v", publish.Parent())
+	}
+	write := spans["mqtt.write"][0].SpanContext()
+	if want := "00-" + traceId + "-" + write.SpanID().String() + "-01"; users.Get("traceparent") != want {
+		t.Fatalf("traceparent %q, want %q", users.Get("traceparent"), want)
+	}
+}
@@ -0,0 +1,79 @@
+package clients
+
+import (
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"github.com/qdmc/mqtt_single_proxy/webhook"
+	"time"
+)
+
+// emitWebhook    事件推送到所有webhook,不阻塞
+func emitWebhook(whs []*webhook.Emitter, ev clients_dto.WebhookEvent) {
+	for _, w := range whs {
+		_ = w.Emit(ev)
+	}
+}
+
+func connectedWebhookEvent(db clients_dto.ConnectionDatabase) clients_dto.WebhookEvent {
+	ev := clients_dto.WebhookEvent{
+		Event:    enmu.ConnectedWebhook,
+		ClientId: db.Id,
+		UserName: db.UserName,
+		Nano:     db.ConnectedNano,
+	}
+	if db.Addr != nil {
+		ev.Addr = db.Addr.String()
+	}
+	return ev
+}
+
+func disconnectedWebhookEvent(cd *clients_dto.ConnectionDatabase) clients_dto.WebhookEvent {
+	ev := clients_dto.WebhookEvent{
+		Event:    enmu.DisconnectedWebhook,
+		ClientId: cd.Id,
+		UserName: cd.UserName,
+		Nano:     cd.CloseNano,
+	}
+	if cd.Err != nil {
+		ev.Reason = cd.Err.Error()
+	}
+	if ev.Nano == 0 {
+		ev.Nano = time.Now().UnixNano()
+	}
+	return ev
+}
+
+// emitPacketWebhook    推送SUBSCRIBE、UNSUBSCRIBE与PUBLISH事件
+func (m *defaultClientManager) emitPacketWebhook(whs []*webhook.Emitter, id string, p mqtt_packet.ControlPacketInterface) {
+	ev := clients_dto.WebhookEvent{ClientId: id, Nano: time.Now().UnixNano()}
+	switch packet := p.(type) {
+	case *packets.PublishPacket:
+		ev.Event = enmu.PublishWebhook
+		ev.Topic = packet.TopicName
+		ev.Qos = packet.Qos()
+		ev.Retain = packet.GetFixedHead().Retain
+		ev.Payload = packet.Payload
+	case *packets.SubscribePacket:
+		ev.Event = enmu.SubscribeWebhook
+		ev.Subscriptions = make(map[string]byte, len(packet.List))
+		for _, tf := range packet.List {
+			if tf != nil && tf.Qos <= 2 {
+				ev.Subscriptions[tf.Topic] = tf.Qos
+			}
+		}
+	case *packets.UnSubscribePacket:
+		ev.Event = enmu.UnsubscribeWebhook
+		ev.Topics = packet.Topics
+	default:
+		return
+	}
+	m.mu.RLock()
+	client, ok := m.clientMap[id]
+	m.mu.RUnlock()
+	if ok {
+		ev.UserName = client.GetDataBase().UserName
+	}
+	emitWebhook(whs, ev)
+}
@@ -16,13 +16,14 @@ import (
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type websocketClient struct {
 	id                string
-	status            bool
+	status            atomic.Bool
 	disConnectCb      DisConnectCallbackHandle
 	packetCb          PacketCallbackHandle
 	connectedNano     int64   // 链接开始时间
@@ -30,8 +31,9 @@ type websocketClient struct {
 	writeLength       *uint64 // 发送的数据长度
 	readLength        *uint64 // 接收的数据长度
 	isStatistics      bool    // 是否开启流量统计,默认为false
-	e                 error
-	isNoCb            bool
+	errMu             sync.Mutex
+	e                 error // 断开原因,读协程与断开时写入、其他协程读取,由errMu保护
+	isNoCb            atomic.Bool
 	conn              net.Conn
 	stopChan          chan struct{}
 	tr                *time.Timer
@@ -39,7 +41,23 @@ type websocketClient struct {
 	pt                time.Duration
 	ptt               *time.Ticker
 	continuationFrame *frame.Frame
-	mqttBuf           []byte
+	stream            packetStream // websocket消息中未读完的MQTT报文
+	maxPacketSize     int          // 报文最大长度
+	maxMessageSize    int          // websocket消息最大长度
+	wq                *writeQueue
+	closeOnce         sync.Once
+	doneChan          chan struct{} // 读协程退出后关闭
+	userName          string
+	tagsMu            sync.RWMutex
+	tags              map[string]string
+	info              connectInfo
+	counter           packetCounter
+	lastActiveNano    int64
+	subprotocol       string
+	remoteAddr        net.Addr                // 客户端地址,经过可信代理时为转发头中的地址
+	tap               atomic.Pointer[capture] // 抓包,未抓包时为nil
+	arrival           arrivalReader           // 读取帧并记录首字节到达时间
+	v5                *mqtt5Conn              // MQTT 5报文转换,3.1.1客户端为nil
 }
 
 func (c *websocketClient) GetId() string {
@@ -47,16 +65,51 @@ func (c *websocketClient) GetId() string {
 }
 
 func (c *websocketClient) GetDataBase() clients_dto.ConnectionDatabase {
+	read, write := c.counter.load()
 	return clients_dto.ConnectionDatabase{
-		Id:            c.id,
-		Protocol:      c.GetProtocol(),
-		ConnectedNano: c.connectedNano,
-		CloseNano:     c.closeNano,
-		WriteLength:   atomic.LoadUint64(c.writeLength),
-		ReadLength:    atomic.LoadUint64(c.readLength),
-		Status:        c.status,
-		IsStatistics:  c.isStatistics,
-		Err:           c.e,
+		Id:              c.id,
+		Protocol:        c.GetProtocol(),
+		ConnectedNano:   c.connectedNano,
+		CloseNano:       atomic.LoadInt64(&c.closeNano),
+		WriteLength:     atomic.LoadUint64(c.writeLength),
+		ReadLength:      atomic.LoadUint64(c.readLength),
+		Status:          c.status.Load(),
+		IsStatistics:    c.isStatistics,
+		Err:             c.getErr(),
+		UserName:        c.userName,
+		Addr:            c.remoteAddr,
+		Tags:            c.GetTags(),
+		ProtocolVersion: c.info.protocolVersion,
+		Keepalive:       c.info.keepalive,
+		CleanSession:    c.info.cleanSession,
+		HasWill:         c.info.hasWill,
+		Will:            c.info.will,
+		Subprotocol:     c.subprotocol,
+		LastActiveNano:  atomic.LoadInt64(&c.lastActiveNano),
+		ReadPackets:     read,
+		WritePackets:    write,
+	}
+}
+
+func (c *websocketClient) GetTags() map[string]string {
+	c.tagsMu.RLock()
+	defer c.tagsMu.RUnlock()
+	if c.tags == nil {
+		return nil
+	}
+	tags := make(map[string]string, len(c.tags))
+	for k, v := range c.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+func (c *websocketClient) SetTags(tags map[string]string) {
+	c.tagsMu.Lock()
+	defer c.tagsMu.Unlock()
+	c.tags = make(map[string]string, len(tags))
+	for k, v := range tags {
+		c.tags[k] = v
 	}
 }
 func (c *websocketClient) doFrame(f *frame.Frame) error {
@@ -65,13 +118,7 @@ func (c *websocketClient) doFrame(f *frame.Frame) error {
 	}
 	if f.Opcode == 9 {
 		bs, _ := frame.NewPongFrame(f.PayloadData).ToBytes()
-		writeLen, err := c.conn.Write(bs)
-		if err != nil {
-			return err
-		}
-		if c.isStatistics {
-			atomic.AddUint64(c.writeLength, uint64(writeLen))
-		}
+		c.wq.push(bs, 0)
 		return nil
 	} else if f.Opcode == 8 {
 		c.DisConnect()
@@ -79,35 +126,25 @@ func (c *websocketClient) doFrame(f *frame.Frame) error {
 	} else if f.Opcode == 10 {
 		return nil
 	} else if f.Opcode == 1 || f.Opcode == 2 {
-		c.mqttBuf = append(c.mqttBuf, f.PayloadData...)
-		list, lastBs, err := mqtt_packet.ReadStream(c.mqttBuf)
-		if err != nil {
-			return err
-		} else {
-			if list != nil && len(list) > 0 {
-				for _, p := range list {
-					go c.doPacket(p)
-				}
-			}
-			if lastBs != nil && len(lastBs) > 0 {
-				c.mqttBuf = lastBs
-			} else {
-				c.mqttBuf = []byte{}
-			}
-			return nil
+		list, err := c.stream.feed(f.PayloadData, c.maxPacketSize, c.v5)
+		for _, p := range list {
+			c.doPacket(p)
 		}
+		return err
 	} else {
 		return errors.New("frame type error")
 	}
 }
 func (c *websocketClient) AsyncDoConnection() {
-	c.status = true
+	c.status.Store(true)
 	var err error
 	defer func() {
-		c.status = false
-		c.closeNano = time.Now().UnixNano()
+		c.status.Store(false)
+		atomic.StoreInt64(&c.closeNano, time.Now().UnixNano())
 		c.doDisconnect(err)
+		close(c.doneChan)
 	}()
+	c.wq.start()
 	c.tr = time.NewTimer(c.t)
 	c.ptt = time.NewTicker(c.pt)
 	for {
@@ -122,15 +159,29 @@ func (c *websocketClient) AsyncDoConnection() {
 			err = enmu.ClientHeartTimeoutError
 			return
 		default:
-			readLen, f, code := frame.ReadOnceFrame(c.conn)
+			c.arrival.next()
+			readLen, f, code := readFrameWithLimit(&c.arrival, c.maxMessageSize)
+			if code == frame.CloseMessageTooBig {
+				err = enmu.WebsocketMessageTooLargeError
+				c.writeCloseFrame(code)
+				return
+			}
 			if code != frame.CloseNormalClosure {
-				err = enmu.ClientReadConnectionError
+				if !c.isStopped() {
+					err = enmu.ClientReadConnectionError
+				}
 				return
 			}
 			c.tr.Reset(c.t)
+			atomic.StoreInt64(&c.lastActiveNano, time.Now().UnixNano())
 			if c.isStatistics {
 				atomic.AddUint64(c.readLength, uint64(readLen))
 			}
+			if c.continuationFrame != nil && len(c.continuationFrame.PayloadData)+len(f.PayloadData) > c.maxMessageSize {
+				err = enmu.WebsocketMessageTooLargeError
+				c.writeCloseFrame(frame.CloseMessageTooBig)
+				return
+			}
 			if f.Fin == 0 {
 				if c.continuationFrame == nil {
 					c.continuationFrame = f
@@ -149,6 +200,9 @@ func (c *websocketClient) AsyncDoConnection() {
 					err = c.doFrame(f)
 				}
 				if err != nil {
+					if err == enmu.PacketTooLargeError {
+						c.writeCloseFrame(frame.CloseMessageTooBig)
+					}
 					return
 				}
 			}
@@ -157,16 +211,25 @@ func (c *websocketClient) AsyncDoConnection() {
 	}
 }
 func (c *websocketClient) doPing() {
-	if c.status {
+	if c.status.Load() {
 		frameBytes, _ := frame.NewPingFrame([]byte("hello")).ToBytes()
-		writeLen, err := c.conn.Write(frameBytes)
-		if err != nil {
-			atomic.AddUint64(c.writeLength, uint64(writeLen))
-		}
+		c.wq.push(frameBytes, 0)
+	}
+}
+
+// writeCloseFrame    发送关闭帧
+func (c *websocketClient) writeCloseFrame(code frame.CloseStatus) {
+	bs, err := frame.NewCloseFrame(code).ToBytes()
+	if err != nil {
+		return
+	}
+	select {
+	case <-c.wq.push(bs, 0):
+	case <-time.After(time.Second):
 	}
 }
 func (c *websocketClient) SetTimeOut(t int64) {
-	if !c.status {
+	if !c.status.Load() {
 		if t >= 10 && t <= 300 {
 			c.t = time.Duration(t) * time.Second
 			c.pt = time.Duration(t-5) * time.Second
@@ -174,104 +237,264 @@ func (c *websocketClient) SetTimeOut(t int64) {
 	}
 }
 func (c *websocketClient) SetStatistics(b bool) {
-	if !c.status {
+	if !c.status.Load() {
 		c.isStatistics = b
 	}
 }
 
+func (c *websocketClient) SetMaxPacketSize(packetSize, messageSize int) {
+	if !c.status.Load() {
+		if packetSize > 0 {
+			c.maxPacketSize = packetSize
+		}
+		if messageSize > 0 {
+			c.maxMessageSize = messageSize
+		}
+	}
+}
+
 func (c *websocketClient) SetPacketHandle(handle PacketCallbackHandle) {
-	if !c.status {
+	if !c.status.Load() {
 		c.packetCb = handle
 	}
 }
 
 func (c *websocketClient) SetDisConnectCallback(handle DisConnectCallbackHandle) {
-	if !c.status {
+	if !c.status.Load() {
 		c.disConnectCb = handle
 	}
 }
 
 func (c *websocketClient) DisConnect(isNoCb ...bool) {
 	if isNoCb != nil && len(isNoCb) == 1 && isNoCb[0] {
-		c.isNoCb = true
+		c.isNoCb.Store(true)
 	}
-	close(c.stopChan)
+	c.closeOnce.Do(func() {
+		close(c.stopChan)
+		// 中断阻塞中的读取
+		_ = c.conn.SetReadDeadline(time.Now())
+	})
 }
 
-func (c *websocketClient) GetProtocol() enmu.ClientProtocol {
-	return enmu.TcpProtocol
+func (c *websocketClient) setErr(err error) {
+	c.errMu.Lock()
+	c.e = err
+	c.errMu.Unlock()
 }
-func (c *websocketClient) WritePacketOnce(p mqtt_packet.ControlPacketInterface) (int64, error) {
-	if p == nil {
-		return 0, enmu.PacketEmptyError
+
+func (c *websocketClient) getErr() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.e
+}
+
+// disConnectWithError    记录错误后断开链接
+func (c *websocketClient) disConnectWithError(err error) {
+	c.closeOnce.Do(func() {
+		c.setErr(err)
+		close(c.stopChan)
+		_ = c.conn.SetReadDeadline(time.Now())
+	})
+}
+
+func (c *websocketClient) Shutdown() {
+	c.wq.setFlush()
+	c.AsyncWritePacket(packets.NewDisconnect(nil))
+	if c.status.Load() {
+		if bs, err := frame.NewCloseFrame(frame.CloseGoingAway).ToBytes(); err == nil {
+			c.wq.push(bs, 0)
+		}
 	}
-	if c.status {
-		mqBuf := bytes.NewBuffer([]byte{})
-		_, err := p.Write(mqBuf)
-		if err != nil {
-			return 0, err
+	c.DisConnect()
+}
+
+func (c *websocketClient) ForceClose() {
+	c.DisConnect()
+	_ = c.conn.Close()
+}
+
+func (c *websocketClient) Done() <-chan struct{} {
+	return c.doneChan
+}
+
+// writeConnAck    回复CONNACK,需在AsyncDoConnection之前调用
+func (c *websocketClient) writeConnAck(code enmu.HandshakeResult, sessionPresent bool) error {
+	if cp := c.tap.Load(); cp != nil {
+		cp.record(c.id, enmu.OutboundCapture, connAckBytes(code, sessionPresent, mqtt311Version, ""))
+	}
+	bs, err := frame.AutoBinaryFramesBytes(connAckBytes(code, sessionPresent, c.info.protocolVersion, assignedClientId(c.id, c.info)))
+	if err != nil {
+		return err
+	}
+	return writeHandshakeBytes(c.conn, bs)
+}
+
+// setId    修改ClientId,需在AsyncDoConnection之前调用
+func (c *websocketClient) setId(id string) {
+	if !c.status.Load() {
+		c.id = id
+	}
+}
+
+func (c *websocketClient) setCapture(cp *capture) {
+	c.tap.Store(cp)
+}
+
+func (c *websocketClient) connectPacket() *packets.ConnectPacket {
+	return c.info.connect
+}
+
+func (c *websocketClient) userProperties() userProperties {
+	return c.v5.userProperties()
+}
+
+func (c *websocketClient) arrivalNano() int64 {
+	return c.arrival.nano
+}
+
+func (c *websocketClient) setWillTopic(topic string) {
+	c.info.withWillTopic(topic)
+}
+
+func (c *websocketClient) isStopped() bool {
+	select {
+	case <-c.stopChan:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *websocketClient) SetWriteQueue(size int, policy enmu.QueueFullPolicy, timeout int64) {
+	if !c.status.Load() {
+		if timeout <= 0 {
+			timeout = defaultWriteTimeOut
 		}
-		bs, err := frame.AutoBinaryFramesBytes(mqBuf.Bytes())
-		if err != nil {
-			return 0, err
+		c.wq = newWriteQueue(c.conn, size, policy, time.Duration(timeout)*time.Second)
+		c.initWriteQueue()
+	}
+}
+
+func (c *websocketClient) initWriteQueue() {
+	c.wq.onWrite = func(n int, messageType byte) {
+		if c.isStatistics {
+			atomic.AddUint64(c.writeLength, uint64(n))
 		}
-		l, err := c.conn.Write(bs)
-		if err != nil {
-			return 0, err
+		if messageType != 0 {
+			c.counter.addWrite(messageType)
 		}
-		return int64(l), nil
+	}
+	c.wq.onError = c.disConnectWithError
+}
+
+func (c *websocketClient) GetProtocol() enmu.ClientProtocol {
+	return enmu.Websocket
+}
+func (c *websocketClient) WritePacketOnce(p mqtt_packet.ControlPacketInterface) (int64, error) {
+	res := <-c.AsyncWritePacket(p)
+	return res.Length, res.Err
+}
+
+func (c *websocketClient) AsyncWritePacket(p mqtt_packet.ControlPacketInterface) <-chan clients_dto.SendResult {
+	if p == nil {
+		return sendResultChan(0, enmu.PacketEmptyError)
+	}
+	e, err := encodePacket(p)
+	if err != nil {
+		return sendResultChan(0, err)
+	}
+	return c.asyncWriteEncoded(e)
+}
+
+func (c *websocketClient) asyncWriteEncoded(e *encodedPacket) <-chan clients_dto.SendResult {
+	if !c.status.Load() {
+		return sendResultChan(0, enmu.ClientDisconnectError)
+	}
+	return c.enqueueEncoded(e)
+}
+
+// enqueueEncoded    不检查链接状态直接入队,用于链接开始前恢复会话消息
+func (c *websocketClient) enqueueEncoded(e *encodedPacket) <-chan clients_dto.SendResult {
+	if cp := c.tap.Load(); cp != nil {
+		cp.record(c.id, enmu.OutboundCapture, e.raw)
+	}
+	var bs []byte
+	var err error
+	if c.v5 != nil {
+		bs, err = frame.AutoBinaryFramesBytes(c.v5.outbound(e))
 	} else {
-		return 0, enmu.ClientDisconnectError
+		bs, err = e.websocketFrames()
 	}
+	if err != nil {
+		return sendResultChan(0, err)
+	}
+	return c.wq.push(bs, e.raw[0]>>4)
 }
 func (c *websocketClient) doPacket(p mqtt_packet.ControlPacketInterface) {
+	_, isPublish := p.(*packets.PublishPacket)
+	c.v5.next(isPublish)
+	if p != nil {
+		c.counter.addRead(byte(p.MessageType()))
+	}
+	if cp := c.tap.Load(); cp != nil && p != nil {
+		cp.recordPacket(c.id, enmu.InboundCapture, p)
+	}
 	if p == nil || c.packetCb == nil {
 		return
 	}
-	go c.packetCb(c.id, p)
+	c.packetCb(c.id, p)
 }
 
 func (c *websocketClient) doDisconnect(err error) {
 	if err != nil {
-		c.e = err
+		c.setErr(err)
 	}
 	if c.tr != nil {
 		c.tr.Stop()
 	}
+	c.wq.stop()
+	_ = c.conn.Close()
 	if c.ptt != nil {
 		c.ptt.Stop()
 	}
-	if !c.isNoCb && c.disConnectCb != nil {
+	if !c.isNoCb.Load() && c.disConnectCb != nil {
 		db := c.GetDataBase()
-		go c.disConnectCb(&db)
+		c.disConnectCb(&db)
 	}
 }
 func newWebsocketClient(id string, c net.Conn) *websocketClient {
 	var rl, wl uint64
-	return &websocketClient{
+	client := &websocketClient{
 		id:                id,
-		status:            false,
 		disConnectCb:      nil,
 		packetCb:          nil,
 		connectedNano:     time.Now().UnixNano(),
+		lastActiveNano:    time.Now().UnixNano(),
 		closeNano:         0,
 		writeLength:       &wl,
 		readLength:        &rl,
 		isStatistics:      false,
 		e:                 nil,
-		isNoCb:            false,
-		conn:              nil,
+		conn:              c,
+		remoteAddr:        c.RemoteAddr(),
 		stopChan:          make(chan struct{}, 1),
+		doneChan:          make(chan struct{}),
 		tr:                nil,
 		t:                 time.Duration(60) * time.Second,
 		pt:                time.Duration(55) * time.Second,
 		ptt:               nil,
 		continuationFrame: nil,
-		mqttBuf:           nil,
+		maxPacketSize:     defaultMaxPacketSize,
+		maxMessageSize:    defaultMaxMessageSize,
 	}
+	client.arrival.r = c
+	client.wq = newWriteQueue(c, defaultWriteQueueSize, enmu.BlockPolicy, defaultWriteTimeOut*time.Second)
+	client.initWriteQueue()
+	return client
 }
-func handshakeWebsocket(c net.Conn, handle HandshakeHandle, handshakeTime int64) (*websocketClient, error) {
+func handshakeWebsocket(c net.Conn, httpCtx *clients_dto.HttpContext, addr net.Addr, opt *ClientManagerOptions) (*websocketClient, error) {
 	var err error
+	handshakeTime := opt.MaxHandshakeTime
 	if handshakeTime <= 0 {
 		handshakeTime = 10
 	}
@@ -279,11 +502,14 @@ func handshakeWebsocket(c net.Conn, handle HandshakeHandle, handshakeTime int64)
 	if err != nil {
 		return nil, err
 	}
-	_, f, code := frame.ReadOnceFrame(c)
+	_, f, code := readFrameWithLimit(c, opt.MaxMessageSize)
+	if code == frame.CloseMessageTooBig {
+		return nil, enmu.WebsocketMessageTooLargeError
+	}
 	if code != frame.CloseNormalClosure {
 		return nil, enmu.ClientReadConnectionError
 	}
-	_, p, err := mqtt_packet.ReadOnce(bytes.NewBuffer(f.PayloadData))
+	_, p, err := readPacketWithLimit(bytes.NewBuffer(f.PayloadData), opt.MaxPacketSize, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -291,23 +517,25 @@ func handshakeWebsocket(c net.Conn, handle HandshakeHandle, handshakeTime int64)
 	if !ok {
 		return nil, enmu.NotConnectPacketError
 	}
-	if handle != nil {
-		hd := clients_dto.ConnectionHandshakeDatabase{
-			ClientId: packet.ClientIdentifier,
-			UserName: packet.Username,
-			Password: string(packet.Password),
-			Addr:     c.RemoteAddr(),
-		}
-		res := handle(hd)
-		if res != enmu.Success {
-			return nil, enmu.ClienthHandshakeFaild
+	hd, res := checkConnect(addr, httpCtx, packet, opt)
+	if res != enmu.Success {
+		if bs, frameErr := frame.AutoBinaryFramesBytes(connAckBytes(res, false, packet.ProtocolVersion, "")); frameErr == nil {
+			_ = writeHandshakeBytes(c, bs)
 		}
+		return nil, enmu.ClienthHandshakeFaild
 	}
 	err = c.SetDeadline(time.Time{})
 	if err != nil {
 		return nil, err
 	}
-	return newWebsocketClient(packet.ClientIdentifier, c), nil
+	client := newWebsocketClient(hd.ClientId, c)
+	client.userName = hd.UserName
+	client.remoteAddr = addr
+	client.info = newConnectInfo(packet)
+	client.v5 = newMqtt5Conn(packet.ProtocolVersion)
+	client.SetMaxPacketSize(opt.MaxPacketSize, opt.MaxMessageSize)
+	client.SetWriteQueue(opt.WriteQueueSize, opt.QueueFullPolicy, opt.WriteTimeOut)
+	return client, nil
 }
 
 // websocketUpgradeHandler      websocket校验握手
@@ -387,13 +615,36 @@ func checkSecWebsocketKey(h http.Header) bool {
 	return err == nil && len(decoded) == 16
 }
 
+// supportedSubprotocols   支持的websocket子协议
+var supportedSubprotocols = []string{"mqtt", "mqttv3.1"}
+
+// selectSubprotocol    按客户端请求的顺序选择第一个支持的子协议,没有则返回空
+func selectSubprotocol(req *http.Request) string {
+	for _, val := range req.Header.Values("Sec-Websocket-Protocol") {
+		for _, protocol := range strings.Split(val, ",") {
+			protocol = strings.TrimSpace(protocol)
+			for _, supported := range supportedSubprotocols {
+				if strings.EqualFold(protocol, supported) {
+					return protocol
+				}
+			}
+		}
+	}
+	return ""
+}
+
 // makeServerHandshakeBytes    生成服务端回复的报文
-func makeServerHandshakeBytes(req *http.Request) []byte {
+func makeServerHandshakeBytes(req *http.Request, subprotocol string) []byte {
 	key := req.Header.Get("Sec-Websocket-Key")
 	var p []byte
 	p = append(p, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: "...)
 	p = append(p, computeAcceptKey(key)...)
 	p = append(p, "\r\n"...)
+	if subprotocol != "" {
+		p = append(p, "Sec-WebSocket-Protocol: "...)
+		p = append(p, subprotocol...)
+		p = append(p, "\r\n"...)
+	}
 	p = append(p, "\r\n"...)
 	return p
 }
@@ -0,0 +1,245 @@
+package clients
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsFrame    客户端发送的帧,按协议加掩码
+func wsFrame(fin bool, opcode byte, payload []byte) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	bs := []byte{first}
+	switch {
+	case len(payload) < 126:
+		bs = append(bs, 0x80|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		bs = binary.BigEndian.AppendUint16(append(bs, 0x80|126), uint16(len(payload)))
+	default:
+		bs = binary.BigEndian.AppendUint64(append(bs, 0x80|127), uint64(len(payload)))
+	}
+	mask := []byte{1, 2, 3, 4}
+	bs = append(bs, mask...)
+	for i, b := range payload {
+		bs = append(bs, b^mask[i%4])
+	}
+	return bs
+}
+
+// dialWebsocket    完成websocket升级,header为附加的请求头;返回的reader用于读取升级响应之后的数据
+func dialWebsocket(t *testing.T, port uint16, header http.Header) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	req := "GET /websocket HTTP/1.1\r\nHost: localhost\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Protocol: mqtt\r\n"
+	for k, vs := range header {
+		for _, v := range vs {
+			req += k + ": " + v + "\r\n"
+		}
+	}
+	if _, err = c.Write([]byte(req + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade status %d", resp.StatusCode)
+	}
+	return c, r
+}
+
+// readWsFrame    读取服务端的一个帧(不加掩码)
+func readWsFrame(r io.Reader) (byte, []byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return 0, nil, err
+	}
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	payload := make([]byte, length)
+	_, err := io.ReadFull(r, payload)
+	return head[0] & 0x0F, payload, err
+}
+
+// wsConnect    在websocket链接上完成MQTT握手
+func wsConnect(t *testing.T, c net.Conn, r *bufio.Reader, id string) {
+	t.Helper()
+	e, err := encodePacket(connectPacket(id, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write(wsFrame(true, 2, e.raw)); err != nil {
+		t.Fatal(err)
+	}
+	_, payload, err := readWsFrame(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := mqtt_packet.ReadOnce(bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ack, ok := p.(*packets.ConnAckPacket); !ok || ack.ReturnCode != 0 {
+		t.Fatalf("connack %v", p)
+	}
+}
+
+// limitManager    MaxPacketSize与MaxMessageSize较小的管理器,断开原因写入返回的通道
+func limitManager(t *testing.T, opt *ClientManagerOptions) (ClientManagerInterface, chan error, chan mqtt_packet.ControlPacketInterface) {
+	t.Helper()
+	disconnected := make(chan error, 4)
+	received := make(chan mqtt_packet.ControlPacketInterface, 16)
+	opt.DisConnectCb = func(db *clients_dto.ConnectionDatabase) { disconnected <- db.Err }
+	opt.PacketCb = func(_ string, p mqtt_packet.ControlPacketInterface) { received <- p }
+	if opt.IsWebsocket {
+		opt.WebsocketPath = "/websocket"
+	}
+	m := NewClientManagerInstance(opt)
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = m.Stop() })
+	return m, disconnected, received
+}
+
+func waitDisconnect(t *testing.T, ch chan error, want error) {
+	t.Helper()
+	select {
+	case err := <-ch:
+		if err != want {
+			t.Fatalf("disconnect reason %v, want %v", err, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("client is not disconnected, want %v", want)
+	}
+}
+
+// TestTcpPacketTooLarge    声明超过MaxPacketSize的报文时断开,不等待报文内容
+func TestTcpPacketTooLarge(t *testing.T) {
+	port := freePort(t)
+	_, disconnected, _ := limitManager(t, &ClientManagerOptions{TcpPort: port, MaxPacketSize: 1024})
+	c, _ := dialMqtt(t, port, "hostile", "")
+	if _, err := c.Write([]byte{0x30, 0xFF, 0xFF, 0xFF, 0x7F}); err != nil {
+		t.Fatal(err)
+	}
+	waitDisconnect(t, disconnected, enmu.PacketTooLargeError)
+}
+
+// TestWebsocketOversizedFrame    帧头声明超过MaxMessageSize的负载时回复1009并断开,不读取负载
+func TestWebsocketOversizedFrame(t *testing.T) {
+	port := freePort(t)
+	_, disconnected, _ := limitManager(t, &ClientManagerOptions{TcpPort: freePort(t), IsWebsocket: true, WebsocketPort: port, MaxMessageSize: 4096})
+	c, r := dialWebsocket(t, port, nil)
+	wsConnect(t, c, r, "hostile")
+	// 声明1GB的帧,只发送帧头与掩码
+	head := binary.BigEndian.AppendUint64([]byte{0x82, 0x80 | 127}, 1<<30)
+	if _, err := c.Write(append(head, 1, 2, 3, 4)); err != nil {
+		t.Fatal(err)
+	}
+	op, payload, err := readWsFrame(r)
+	if err != nil || op != 8 || len(payload) < 2 || binary.BigEndian.Uint16(payload) != 1009 {
+		t.Fatalf("close frame %d %x %v", op, payload, err)
+	}
+	waitDisconnect(t, disconnected, enmu.WebsocketMessageTooLargeError)
+}
+
+// TestWebsocketEndlessContinuation    不断发送未结束的分片时,重组的消息超过MaxMessageSize即断开
+func TestWebsocketEndlessContinuation(t *testing.T) {
+	port := freePort(t)
+	_, disconnected, _ := limitManager(t, &ClientManagerOptions{TcpPort: freePort(t), IsWebsocket: true, WebsocketPort: port, MaxMessageSize: 8192})
+	c, r := dialWebsocket(t, port, nil)
+	wsConnect(t, c, r, "hostile")
+	chunk := make([]byte, 1024)
+	sent := 0
+	for i := 0; i < 64; i++ {
+		opcode := byte(0)
+		if i == 0 {
+			opcode = 2
+		}
+		if _, err := c.Write(wsFrame(false, opcode, chunk)); err != nil {
+			break // 服务端已断开
+		}
+		sent += len(chunk)
+	}
+	waitDisconnect(t, disconnected, enmu.WebsocketMessageTooLargeError)
+	if sent < 8192 {
+		t.Fatalf("disconnected after %d bytes, before reaching MaxMessageSize", sent)
+	}
+}
+
+// TestWebsocketPacketTooLarge    逐字节分帧发送的MQTT报文声明的长度超过MaxPacketSize时断开
+func TestWebsocketPacketTooLarge(t *testing.T) {
+	port := freePort(t)
+	_, disconnected, _ := limitManager(t, &ClientManagerOptions{TcpPort: freePort(t), IsWebsocket: true, WebsocketPort: port, MaxPacketSize: 1024})
+	c, r := dialWebsocket(t, port, nil)
+	wsConnect(t, c, r, "hostile")
+	for _, b := range appendVarint([]byte{0x30}, 1<<20) {
+		if _, err := c.Write(wsFrame(true, 2, []byte{b})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitDisconnect(t, disconnected, enmu.PacketTooLargeError)
+}
+
+// TestWebsocketOneByteFrames    逐字节分帧发送的报文与一帧中的多个报文都能读出
+func TestWebsocketOneByteFrames(t *testing.T) {
+	port := freePort(t)
+	_, _, received := limitManager(t, &ClientManagerOptions{TcpPort: freePort(t), IsWebsocket: true, WebsocketPort: port})
+	c, r := dialWebsocket(t, port, nil)
+	wsConnect(t, c, r, "dev")
+	e, _ := encodePacket(publishPacket("a/b", strings.Repeat("x", 200), 0, 0))
+	for _, b := range e.raw {
+		if _, err := c.Write(wsFrame(true, 2, []byte{b})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	two, _ := encodePacket(publishPacket("c", "1", 0, 0))
+	if _, err := c.Write(wsFrame(true, 2, append(append([]byte{}, two.raw...), two.raw...))); err != nil {
+		t.Fatal(err)
+	}
+	for i, topic := range []string{"a/b", "c", "c"} {
+		select {
+		case p := <-received:
+			if pp, ok := p.(*packets.PublishPacket); !ok || pp.TopicName != topic {
+				t.Fatalf("packet %d: %v", i, p)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("packet %d is not received", i)
+		}
+	}
+}
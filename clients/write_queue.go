@@ -0,0 +1,197 @@
+package clients
+
+import (
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultWriteQueueSize = 128
+	defaultWriteTimeOut   = 10
+)
+
+// writeRequest   待发送的数据
+type writeRequest struct {
+	bs          []byte
+	messageType byte // MQTT报文类型,websocket控制帧为0
+	result      chan clients_dto.SendResult
+}
+
+func (r *writeRequest) done(length int64, err error) {
+	r.result <- clients_dto.SendResult{Length: length, Err: err}
+}
+
+// sendResultChan    返回一个已写入结果的通道
+func sendResultChan(length int64, err error) <-chan clients_dto.SendResult {
+	ch := make(chan clients_dto.SendResult, 1)
+	ch <- clients_dto.SendResult{Length: length, Err: err}
+	return ch
+}
+
+// writeQueue   单写协程的有界发送队列,保证同一链接上的报文不会交错写入
+type writeQueue struct {
+	conn     net.Conn
+	queue    chan *writeRequest
+	policy   enmu.QueueFullPolicy
+	timeout  time.Duration
+	mu       sync.RWMutex
+	stopChan chan struct{}
+	doneChan chan struct{}
+	stopOnce sync.Once
+	started  int32
+	flush    int32           // 停止时是否先写完队列中的报文
+	onWrite  func(int, byte) // 写入成功回调,用于流量及报文类型统计
+	onError  func(error)     // 写入失败或慢消费回调,用于断开客户端
+}
+
+func newWriteQueue(conn net.Conn, size int, policy enmu.QueueFullPolicy, timeout time.Duration) *writeQueue {
+	if size <= 0 {
+		size = defaultWriteQueueSize
+	}
+	return &writeQueue{
+		conn:     conn,
+		queue:    make(chan *writeRequest, size),
+		policy:   policy,
+		timeout:  timeout,
+		stopChan: make(chan struct{}),
+		doneChan: make(chan struct{}),
+	}
+}
+
+// start    启动写协程
+func (q *writeQueue) start() {
+	if atomic.CompareAndSwapInt32(&q.started, 0, 1) {
+		go q.run()
+	}
+}
+
+func (q *writeQueue) run() {
+	defer close(q.doneChan)
+	for {
+		select {
+		case <-q.stopChan:
+			if atomic.LoadInt32(&q.flush) == 1 {
+				q.flushQueue()
+			}
+			return
+		case req := <-q.queue:
+			q.write(req)
+		}
+	}
+}
+
+// flushQueue    写完队列中剩余的报文
+func (q *writeQueue) flushQueue() {
+	for {
+		select {
+		case req := <-q.queue:
+			q.write(req)
+		default:
+			return
+		}
+	}
+}
+
+// setFlush   设置停止时先写完队列中的报文
+func (q *writeQueue) setFlush() {
+	atomic.StoreInt32(&q.flush, 1)
+}
+
+func (q *writeQueue) write(req *writeRequest) {
+	if q.timeout > 0 {
+		_ = q.conn.SetWriteDeadline(time.Now().Add(q.timeout))
+	}
+	n, err := q.conn.Write(req.bs)
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			err = enmu.WriteTimeoutError
+		}
+		req.done(int64(n), err)
+		if q.onError != nil {
+			q.onError(err)
+		}
+		return
+	}
+	if q.onWrite != nil {
+		q.onWrite(n, req.messageType)
+	}
+	req.done(int64(n), nil)
+}
+
+// push     写入队列,队列满时按策略处理;返回的通道会收到一次发送结果
+func (q *writeQueue) push(bs []byte, messageType byte) <-chan clients_dto.SendResult {
+	req := &writeRequest{bs: bs, messageType: messageType, result: make(chan clients_dto.SendResult, 1)}
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	select {
+	case <-q.stopChan:
+		req.done(0, enmu.ClientDisconnectError)
+		return req.result
+	default:
+	}
+	select {
+	case q.queue <- req:
+		return req.result
+	default:
+	}
+	switch q.policy {
+	case enmu.DropOldestPolicy:
+		for {
+			select {
+			case q.queue <- req:
+				return req.result
+			default:
+			}
+			select {
+			case old := <-q.queue:
+				old.done(0, enmu.PacketDroppedError)
+			default:
+			}
+		}
+	case enmu.DisconnectPolicy:
+		req.done(0, enmu.SlowConsumerError)
+		if q.onError != nil {
+			go q.onError(enmu.SlowConsumerError)
+		}
+	default:
+		var timeout <-chan time.Time
+		if q.timeout > 0 {
+			tr := time.NewTimer(q.timeout)
+			defer tr.Stop()
+			timeout = tr.C
+		}
+		select {
+		case q.queue <- req:
+		case <-q.stopChan:
+			req.done(0, enmu.ClientDisconnectError)
+		case <-timeout:
+			req.done(0, enmu.WriteTimeoutError)
+		}
+	}
+	return req.result
+}
+
+// stop     停止写协程,未发送的报文返回ClientDisconnectError
+func (q *writeQueue) stop() {
+	q.stopOnce.Do(func() {
+		close(q.stopChan)
+		// 等待所有push退出,之后不会再有报文入队
+		q.mu.Lock()
+		q.mu.Unlock()
+		if atomic.LoadInt32(&q.started) == 1 {
+			<-q.doneChan
+		}
+		for {
+			select {
+			case req := <-q.queue:
+				req.done(0, enmu.ClientDisconnectError)
+			default:
+				return
+			}
+		}
+	})
+}
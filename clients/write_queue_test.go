@@ -0,0 +1,135 @@
+package clients
+
+import (
+	"errors"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testQueueSize   = 8
+	testPayloadSize = 64 << 10
+	testPushes      = 2000 // 共约125MB,远大于队列容量
+)
+
+// stalledQueue    对端从不读取的写队列,写协程阻塞在第一条报文上
+func stalledQueue(t *testing.T, policy enmu.QueueFullPolicy, timeout time.Duration) *writeQueue {
+	t.Helper()
+	local, remote := net.Pipe()
+	q := newWriteQueue(local, testQueueSize, policy, timeout)
+	q.start()
+	t.Cleanup(func() {
+		// 先关闭链接,使阻塞的写入返回
+		_ = local.Close()
+		_ = remote.Close()
+		q.stop()
+	})
+	return q
+}
+
+func heapInUse() uint64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return ms.HeapInuse
+}
+
+// assertBounded    推送后队列中的报文数与堆增长都不超过队列容量对应的上限
+func assertBounded(t *testing.T, q *writeQueue, before uint64) {
+	t.Helper()
+	if n := len(q.queue); n > testQueueSize {
+		t.Fatalf("queue length %d exceeds %d", n, testQueueSize)
+	}
+	// 队列中的报文加写协程正在写的一条,再留出固定余量
+	limit := uint64((testQueueSize+1)*testPayloadSize) + 8<<20
+	if grown := int64(heapInUse()) - int64(before); grown > int64(limit) {
+		t.Fatalf("heap grew %d bytes, limit %d", grown, limit)
+	}
+}
+
+func TestWriteQueueDropOldestBounded(t *testing.T) {
+	q := stalledQueue(t, enmu.DropOldestPolicy, time.Minute)
+	before := heapInUse()
+	var dropped int
+	results := make([]<-chan clients_dto.SendResult, 0, testPushes)
+	for i := 0; i < testPushes; i++ {
+		results = append(results, q.push(make([]byte, testPayloadSize), 3))
+	}
+	assertBounded(t, q, before)
+	for _, ch := range results {
+		select {
+		case res := <-ch:
+			if !errors.Is(res.Err, enmu.PacketDroppedError) {
+				t.Fatalf("unexpected result %+v", res)
+			}
+			dropped++
+		default:
+		}
+	}
+	// 一条在写协程中,testQueueSize条在队列中
+	if want := testPushes - testQueueSize - 1; dropped != want {
+		t.Fatalf("dropped %d, want %d", dropped, want)
+	}
+}
+
+func TestWriteQueueDisconnectBounded(t *testing.T) {
+	q := stalledQueue(t, enmu.DisconnectPolicy, time.Minute)
+	var slow int32
+	q.onError = func(err error) {
+		if errors.Is(err, enmu.SlowConsumerError) {
+			atomic.AddInt32(&slow, 1)
+		}
+	}
+	before := heapInUse()
+	var rejected int
+	for i := 0; i < testPushes; i++ {
+		select {
+		case res := <-q.push(make([]byte, testPayloadSize), 3):
+			if !errors.Is(res.Err, enmu.SlowConsumerError) {
+				t.Fatalf("unexpected result %+v", res)
+			}
+			rejected++
+		default:
+		}
+	}
+	assertBounded(t, q, before)
+	if rejected < testPushes-testQueueSize-1 {
+		t.Fatalf("rejected %d, want at least %d", rejected, testPushes-testQueueSize-1)
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&slow) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if atomic.LoadInt32(&slow) == 0 {
+		t.Fatal("onError is not called with SlowConsumerError")
+	}
+}
+
+func TestWriteQueueBlockBounded(t *testing.T) {
+	timeout := 50 * time.Millisecond
+	q := stalledQueue(t, enmu.BlockPolicy, timeout)
+	before := heapInUse()
+	// 队列满后每次push最多阻塞timeout,超时的报文不入队
+	for i := 0; i < testQueueSize*4; i++ {
+		start := time.Now()
+		ch := q.push(make([]byte, testPayloadSize), 3)
+		if i > testQueueSize+1 {
+			if elapsed := time.Since(start); elapsed > 10*timeout {
+				t.Fatalf("push blocked %v, write timeout %v", elapsed, timeout)
+			}
+			select {
+			case res := <-ch:
+				if !errors.Is(res.Err, enmu.WriteTimeoutError) && !errors.Is(res.Err, enmu.ClientDisconnectError) {
+					t.Fatalf("unexpected result %+v", res)
+				}
+			default:
+			}
+		}
+	}
+	assertBounded(t, q, before)
+}
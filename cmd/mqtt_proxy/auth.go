@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/clients"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"github.com/qdmc/mqtt_single_proxy/rules"
+	"strings"
+)
+
+// subAckFailure    SUBACK中拒绝订阅的返回码
+const subAckFailure = 0x80
+
+var aclDeniedError = errors.New("acl denied")
+
+// authenticator    按配置校验用户名与密码
+type authenticator struct {
+	allowAnonymous bool
+	users          map[string][]byte // 用户名 -> 密码的sha256
+}
+
+func newAuthenticator(c authConfig) *authenticator {
+	a := &authenticator{allowAnonymous: c.AllowAnonymous, users: map[string][]byte{}}
+	for _, u := range c.Users {
+		if u.PasswordSha256 != "" {
+			a.users[u.Username], _ = hex.DecodeString(u.PasswordSha256)
+		} else {
+			sum := sha256.Sum256([]byte(u.Password))
+			a.users[u.Username] = sum[:]
+		}
+	}
+	return a
+}
+
+func (a *authenticator) handshake(hd clients_dto.ConnectionHandshakeDatabase) enmu.HandshakeResult {
+	if hd.UserName == "" {
+		if a.allowAnonymous {
+			return enmu.Success
+		}
+		return enmu.UserNameOrPasswordError
+	}
+	if len(a.users) == 0 {
+		return enmu.Success
+	}
+	want, ok := a.users[hd.UserName]
+	sum := sha256.Sum256([]byte(hd.Password))
+	if !ok || subtle.ConstantTimeCompare(want, sum[:]) != 1 {
+		return enmu.UserNameOrPasswordError
+	}
+	return enmu.Success
+}
+
+// acl    发布与订阅权限;拒绝的PUBLISH被丢弃,拒绝的订阅在SUBACK中返回0x80
+type acl struct {
+	clients.HooksBase
+	m            clients.ClientManagerInterface
+	allowDefault bool
+	rules        []aclRuleConfig
+}
+
+func newAcl(c aclConfig) *acl {
+	return &acl{allowDefault: c.Default == "allow", rules: c.Rules}
+}
+
+func (a *acl) OnPublish(id string, p *packets.PublishPacket) error {
+	if !a.allowed(id, "publish", p.TopicName) {
+		return aclDeniedError
+	}
+	return nil
+}
+
+func (a *acl) OnSubscribe(id string, p *packets.SubscribePacket) error {
+	for _, tf := range p.List {
+		if tf != nil && !a.allowed(id, "subscribe", tf.Topic) {
+			tf.Qos = subAckFailure
+		}
+	}
+	return nil
+}
+
+// allowed    按顺序匹配规则,第一条匹配的规则生效
+func (a *acl) allowed(id, access, topic string) bool {
+	if len(a.rules) == 0 {
+		return a.allowDefault
+	}
+	userName := ""
+	if db, err := a.m.GetOnce(id); err == nil {
+		userName = db.UserName
+	}
+	for _, r := range a.rules {
+		if (r.Username != "" && r.Username != userName) || (r.ClientId != "" && r.ClientId != id) {
+			continue
+		}
+		if r.Access != "all" && r.Access != access {
+			continue
+		}
+		replacer := strings.NewReplacer("${username}", userName, "${clientid}", id)
+		for _, filter := range r.Topics {
+			filter = replacer.Replace(filter)
+			if (access == "publish" && rules.MatchTopic(filter, topic)) || (access == "subscribe" && covers(filter, topic)) {
+				return r.Permission == "allow"
+			}
+		}
+	}
+	return a.allowDefault
+}
+
+// covers    规则过滤器是否包含订阅的过滤器,如:a/#包含a/+/b,a/+不包含a/#
+func covers(filter, sub string) bool {
+	fs, ss := strings.Split(filter, "/"), strings.Split(sub, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ss) || ss[i] == "#" {
+			return false
+		}
+		if f != "+" && (f != ss[i] || ss[i] == "+") {
+			return false
+		}
+	}
+	return len(fs) == len(ss)
+}
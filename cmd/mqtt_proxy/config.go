@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/qdmc/mqtt_single_proxy/clients"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// config   配置文件,JSON、YAML或TOML格式(按扩展名区分,字段名相同);未填写的字段使用默认值
+type config struct {
+	Listeners       listenersConfig `json:"listeners"`
+	Auth            authConfig      `json:"auth"`
+	Acl             aclConfig       `json:"acl"`
+	Limits          limitsConfig    `json:"limits"`
+	Statistics      bool            `json:"statistics"` // 是否开启流量统计
+	Session         sessionConfig   `json:"session"`
+	Journal         journalConfig   `json:"journal"`
+	Cluster         clusterConfig   `json:"cluster"`
+	ShutdownTimeout int64           `json:"shutdown_timeout"` // 优雅关闭的最长等待(秒)
+}
+
+type listenersConfig struct {
+	Tcp              portConfig          `json:"tcp"`
+	Websocket        websocketConfig     `json:"websocket"`
+	Udp              udpConfig           `json:"udp"`
+	ProxyProtocol    proxyProtocolConfig `json:"proxy_protocol"`
+	ForwardedTrusted []string            `json:"forwarded_trusted"` // 可信的http代理网段
+}
+
+type portConfig struct {
+	Port uint16 `json:"port"`
+}
+
+type websocketConfig struct {
+	Enabled bool   `json:"enabled"`
+	Port    uint16 `json:"port"`
+	Path    string `json:"path"`
+}
+
+type udpConfig struct {
+	Enabled bool   `json:"enabled"`
+	Port    uint16 `json:"port"`
+}
+
+type proxyProtocolConfig struct {
+	Enabled bool     `json:"enabled"`
+	Trusted []string `json:"trusted"` // 可信的上游网段,来自这些地址的链接必须带有协议头
+}
+
+type authConfig struct {
+	AllowAnonymous bool         `json:"allow_anonymous"` // 是否允许不带用户名的链接
+	Users          []userConfig `json:"users"`           // 为空时不校验用户名密码
+}
+
+type userConfig struct {
+	Username       string `json:"username"`
+	Password       string `json:"password,omitempty"`        // 明文密码
+	PasswordSha256 string `json:"password_sha256,omitempty"` // 密码的sha256(hex),与password二选一
+}
+
+type aclConfig struct {
+	Default string          `json:"default"` // 没有规则匹配时的权限:allow或deny
+	Rules   []aclRuleConfig `json:"rules"`   // 按顺序匹配,第一条匹配的规则生效
+}
+
+type aclRuleConfig struct {
+	Username   string   `json:"username,omitempty"` // 为空时匹配任意用户
+	ClientId   string   `json:"clientid,omitempty"` // 为空时匹配任意客户端
+	Access     string   `json:"access"`             // publish、subscribe或all
+	Permission string   `json:"permission"`         // allow或deny
+	Topics     []string `json:"topics"`             // 主题过滤器,支持${username}、${clientid}占位符
+}
+
+type limitsConfig struct {
+	MaxPacketSize     int    `json:"max_packet_size"`     // 报文最大长度(字节)
+	MaxMessageSize    int    `json:"max_message_size"`    // websocket消息最大长度(字节)
+	WriteQueueSize    int    `json:"write_queue_size"`    // 每个客户端的发送队列长度
+	WriteTimeout      int64  `json:"write_timeout"`       // 写超时(秒)
+	QueueFullPolicy   string `json:"queue_full_policy"`   // block、drop_oldest或disconnect
+	ClientTimeout     int64  `json:"client_timeout"`      // 客户端超时(秒),10-300
+	MaxHandshakeTime  int64  `json:"max_handshake_time"`  // 握手超时(秒)
+	DispatchWorkers   int    `json:"dispatch_workers"`    // 回调分发的工作协程数
+	DispatchQueue     int    `json:"dispatch_queue"`      // 每个分发分片的队列长度
+	MaxQueuedMessages int    `json:"max_queued_messages"` // 每个离线持久会话的排队消息上限
+}
+
+type sessionConfig struct {
+	File   string `json:"file"`   // 持久会话文件,为空时不持久化
+	Expiry int64  `json:"expiry"` // 离线会话的保留时长(秒),0为不过期
+}
+
+type journalConfig struct {
+	Size int    `json:"size"`
+	File string `json:"file"` // 为空时只保存在内存中
+}
+
+type clusterConfig struct {
+	NodeId    string           `json:"node_id"` // 为空时不开启集群
+	Port      uint16           `json:"port"`
+	Bind      string           `json:"bind"` // 监听的IP,为空时监听所有网卡
+	Advertise string           `json:"advertise"`
+	Seeds     []string         `json:"seeds"`
+	Secret    string           `json:"secret,omitempty"` // 节点间的共享密钥,与tls至少配置一个
+	Tls       clusterTlsConfig `json:"tls"`
+}
+
+// clusterTlsConfig    节点间的TLS双向认证,证书需同时可用于服务端与客户端
+type clusterTlsConfig struct {
+	Cert string `json:"cert,omitempty"` // 证书文件(PEM)
+	Key  string `json:"key,omitempty"`  // 私钥文件(PEM)
+	Ca   string `json:"ca,omitempty"`   // 校验对端证书的CA文件(PEM)
+}
+
+// tlsConfig    未配置证书时返回nil
+func (c clusterTlsConfig) tlsConfig() (*tls.Config, error) {
+	if c.Cert == "" && c.Key == "" && c.Ca == "" {
+		return nil, nil
+	}
+	if c.Cert == "" || c.Key == "" || c.Ca == "" {
+		return nil, errors.New("cert, key and ca are all required")
+	}
+	cert, err := tls.LoadX509KeyPair(c.Cert, c.Key)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(c.Ca)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("%s contains no certificate", c.Ca)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+var queueFullPolicies = map[string]enmu.QueueFullPolicy{
+	"block":       enmu.BlockPolicy,
+	"drop_oldest": enmu.DropOldestPolicy,
+	"disconnect":  enmu.DisconnectPolicy,
+}
+
+// defaultConfig    默认配置,与ClientManagerOptions的默认值一致
+func defaultConfig() *config {
+	return &config{
+		Listeners: listenersConfig{
+			Tcp:       portConfig{Port: 1883},
+			Websocket: websocketConfig{Port: 80, Path: "/websocket"},
+			Udp:       udpConfig{Port: 1884},
+		},
+		Auth: authConfig{AllowAnonymous: true},
+		Acl:  aclConfig{Default: "allow"},
+		Limits: limitsConfig{
+			MaxPacketSize:     1 << 20,
+			MaxMessageSize:    1 << 20,
+			WriteQueueSize:    128,
+			WriteTimeout:      10,
+			QueueFullPolicy:   "block",
+			ClientTimeout:     60,
+			MaxHandshakeTime:  10,
+			DispatchWorkers:   runtime.NumCPU(),
+			DispatchQueue:     1024,
+			MaxQueuedMessages: 1000,
+		},
+		Journal:         journalConfig{Size: 10000},
+		Cluster:         clusterConfig{Port: 1885},
+		ShutdownTimeout: 30,
+	}
+}
+
+// loadConfig    读取并校验配置文件,path为空时使用默认配置
+func loadConfig(path string) (*config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		return cfg, cfg.validate()
+	}
+	var decode func(bs []byte, cfg *config) error
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json", "":
+		decode = decodeConfig
+	case ".yaml", ".yml":
+		decode = decodeYaml
+	case ".toml":
+		decode = decodeToml
+	default:
+		return nil, fmt.Errorf("%s: unsupported config format %q, only JSON, YAML and TOML are supported", path, filepath.Ext(path))
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = decode(bs, cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err = cfg.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// decodeConfig    解析JSON,未知字段视为错误,错误中带行列号
+func decodeConfig(bs []byte, cfg *config) error {
+	return decodeJson(bs, cfg, func(offset int64) string {
+		return position(bs, offset)
+	})
+}
+
+// decodeJson    按JSON解析,pos将偏移量转换为错误中的位置
+func decodeJson(bs []byte, cfg *config, pos func(offset int64) string) error {
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(cfg)
+	if err == nil {
+		if _, extra := dec.Token(); extra != io.EOF {
+			return errors.New("unexpected data after the top-level object")
+		}
+		return nil
+	}
+	var se *json.SyntaxError
+	var te *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &se):
+		return fmt.Errorf("%s: %s", pos(se.Offset), se.Error())
+	case errors.As(err, &te):
+		return fmt.Errorf("%s: %s: expected %s, got %s", pos(te.Offset), te.Field, te.Type, te.Value)
+	}
+	return err
+}
+
+// position    偏移量对应的行列号
+func position(bs []byte, offset int64) string {
+	if offset > int64(len(bs)) {
+		offset = int64(len(bs))
+	}
+	line := 1 + bytes.Count(bs[:offset], []byte("\n"))
+	col := offset - int64(bytes.LastIndexByte(bs[:offset], '\n'))
+	return fmt.Sprintf("line %d, column %d", line, col)
+}
+
+// validate    校验全部字段,返回所有错误
+func (c *config) validate() error {
+	var errs []error
+	fail := func(field, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", field, fmt.Sprintf(format, args...)))
+	}
+	checkPort := func(field string, port uint16) {
+		if port == 0 {
+			fail(field, "must be between 1 and 65535")
+		}
+	}
+	checkCidrs := func(field string, cidrs []string) {
+		for i, s := range cidrs {
+			if _, _, err := net.ParseCIDR(s); err != nil {
+				fail(fmt.Sprintf("%s[%d]", field, i), "%q is not a cidr, such as 10.0.0.0/8", s)
+			}
+		}
+	}
+	l := c.Listeners
+	checkPort("listeners.tcp.port", l.Tcp.Port)
+	if l.Websocket.Enabled {
+		checkPort("listeners.websocket.port", l.Websocket.Port)
+		if !strings.HasPrefix(l.Websocket.Path, "/") {
+			fail("listeners.websocket.path", "must start with '/'")
+		}
+		if l.Websocket.Port == l.Tcp.Port {
+			fail("listeners.websocket.port", "conflicts with listeners.tcp.port")
+		}
+	}
+	if l.Udp.Enabled {
+		checkPort("listeners.udp.port", l.Udp.Port)
+	}
+	if l.ProxyProtocol.Enabled && len(l.ProxyProtocol.Trusted) == 0 {
+		fail("listeners.proxy_protocol.trusted", "is required when proxy_protocol is enabled")
+	}
+	checkCidrs("listeners.proxy_protocol.trusted", l.ProxyProtocol.Trusted)
+	checkCidrs("listeners.forwarded_trusted", l.ForwardedTrusted)
+	names := map[string]bool{}
+	for i, u := range c.Auth.Users {
+		field := fmt.Sprintf("auth.users[%d]", i)
+		if u.Username == "" {
+			fail(field+".username", "is required")
+		} else if names[u.Username] {
+			fail(field+".username", "%q is duplicated", u.Username)
+		}
+		names[u.Username] = true
+		switch {
+		case u.Password != "" && u.PasswordSha256 != "":
+			fail(field, "password and password_sha256 are mutually exclusive")
+		case u.Password == "" && u.PasswordSha256 == "":
+			fail(field, "password or password_sha256 is required")
+		case u.PasswordSha256 != "":
+			if bs, err := hex.DecodeString(u.PasswordSha256); err != nil || len(bs) != 32 {
+				fail(field+".password_sha256", "must be 64 hex characters")
+			}
+		}
+	}
+	checkPermission := func(field, p string) {
+		if p != "allow" && p != "deny" {
+			fail(field, "must be allow or deny, got %q", p)
+		}
+	}
+	checkPermission("acl.default", c.Acl.Default)
+	for i, r := range c.Acl.Rules {
+		field := fmt.Sprintf("acl.rules[%d]", i)
+		if r.Access != "publish" && r.Access != "subscribe" && r.Access != "all" {
+			fail(field+".access", "must be publish, subscribe or all, got %q", r.Access)
+		}
+		checkPermission(field+".permission", r.Permission)
+		if len(r.Topics) == 0 {
+			fail(field+".topics", "is required")
+		}
+		for j, t := range r.Topics {
+			if !validFilter(t) {
+				fail(fmt.Sprintf("%s.topics[%d]", field, j), "%q is not a valid topic filter", t)
+			}
+		}
+	}
+	lm := c.Limits
+	positive := map[string]int64{
+		"limits.max_packet_size":     int64(lm.MaxPacketSize),
+		"limits.max_message_size":    int64(lm.MaxMessageSize),
+		"limits.write_queue_size":    int64(lm.WriteQueueSize),
+		"limits.write_timeout":       lm.WriteTimeout,
+		"limits.max_handshake_time":  lm.MaxHandshakeTime,
+		"limits.dispatch_workers":    int64(lm.DispatchWorkers),
+		"limits.dispatch_queue":      int64(lm.DispatchQueue),
+		"limits.max_queued_messages": int64(lm.MaxQueuedMessages),
+		"journal.size":               int64(c.Journal.Size),
+		"shutdown_timeout":           c.ShutdownTimeout,
+	}
+	for _, field := range sortedKeys(positive) {
+		if positive[field] <= 0 {
+			fail(field, "must be greater than 0")
+		}
+	}
+	if c.Session.Expiry < 0 {
+		fail("session.expiry", "must not be negative")
+	}
+	if lm.ClientTimeout < 10 || lm.ClientTimeout > 300 {
+		fail("limits.client_timeout", "must be between 10 and 300")
+	}
+	if _, ok := queueFullPolicies[lm.QueueFullPolicy]; !ok {
+		fail("limits.queue_full_policy", "must be block, drop_oldest or disconnect, got %q", lm.QueueFullPolicy)
+	}
+	if c.Cluster.NodeId != "" {
+		checkPort("cluster.port", c.Cluster.Port)
+		for i, s := range c.Cluster.Seeds {
+			if _, _, err := net.SplitHostPort(s); err != nil {
+				fail(fmt.Sprintf("cluster.seeds[%d]", i), "%q is not host:port", s)
+			}
+		}
+		if c.Cluster.Bind != "" && net.ParseIP(c.Cluster.Bind) == nil {
+			fail("cluster.bind", "%q is not an IP", c.Cluster.Bind)
+		}
+		tc, err := c.Cluster.Tls.tlsConfig()
+		if err != nil {
+			fail("cluster.tls", "%v", err)
+		} else if tc == nil && c.Cluster.Secret == "" {
+			fail("cluster", "secret or tls is required")
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validFilter    主题过滤器是否合法:#只能在最后一段,通配符必须独占一段
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	segs := strings.Split(filter, "/")
+	for i, s := range segs {
+		if s == "#" && i != len(segs)-1 {
+			return false
+		}
+		if len(s) > 1 && strings.ContainsAny(s, "+#") {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedKeys(m map[string]int64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// redacted    隐藏密码后的配置,用于打印
+func (c *config) redacted() *config {
+	cp := *c
+	cp.Auth.Users = make([]userConfig, len(c.Auth.Users))
+	for i, u := range c.Auth.Users {
+		cp.Auth.Users[i] = u
+		if u.Password != "" {
+			cp.Auth.Users[i].Password = "******"
+		}
+	}
+	if c.Cluster.Secret != "" {
+		cp.Cluster.Secret = "******"
+	}
+	return &cp
+}
+
+// printConfig    以JSON打印生效的配置
+func printConfig(w io.Writer, c *config) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(c.redacted())
+}
+
+// options    转换为ClientManagerOptions
+func (c *config) options() *clients.ClientManagerOptions {
+	l, lm := c.Listeners, c.Limits
+	clusterTls, _ := c.Cluster.Tls.tlsConfig() // 已在validate中校验
+	return &clients.ClientManagerOptions{
+		TcpPort:           l.Tcp.Port,
+		IsWebsocket:       l.Websocket.Enabled,
+		WebsocketPort:     l.Websocket.Port,
+		WebsocketPath:     l.Websocket.Path,
+		IsUdp:             l.Udp.Enabled,
+		UdpPort:           l.Udp.Port,
+		IsStatistics:      c.Statistics,
+		ClientTimeOut:     lm.ClientTimeout,
+		MaxHandshakeTime:  lm.MaxHandshakeTime,
+		MaxPacketSize:     lm.MaxPacketSize,
+		MaxMessageSize:    lm.MaxMessageSize,
+		WriteQueueSize:    lm.WriteQueueSize,
+		WriteTimeOut:      lm.WriteTimeout,
+		QueueFullPolicy:   queueFullPolicies[lm.QueueFullPolicy],
+		DispatchWorkers:   lm.DispatchWorkers,
+		DispatchQueue:     lm.DispatchQueue,
+		JournalSize:       c.Journal.Size,
+		JournalFile:       c.Journal.File,
+		ProxyProtocol:     l.ProxyProtocol.Enabled,
+		ProxyTrusted:      l.ProxyProtocol.Trusted,
+		ForwardedTrusted:  l.ForwardedTrusted,
+		ClusterNodeId:     c.Cluster.NodeId,
+		ClusterPort:       c.Cluster.Port,
+		ClusterAdvertise:  c.Cluster.Advertise,
+		ClusterSeeds:      c.Cluster.Seeds,
+		ClusterBind:       c.Cluster.Bind,
+		ClusterSecret:     c.Cluster.Secret,
+		ClusterTLS:        clusterTls,
+		MaxQueuedMessages: lm.MaxQueuedMessages,
+		SessionExpiry:     c.Session.Expiry,
+		Logger:            slog.Default(),
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strings"
+)
+
+// sourceMap    转换后JSON中的偏移量到原文件位置的映射,按偏移量递增记录
+type sourceMap struct {
+	buf     []byte
+	offsets []int64
+	pos     []string
+}
+
+// mark    记录当前写入位置对应的原文件行列号
+func (s *sourceMap) mark(line, col int) {
+	s.offsets = append(s.offsets, int64(len(s.buf)))
+	s.pos = append(s.pos, fmt.Sprintf("line %d, column %d", line, col))
+}
+
+func (s *sourceMap) write(v any) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.buf = append(s.buf, bs...)
+	return nil
+}
+
+// position    偏移量之前最近一次记录的位置
+func (s *sourceMap) position(offset int64) string {
+	i := sort.Search(len(s.offsets), func(i int) bool { return s.offsets[i] > offset })
+	if i == 0 {
+		return "line 1, column 1"
+	}
+	return s.pos[i-1]
+}
+
+// decodeYaml    将YAML转换为JSON后解析,错误中的行列号对应YAML文件
+func decodeYaml(bs []byte, cfg *config) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(bs, &doc); err != nil {
+		return errors.New(strings.TrimPrefix(err.Error(), "yaml: "))
+	}
+	s := &sourceMap{}
+	if len(doc.Content) == 0 {
+		s.buf = []byte("{}")
+	} else if err := s.yamlNode(doc.Content[0]); err != nil {
+		return err
+	}
+	return decodeJson(s.buf, cfg, s.position)
+}
+
+func (s *sourceMap) yamlNode(n *yaml.Node) error {
+	s.mark(n.Line, n.Column)
+	switch n.Kind {
+	case yaml.AliasNode:
+		return s.yamlNode(n.Alias)
+	case yaml.MappingNode:
+		s.buf = append(s.buf, '{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			if key.Kind != yaml.ScalarNode {
+				return fmt.Errorf("line %d, column %d: mapping key must be a scalar", key.Line, key.Column)
+			}
+			if i > 0 {
+				s.buf = append(s.buf, ',')
+			}
+			s.mark(key.Line, key.Column)
+			if err := s.write(key.Value); err != nil {
+				return err
+			}
+			s.buf = append(s.buf, ':')
+			if err := s.yamlNode(n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		s.buf = append(s.buf, '}')
+	case yaml.SequenceNode:
+		s.buf = append(s.buf, '[')
+		for i, item := range n.Content {
+			if i > 0 {
+				s.buf = append(s.buf, ',')
+			}
+			if err := s.yamlNode(item); err != nil {
+				return err
+			}
+		}
+		s.buf = append(s.buf, ']')
+	default:
+		var v any
+		if err := n.Decode(&v); err != nil {
+			return fmt.Errorf("line %d, column %d: %s", n.Line, n.Column, strings.TrimPrefix(err.Error(), "yaml: "))
+		}
+		if err := s.write(v); err != nil {
+			return fmt.Errorf("line %d, column %d: %s", n.Line, n.Column, err)
+		}
+	}
+	return nil
+}
+
+// decodeToml    将TOML转换为JSON后解析,错误中的行列号对应TOML文件
+func decodeToml(bs []byte, cfg *config) error {
+	var root map[string]toml.Primitive
+	md, err := toml.Decode(string(bs), &root)
+	if err != nil {
+		var pe toml.ParseError
+		if errors.As(err, &pe) {
+			return fmt.Errorf("line %d, column %d: %s", pe.Position.Line, pe.Position.Col, pe.Message)
+		}
+		return err
+	}
+	s := &sourceMap{}
+	if err = s.tomlTable(&md, root); err != nil {
+		return err
+	}
+	return decodeJson(s.buf, cfg, s.position)
+}
+
+// tomlTable    键按名称排序输出,位置为键对应的值;数组内的值使用数组的位置,隐式定义的表没有位置
+func (s *sourceMap) tomlTable(md *toml.MetaData, table map[string]toml.Primitive) error {
+	keys := make([]string, 0, len(table))
+	for k := range table {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	s.buf = append(s.buf, '{')
+	for i, k := range keys {
+		if i > 0 {
+			s.buf = append(s.buf, ',')
+		}
+		s.tomlMark(md, table[k])
+		if err := s.write(k); err != nil {
+			return err
+		}
+		s.buf = append(s.buf, ':')
+		var v any
+		if err := md.PrimitiveDecode(table[k], &v); err != nil {
+			return err
+		}
+		if _, ok := v.(map[string]any); ok {
+			var sub map[string]toml.Primitive
+			if err := md.PrimitiveDecode(table[k], &sub); err != nil {
+				return err
+			}
+			if err := s.tomlTable(md, sub); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := s.write(v); err != nil {
+			return err
+		}
+	}
+	s.buf = append(s.buf, '}')
+	return nil
+}
+
+// tomlLocator    解码时总是返回错误,用于从ParseError中取得值的位置
+type tomlLocator struct{}
+
+var errTomlLocate = errors.New("locate")
+
+func (tomlLocator) UnmarshalTOML(any) error {
+	return errTomlLocate
+}
+
+func (s *sourceMap) tomlMark(md *toml.MetaData, p toml.Primitive) {
+	var pe toml.ParseError
+	if err := md.PrimitiveDecode(p, &tomlLocator{}); errors.As(err, &pe) && pe.Position.Line > 0 {
+		s.mark(pe.Position.Line, pe.Position.Col)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFormats(t *testing.T) {
+	files := map[string]string{
+		"proxy.json": `{"listeners": {"tcp": {"port": 2883}, "websocket": {"enabled": true, "port": 2884, "path": "/mqtt"}},
+ "auth": {"allow_anonymous": true, "users": [{"username": "u1", "password": "p1"}]}}`,
+		"proxy.yaml": `
+listeners:
+  tcp:
+    port: 2883
+  websocket: {enabled: true, port: 2884, path: /mqtt}
+auth:
+  allow_anonymous: true
+  users:
+    - username: u1
+      password: p1
+`,
+		"proxy.toml": `
+[listeners.tcp]
+port = 2883
+
+[listeners.websocket]
+enabled = true
+port = 2884
+path = "/mqtt"
+
+[auth]
+allow_anonymous = true
+
+[[auth.users]]
+username = "u1"
+password = "p1"
+`,
+	}
+	for name, content := range files {
+		cfg, err := loadConfig(writeConfig(t, name, content))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		l := cfg.Listeners
+		if l.Tcp.Port != 2883 || !l.Websocket.Enabled || l.Websocket.Port != 2884 || l.Websocket.Path != "/mqtt" {
+			t.Fatalf("%s: listeners %+v", name, l)
+		}
+		if !cfg.Auth.AllowAnonymous || len(cfg.Auth.Users) != 1 || cfg.Auth.Users[0].Username != "u1" {
+			t.Fatalf("%s: auth %+v", name, cfg.Auth)
+		}
+		// 未填写的字段使用默认值
+		if cfg.ShutdownTimeout != defaultConfig().ShutdownTimeout {
+			t.Fatalf("%s: shutdown_timeout %d", name, cfg.ShutdownTimeout)
+		}
+	}
+}
+
+func TestLoadConfigErrorPosition(t *testing.T) {
+	cases := []struct {
+		name, content, want string
+	}{
+		{"type.json", "{\n  \"listeners\": {\n    \"tcp\": {\"port\": \"x\"}\n  }\n}", "line 3, column"},
+		{"syntax.json", "{\n  \"statistics\": true,\n}", "line 3, column"},
+		{"type.yaml", "statistics: true\nlisteners:\n  tcp:\n    port: abc\n", "line 4, column 11"},
+		{"syntax.yaml", "statistics: true\nlisteners: tcp: 1\n", "line 2: mapping values"},
+		{"unknown.yaml", "statistics: true\nlistenrs:\n  tcp: {}\n", "unknown field"},
+		{"type.toml", "statistics = true\n\n[listeners.tcp]\nport = \"abc\"\n", "line 4, column"},
+		{"syntax.toml", "statistics = true\nport = = 1\n", "line 2, column"},
+	}
+	for _, c := range cases {
+		_, err := loadConfig(writeConfig(t, c.name, c.content))
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Fatalf("%s: error %v, want %q", c.name, err, c.want)
+		}
+	}
+}
+
+func TestLoadConfigUnsupported(t *testing.T) {
+	_, err := loadConfig(writeConfig(t, "proxy.ini", "port=1"))
+	if err == nil || !strings.Contains(err.Error(), "unsupported config format") {
+		t.Fatalf("error %v", err)
+	}
+}
@@ -0,0 +1,127 @@
+// mqtt_proxy  按配置文件启动客户端管理器
+//
+//	mqtt_proxy -config proxy.json
+//	mqtt_proxy -config proxy.json -print-config
+//	mqtt_proxy -config proxy.json -check
+//	mqtt_proxy -config proxy.yaml
+//	mqtt_proxy -config proxy.toml
+//
+// 收到SIGHUP时重新加载配置文件,已有链接不受影响
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/qdmc/mqtt_single_proxy/clients"
+	"github.com/qdmc/mqtt_single_proxy/store"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	path := flag.String("config", "", "配置文件(JSON、YAML或TOML,按扩展名区分),为空时使用默认配置")
+	printCfg := flag.Bool("print-config", false, "打印生效的配置(隐藏密码)后退出")
+	check := flag.Bool("check", false, "只校验配置")
+	flag.Parse()
+	cfg, err := loadConfig(*path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *printCfg {
+		if err = printConfig(os.Stdout, cfg); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *check {
+		fmt.Println("config ok")
+		return
+	}
+	if err = run(*path, cfg); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run    启动管理器,收到SIGHUP时重新加载配置文件,收到SIGINT/SIGTERM后优雅关闭;再次收到信号时立即退出
+func run(path string, cfg *config) error {
+	opt := cfg.options()
+	if cfg.Session.File != "" {
+		st, err := store.NewFileStore(cfg.Session.File)
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+		opt.SessionStore = st
+	}
+	rt := newRouter()
+	m := clients.NewClientManagerInstance(opt)
+	rt.m = m
+	m.SetOptions(handlers(m, rt, cfg, opt))
+	if err := m.Start(); err != nil {
+		return err
+	}
+	log.Printf("mqtt_proxy started, tcp port %d", cfg.Listeners.Tcp.Port)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	var s os.Signal
+	for s == nil {
+		select {
+		case <-hup:
+			cfg = reload(m, rt, path, cfg, opt.SessionStore)
+		case s = <-sig:
+		}
+	}
+	log.Printf("received %s, shutting down", s)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout)*time.Second)
+	defer cancel()
+	go func() {
+		s := <-sig
+		log.Printf("received %s again, forcing shutdown", s)
+		cancel()
+	}()
+	if err := m.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	log.Print("mqtt_proxy stopped")
+	return nil
+}
+
+// handlers    按配置设置握手、ACL与路由回调
+func handlers(m clients.ClientManagerInterface, rt *router, cfg *config, opt *clients.ClientManagerOptions) *clients.ClientManagerOptions {
+	ac := newAcl(cfg.Acl)
+	ac.m = m
+	opt.Handshake = newAuthenticator(cfg.Auth).handshake
+	opt.PacketContextCb = rt.onPacket
+	opt.DisConnectCb = rt.onDisconnect
+	opt.Hooks = []clients.Hooks{ac}
+	return opt
+}
+
+// reload    重新读取配置文件并热加载,失败时保持原配置;会话文件的修改需要重启
+func reload(m clients.ClientManagerInterface, rt *router, path string, cfg *config, st clients.SessionStore) *config {
+	newCfg, err := loadConfig(path)
+	if err != nil {
+		log.Printf("reload: %v", err)
+		return cfg
+	}
+	opt := newCfg.options()
+	opt.SessionStore = st
+	report, err := m.ReloadOptions(handlers(m, rt, newCfg, opt))
+	if err != nil {
+		log.Printf("reload: %v", err)
+		return cfg
+	}
+	if newCfg.Session.File != cfg.Session.File {
+		report.RestartRequired = append(report.RestartRequired, "session.file")
+	}
+	log.Printf("reloaded %s, applied: %v, restart required: %v", path, report.Applied, report.RestartRequired)
+	return newCfg
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/clients"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/rules"
+	"sync"
+)
+
+// router    内置的简单路由:回复确认与心跳,按订阅在本节点内以QoS0转发PUBLISH;其他节点的消息由集群转发
+type router struct {
+	m    clients.ClientManagerInterface
+	mu   sync.RWMutex
+	subs map[string]map[string]bool // ClientId -> 主题过滤器
+}
+
+func newRouter() *router {
+	return &router{subs: map[string]map[string]bool{}}
+}
+
+// onPacket    其他节点转发的PUBLISH已由集群投递给本地订阅者,确认也由来源节点回复,这里不处理
+func (r *router) onPacket(ctx context.Context, id string, p mqtt_packet.ControlPacketInterface) {
+	if clients.ClusterOrigin(ctx) != "" {
+		return
+	}
+	switch packet := p.(type) {
+	case *packets.PingReqPacket:
+		r.reply(id, packets.NewPingResp(nil))
+	case *packets.SubscribePacket:
+		ack := packets.NewSubAck(nil)
+		ack.MessageID = packet.MessageID
+		var filters []string
+		for _, tf := range packet.List {
+			if tf == nil || tf.Qos > 2 {
+				ack.ReturnCodes = append(ack.ReturnCodes, subAckFailure)
+				continue
+			}
+			filters = append(filters, tf.Topic)
+			ack.ReturnCodes = append(ack.ReturnCodes, 0)
+		}
+		r.subscribe(id, filters)
+		r.reply(id, ack)
+	case *packets.UnSubscribePacket:
+		r.unsubscribe(id, packet.Topics)
+		ack := packets.NewUnSubAck(nil)
+		ack.MessageID = packet.MessageID
+		r.reply(id, ack)
+	case *packets.PublishPacket:
+		switch packet.Qos() {
+		case 1:
+			ack := packets.NewPubAck(nil)
+			ack.MessageID = packet.MessageID
+			r.reply(id, ack)
+		case 2:
+			rec := packets.NewPubRec(nil)
+			rec.MessageID = packet.MessageID
+			r.reply(id, rec)
+		}
+		r.publish(packet)
+	case *packets.PubRelPacket:
+		comp := packets.NewPubComp(nil)
+		comp.MessageID = packet.MessageID
+		r.reply(id, comp)
+	}
+}
+
+func (r *router) onDisconnect(cd *clients_dto.ConnectionDatabase) {
+	r.mu.Lock()
+	delete(r.subs, cd.Id)
+	r.mu.Unlock()
+}
+
+func (r *router) reply(id string, p mqtt_packet.ControlPacketInterface) {
+	r.m.AsyncSendPacketOnce(id, p)
+}
+
+func (r *router) subscribe(id string, filters []string) {
+	if len(filters) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fs, ok := r.subs[id]
+	if !ok {
+		fs = map[string]bool{}
+		r.subs[id] = fs
+	}
+	for _, f := range filters {
+		fs[f] = true
+	}
+}
+
+func (r *router) unsubscribe(id string, filters []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, f := range filters {
+		delete(r.subs[id], f)
+	}
+}
+
+// publish    以QoS0转发给本节点匹配的订阅者
+func (r *router) publish(p *packets.PublishPacket) {
+	var ids []string
+	r.mu.RLock()
+	for id, fs := range r.subs {
+		for f := range fs {
+			if rules.MatchTopic(f, p.TopicName) {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	r.mu.RUnlock()
+	for _, id := range ids {
+		out := packets.NewPublish(nil)
+		out.TopicName = p.TopicName
+		out.Payload = p.Payload
+		r.m.AsyncSendPacketOnce(id, out)
+	}
+}
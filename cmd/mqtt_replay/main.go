@@ -0,0 +1,43 @@
+// mqtt_replay  按抓包文件向管理器重放客户端报文
+//
+//	mqtt_replay -file capture.jsonl -addr 127.0.0.1:1883 -speed 10 -ids dev1,dev2
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/qdmc/mqtt_single_proxy/replay"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+)
+
+func main() {
+	var opt replay.Options
+	var ids string
+	flag.StringVar(&opt.File, "file", "", "抓包文件")
+	flag.StringVar(&opt.Addr, "addr", "127.0.0.1:1883", "管理器的tcp地址")
+	flag.Float64Var(&opt.Speed, "speed", 1, "回放速度倍数,小于0时不等待")
+	flag.StringVar(&ids, "ids", "", "只回放这些ClientId,逗号分隔")
+	flag.StringVar(&opt.Password, "password", "", "CONNECT使用的密码")
+	flag.Int64Var(&opt.Wait, "wait", 500, "发送完成后等待响应的时长(毫秒)")
+	flag.Parse()
+	if opt.File == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if ids != "" {
+		opt.Ids = strings.Split(ids, ",")
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	res, err := replay.Run(ctx, opt)
+	fmt.Printf("clients=%d connects=%d sent=%d received=%d errors=%d duration=%s\n",
+		res.Clients, res.Connects, res.Sent, res.Received, res.Errors, time.Duration(res.DurationNano))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
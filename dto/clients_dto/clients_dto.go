@@ -1,26 +1,249 @@
 package clients_dto
 
 import (
+	"crypto/tls"
 	"github.com/qdmc/mqtt_single_proxy/enmu"
 	"net"
+	"net/http"
+	"net/url"
 )
 
 // ConnectionDatabase  链接数据统计
 type ConnectionDatabase struct {
-	Id            string // sessionId
+	Id              string // sessionId
+	Protocol        enmu.ClientProtocol
+	ConnectedNano   int64  // 链接开始时间
+	CloseNano       int64  // 链接断开时间
+	WriteLength     uint64 // 发送的数据长度
+	ReadLength      uint64 // 接收的数据长度
+	Status          bool   // 状态
+	IsStatistics    bool   // 是否开启流量统计,默认为false
+	Err             error
+	UserName        string            // 握手时的用户名
+	Addr            net.Addr          // 客户端地址
+	Tags            map[string]string // 客户端标签,由ClientManager.SetTags设置
+	ProtocolVersion byte              // MQTT协议版本,3:3.1;4:3.1.1;5:5.0
+	Keepalive       uint16            // 握手时的保活时长(秒)
+	CleanSession    bool              // 握手时的清理会话标志
+	HasWill         bool              // 握手时是否带遗嘱
+	Will            *StoredMessage    // 握手时的遗嘱消息,没有遗嘱时为nil;配置主题映射时主题已加上挂载点
+	Subprotocol     string            // websocket协商的子协议,tcp链接为空
+	LastActiveNano  int64             // 最后一次收到数据的时间
+	ReadPackets     [16]uint64        // 按报文类型统计的接收数量,下标为报文类型;不受IsStatistics影响
+	WritePackets    [16]uint64        // 按报文类型统计的发送数量,下标为报文类型;不受IsStatistics影响
+}
+
+type ConnectionHandshakeDatabase struct {
+	ClientId     string
+	UserName     string
+	Password     string
+	Addr         net.Addr
+	IsAssignedId bool         // ClientId是否由服务端分配(客户端上报为空且清理会话)
+	Http         *HttpContext // websocket升级请求的上下文,tcp链接为nil
+}
+
+// HttpContext   websocket升级请求的上下文
+type HttpContext struct {
+	Host         string
+	Path         string
+	Header       http.Header
+	Cookies      []*http.Cookie
+	Query        url.Values
+	TLS          *tls.ConnectionState // 非TLS请求为nil
+	Peer         net.Addr             // 直连的对端地址(代理地址)
+	ForwardedFor []string             // X-Forwarded-For/Forwarded中的地址链,从客户端到最近的代理
+}
+
+// SendResult   异步发送结果
+type SendResult struct {
+	Length int64 // 写入的字节数
+	Err    error
+	Queued bool // 客户端离线,消息已存入持久会话的排队队列
+}
+
+// DispatchStatistics   回调分发统计
+type DispatchStatistics struct {
+	Workers         int    // 分片(工作协程)数量
+	QueueSize       int    // 每个分片的队列长度
+	Pending         int    // 所有分片中等待执行的任务数
+	MaxShardPending int    // 最拥堵分片中等待执行的任务数
+	Dispatched      uint64 // 已执行的任务数
+	Panics          uint64 // 回调panic次数
+	LastLagNano     int64  // 最近一个任务的排队时长
+	MaxLagNano      int64  // 最大排队时长
+	AvgLagNano      int64  // 平均排队时长
+}
+
+// BroadcastResult   批量发送结果
+type BroadcastResult struct {
+	Total   int                   // 匹配的客户端数量
+	Success int                   // 发送成功数量
+	Failed  int                   // 发送失败数量
+	Results map[string]SendResult // 每个客户端的发送结果,key为ClientId
+}
+
+// ClientQuery   客户端查询条件,零值字段不参与筛选
+type ClientQuery struct {
+	Protocol       enmu.ClientProtocol // 协议
+	Status         *bool               // 状态
+	UserName       string              // 用户名
+	Cidr           string              // 客户端地址网段,如:10.0.0.0/8
+	ConnectedSince int64               // 链接开始时间不早于该时间(纳秒)
+	IdPattern      string              // ClientId通配,语法同path.Match,如:device-*
+	SortBy         enmu.ClientSortKey  // 排序字段,默认:enmu.SortById
+	Desc           bool                // 是否降序
+	Limit          int                 // 每页数量,默认:100
+	Cursor         string              // 上一页返回的NextCursor,为空时从第一页开始;按收发长度排序时不支持
+}
+
+// ClientQueryResult   客户端查询结果
+type ClientQueryResult struct {
+	List       []ConnectionDatabase
+	NextCursor string // 下一页游标,为空表示没有更多数据;按收发长度排序时始终为空
+}
+
+// JournalEvent   链接日志事件
+type JournalEvent struct {
+	Type          enmu.JournalEventType
+	Id            string
+	UserName      string
 	Protocol      enmu.ClientProtocol
+	Addr          string // 客户端地址
+	Nano          int64  // 事件时间
 	ConnectedNano int64  // 链接开始时间
-	CloseNano     int64  // 链接断开时间
-	WriteLength   uint64 // 发送的数据长度
-	ReadLength    uint64 // 接收的数据长度
-	Status        bool   // 状态
-	IsStatistics  bool   // 是否开启流量统计,默认为false
-	Err           error
+	CloseNano     int64  // 链接断开时间,断开事件有效
+	DurationNano  int64  // 链接时长,断开事件有效
+	ReadLength    uint64 // 接收的数据长度,断开事件有效
+	WriteLength   uint64 // 发送的数据长度,断开事件有效
+	Reason        string // 断开原因,即ConnectionDatabase.Err
 }
 
-type ConnectionHandshakeDatabase struct {
-	ClientId string
-	UserName string
-	Password string
-	Addr     net.Addr
+// JournalQuery   链接日志查询条件,零值字段不参与筛选
+type JournalQuery struct {
+	Id        string // ClientId
+	StartNano int64  // 事件时间不早于
+	EndNano   int64  // 事件时间不晚于
+	Limit     int    // 最多返回条数(最新的优先),默认:全部
+}
+
+// ClusterNode   集群中已连接的其他节点
+type ClusterNode struct {
+	NodeId        string
+	Addr          string // 节点间通信地址
+	Clients       int    // 节点上的客户端数
+	Filters       int    // 节点上有订阅者的主题过滤器数
+	ConnectedNano int64  // 建立链接的时间
+}
+
+// Session   持久会话(CleanSession为false的客户端)
+type Session struct {
+	ClientId         string
+	Subscriptions    map[string]byte // 主题过滤器 -> QoS
+	CreatedNano      int64
+	UpdatedNano      int64
+	DisconnectedNano int64 // 最近一次断开的时间,在线时为0
+}
+
+// StoredMessage   持久化的消息:离线排队、飞行中或保留消息
+type StoredMessage struct {
+	ClientId  string // 排队与飞行中消息的目标客户端,保留消息为空
+	Topic     string
+	Payload   []byte
+	Qos       byte
+	Retain    bool
+	MessageId uint16 // 报文标识,QoS0为0
+	Nano      int64  // 写入时间
+}
+
+// DelayedMessage   等待发布的延迟消息
+type DelayedMessage struct {
+	Id          string // 延迟消息Id,取消时使用
+	ClientId    string // 发布者
+	Topic       string // 到期后发布的主题
+	Payload     []byte
+	Qos         byte
+	Retain      bool
+	Nano        int64 // 接收时间
+	ReleaseNano int64 // 到期时间
+}
+
+// DelayedQuery   延迟消息查询条件
+type DelayedQuery struct {
+	ClientId string // 发布者
+	Topic    string // 主题过滤器,支持+与#通配符
+	Limit    int    // 最多返回条数(最早到期的优先),默认:全部
+}
+
+// WebhookEvent   webhook推送的事件,按JSON编码,Payload为base64
+type WebhookEvent struct {
+	Event         enmu.WebhookEventType `json:"event"`
+	ClientId      string                `json:"clientid"`
+	UserName      string                `json:"username,omitempty"`
+	Addr          string                `json:"addr,omitempty"`          // connected
+	Reason        string                `json:"reason,omitempty"`        // disconnected:断开原因
+	Topic         string                `json:"topic,omitempty"`         // publish、rule
+	Qos           byte                  `json:"qos,omitempty"`           // publish、rule
+	Retain        bool                  `json:"retain,omitempty"`        // publish、rule
+	Payload       []byte                `json:"payload,omitempty"`       // publish、rule
+	Subscriptions map[string]byte       `json:"subscriptions,omitempty"` // subscribe:主题过滤器 -> QoS
+	Topics        []string              `json:"topics,omitempty"`        // unsubscribe
+	RuleId        string                `json:"rule_id,omitempty"`       // rule
+	Nano          int64                 `json:"nano"`
+}
+
+// WebhookStatistics   webhook推送统计
+type WebhookStatistics struct {
+	Url     string
+	Queued  int    // 队列中待发送的事件数
+	Sent    uint64 // 发送成功的事件数
+	Failed  uint64 // 重试后仍发送失败的事件数
+	Dropped uint64 // 队列满时丢弃的事件数
+	Retries uint64 // 重试次数
+}
+
+// CapturedPacket   抓包记录,抓包文件每行一条JSON;CONNECT报文中的密码已清除
+type CapturedPacket struct {
+	Nano      int64                 `json:"nano"`
+	ClientId  string                `json:"clientid"`
+	Direction enmu.CaptureDirection `json:"dir"`
+	Type      byte                  `json:"type"` // MQTT报文类型
+	Data      []byte                `json:"data"` // 完整的MQTT报文,JSON中为base64
+}
+
+// CaptureStatistics   抓包统计
+type CaptureStatistics struct {
+	File      string
+	Clients   int    // 被抓包的客户端数
+	Packets   uint64 // 已记录的报文数
+	StartNano int64
+	StopNano  int64 // 停止时间,未停止时为0
+	Err       error // 写文件失败时的错误,此后不再记录
+}
+
+// ReplayResult   回放结果
+type ReplayResult struct {
+	Clients      int    // 回放的客户端数
+	Connects     int    // 建立的链接数
+	Sent         uint64 // 发送的报文数
+	Received     uint64 // 收到的报文数
+	Errors       uint64 // 链接或写入失败数
+	DurationNano int64
+}
+
+// ReloadReport    运行中重新加载配置的结果,字段名为ClientManagerOptions的字段名
+type ReloadReport struct {
+	Applied         []string // 已生效的配置项;超时与长度限制只对之后的链接生效
+	RestartRequired []string // 已修改但需要重启才生效的配置项,运行中保持原值
+}
+
+// SchemaDeadLetter   负载校验失败后发布到死信主题的消息(JSON)
+type SchemaDeadLetter struct {
+	Topic    string `json:"topic"` // 原主题
+	ClientId string `json:"clientid"`
+	Schema   string `json:"schema"` // 校验失败的校验器名称
+	Error    string `json:"error"`
+	Qos      byte   `json:"qos"`
+	Retain   bool   `json:"retain"`
+	Payload  []byte `json:"payload"` // 原负载,base64编码
+	Nano     int64  `json:"nano"`
 }
@@ -11,6 +11,33 @@ const (
 	Websocket    ClientProtocol = "websocket"
 )
 
+// ClientSortKey  客户端列表排序字段,相同值按ClientId排序
+type ClientSortKey byte
+
+const (
+	SortById            ClientSortKey = 0x00 // 按ClientId
+	SortByConnectedTime ClientSortKey = 0x01 // 按链接开始时间
+	SortByReadLength    ClientSortKey = 0x02 // 按接收的数据长度,只返回第一页,不支持游标
+	SortByWriteLength   ClientSortKey = 0x03 // 按发送的数据长度,只返回第一页,不支持游标
+)
+
+// TakeoverPolicy   ClientId重复时的处理策略
+type TakeoverPolicy byte
+
+const (
+	KickOldPolicy   TakeoverPolicy = 0x00 // 断开已有的客户端
+	RejectNewPolicy TakeoverPolicy = 0x01 // 拒绝新的客户端,回复IdError
+	AllowBothPolicy TakeoverPolicy = 0x02 // 保留两者,新客户端的ClientId加"-n"后缀;加后缀后不符合ClientIdRule时回复IdError
+)
+
+// JournalEventType  链接日志事件类型
+type JournalEventType string
+
+const (
+	ConnectEvent    JournalEventType = "connect"
+	DisconnectEvent JournalEventType = "disconnect"
+)
+
 // HandshakeResult    握手结果
 type HandshakeResult byte
 
@@ -23,6 +50,15 @@ const (
 	uUnauthorizedError      HandshakeResult = 0x05 // 0x05连接已拒绝，未授权
 )
 
+// QueueFullPolicy   发送队列满时的处理策略
+type QueueFullPolicy byte
+
+const (
+	BlockPolicy      QueueFullPolicy = 0x00 // 阻塞调用方,直到队列有空位或写超时
+	DropOldestPolicy QueueFullPolicy = 0x01 // 丢弃队列中最早的报文
+	DisconnectPolicy QueueFullPolicy = 0x02 // 断开消费过慢的客户端
+)
+
 var ClientDisconnectError = errors.New("client is disconnect")
 var ClientHeartTimeoutError = errors.New("client heartbeat is time out")
 var PacketEmptyError = errors.New("packet is empty")
@@ -30,3 +66,93 @@ var ClientReadConnectionError = errors.New("client read connection error")
 var NotFoundClientError = errors.New("not found client")
 var NotConnectPacketError = errors.New("this packet is not connectPacket")
 var ClienthHandshakeFaild = errors.New("connect handshake failed")
+var PacketTooLargeError = errors.New("packet size exceeds the maximum packet size")
+var PacketRemainingLengthError = errors.New("packet remaining length is malformed")
+var WebsocketMessageTooLargeError = errors.New("websocket message exceeds the maximum message size")
+var WriteTimeoutError = errors.New("client write is time out")
+var PacketDroppedError = errors.New("packet is dropped because the write queue is full")
+var SlowConsumerError = errors.New("client is disconnected because the write queue is full")
+var QueryCursorError = errors.New("query cursor is invalid")
+var ClientTakeoverError = errors.New("client is taken over by a new connection with the same id")
+var ClientIdBannedError = errors.New("client id is temporarily banned for flapping")
+var ClientIdInvalidError = errors.New("client id does not match the id rule")
+var ProxyProtocolError = errors.New("proxy protocol header is malformed")
+var ProxyProtocolMissingError = errors.New("proxy protocol header is missing from a trusted upstream")
+var ClusterFrameTooLargeError = errors.New("cluster frame is too large")
+var ClusterAuthRequiredError = errors.New("cluster requires ClusterSecret or mutual ClusterTLS")
+var ClusterAuthError = errors.New("cluster peer authentication failed")
+
+// RuleActionType   规则动作类型
+type RuleActionType string
+
+const (
+	RepublishAction RuleActionType = "republish" // 以新的主题重新发布
+	DropAction      RuleActionType = "drop"      // 丢弃原消息,不再进入PacketCb
+	SinkAction      RuleActionType = "sink"      // 发送到已注册的sink
+)
+
+var RuleSqlError = errors.New("rule sql syntax error")
+var RuleIdError = errors.New("rule id is empty or duplicated")
+var RuleActionError = errors.New("rule action is invalid")
+var RuleSinkNotFoundError = errors.New("rule sink is not found")
+
+// WebhookEventType   webhook事件类型
+type WebhookEventType string
+
+const (
+	ConnectedWebhook    WebhookEventType = "connected"
+	DisconnectedWebhook WebhookEventType = "disconnected"
+	SubscribeWebhook    WebhookEventType = "subscribe"
+	UnsubscribeWebhook  WebhookEventType = "unsubscribe"
+	PublishWebhook      WebhookEventType = "publish"
+	RuleWebhook         WebhookEventType = "rule" // 规则SinkAction的输出
+)
+
+var WebhookUrlError = errors.New("webhook url is invalid")
+var WebhookQueueFullError = errors.New("webhook queue is full")
+var WebhookStatusError = errors.New("webhook response status is not 2xx")
+var WebhookClosedError = errors.New("webhook emitter is closed")
+
+// CaptureDirection   抓包记录的方向
+type CaptureDirection string
+
+const (
+	InboundCapture  CaptureDirection = "in"  // 客户端发送给服务端
+	OutboundCapture CaptureDirection = "out" // 服务端发送给客户端
+)
+
+var CaptureRunningError = errors.New("capture is already running")
+var CaptureNotRunningError = errors.New("capture is not running")
+
+// TopicDirection   主题改写的方向
+type TopicDirection string
+
+const (
+	IngressTopic TopicDirection = "in"   // 客户端发布、订阅、取消订阅的主题及遗嘱主题
+	EgressTopic  TopicDirection = "out"  // 下发给客户端的主题
+	BothTopic    TopicDirection = "both" // 入站与出站
+)
+
+var TopicMountError = errors.New("topic is outside the mount point of the client")
+var Mqtt5PacketError = errors.New("mqtt 5 packet is malformed or unsupported")
+var TopicMountPointError = errors.New("topic mount point must end with / and must not contain + or #")
+
+// SchemaPolicy   负载校验失败时的处理策略
+type SchemaPolicy string
+
+const (
+	RejectSchema     SchemaPolicy = "reject"      // 丢弃消息,不再进入规则与PacketCb
+	DeadLetterSchema SchemaPolicy = "dead_letter" // 丢弃原消息,以死信主题重新发布
+	TagSchema        SchemaPolicy = "tag"         // 照常处理,在报文上下文中标记校验错误
+)
+
+var SchemaNameError = errors.New("schema name is empty")
+var SchemaFilterError = errors.New("schema topic filter is invalid")
+var SchemaPolicyError = errors.New("schema policy is invalid")
+var SchemaValidatorError = errors.New("schema validator is nil")
+var SchemaNotFoundError = errors.New("schema is not found")
+var SchemaMismatchError = errors.New("payload does not match the schema")
+
+var DelayedTopicError = errors.New("delayed topic is invalid")
+var DelayedQueueFullError = errors.New("delayed message queue is full")
+var DelayedNotFoundError = errors.New("delayed message is not found")
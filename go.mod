@@ -3,8 +3,21 @@ module github.com/qdmc/mqtt_single_proxy
 go 1.22.1
 
 require (
-	github.com/qdmc/mqtt_packet v0.0.0-20240320014909-65ee56c897e8 // indirect
-	github.com/qdmc/websocket_packet v1.0.4 // indirect
+	github.com/BurntSushi/toml v1.6.0
+	github.com/qdmc/mqtt_packet v0.0.0-20240320014909-65ee56c897e8
+	github.com/qdmc/websocket_packet v1.0.4
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	go.opentelemetry.io/otel v1.31.0
+	go.opentelemetry.io/otel/sdk v1.31.0
+	go.opentelemetry.io/otel/trace v1.31.0
+	google.golang.org/protobuf v1.36.6
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-replace github.com/qdmc/mqtt_packet v0.0.0-20240320014909-65ee56c897e8 => /home/qdmc/project/my_golang/git_mqtt_packet
+require (
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	go.opentelemetry.io/otel/metric v1.31.0 // indirect
+	golang.org/x/sys v0.26.0 // indirect
+)
@@ -0,0 +1,233 @@
+// Package replay  按抓包文件重放客户端发送的报文,用于离线复现问题
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTimeout = 5
+	defaultWait    = 500
+	connectType    = 1
+)
+
+// Options   回放配置项
+type Options struct {
+	File     string   // 抓包文件,由ClientManager.StartCapture生成
+	Addr     string   // 管理器的tcp地址,如:127.0.0.1:1883
+	Speed    float64  // 回放速度倍数,默认:1,按原始间隔;大于1时加速;小于0时不等待
+	Ids      []string // 只回放这些客户端,为空时回放全部
+	Password string   // 回放CONNECT时使用的密码,抓包文件中不含密码
+	Timeout  int64    // 链接超时(秒),默认:5
+	Wait     int64    // 发送完成后等待响应的时长(毫秒),默认:500
+}
+
+// ReadFile    读取抓包文件,按时间排序
+func ReadFile(path string) ([]clients_dto.CapturedPacket, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var list []clients_dto.CapturedPacket
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var cp clients_dto.CapturedPacket
+		if err = dec.Decode(&cp); err != nil {
+			return nil, err
+		}
+		list = append(list, cp)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Nano < list[j].Nano })
+	return list, nil
+}
+
+// Run    按原始时间间隔(可加速)重新发送抓包中客户端发出的报文;每个CONNECT建立一条新链接
+func Run(ctx context.Context, opt Options) (clients_dto.ReplayResult, error) {
+	list, err := ReadFile(opt.File)
+	if err != nil {
+		return clients_dto.ReplayResult{}, err
+	}
+	if opt.Speed == 0 {
+		opt.Speed = 1
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = defaultTimeout
+	}
+	if opt.Wait <= 0 {
+		opt.Wait = defaultWait
+	}
+	var ids map[string]bool
+	if len(opt.Ids) > 0 {
+		ids = make(map[string]bool, len(opt.Ids))
+		for _, id := range opt.Ids {
+			ids[id] = true
+		}
+	}
+	r := &runner{opt: opt, conns: map[string]net.Conn{}}
+	clients := map[string]bool{}
+	start := time.Now()
+	var first int64
+	for _, cp := range list {
+		if cp.Direction != enmu.InboundCapture || len(cp.Data) == 0 || (ids != nil && !ids[cp.ClientId]) {
+			continue
+		}
+		if first == 0 {
+			first = cp.Nano
+		}
+		if opt.Speed > 0 {
+			at := start.Add(time.Duration(float64(cp.Nano-first) / opt.Speed))
+			select {
+			case <-time.After(time.Until(at)):
+			case <-ctx.Done():
+				r.closeAll()
+				return r.result(clients, start), ctx.Err()
+			}
+		}
+		clients[cp.ClientId] = true
+		r.send(cp)
+	}
+	select {
+	case <-time.After(time.Duration(opt.Wait) * time.Millisecond):
+	case <-ctx.Done():
+	}
+	r.closeAll()
+	return r.result(clients, start), nil
+}
+
+type runner struct {
+	opt      Options
+	conns    map[string]net.Conn
+	wg       sync.WaitGroup
+	connects int
+	sent     uint64
+	received uint64
+	errors   uint64
+}
+
+// send    CONNECT时重新建立链接;链接不存在时先补发一个清理会话的CONNECT
+func (r *runner) send(cp clients_dto.CapturedPacket) {
+	data := cp.Data
+	if cp.Type == connectType {
+		if c, ok := r.conns[cp.ClientId]; ok {
+			_ = c.Close()
+			delete(r.conns, cp.ClientId)
+		}
+		data = r.withPassword(data)
+	}
+	c, ok := r.conns[cp.ClientId]
+	if !ok {
+		var err error
+		if c, err = r.dial(); err != nil {
+			r.errors++
+			return
+		}
+		r.conns[cp.ClientId] = c
+		if cp.Type != connectType {
+			p := packets.NewConnect(nil)
+			p.ProtocolName = "MQTT"
+			p.ProtocolVersion = 4
+			p.CleanSession = true
+			p.Keepalive = 60
+			p.ClientIdentifier = cp.ClientId
+			r.write(cp.ClientId, c, encode(r.setPassword(p)))
+		}
+	}
+	r.write(cp.ClientId, c, data)
+}
+
+func (r *runner) dial() (net.Conn, error) {
+	c, err := net.DialTimeout("tcp", r.opt.Addr, time.Duration(r.opt.Timeout)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	r.connects++
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		for {
+			if _, err := mqtt_packet.ReadOnce(c); err != nil {
+				return
+			}
+			atomic.AddUint64(&r.received, 1)
+		}
+	}()
+	return c, nil
+}
+
+func (r *runner) write(id string, c net.Conn, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+	_ = c.SetWriteDeadline(time.Now().Add(time.Duration(r.opt.Timeout) * time.Second))
+	if _, err := c.Write(data); err != nil {
+		r.errors++
+		_ = c.Close()
+		delete(r.conns, id)
+		return
+	}
+	r.sent++
+}
+
+// withPassword    为抓包中的CONNECT加上Options.Password
+func (r *runner) withPassword(data []byte) []byte {
+	if r.opt.Password == "" {
+		return data
+	}
+	p, err := mqtt_packet.ReadOnce(bytes.NewReader(data))
+	if err != nil {
+		return data
+	}
+	if cp, ok := p.(*packets.ConnectPacket); ok {
+		return encode(r.setPassword(cp))
+	}
+	return data
+}
+
+func (r *runner) setPassword(p *packets.ConnectPacket) *packets.ConnectPacket {
+	if r.opt.Password != "" {
+		p.PasswordFlag = true
+		p.Password = []byte(r.opt.Password)
+	}
+	return p
+}
+
+func (r *runner) closeAll() {
+	for id, c := range r.conns {
+		_ = c.Close()
+		delete(r.conns, id)
+	}
+	r.wg.Wait()
+}
+
+func (r *runner) result(clients map[string]bool, start time.Time) clients_dto.ReplayResult {
+	return clients_dto.ReplayResult{
+		Clients:      len(clients),
+		Connects:     r.connects,
+		Sent:         r.sent,
+		Received:     atomic.LoadUint64(&r.received),
+		Errors:       r.errors,
+		DurationNano: int64(time.Since(start)),
+	}
+}
+
+func encode(p mqtt_packet.ControlPacketInterface) []byte {
+	buf := bytes.NewBuffer(nil)
+	if _, err := p.Write(buf); err != nil {
+		return nil
+	}
+	return buf.Bytes()
+}
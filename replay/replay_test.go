@@ -0,0 +1,196 @@
+package replay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/qdmc/mqtt_packet"
+	"github.com/qdmc/mqtt_packet/packets"
+	"github.com/qdmc/mqtt_single_proxy/clients"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) uint16 {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return uint16(l.Addr().(*net.TCPAddr).Port)
+}
+
+// startManager    启动管理器,收到的PUBLISH以"id topic payload"写入返回的通道,握手信息写入hs
+func startManager(t *testing.T, hs chan<- clients_dto.ConnectionHandshakeDatabase) (uint16, clients.ClientManagerInterface, <-chan string) {
+	t.Helper()
+	port := freePort(t)
+	received := make(chan string, 16)
+	m := clients.NewClientManagerInstance(&clients.ClientManagerOptions{
+		TcpPort: port,
+		Handshake: func(hd clients_dto.ConnectionHandshakeDatabase) enmu.HandshakeResult {
+			if hs != nil {
+				hs <- hd
+			}
+			return enmu.Success
+		},
+		PacketCb: func(id string, p mqtt_packet.ControlPacketInterface) {
+			if pp, ok := p.(*packets.PublishPacket); ok {
+				received <- id + " " + pp.TopicName + " " + string(pp.Payload)
+			}
+		},
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = m.Stop() })
+	return port, m, received
+}
+
+func publish(topic, payload string) *packets.PublishPacket {
+	p := packets.NewPublish(nil)
+	p.TopicName = topic
+	p.Payload = []byte(payload)
+	return p
+}
+
+// dial    建立链接并完成握手
+func dial(t *testing.T, port uint16, id, user, password string) net.Conn {
+	t.Helper()
+	c, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	p := packets.NewConnect(nil)
+	p.ProtocolName = "MQTT"
+	p.ProtocolVersion = 4
+	p.CleanSession = true
+	p.Keepalive = 30
+	p.ClientIdentifier = id
+	p.UsernameFlag, p.Username = user != "", user
+	p.PasswordFlag, p.Password = password != "", []byte(password)
+	write(t, c, p)
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	ack, err := mqtt_packet.ReadOnce(c)
+	if a, ok := ack.(*packets.ConnAckPacket); err != nil || !ok || a.ReturnCode != 0 {
+		t.Fatalf("connack %v %v", ack, err)
+	}
+	return c
+}
+
+func write(t *testing.T, c net.Conn, p mqtt_packet.ControlPacketInterface) {
+	t.Helper()
+	if _, err := c.Write(encode(p)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expect(t *testing.T, received <-chan string, want ...string) {
+	t.Helper()
+	for _, w := range want {
+		select {
+		case got := <-received:
+			if got != w {
+				t.Fatalf("received %q, want %q", got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q is not received", w)
+		}
+	}
+}
+
+// TestCaptureThenReplay    抓包后回放到另一个管理器,只回放选中的客户端,CONNECT使用Options.Password
+func TestCaptureThenReplay(t *testing.T) {
+	port, m, received := startManager(t, nil)
+	file := filepath.Join(t.TempDir(), "capture.jsonl")
+	if err := m.StartCapture(clients.CaptureOptions{File: file}); err != nil {
+		t.Fatal(err)
+	}
+	dev := dial(t, port, "dev", "u", "secret")
+	other := dial(t, port, "other", "", "")
+	write(t, dev, publish("a/1", "x"))
+	expect(t, received, "dev a/1 x")
+	write(t, other, publish("b", "z"))
+	expect(t, received, "other b z")
+	write(t, dev, publish("a/2", "y"))
+	expect(t, received, "dev a/2 y")
+	if _, err := m.StopCapture(); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i < len(list); i++ {
+		if list[i].Nano < list[i-1].Nano {
+			t.Fatalf("records are not sorted: %+v", list)
+		}
+	}
+
+	hs := make(chan clients_dto.ConnectionHandshakeDatabase, 4)
+	target, _, replayed := startManager(t, hs)
+	res, err := Run(context.Background(), Options{
+		File:     file,
+		Addr:     fmt.Sprintf("127.0.0.1:%d", target),
+		Speed:    -1,
+		Ids:      []string{"dev"},
+		Password: "replayed",
+		Wait:     200,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Clients != 1 || res.Connects != 1 || res.Sent != 3 || res.Errors != 0 || res.Received < 1 {
+		t.Fatalf("result %+v", res)
+	}
+	if hd := <-hs; hd.ClientId != "dev" || hd.UserName != "u" || hd.Password != "replayed" {
+		t.Fatalf("handshake %+v", hd)
+	}
+	expect(t, replayed, "dev a/1 x", "dev a/2 y")
+	select {
+	case got := <-replayed:
+		t.Fatalf("unexpected %q", got)
+	default:
+	}
+}
+
+// TestReplayWithoutConnect    抓包中没有CONNECT时先补发清理会话的CONNECT;服务端发出的报文不回放
+func TestReplayWithoutConnect(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "capture.jsonl")
+	var lines []string
+	for _, cp := range []clients_dto.CapturedPacket{
+		{Nano: 30, ClientId: "x", Direction: enmu.InboundCapture, Type: 3, Data: encode(publish("t/2", ""))},
+		{Nano: 10, ClientId: "x", Direction: enmu.InboundCapture, Type: 3, Data: encode(publish("t/1", ""))},
+		{Nano: 20, ClientId: "x", Direction: enmu.OutboundCapture, Type: 3, Data: encode(publish("out", ""))},
+	} {
+		b, err := json.Marshal(cp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(b))
+	}
+	if err := os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	port, _, received := startManager(t, nil)
+	res, err := Run(context.Background(), Options{File: file, Addr: fmt.Sprintf("127.0.0.1:%d", port), Wait: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Clients != 1 || res.Connects != 1 || res.Sent != 3 || res.Errors != 0 {
+		t.Fatalf("result %+v", res)
+	}
+	expect(t, received, "x t/1 ", "x t/2 ")
+
+	if _, err = Run(context.Background(), Options{File: filepath.Join(t.TempDir(), "missing.jsonl")}); err == nil {
+		t.Fatal("replay of a missing file")
+	}
+}
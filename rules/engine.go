@@ -0,0 +1,295 @@
+// Package rules  声明式规则引擎:按SQL筛选消息并执行重新发布、丢弃或发送到sink的动作
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Rule   规则定义
+type Rule struct {
+	Id       string
+	Sql      string // 如:SELECT payload.temp FROM 'sensors/+/data' WHERE payload.temp > 50
+	Actions  []Action
+	Disabled bool
+}
+
+// Action   规则动作
+type Action struct {
+	Type   enmu.RuleActionType
+	Topic  string // RepublishAction的目标主题,支持${topic}、${clientid}、${username}占位符
+	Qos    byte   // RepublishAction的QoS,只用于输出;重新发布的消息没有可回复确认的发送方,总是以QoS0路由
+	Retain bool   // RepublishAction的保留标志
+	Sink   string // SinkAction的sink名称
+}
+
+// Message   规则的输入消息
+type Message struct {
+	ClientId string
+	UserName string
+	Topic    string
+	Qos      byte
+	Retain   bool
+	Payload  []byte
+	Nano     int64
+}
+
+// Output   规则命中后每个动作的输出
+type Output struct {
+	RuleId  string
+	Action  Action
+	Topic   string                 // RepublishAction替换占位符后的目标主题
+	Data    map[string]interface{} // SELECT的结果
+	Payload []byte                 // SELECT *时为原始负载,否则为Data的JSON编码
+	Message Message
+}
+
+// Sink   规则输出的目的地,Send需尽快返回
+type Sink interface {
+	Send(out Output) error
+}
+
+// Statistics   规则命中计数
+type Statistics struct {
+	Id          string
+	Matched     uint64 // 主题匹配的消息数
+	Hits        uint64 // WHERE成立的消息数
+	Failed      uint64 // 动作执行失败数
+	LastHitNano int64
+}
+
+type counter struct {
+	matched uint64
+	hits    uint64
+	failed  uint64
+	lastHit int64
+}
+
+type compiledRule struct {
+	rule    Rule
+	st      *statement
+	counter *counter
+}
+
+// Engine   规则引擎,Load可在运行中调用以热加载规则
+type Engine struct {
+	mu       sync.RWMutex
+	rules    []*compiledRule
+	counters map[string]*counter
+}
+
+func NewEngine() *Engine {
+	return &Engine{counters: map[string]*counter{}}
+}
+
+// Load    编译并替换全部规则;任一规则无效时返回错误且保留原规则;相同Id的计数保留
+func (e *Engine) Load(rs []Rule) error {
+	compiled := make([]*compiledRule, 0, len(rs))
+	ids := map[string]bool{}
+	for _, r := range rs {
+		if r.Id == "" || ids[r.Id] {
+			return fmt.Errorf("%w: %q", enmu.RuleIdError, r.Id)
+		}
+		ids[r.Id] = true
+		st, err := parse(r.Sql)
+		if err != nil {
+			return fmt.Errorf("rule %s: %w", r.Id, err)
+		}
+		for _, a := range r.Actions {
+			if err = checkAction(a); err != nil {
+				return fmt.Errorf("rule %s: %w", r.Id, err)
+			}
+		}
+		r.Actions = append([]Action{}, r.Actions...)
+		compiled = append(compiled, &compiledRule{rule: r, st: st})
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	counters := make(map[string]*counter, len(compiled))
+	for _, cr := range compiled {
+		c, ok := e.counters[cr.rule.Id]
+		if !ok {
+			c = &counter{}
+		}
+		cr.counter = c
+		counters[cr.rule.Id] = c
+	}
+	e.rules = compiled
+	e.counters = counters
+	return nil
+}
+
+func checkAction(a Action) error {
+	switch a.Type {
+	case enmu.RepublishAction:
+		if a.Topic == "" || strings.ContainsAny(a.Topic, "+#") || a.Qos > 2 {
+			return enmu.RuleActionError
+		}
+	case enmu.SinkAction:
+		if a.Sink == "" {
+			return enmu.RuleActionError
+		}
+	case enmu.DropAction:
+	default:
+		return enmu.RuleActionError
+	}
+	return nil
+}
+
+// Len    已加载的启用规则数
+func (e *Engine) Len() int {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	n := 0
+	for _, cr := range e.rules {
+		if !cr.rule.Disabled {
+			n++
+		}
+	}
+	return n
+}
+
+// Rules    返回已加载的规则
+func (e *Engine) Rules() []Rule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	rs := make([]Rule, 0, len(e.rules))
+	for _, cr := range e.rules {
+		rs = append(rs, cr.rule)
+	}
+	return rs
+}
+
+// Evaluate    按加载顺序执行规则,返回命中规则的所有动作输出
+func (e *Engine) Evaluate(msg Message) []Output {
+	e.mu.RLock()
+	rs := e.rules
+	e.mu.RUnlock()
+	var outs []Output
+	var env map[string]interface{}
+	for _, cr := range rs {
+		if cr.rule.Disabled || !matchAny(cr.st.filters, msg.Topic) {
+			continue
+		}
+		atomic.AddUint64(&cr.counter.matched, 1)
+		if env == nil {
+			env = newEnv(msg)
+		}
+		if cr.st.where != nil && !truthy(cr.st.where.eval(env)) {
+			continue
+		}
+		atomic.AddUint64(&cr.counter.hits, 1)
+		atomic.StoreInt64(&cr.counter.lastHit, time.Now().UnixNano())
+		data, payload := cr.st.project(env, msg.Payload)
+		for _, a := range cr.rule.Actions {
+			out := Output{RuleId: cr.rule.Id, Action: a, Data: data, Payload: payload, Message: msg}
+			if a.Type == enmu.RepublishAction {
+				out.Topic = strings.NewReplacer("${topic}", msg.Topic, "${clientid}", msg.ClientId, "${username}", msg.UserName).Replace(a.Topic)
+				// 占位符的值可能含有通配符,替换后的主题不能用于发布
+				if out.Topic == "" || strings.ContainsAny(out.Topic, "+#\x00") {
+					atomic.AddUint64(&cr.counter.failed, 1)
+					continue
+				}
+			}
+			outs = append(outs, out)
+		}
+	}
+	return outs
+}
+
+// Failed    记录一次动作执行失败
+func (e *Engine) Failed(id string) {
+	e.mu.RLock()
+	c, ok := e.counters[id]
+	e.mu.RUnlock()
+	if ok {
+		atomic.AddUint64(&c.failed, 1)
+	}
+}
+
+// Statistics    返回各规则的命中计数,按Id排序
+func (e *Engine) Statistics() []Statistics {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	list := make([]Statistics, 0, len(e.counters))
+	for id, c := range e.counters {
+		list = append(list, Statistics{
+			Id:          id,
+			Matched:     atomic.LoadUint64(&c.matched),
+			Hits:        atomic.LoadUint64(&c.hits),
+			Failed:      atomic.LoadUint64(&c.failed),
+			LastHitNano: atomic.LoadInt64(&c.lastHit),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+// newEnv    生成表达式的取值环境;负载为JSON时可按路径取值,否则为字符串
+func newEnv(msg Message) map[string]interface{} {
+	var payload interface{}
+	if json.Unmarshal(msg.Payload, &payload) != nil {
+		payload = string(msg.Payload)
+	}
+	return map[string]interface{}{
+		"clientid":  msg.ClientId,
+		"username":  msg.UserName,
+		"topic":     msg.Topic,
+		"qos":       float64(msg.Qos),
+		"retain":    msg.Retain,
+		"timestamp": float64(msg.Nano / int64(time.Millisecond)),
+		"payload":   payload,
+	}
+}
+
+// project    计算SELECT结果
+func (st *statement) project(env map[string]interface{}, raw []byte) (map[string]interface{}, []byte) {
+	if len(st.fields) == 0 {
+		return env, raw
+	}
+	data := make(map[string]interface{}, len(st.fields))
+	for _, f := range st.fields {
+		data[f.alias] = lookup(env, f.path)
+	}
+	bs, _ := json.Marshal(data)
+	return data, bs
+}
+
+func matchAny(filters []string, topic string) bool {
+	for _, filter := range filters {
+		if MatchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchTopic    主题过滤器匹配,支持+与#通配符;通配符不匹配以$开头的主题
+func MatchTopic(filter, topic string) bool {
+	if filter == topic {
+		return true
+	}
+	if strings.HasPrefix(topic, "$") && (strings.HasPrefix(filter, "+") || strings.HasPrefix(filter, "#")) {
+		return false
+	}
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return i == len(fs)-1
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
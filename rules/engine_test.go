@@ -0,0 +1,146 @@
+package rules
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"testing"
+)
+
+func TestLoadErrors(t *testing.T) {
+	republish := Action{Type: enmu.RepublishAction, Topic: "out"}
+	cases := []struct {
+		name  string
+		rules []Rule
+		want  error
+	}{
+		{"empty id", []Rule{{Sql: "SELECT * FROM 'a'"}}, enmu.RuleIdError},
+		{"duplicated id", []Rule{{Id: "r", Sql: "SELECT * FROM 'a'"}, {Id: "r", Sql: "SELECT * FROM 'b'"}}, enmu.RuleIdError},
+		{"bad sql", []Rule{{Id: "r", Sql: "SELECT FROM 'a'"}}, enmu.RuleSqlError},
+		{"bad filter", []Rule{{Id: "r", Sql: "SELECT * FROM 'a/#/b'"}}, enmu.RuleSqlError},
+		{"unknown action", []Rule{{Id: "r", Sql: "SELECT * FROM 'a'", Actions: []Action{{Type: "x"}}}}, enmu.RuleActionError},
+		{"republish without topic", []Rule{{Id: "r", Sql: "SELECT * FROM 'a'", Actions: []Action{{Type: enmu.RepublishAction}}}}, enmu.RuleActionError},
+		{"republish to wildcard", []Rule{{Id: "r", Sql: "SELECT * FROM 'a'", Actions: []Action{{Type: enmu.RepublishAction, Topic: "out/+"}}}}, enmu.RuleActionError},
+		{"republish qos 3", []Rule{{Id: "r", Sql: "SELECT * FROM 'a'", Actions: []Action{{Type: enmu.RepublishAction, Topic: "out", Qos: 3}}}}, enmu.RuleActionError},
+		{"sink without name", []Rule{{Id: "r", Sql: "SELECT * FROM 'a'", Actions: []Action{{Type: enmu.SinkAction}}}}, enmu.RuleActionError},
+	}
+	for _, c := range cases {
+		e := NewEngine()
+		_ = e.Load([]Rule{{Id: "old", Sql: "SELECT * FROM 'a'", Actions: []Action{republish}}})
+		if err := e.Load(c.rules); !errors.Is(err, c.want) {
+			t.Errorf("%s: %v, want %v", c.name, err, c.want)
+		}
+		if rs := e.Rules(); len(rs) != 1 || rs[0].Id != "old" {
+			t.Errorf("%s: rules replaced after failed load: %+v", c.name, rs)
+		}
+	}
+}
+
+func TestEvaluateActions(t *testing.T) {
+	e := NewEngine()
+	err := e.Load([]Rule{
+		{Id: "hot", Sql: "SELECT payload.temp AS t, clientid FROM 'sensors/+/data' WHERE payload.temp > 50", Actions: []Action{
+			{Type: enmu.RepublishAction, Topic: "alerts/${clientid}/${username}", Qos: 1, Retain: true},
+			{Type: enmu.SinkAction, Sink: "db"},
+		}},
+		{Id: "drop", Sql: "SELECT * FROM 'sensors/#' WHERE payload.drop = true", Actions: []Action{{Type: enmu.DropAction}}},
+		{Id: "off", Sql: "SELECT * FROM '#'", Disabled: true, Actions: []Action{{Type: enmu.DropAction}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Len() != 2 {
+		t.Fatalf("len %d", e.Len())
+	}
+	outs := e.Evaluate(Message{ClientId: "dev1", UserName: "u", Topic: "sensors/1/data", Payload: []byte(`{"temp":60}`)})
+	if len(outs) != 2 {
+		t.Fatalf("outputs %+v", outs)
+	}
+	rp, sink := outs[0], outs[1]
+	if rp.RuleId != "hot" || rp.Action.Type != enmu.RepublishAction || rp.Topic != "alerts/dev1/u" || !rp.Action.Retain {
+		t.Fatalf("republish %+v", rp)
+	}
+	var data map[string]interface{}
+	if err = json.Unmarshal(rp.Payload, &data); err != nil || data["t"] != 60.0 || data["clientid"] != "dev1" || len(data) != 2 {
+		t.Fatalf("projected payload %s %v", rp.Payload, err)
+	}
+	if sink.Action.Type != enmu.SinkAction || sink.Action.Sink != "db" || sink.Topic != "" || sink.Data["t"] != 60.0 {
+		t.Fatalf("sink %+v", sink)
+	}
+	// WHERE不成立
+	if outs = e.Evaluate(Message{ClientId: "dev1", Topic: "sensors/1/data", Payload: []byte(`{"temp":10}`)}); len(outs) != 0 {
+		t.Fatalf("cold outputs %+v", outs)
+	}
+	// SELECT *保留原始负载
+	raw := []byte(`{"drop":true}`)
+	outs = e.Evaluate(Message{Topic: "sensors/1", Payload: raw})
+	if len(outs) != 1 || outs[0].Action.Type != enmu.DropAction || string(outs[0].Payload) != string(raw) {
+		t.Fatalf("drop outputs %+v", outs)
+	}
+	// 通配符不匹配$开头的主题
+	if outs = e.Evaluate(Message{Topic: "$SYS/x"}); len(outs) != 0 {
+		t.Fatalf("$SYS outputs %+v", outs)
+	}
+	st := e.Statistics()
+	if len(st) != 3 || st[1].Id != "hot" || st[1].Matched != 2 || st[1].Hits != 1 || st[1].LastHitNano == 0 {
+		t.Fatalf("statistics %+v", st)
+	}
+	e.Failed("hot")
+	// 重新加载后相同Id的计数保留
+	if err = e.Load([]Rule{{Id: "hot", Sql: "SELECT * FROM 'x'"}}); err != nil {
+		t.Fatal(err)
+	}
+	if st = e.Statistics(); len(st) != 1 || st[0].Hits != 1 || st[0].Failed != 1 {
+		t.Fatalf("statistics after reload %+v", st)
+	}
+}
+
+// TestRepublishPlaceholderWildcard    占位符替换后含有通配符或为空的主题不输出,记为失败
+func TestRepublishPlaceholderWildcard(t *testing.T) {
+	e := NewEngine()
+	err := e.Load([]Rule{{Id: "r", Sql: "SELECT * FROM '#'", Actions: []Action{
+		{Type: enmu.RepublishAction, Topic: "out/${clientid}"},
+		{Type: enmu.RepublishAction, Topic: "${username}"},
+		{Type: enmu.SinkAction, Sink: "s"},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"a+b", "a/#", "+"} {
+		outs := e.Evaluate(Message{ClientId: id, UserName: "u", Topic: "t"})
+		if len(outs) != 2 || outs[0].Topic != "u" || outs[1].Action.Type != enmu.SinkAction {
+			t.Fatalf("client %q: %+v", id, outs)
+		}
+	}
+	outs := e.Evaluate(Message{ClientId: "c", Topic: "t"})
+	if len(outs) != 2 || outs[0].Topic != "out/c" {
+		t.Fatalf("empty username: %+v", outs)
+	}
+	if st := e.Statistics(); st[0].Failed != 4 {
+		t.Fatalf("failed %d", st[0].Failed)
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		want          bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"#", "a/b", true},
+		{"+/+", "/a", true},
+		{"+", "$SYS", false},
+		{"#", "$SYS/a", false},
+		{"$SYS/#", "$SYS/a", true},
+		{"a/b", "a/c", false},
+	}
+	for _, c := range cases {
+		if got := MatchTopic(c.filter, c.topic); got != c.want {
+			t.Errorf("%s %s: %v", c.filter, c.topic, got)
+		}
+	}
+}
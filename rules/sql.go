@@ -0,0 +1,465 @@
+package rules
+
+import (
+	"fmt"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+规则SQL语法:
+
+		SELECT <field> [AS alias], ... FROM '<topic filter>', ... [WHERE <expr>]
+
+	  - field     *、payload、payload.a.b、topic、clientid、username、qos、retain、timestamp;默认以路径最后一段为输出字段名
+	  - expr      比较(= != <> < <= > >=)、AND、OR、NOT及括号;字面量支持数字、'字符串'、true、false、null
+*/
+type statement struct {
+	fields  []selectField // 为空时表示SELECT *
+	filters []string
+	where   expr // 为nil时不过滤
+}
+
+type selectField struct {
+	path  []string
+	alias string
+}
+
+// token类型
+const (
+	tokenEOF = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenOp
+	tokenComma
+	tokenLParen
+	tokenRParen
+	tokenStar
+)
+
+type token struct {
+	kind  int
+	text  string
+	value float64
+}
+
+func lex(sql string) ([]token, error) {
+	var tokens []token
+	rs := []rune(sql)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ","})
+			i++
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")"})
+			i++
+		case r == '*':
+			tokens = append(tokens, token{kind: tokenStar, text: "*"})
+			i++
+		case r == '\'' || r == '"':
+			j := i + 1
+			var sb strings.Builder
+			for ; j < len(rs) && rs[j] != r; j++ {
+				if rs[j] == '\\' && j+1 < len(rs) {
+					j++
+				}
+				sb.WriteRune(rs[j])
+			}
+			if j >= len(rs) {
+				return nil, fmt.Errorf("%w: unterminated string", enmu.RuleSqlError)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: sb.String()})
+			i = j + 1
+		case strings.ContainsRune("=!<>", r):
+			j := i + 1
+			if j < len(rs) && (rs[j] == '=' || (r == '<' && rs[j] == '>')) {
+				j++
+			}
+			op := string(rs[i:j])
+			if op == "!" {
+				return nil, fmt.Errorf("%w: unexpected '!'", enmu.RuleSqlError)
+			}
+			tokens = append(tokens, token{kind: tokenOp, text: op})
+			i = j
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(rs) && unicode.IsDigit(rs[i+1])):
+			j := i + 1
+			for j < len(rs) && (unicode.IsDigit(rs[j]) || rs[j] == '.' || rs[j] == 'e' || rs[j] == 'E') {
+				j++
+			}
+			v, err := strconv.ParseFloat(string(rs[i:j]), 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: bad number %q", enmu.RuleSqlError, string(rs[i:j]))
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: string(rs[i:j]), value: v})
+			i = j
+		case unicode.IsLetter(r) || r == '_':
+			j := i + 1
+			for j < len(rs) && (unicode.IsLetter(rs[j]) || unicode.IsDigit(rs[j]) || rs[j] == '_' || rs[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: string(rs[i:j])})
+			i = j
+		default:
+			return nil, fmt.Errorf("%w: unexpected %q", enmu.RuleSqlError, r)
+		}
+	}
+	return append(tokens, token{kind: tokenEOF}), nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword    当前token是否为关键字(不区分大小写)
+func (p *parser) keyword(k string) bool {
+	t := p.peek()
+	return t.kind == tokenIdent && strings.EqualFold(t.text, k)
+}
+
+func (p *parser) expectKeyword(k string) error {
+	if !p.keyword(k) {
+		return fmt.Errorf("%w: expected %s near %q", enmu.RuleSqlError, k, p.peek().text)
+	}
+	p.next()
+	return nil
+}
+
+func parse(sql string) (*statement, error) {
+	tokens, err := lex(sql)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	st := &statement{}
+	if err = p.expectKeyword("SELECT"); err != nil {
+		return nil, err
+	}
+	if p.peek().kind == tokenStar {
+		p.next()
+	} else {
+		for {
+			t := p.next()
+			if t.kind != tokenIdent {
+				return nil, fmt.Errorf("%w: expected field near %q", enmu.RuleSqlError, t.text)
+			}
+			f := selectField{path: strings.Split(t.text, ".")}
+			f.alias = f.path[len(f.path)-1]
+			if p.keyword("AS") {
+				p.next()
+				a := p.next()
+				if a.kind != tokenIdent && a.kind != tokenString {
+					return nil, fmt.Errorf("%w: expected alias near %q", enmu.RuleSqlError, a.text)
+				}
+				f.alias = a.text
+			}
+			st.fields = append(st.fields, f)
+			if p.peek().kind != tokenComma {
+				break
+			}
+			p.next()
+		}
+	}
+	if err = p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	for {
+		t := p.next()
+		if t.kind != tokenString || t.text == "" {
+			return nil, fmt.Errorf("%w: expected quoted topic filter near %q", enmu.RuleSqlError, t.text)
+		}
+		if !validFilter(t.text) {
+			return nil, fmt.Errorf("%w: invalid topic filter %q", enmu.RuleSqlError, t.text)
+		}
+		st.filters = append(st.filters, t.text)
+		if p.peek().kind != tokenComma {
+			break
+		}
+		p.next()
+	}
+	if p.keyword("WHERE") {
+		p.next()
+		if st.where, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+	}
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("%w: unexpected %q", enmu.RuleSqlError, t.text)
+	}
+	return st, nil
+}
+
+// validFilter    主题过滤器是否合法:+与#需独占一级,#只能在最后一级
+func validFilter(filter string) bool {
+	if strings.ContainsRune(filter, 0) {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if level == "#" {
+			if i != len(levels)-1 {
+				return false
+			}
+			continue
+		}
+		if level != "+" && strings.ContainsAny(level, "+#") {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *parser) parseOr() (expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicExpr{op: "OR", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (expr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicExpr{op: "AND", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseNot() (expr, error) {
+	if p.keyword("NOT") {
+		p.next()
+		e, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{e: e}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *parser) parseCompare() (expr, error) {
+	left, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokenOp {
+		return left, nil
+	}
+	op := p.next().text
+	right, err := p.parseOperand()
+	if err != nil {
+		return nil, err
+	}
+	return &compareExpr{op: op, left: left, right: right}, nil
+}
+
+func (p *parser) parseOperand() (expr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenLParen:
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next().kind != tokenRParen {
+			return nil, fmt.Errorf("%w: expected ')'", enmu.RuleSqlError)
+		}
+		return e, nil
+	case tokenNumber:
+		return &literalExpr{value: t.value}, nil
+	case tokenString:
+		return &literalExpr{value: t.text}, nil
+	case tokenIdent:
+		switch strings.ToLower(t.text) {
+		case "true":
+			return &literalExpr{value: true}, nil
+		case "false":
+			return &literalExpr{value: false}, nil
+		case "null":
+			return &literalExpr{value: nil}, nil
+		}
+		return &fieldExpr{path: strings.Split(t.text, ".")}, nil
+	}
+	return nil, fmt.Errorf("%w: unexpected %q", enmu.RuleSqlError, t.text)
+}
+
+// expr    WHERE表达式
+type expr interface {
+	eval(env map[string]interface{}) interface{}
+}
+
+type literalExpr struct {
+	value interface{}
+}
+
+func (e *literalExpr) eval(map[string]interface{}) interface{} {
+	return e.value
+}
+
+type fieldExpr struct {
+	path []string
+}
+
+func (e *fieldExpr) eval(env map[string]interface{}) interface{} {
+	return lookup(env, e.path)
+}
+
+type notExpr struct {
+	e expr
+}
+
+func (e *notExpr) eval(env map[string]interface{}) interface{} {
+	return !truthy(e.e.eval(env))
+}
+
+type logicExpr struct {
+	op          string
+	left, right expr
+}
+
+func (e *logicExpr) eval(env map[string]interface{}) interface{} {
+	if e.op == "AND" {
+		return truthy(e.left.eval(env)) && truthy(e.right.eval(env))
+	}
+	return truthy(e.left.eval(env)) || truthy(e.right.eval(env))
+}
+
+type compareExpr struct {
+	op          string
+	left, right expr
+}
+
+// eval    数字与数字、字符串与字符串比较;类型不同时只有!=/<>成立
+func (e *compareExpr) eval(env map[string]interface{}) interface{} {
+	l, r := e.left.eval(env), e.right.eval(env)
+	if l == nil || r == nil {
+		switch e.op {
+		case "=":
+			return l == nil && r == nil
+		case "!=", "<>":
+			return (l == nil) != (r == nil)
+		}
+		return false
+	}
+	var c int
+	switch lv := l.(type) {
+	case float64:
+		rv, ok := r.(float64)
+		if !ok {
+			return e.op == "!=" || e.op == "<>"
+		}
+		c = compareFloat(lv, rv)
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return e.op == "!=" || e.op == "<>"
+		}
+		c = strings.Compare(lv, rv)
+	case bool:
+		rv, ok := r.(bool)
+		if !ok {
+			return e.op == "!=" || e.op == "<>"
+		}
+		switch e.op {
+		case "=":
+			return lv == rv
+		case "!=", "<>":
+			return lv != rv
+		}
+		return false
+	default:
+		return false
+	}
+	switch e.op {
+	case "=":
+		return c == 0
+	case "!=", "<>":
+		return c != 0
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	case ">=":
+		return c >= 0
+	}
+	return false
+}
+
+func compareFloat(a, b float64) int {
+	if a < b {
+		return -1
+	}
+	if a > b {
+		return 1
+	}
+	return 0
+}
+
+func truthy(v interface{}) bool {
+	switch b := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return b
+	case float64:
+		return b != 0
+	case string:
+		return b != ""
+	}
+	return true
+}
+
+// lookup    按路径取值,路径不存在时为nil
+func lookup(env map[string]interface{}, path []string) interface{} {
+	var cur interface{} = env
+	for _, key := range path {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		if cur, ok = m[key]; !ok {
+			return nil
+		}
+	}
+	return cur
+}
@@ -0,0 +1,115 @@
+package rules
+
+import (
+	"errors"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"testing"
+)
+
+func TestParseErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		sql  string
+	}{
+		{"empty", ""},
+		{"no select", "payload FROM 'a'"},
+		{"no from", "SELECT *"},
+		{"unquoted filter", "SELECT * FROM a/b"},
+		{"empty filter", "SELECT * FROM ''"},
+		{"unterminated string", "SELECT * FROM 'a"},
+		{"missing field", "SELECT , payload FROM 'a'"},
+		{"missing alias", "SELECT payload AS FROM 'a'"},
+		{"bare bang", "SELECT * FROM 'a' WHERE qos ! 1"},
+		{"bad number", "SELECT * FROM 'a' WHERE qos = 1.2.3"},
+		{"unexpected rune", "SELECT * FROM 'a' WHERE qos = 1;"},
+		{"unclosed paren", "SELECT * FROM 'a' WHERE (qos = 1"},
+		{"missing operand", "SELECT * FROM 'a' WHERE qos ="},
+		{"trailing token", "SELECT * FROM 'a' WHERE qos = 1 qos"},
+		{"hash not last", "SELECT * FROM 'a/#/b'"},
+		{"hash inside level", "SELECT * FROM 'a/b#'"},
+		{"plus inside level", "SELECT * FROM 'a/b+/c'"},
+		{"second filter invalid", "SELECT * FROM 'a/+', 'a/+b'"},
+		{"nul in filter", "SELECT * FROM 'a/\x00'"},
+	}
+	for _, c := range cases {
+		if _, err := parse(c.sql); !errors.Is(err, enmu.RuleSqlError) {
+			t.Errorf("%s: %q: %v", c.name, c.sql, err)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	st, err := parse(`select payload.a.b, clientid AS "who", topic FROM 'x/+/y', '#', '+', 'a/b/' where NOT qos = 0`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.fields) != 3 || st.fields[0].alias != "b" || len(st.fields[0].path) != 3 || st.fields[1].alias != "who" || st.fields[2].alias != "topic" {
+		t.Fatalf("fields %+v", st.fields)
+	}
+	if len(st.filters) != 4 || st.filters[0] != "x/+/y" || st.where == nil {
+		t.Fatalf("statement %+v", st)
+	}
+	st, err = parse("SELECT * FROM 'a'")
+	if err != nil || st.fields != nil || st.where != nil {
+		t.Fatalf("select *: %+v %v", st, err)
+	}
+}
+
+func TestWhere(t *testing.T) {
+	env := newEnv(Message{
+		ClientId: "dev1",
+		UserName: "u",
+		Topic:    "sensors/1/data",
+		Qos:      1,
+		Retain:   true,
+		Payload:  []byte(`{"temp":55.5,"name":"boiler","on":true,"nested":{"level":3},"none":null}`),
+	})
+	cases := []struct {
+		where string
+		want  bool
+	}{
+		{"payload.temp > 50", true},
+		{"payload.temp >= 55.5", true},
+		{"payload.temp < 50", false},
+		{"payload.temp <= 55.4", false},
+		{"payload.temp = 55.5", true},
+		{"payload.temp != 55.5", false},
+		{"payload.temp <> 1", true},
+		{"payload.name = 'boiler'", true},
+		{"payload.name > 'a'", true},
+		{"payload.on = true", true},
+		{"payload.on != false", true},
+		{"payload.on > false", false},
+		{"payload.nested.level = 3", true},
+		{"payload.missing = null", true},
+		{"payload.none = null", true},
+		{"payload.temp = null", false},
+		{"payload.temp != null", true},
+		{"payload.missing > 1", false},
+		{"payload.name = 1", false},
+		{"payload.name != 1", true},
+		{"clientid = 'dev1' AND username = 'u'", true},
+		{"clientid = 'x' OR topic = 'sensors/1/data'", true},
+		{"NOT retain", false},
+		{"qos = 1 AND (payload.temp < 0 OR payload.on)", true},
+		{"NOT (qos = 1 AND payload.on)", false},
+		{"payload.name", true},
+		{"payload.missing", false},
+		{"WHERE_is_not_a_field = 1", false},
+	}
+	for _, c := range cases {
+		st, err := parse("SELECT * FROM '#' WHERE " + c.where)
+		if err != nil {
+			t.Fatalf("%s: %v", c.where, err)
+		}
+		if got := truthy(st.where.eval(env)); got != c.want {
+			t.Errorf("%s: got %v, want %v", c.where, got, c.want)
+		}
+	}
+	// 负载不是JSON时按字符串比较
+	env = newEnv(Message{Payload: []byte("on")})
+	st, _ := parse("SELECT * FROM '#' WHERE payload = 'on'")
+	if !truthy(st.where.eval(env)) {
+		t.Fatal("plain text payload")
+	}
+}
@@ -0,0 +1,203 @@
+// Package schema  按主题过滤器校验PUBLISH负载,支持JSON Schema与protobuf描述符
+package schema
+
+import (
+	"fmt"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"github.com/qdmc/mqtt_single_proxy/rules"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Validator   负载校验器,不匹配时返回错误;需并发安全
+type Validator interface {
+	Validate(payload []byte) error
+}
+
+// Schema   注册到主题过滤器的校验器
+type Schema struct {
+	Name            string            // 名称,唯一
+	Filter          string            // 主题过滤器,支持+与#通配符
+	Validator       Validator         // 校验器,见NewJsonSchema与NewProtobuf
+	Policy          enmu.SchemaPolicy // 校验失败时的策略,默认:enmu.RejectSchema
+	DeadLetterTopic string            // DeadLetterSchema的目标主题,支持${topic}、${clientid}、${schema}占位符
+}
+
+// Statistics   校验计数
+type Statistics struct {
+	Name         string
+	Filter       string
+	Policy       enmu.SchemaPolicy
+	Checked      uint64 // 主题匹配并校验的消息数
+	Failed       uint64 // 校验失败数
+	LastError    string // 最近一次校验失败的原因
+	LastFailNano int64
+}
+
+// Failure   校验失败的结果
+type Failure struct {
+	Schema Schema
+	Err    error // 包装enmu.SchemaMismatchError
+}
+
+// DeadLetterTopic    替换占位符后的死信主题
+func (f *Failure) DeadLetterTopic(topic, clientId string) string {
+	return strings.NewReplacer("${topic}", topic, "${clientid}", clientId, "${schema}", f.Schema.Name).Replace(f.Schema.DeadLetterTopic)
+}
+
+type counter struct {
+	checked  uint64
+	failed   uint64
+	lastFail int64
+	lastErr  atomic.Value
+}
+
+type entry struct {
+	schema  Schema
+	counter *counter
+}
+
+// Registry   校验器注册表,可在运行中注册与注销
+type Registry struct {
+	mu      sync.RWMutex
+	entries []*entry
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register    注册校验器;同名的校验器被替换,计数保留
+func (r *Registry) Register(s Schema) error {
+	if s.Name == "" {
+		return enmu.SchemaNameError
+	}
+	if !validFilter(s.Filter) {
+		return fmt.Errorf("%w: %q", enmu.SchemaFilterError, s.Filter)
+	}
+	if s.Validator == nil {
+		return enmu.SchemaValidatorError
+	}
+	if s.Policy == "" {
+		s.Policy = enmu.RejectSchema
+	}
+	switch s.Policy {
+	case enmu.RejectSchema, enmu.TagSchema:
+	case enmu.DeadLetterSchema:
+		if s.DeadLetterTopic == "" || strings.ContainsAny(s.DeadLetterTopic, "+#") {
+			return fmt.Errorf("%w: dead letter topic %q", enmu.SchemaPolicyError, s.DeadLetterTopic)
+		}
+	default:
+		return fmt.Errorf("%w: %q", enmu.SchemaPolicyError, s.Policy)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := make([]*entry, 0, len(r.entries)+1)
+	replaced := false
+	for _, e := range r.entries {
+		if e.schema.Name == s.Name {
+			entries = append(entries, &entry{schema: s, counter: e.counter})
+			replaced = true
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if !replaced {
+		entries = append(entries, &entry{schema: s, counter: &counter{}})
+	}
+	r.entries = entries
+	return nil
+}
+
+// Unregister    注销校验器,不存在时返回enmu.SchemaNotFoundError
+func (r *Registry) Unregister(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, e := range r.entries {
+		if e.schema.Name == name {
+			entries := make([]*entry, 0, len(r.entries)-1)
+			entries = append(entries, r.entries[:i]...)
+			r.entries = append(entries, r.entries[i+1:]...)
+			return nil
+		}
+	}
+	return enmu.SchemaNotFoundError
+}
+
+// Len    已注册的校验器数
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.entries)
+}
+
+// Schemas    返回已注册的校验器
+func (r *Registry) Schemas() []Schema {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ss := make([]Schema, 0, len(r.entries))
+	for _, e := range r.entries {
+		ss = append(ss, e.schema)
+	}
+	return ss
+}
+
+// Statistics    返回各校验器的计数
+func (r *Registry) Statistics() []Statistics {
+	r.mu.RLock()
+	es := r.entries
+	r.mu.RUnlock()
+	sts := make([]Statistics, 0, len(es))
+	for _, e := range es {
+		st := Statistics{
+			Name:         e.schema.Name,
+			Filter:       e.schema.Filter,
+			Policy:       e.schema.Policy,
+			Checked:      atomic.LoadUint64(&e.counter.checked),
+			Failed:       atomic.LoadUint64(&e.counter.failed),
+			LastFailNano: atomic.LoadInt64(&e.counter.lastFail),
+		}
+		st.LastError, _ = e.counter.lastErr.Load().(string)
+		sts = append(sts, st)
+	}
+	return sts
+}
+
+// Validate    按注册顺序校验主题匹配的校验器,返回第一个失败的结果;全部通过时返回nil
+func (r *Registry) Validate(topic string, payload []byte) *Failure {
+	r.mu.RLock()
+	es := r.entries
+	r.mu.RUnlock()
+	for _, e := range es {
+		if !rules.MatchTopic(e.schema.Filter, topic) {
+			continue
+		}
+		atomic.AddUint64(&e.counter.checked, 1)
+		if err := e.schema.Validator.Validate(payload); err != nil {
+			atomic.AddUint64(&e.counter.failed, 1)
+			atomic.StoreInt64(&e.counter.lastFail, time.Now().UnixNano())
+			e.counter.lastErr.Store(err.Error())
+			return &Failure{Schema: e.schema, Err: fmt.Errorf("%w: %s: %v", enmu.SchemaMismatchError, e.schema.Name, err)}
+		}
+	}
+	return nil
+}
+
+// validFilter    #只能是最后一级,+与#必须独占一级
+func validFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	levels := strings.Split(filter, "/")
+	for i, level := range levels {
+		if strings.ContainsAny(level, "+#") && len(level) > 1 {
+			return false
+		}
+		if level == "#" && i != len(levels)-1 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,218 @@
+package schema
+
+import (
+	"errors"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"testing"
+)
+
+const readingSchema = `{
+	"type": "object",
+	"required": ["id", "value"],
+	"properties": {
+		"id": {"type": "string"},
+		"value": {"type": "number", "minimum": 0}
+	},
+	"additionalProperties": false
+}`
+
+func TestJsonSchema(t *testing.T) {
+	v, err := NewJsonSchema([]byte(readingSchema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		payload string
+		ok      bool
+	}{
+		{`{"id": "a", "value": 1.5}`, true},
+		{`{"id": "a", "value": 12345678901234567890}`, true},
+		{` {"id": "a", "value": 0} `, true},
+		{`{"id": "a"}`, false},
+		{`{"id": 1, "value": 1}`, false},
+		{`{"id": "a", "value": -1}`, false},
+		{`{"id": "a", "value": 1, "extra": true}`, false},
+		{`{"id": "a", "value": 1`, false},
+		{`{"id": "a", "value": 1} {}`, false},
+		{``, false},
+		{`not json`, false},
+	}
+	for _, c := range cases {
+		if err = v.Validate([]byte(c.payload)); (err == nil) != c.ok {
+			t.Errorf("%q: %v", c.payload, err)
+		}
+	}
+
+	for _, doc := range []string{
+		`{"type": "object"`,
+		`{"type": "no-such-type"}`,
+		`{"$ref": "http://example.com/schema.json"}`,
+	} {
+		if _, err = NewJsonSchema([]byte(doc)); err == nil {
+			t.Errorf("schema %s is accepted", doc)
+		}
+	}
+}
+
+// readingDescriptor    proto2的acme.Reading{required string id = 1; optional double value = 2}
+func readingDescriptor(t *testing.T) []byte {
+	t.Helper()
+	fd := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("reading.proto"),
+		Package: proto.String("acme"),
+		Syntax:  proto.String("proto2"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Reading"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				{Name: proto.String("id"), Number: proto.Int32(1), Label: descriptorpb.FieldDescriptorProto_LABEL_REQUIRED.Enum(), Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum()},
+				{Name: proto.String("value"), Number: proto.Int32(2), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(), Type: descriptorpb.FieldDescriptorProto_TYPE_DOUBLE.Enum()},
+			},
+		}},
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name:  proto.String("Unit"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{{Name: proto.String("CELSIUS"), Number: proto.Int32(0)}},
+		}},
+	}
+	bs, err := proto.Marshal(&descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{fd}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bs
+}
+
+func TestProtobuf(t *testing.T) {
+	set := readingDescriptor(t)
+	v, err := NewProtobuf(set, "acme.Reading")
+	if err != nil {
+		t.Fatal(err)
+	}
+	md := v.(*protobufValidator).message
+	msg := dynamicpb.NewMessage(md)
+	msg.Set(md.Fields().ByName("id"), protoreflect.ValueOfString("a"))
+	valid, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = v.Validate(valid); err != nil {
+		t.Fatalf("valid payload: %v", err)
+	}
+	for name, payload := range map[string][]byte{
+		"missing required field": {0x11, 0, 0, 0, 0, 0, 0, 0xf0, 0x3f}, // 只有value = 1
+		"empty":                  nil,
+		"truncated":              valid[:len(valid)-1],
+		"garbage":                {0xff, 0xff, 0xff},
+	} {
+		if err = v.Validate(payload); err == nil {
+			t.Errorf("%s is accepted", name)
+		}
+	}
+
+	for name, c := range map[string]struct {
+		set     []byte
+		message string
+	}{
+		"unknown message": {set, "acme.Missing"},
+		"enum":            {set, "acme.Unit"},
+		"bad descriptor":  {[]byte{0xff}, "acme.Reading"},
+	} {
+		if _, err = NewProtobuf(c.set, c.message); err == nil {
+			t.Errorf("%s is accepted", name)
+		}
+	}
+}
+
+// validatorFunc    测试用的校验器
+type validatorFunc func([]byte) error
+
+func (f validatorFunc) Validate(payload []byte) error {
+	return f(payload)
+}
+
+var (
+	pass = validatorFunc(func([]byte) error { return nil })
+	fail = validatorFunc(func([]byte) error { return errors.New("bad payload") })
+)
+
+func TestRegisterRejected(t *testing.T) {
+	r := NewRegistry()
+	cases := []struct {
+		schema Schema
+		err    error
+	}{
+		{Schema{Filter: "a", Validator: pass}, enmu.SchemaNameError},
+		{Schema{Name: "s", Validator: pass}, enmu.SchemaFilterError},
+		{Schema{Name: "s", Filter: "a/#/b", Validator: pass}, enmu.SchemaFilterError},
+		{Schema{Name: "s", Filter: "a/b+", Validator: pass}, enmu.SchemaFilterError},
+		{Schema{Name: "s", Filter: "a"}, enmu.SchemaValidatorError},
+		{Schema{Name: "s", Filter: "a", Validator: pass, Policy: "drop"}, enmu.SchemaPolicyError},
+		{Schema{Name: "s", Filter: "a", Validator: pass, Policy: enmu.DeadLetterSchema}, enmu.SchemaPolicyError},
+		{Schema{Name: "s", Filter: "a", Validator: pass, Policy: enmu.DeadLetterSchema, DeadLetterTopic: "dead/+"}, enmu.SchemaPolicyError},
+	}
+	for _, c := range cases {
+		if err := r.Register(c.schema); !errors.Is(err, c.err) {
+			t.Errorf("%+v: %v, want %v", c.schema, err, c.err)
+		}
+	}
+	if r.Len() != 0 {
+		t.Fatalf("%d schemas are registered", r.Len())
+	}
+	if err := r.Unregister("s"); !errors.Is(err, enmu.SchemaNotFoundError) {
+		t.Fatalf("unregister %v", err)
+	}
+}
+
+// TestRegistryValidate    按注册顺序校验,返回第一个失败;只统计主题匹配的校验器;同名替换时保留计数
+func TestRegistryValidate(t *testing.T) {
+	r := NewRegistry()
+	for _, s := range []Schema{
+		{Name: "all", Filter: "sensors/#", Validator: pass},
+		{Name: "temp", Filter: "sensors/+/temp", Validator: fail, Policy: enmu.DeadLetterSchema, DeadLetterTopic: "dead/${schema}/${clientid}/${topic}"},
+		{Name: "other", Filter: "other", Validator: fail},
+	} {
+		if err := r.Register(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if f := r.Validate("sensors/a/humidity", nil); f != nil {
+		t.Fatalf("humidity %v", f.Err)
+	}
+	f := r.Validate("sensors/a/temp", nil)
+	if f == nil || f.Schema.Name != "temp" || !errors.Is(f.Err, enmu.SchemaMismatchError) {
+		t.Fatalf("temp %+v", f)
+	}
+	if topic := f.DeadLetterTopic("sensors/a/temp", "dev"); topic != "dead/temp/dev/sensors/a/temp" {
+		t.Fatalf("dead letter topic %s", topic)
+	}
+	if r.Schemas()[2].Policy != enmu.RejectSchema {
+		t.Fatalf("default policy %s", r.Schemas()[2].Policy)
+	}
+
+	check := func(want map[string][2]uint64) {
+		t.Helper()
+		for _, st := range r.Statistics() {
+			if w := want[st.Name]; st.Checked != w[0] || st.Failed != w[1] || (st.Failed > 0) != (st.LastError != "" && st.LastFailNano > 0) {
+				t.Fatalf("%s statistics %+v, want %v", st.Name, st, w)
+			}
+		}
+	}
+	check(map[string][2]uint64{"all": {2, 0}, "temp": {1, 1}, "other": {0, 0}})
+
+	if err := r.Register(Schema{Name: "temp", Filter: "sensors/+/temp", Validator: pass}); err != nil {
+		t.Fatal(err)
+	}
+	if f = r.Validate("sensors/a/temp", nil); f != nil || r.Len() != 3 || r.Schemas()[1].Name != "temp" {
+		t.Fatalf("replaced schema %+v %d", f, r.Len())
+	}
+	check(map[string][2]uint64{"all": {3, 0}, "temp": {2, 1}, "other": {0, 0}})
+
+	if err := r.Unregister("all"); err != nil || r.Len() != 2 {
+		t.Fatalf("unregister %v %d", err, r.Len())
+	}
+	if f = r.Validate("other", nil); f == nil || f.Schema.Name != "other" {
+		t.Fatalf("other %+v", f)
+	}
+}
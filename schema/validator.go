@@ -0,0 +1,80 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"io"
+)
+
+const jsonSchemaUrl = "mem://schema.json"
+
+type jsonValidator struct {
+	schema *jsonschema.Schema
+}
+
+// NewJsonSchema    编译JSON Schema文档,未声明$schema时按draft 2020-12处理;不加载外部$ref
+func NewJsonSchema(doc []byte) (Validator, error) {
+	c := jsonschema.NewCompiler()
+	c.LoadURL = func(s string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("external schema %s is not allowed", s)
+	}
+	if err := c.AddResource(jsonSchemaUrl, bytes.NewReader(doc)); err != nil {
+		return nil, err
+	}
+	s, err := c.Compile(jsonSchemaUrl)
+	if err != nil {
+		return nil, err
+	}
+	return &jsonValidator{schema: s}, nil
+}
+
+func (v *jsonValidator) Validate(payload []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("malformed json: %w", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("malformed json: trailing data")
+	}
+	return v.schema.Validate(doc)
+}
+
+type protobufValidator struct {
+	message protoreflect.MessageDescriptor
+}
+
+// NewProtobuf    按FileDescriptorSet(protoc --descriptor_set_out --include_imports的输出)中的消息类型校验负载,
+// message为完整名称,如:acme.telemetry.Reading;负载需能解码为该消息且必填字段齐全
+func NewProtobuf(descriptorSet []byte, message string) (Validator, error) {
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(descriptorSet, &set); err != nil {
+		return nil, err
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, err
+	}
+	d, err := files.FindDescriptorByName(protoreflect.FullName(message))
+	if err != nil {
+		return nil, err
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message", message)
+	}
+	return &protobufValidator{message: md}, nil
+}
+
+func (v *protobufValidator) Validate(payload []byte) error {
+	return proto.Unmarshal(payload, dynamicpb.NewMessage(v.message))
+}
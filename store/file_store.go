@@ -0,0 +1,413 @@
+// Package store  持久会话存储的内置实现
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const compactMinRecords = 1000 // 日志记录数少于该值时不压缩
+
+// 日志记录类型
+const (
+	opSession        = "session"
+	opDeleteSession  = "delete_session"
+	opEnqueue        = "enqueue"
+	opDequeue        = "dequeue"
+	opInflight       = "inflight"
+	opDeleteInflight = "delete_inflight"
+	opRetained       = "retained"
+	opDelayed        = "delayed"
+	opDeleteDelayed  = "delete_delayed"
+)
+
+// record   日志中的一行
+type record struct {
+	Op        string                      `json:"op"`
+	Id        string                      `json:"id,omitempty"`
+	MessageId uint16                      `json:"mid,omitempty"`
+	Max       int                         `json:"max,omitempty"`
+	Session   *clients_dto.Session        `json:"session,omitempty"`
+	Message   *clients_dto.StoredMessage  `json:"message,omitempty"`
+	Delayed   *clients_dto.DelayedMessage `json:"delayed,omitempty"`
+}
+
+/*
+FileStore    基于追加日志的SessionStore实现,同时实现clients.DelayedStore
+  - 每次修改以一行JSON追加写入文件,打开时重放日志恢复状态
+  - 日志记录数超过有效记录数的两倍时,用内存中的状态重写文件
+  - Sync为true时每次写入后刷盘
+  - 打开时最后一行不完整(写入中途崩溃)时截断到最后一条完整记录
+  - 压缩失败不影响已追加的记录,错误写入Logger(为nil时使用slog.Default()),下次写入时重试
+*/
+type FileStore struct {
+	Sync     bool
+	Logger   *slog.Logger
+	mu       sync.Mutex
+	path     string
+	file     *os.File
+	written  int // 文件中的记录数
+	sessions map[string]clients_dto.Session
+	queues   map[string][]clients_dto.StoredMessage
+	inflight map[string]map[uint16]clients_dto.StoredMessage
+	retained map[string]clients_dto.StoredMessage
+	delayed  map[string]clients_dto.DelayedMessage
+}
+
+// NewFileStore    加载日志文件并以追加方式打开,文件不存在时创建
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path:     path,
+		sessions: map[string]clients_dto.Session{},
+		queues:   map[string][]clients_dto.StoredMessage{},
+		inflight: map[string]map[uint16]clients_dto.StoredMessage{},
+		retained: map[string]clients_dto.StoredMessage{},
+		delayed:  map[string]clients_dto.DelayedMessage{},
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.file = f
+	return s, nil
+}
+
+// load    重放日志;没有换行结尾的最后一行是未写完的记录,截断后再追加,避免与下一条记录连在一起
+func (s *FileStore) load() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	var complete int64 // 最后一条完整记录之后的偏移
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_ = f.Close()
+			return err
+		}
+		complete += int64(len(line))
+		var rec record
+		if json.Unmarshal(bytes.TrimSpace(line), &rec) == nil {
+			s.apply(&rec)
+			s.written++
+		}
+	}
+	info, err := f.Stat()
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	if info.Size() == complete {
+		return nil
+	}
+	s.logger().Warn("file store truncated a torn record", slog.String("path", s.path), slog.Int64("offset", complete), slog.Int64("size", info.Size()))
+	return os.Truncate(s.path, complete)
+}
+
+func (s *FileStore) Sessions() ([]clients_dto.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]clients_dto.Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		list = append(list, copySession(session))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ClientId < list[j].ClientId })
+	return list, nil
+}
+
+func (s *FileStore) SaveSession(session clients_dto.Session) error {
+	session = copySession(session)
+	session.UpdatedNano = time.Now().UnixNano()
+	return s.write(&record{Op: opSession, Id: session.ClientId, Session: &session})
+}
+
+func (s *FileStore) DeleteSession(id string) error {
+	return s.write(&record{Op: opDeleteSession, Id: id})
+}
+
+func (s *FileStore) Enqueue(m clients_dto.StoredMessage, max int) error {
+	return s.write(&record{Op: opEnqueue, Id: m.ClientId, Max: max, Message: &m})
+}
+
+// Dequeue    读取与清空在同一次加锁中完成,并发的Enqueue不会在两者之间丢失
+func (s *FileStore) Dequeue(id string) ([]clients_dto.StoredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := s.queues[id]
+	if len(list) == 0 {
+		return nil, nil
+	}
+	if err := s.writeLocked(&record{Op: opDequeue, Id: id}); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (s *FileStore) SaveInflight(m clients_dto.StoredMessage) error {
+	return s.write(&record{Op: opInflight, Id: m.ClientId, MessageId: m.MessageId, Message: &m})
+}
+
+func (s *FileStore) DeleteInflight(id string, messageId uint16) error {
+	s.mu.Lock()
+	_, ok := s.inflight[id][messageId]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return s.write(&record{Op: opDeleteInflight, Id: id, MessageId: messageId})
+}
+
+func (s *FileStore) Inflight(id string) ([]clients_dto.StoredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]clients_dto.StoredMessage, 0, len(s.inflight[id]))
+	for _, m := range s.inflight[id] {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Nano < list[j].Nano })
+	return list, nil
+}
+
+func (s *FileStore) SaveRetained(m clients_dto.StoredMessage) error {
+	m.ClientId = ""
+	return s.write(&record{Op: opRetained, Message: &m})
+}
+
+func (s *FileStore) Retained() ([]clients_dto.StoredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]clients_dto.StoredMessage, 0, len(s.retained))
+	for _, m := range s.retained {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Topic < list[j].Topic })
+	return list, nil
+}
+
+func (s *FileStore) SaveDelayed(d clients_dto.DelayedMessage) error {
+	return s.write(&record{Op: opDelayed, Id: d.Id, Delayed: &d})
+}
+
+func (s *FileStore) DeleteDelayed(id string) error {
+	s.mu.Lock()
+	_, ok := s.delayed[id]
+	s.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return s.write(&record{Op: opDeleteDelayed, Id: id})
+}
+
+// Delayed    按到期时间返回等待中的延迟消息
+func (s *FileStore) Delayed() ([]clients_dto.DelayedMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]clients_dto.DelayedMessage, 0, len(s.delayed))
+	for _, d := range s.delayed {
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ReleaseNano < list[j].ReleaseNano })
+	return list, nil
+}
+
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// write    追加日志并修改内存状态;追加成功后返回nil,压缩的错误只记录日志
+func (s *FileStore) write(r *record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeLocked(r)
+}
+
+// writeLocked    同write,调用方需持有锁
+func (s *FileStore) writeLocked(r *record) error {
+	if r.Message != nil && r.Message.Nano == 0 {
+		r.Message.Nano = time.Now().UnixNano()
+	}
+	bs, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if s.file == nil {
+		return os.ErrClosed
+	}
+	if _, err = s.file.Write(append(bs, '\n')); err != nil {
+		return err
+	}
+	if s.Sync {
+		if err = s.file.Sync(); err != nil {
+			return err
+		}
+	}
+	s.apply(r)
+	s.written++
+	if live := s.live(); s.written >= compactMinRecords && s.written > 2*live {
+		if err = s.compact(); err != nil {
+			s.logger().Warn("file store compaction failed", slog.String("path", s.path), slog.Any("err", err))
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// apply    把一条记录应用到内存状态,调用方需持有锁
+func (s *FileStore) apply(r *record) {
+	switch r.Op {
+	case opSession:
+		if r.Session != nil {
+			s.sessions[r.Id] = *r.Session
+		}
+	case opDeleteSession:
+		delete(s.sessions, r.Id)
+		delete(s.queues, r.Id)
+		delete(s.inflight, r.Id)
+	case opEnqueue:
+		if r.Message == nil {
+			return
+		}
+		queue := append(s.queues[r.Id], *r.Message)
+		if r.Max > 0 && len(queue) > r.Max {
+			queue = append([]clients_dto.StoredMessage{}, queue[len(queue)-r.Max:]...)
+		}
+		s.queues[r.Id] = queue
+	case opDequeue:
+		delete(s.queues, r.Id)
+	case opInflight:
+		if r.Message == nil {
+			return
+		}
+		if s.inflight[r.Id] == nil {
+			s.inflight[r.Id] = map[uint16]clients_dto.StoredMessage{}
+		}
+		s.inflight[r.Id][r.MessageId] = *r.Message
+	case opDeleteInflight:
+		delete(s.inflight[r.Id], r.MessageId)
+		if len(s.inflight[r.Id]) == 0 {
+			delete(s.inflight, r.Id)
+		}
+	case opRetained:
+		if r.Message == nil {
+			return
+		}
+		if len(r.Message.Payload) == 0 {
+			delete(s.retained, r.Message.Topic)
+		} else {
+			s.retained[r.Message.Topic] = *r.Message
+		}
+	case opDelayed:
+		if r.Delayed != nil {
+			s.delayed[r.Id] = *r.Delayed
+		}
+	case opDeleteDelayed:
+		delete(s.delayed, r.Id)
+	}
+}
+
+// live    有效记录数,调用方需持有锁
+func (s *FileStore) live() int {
+	n := len(s.sessions) + len(s.retained) + len(s.delayed)
+	for _, queue := range s.queues {
+		n += len(queue)
+	}
+	for _, ms := range s.inflight {
+		n += len(ms)
+	}
+	return n
+}
+
+// compact    用内存中的状态重写日志,调用方需持有锁。
+// 新文件以追加方式打开,改名后直接作为写入的文件,不需要重新打开;任一步失败时继续使用原文件
+func (s *FileStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	written := 0
+	put := func(r *record) {
+		bs, _ := json.Marshal(r)
+		_, _ = w.Write(append(bs, '\n'))
+		written++
+	}
+	for id, session := range s.sessions {
+		session := session
+		put(&record{Op: opSession, Id: id, Session: &session})
+	}
+	for id, queue := range s.queues {
+		for i := range queue {
+			put(&record{Op: opEnqueue, Id: id, Message: &queue[i]})
+		}
+	}
+	for id, ms := range s.inflight {
+		for mid, m := range ms {
+			m := m
+			put(&record{Op: opInflight, Id: id, MessageId: mid, Message: &m})
+		}
+	}
+	for _, m := range s.retained {
+		m := m
+		put(&record{Op: opRetained, Message: &m})
+	}
+	for id, d := range s.delayed {
+		d := d
+		put(&record{Op: opDelayed, Id: id, Delayed: &d})
+	}
+	if err = w.Flush(); err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return err
+	}
+	_ = s.file.Close()
+	s.file = f
+	s.written = written
+	return nil
+}
+
+func copySession(session clients_dto.Session) clients_dto.Session {
+	subs := make(map[string]byte, len(session.Subscriptions))
+	for filter, qos := range session.Subscriptions {
+		subs[filter] = qos
+	}
+	session.Subscriptions = subs
+	return session
+}
@@ -0,0 +1,159 @@
+package store
+
+import (
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestFileStoreCompactionError    压缩失败时已追加的记录照常生效,写入返回nil
+func TestFileStoreCompactionError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.log")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	// 临时文件的路径被目录占用,压缩无法创建临时文件
+	if err = os.Mkdir(path+".tmp", 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < compactMinRecords; i++ {
+		if err = s.SaveDelayed(clients_dto.DelayedMessage{Id: "old", Topic: "a"}); err != nil {
+			t.Fatalf("save %d: %v", i, err)
+		}
+		if err = s.DeleteDelayed("old"); err != nil {
+			t.Fatalf("delete %d: %v", i, err)
+		}
+	}
+	if err = s.SaveDelayed(clients_dto.DelayedMessage{Id: "d1", Topic: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := s.Delayed(); len(list) != 1 || list[0].Id != "d1" {
+		t.Fatalf("delayed %+v", list)
+	}
+	_ = s.Close()
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if list, _ := reopened.Delayed(); len(list) != 1 || list[0].Id != "d1" {
+		t.Fatalf("delayed after reopen %+v", list)
+	}
+}
+
+// TestFileStoreTornRecord    最后一行没有写完时打开会截断,之后追加的记录不会与之连在一起
+func TestFileStoreTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.log")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SaveSession(clients_dto.Session{ClientId: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+	info, _ := os.Stat(path)
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	_, _ = f.WriteString(`{"op":"session","id":"torn","session":{"ClientId":"to`)
+	_ = f.Close()
+
+	s, err = NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.Stat(path); after.Size() != info.Size() {
+		t.Fatalf("size %d after truncation, want %d", after.Size(), info.Size())
+	}
+	if err = s.SaveSession(clients_dto.Session{ClientId: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+	s, err = NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if list, _ := s.Sessions(); len(list) != 2 || list[0].ClientId != "a" || list[1].ClientId != "b" {
+		t.Fatalf("sessions %+v", list)
+	}
+}
+
+// TestFileStoreDequeueConcurrent    与Enqueue并发时每条消息恰好被取出一次
+func TestFileStoreDequeueConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.log")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	const n = 2000
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			_ = s.Enqueue(clients_dto.StoredMessage{ClientId: "c", Topic: "t", Nano: int64(i + 1)}, 0)
+		}
+	}()
+	seen := map[int64]bool{}
+	take := func() {
+		list, err := s.Dequeue("c")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range list {
+			if seen[m.Nano] {
+				t.Fatalf("message %d dequeued twice", m.Nano)
+			}
+			seen[m.Nano] = true
+		}
+	}
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		take()
+	}
+	take()
+	if len(seen) != n {
+		t.Fatalf("dequeued %d of %d messages", len(seen), n)
+	}
+}
+
+// TestFileStoreWriteAfterCompaction    压缩后的写入追加到新文件,重新打开后可以恢复
+func TestFileStoreWriteAfterCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.log")
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < compactMinRecords; i++ {
+		_ = s.SaveDelayed(clients_dto.DelayedMessage{Id: "old", Topic: "a"})
+		_ = s.DeleteDelayed("old")
+	}
+	if s.written >= compactMinRecords {
+		t.Fatalf("not compacted, %d records", s.written)
+	}
+	if err = s.SaveDelayed(clients_dto.DelayedMessage{Id: "d1", Topic: "b"}); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file is left: %v", err)
+	}
+	s, err = NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if list, _ := s.Delayed(); len(list) != 1 || list[0].Id != "d1" {
+		t.Fatalf("delayed after reopen %+v", list)
+	}
+	if s.written != 1 {
+		t.Fatalf("%d records after reopen", s.written)
+	}
+}
@@ -0,0 +1,292 @@
+// Package webhook  以HTTP POST批量推送链接与消息事件
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"github.com/qdmc/mqtt_single_proxy/rules"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultBatchSize     = 100
+	defaultFlushInterval = 1000
+	defaultMaxRetries    = 3
+	defaultRetryBackoff  = 500
+	defaultQueueSize     = 10000
+	defaultTimeout       = 5
+)
+
+// SignatureHeader    签名请求头,值为sha256=<请求体HMAC-SHA256的hex>
+const SignatureHeader = "X-Webhook-Signature"
+
+// Options   webhook配置项
+type Options struct {
+	Url           string                             // 推送地址,http或https;请求体为[]clients_dto.WebhookEvent的JSON
+	Secret        string                             // HMAC-SHA256签名密钥,为空时不签名
+	Events        map[enmu.WebhookEventType][]string // 推送的事件及其主题过滤器;为nil时推送全部事件,过滤器为空时不按主题筛选
+	Header        map[string]string                  // 附加的请求头
+	BatchSize     int                                // 每次请求最多的事件数,默认:100
+	FlushInterval int64                              // 未满一批时的最长等待(毫秒),默认:1000
+	MaxRetries    int                                // 失败后的重试次数,默认:3,小于0时不重试;4xx响应(429除外)不重试
+	RetryBackoff  int64                              // 首次重试间隔(毫秒),默认:500;之后每次翻倍
+	QueueSize     int                                // 队列长度,默认:10000;队列满时丢弃新事件
+	Timeout       int64                              // 请求超时(秒),默认:5
+	Client        *http.Client                       // 为nil时使用超时为Timeout的http.Client
+}
+
+// Emitter   webhook推送器,可作为rules.Sink使用
+type Emitter struct {
+	opt       Options
+	client    *http.Client
+	queue     chan clients_dto.WebhookEvent
+	closeOnce sync.Once
+	closing   chan struct{}
+	done      chan struct{}
+	sent      uint64
+	failed    uint64
+	dropped   uint64
+	retries   uint64
+}
+
+var _ rules.Sink = (*Emitter)(nil)
+
+// NewEmitter    校验配置并启动推送协程;使用后需Close
+func NewEmitter(opt Options) (*Emitter, error) {
+	u, err := url.Parse(opt.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, enmu.WebhookUrlError
+	}
+	if opt.BatchSize <= 0 {
+		opt.BatchSize = defaultBatchSize
+	}
+	if opt.FlushInterval <= 0 {
+		opt.FlushInterval = defaultFlushInterval
+	}
+	if opt.MaxRetries < 0 {
+		opt.MaxRetries = 0
+	} else if opt.MaxRetries == 0 {
+		opt.MaxRetries = defaultMaxRetries
+	}
+	if opt.RetryBackoff <= 0 {
+		opt.RetryBackoff = defaultRetryBackoff
+	}
+	if opt.QueueSize <= 0 {
+		opt.QueueSize = defaultQueueSize
+	}
+	if opt.Timeout <= 0 {
+		opt.Timeout = defaultTimeout
+	}
+	client := opt.Client
+	if client == nil {
+		client = &http.Client{Timeout: time.Duration(opt.Timeout) * time.Second}
+	}
+	e := &Emitter{
+		opt:     opt,
+		client:  client,
+		queue:   make(chan clients_dto.WebhookEvent, opt.QueueSize),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go e.loop()
+	return e, nil
+}
+
+// Accept    事件是否需要推送
+func (e *Emitter) Accept(ev *clients_dto.WebhookEvent) bool {
+	if e.opt.Events == nil {
+		return true
+	}
+	filters, ok := e.opt.Events[ev.Event]
+	if !ok {
+		return false
+	}
+	if len(filters) == 0 {
+		return true
+	}
+	switch ev.Event {
+	case enmu.PublishWebhook, enmu.RuleWebhook:
+		return matchAny(filters, ev.Topic)
+	case enmu.SubscribeWebhook:
+		for topic := range ev.Subscriptions {
+			if matchAny(filters, topic) {
+				return true
+			}
+		}
+		return false
+	case enmu.UnsubscribeWebhook:
+		for _, topic := range ev.Topics {
+			if matchAny(filters, topic) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Emit    事件入队,不阻塞;不需要推送的事件直接忽略;队列满时返回enmu.WebhookQueueFullError
+func (e *Emitter) Emit(ev clients_dto.WebhookEvent) error {
+	if !e.Accept(&ev) {
+		return nil
+	}
+	select {
+	case <-e.closing:
+		return enmu.WebhookClosedError
+	default:
+	}
+	select {
+	case e.queue <- ev:
+		return nil
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+		return enmu.WebhookQueueFullError
+	}
+}
+
+// Send    实现rules.Sink,推送RuleWebhook事件,负载为规则的输出
+func (e *Emitter) Send(out rules.Output) error {
+	return e.Emit(clients_dto.WebhookEvent{
+		Event:    enmu.RuleWebhook,
+		ClientId: out.Message.ClientId,
+		UserName: out.Message.UserName,
+		Topic:    out.Message.Topic,
+		Qos:      out.Message.Qos,
+		Retain:   out.Message.Retain,
+		Payload:  out.Payload,
+		RuleId:   out.RuleId,
+		Nano:     out.Message.Nano,
+	})
+}
+
+// Close    停止接收事件,推送完队列中剩余的事件后返回
+func (e *Emitter) Close() error {
+	e.closeOnce.Do(func() { close(e.closing) })
+	<-e.done
+	return nil
+}
+
+func (e *Emitter) Statistics() clients_dto.WebhookStatistics {
+	return clients_dto.WebhookStatistics{
+		Url:     e.opt.Url,
+		Queued:  len(e.queue),
+		Sent:    atomic.LoadUint64(&e.sent),
+		Failed:  atomic.LoadUint64(&e.failed),
+		Dropped: atomic.LoadUint64(&e.dropped),
+		Retries: atomic.LoadUint64(&e.retries),
+	}
+}
+
+func (e *Emitter) loop() {
+	defer close(e.done)
+	ticker := time.NewTicker(time.Duration(e.opt.FlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+	batch := make([]clients_dto.WebhookEvent, 0, e.opt.BatchSize)
+	add := func(ev clients_dto.WebhookEvent) {
+		batch = append(batch, ev)
+		if len(batch) >= e.opt.BatchSize {
+			e.post(batch)
+			batch = batch[:0]
+		}
+	}
+	for {
+		select {
+		case ev := <-e.queue:
+			add(ev)
+		case <-ticker.C:
+			if len(batch) > 0 {
+				e.post(batch)
+				batch = batch[:0]
+			}
+		case <-e.closing:
+			for {
+				select {
+				case ev := <-e.queue:
+					add(ev)
+				default:
+					if len(batch) > 0 {
+						e.post(batch)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// post    推送一批事件,失败时按退避间隔重试
+func (e *Emitter) post(batch []clients_dto.WebhookEvent) {
+	n := uint64(len(batch))
+	body, err := json.Marshal(batch)
+	if err != nil {
+		atomic.AddUint64(&e.failed, n)
+		return
+	}
+	backoff := time.Duration(e.opt.RetryBackoff) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		retry, err := e.send(body)
+		if err == nil {
+			atomic.AddUint64(&e.sent, n)
+			return
+		}
+		if !retry || attempt >= e.opt.MaxRetries {
+			atomic.AddUint64(&e.failed, n)
+			return
+		}
+		atomic.AddUint64(&e.retries, 1)
+		time.Sleep(backoff << attempt)
+	}
+}
+
+// send    发送一次请求,返回失败时是否可重试
+func (e *Emitter) send(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, e.opt.Url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range e.opt.Header {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if e.opt.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(e.opt.Secret, body))
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("%w: %d", enmu.WebhookStatusError, resp.StatusCode)
+}
+
+// Sign    计算请求体的签名,接收方可用同样的方法校验SignatureHeader
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func matchAny(filters []string, topic string) bool {
+	for _, filter := range filters {
+		if rules.MatchTopic(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,274 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/qdmc/mqtt_single_proxy/dto/clients_dto"
+	"github.com/qdmc/mqtt_single_proxy/enmu"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// request    receiver收到的一次请求
+type request struct {
+	header http.Header
+	body   []byte
+	events []clients_dto.WebhookEvent
+	at     time.Time
+}
+
+// receiver    记录请求的httptest服务端,status依次作为每次请求的响应码,用完后返回200
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []request
+	status   []int
+}
+
+func newReceiver(t *testing.T, status ...int) *receiver {
+	t.Helper()
+	r := &receiver{status: status}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		var events []clients_dto.WebhookEvent
+		_ = json.Unmarshal(body, &events)
+		r.mu.Lock()
+		r.requests = append(r.requests, request{header: req.Header.Clone(), body: body, events: events, at: time.Now()})
+		code := http.StatusOK
+		if len(r.status) > 0 {
+			code, r.status = r.status[0], r.status[1:]
+		}
+		r.mu.Unlock()
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) received() []request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]request{}, r.requests...)
+}
+
+func newTestEmitter(t *testing.T, opt Options) *Emitter {
+	t.Helper()
+	e, err := NewEmitter(opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = e.Close() })
+	return e
+}
+
+func publishEvent(topic string) clients_dto.WebhookEvent {
+	return clients_dto.WebhookEvent{Event: enmu.PublishWebhook, ClientId: "c1", Topic: topic, Payload: []byte("hello")}
+}
+
+func TestEmitterBatches(t *testing.T) {
+	r := newReceiver(t)
+	e := newTestEmitter(t, Options{Url: r.URL, BatchSize: 3, FlushInterval: 60000})
+	for i := 0; i < 7; i++ {
+		if err := e.Emit(publishEvent("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = e.Close()
+	var sizes []int
+	for _, req := range r.received() {
+		sizes = append(sizes, len(req.events))
+	}
+	if len(sizes) != 3 || sizes[0] != 3 || sizes[1] != 3 || sizes[2] != 1 {
+		t.Fatalf("batch sizes %v, want [3 3 1]", sizes)
+	}
+	if s := e.Statistics(); s.Sent != 7 || s.Failed != 0 {
+		t.Fatalf("statistics %+v", s)
+	}
+}
+
+func TestEmitterFlushInterval(t *testing.T) {
+	r := newReceiver(t)
+	e := newTestEmitter(t, Options{Url: r.URL, BatchSize: 100, FlushInterval: 50})
+	_ = e.Emit(publishEvent("a"))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(r.received()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("partial batch is not flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestEmitterRetriesServerErrors(t *testing.T) {
+	r := newReceiver(t, http.StatusInternalServerError, http.StatusServiceUnavailable)
+	backoff := 40 * time.Millisecond
+	e := newTestEmitter(t, Options{Url: r.URL, BatchSize: 1, MaxRetries: 3, RetryBackoff: backoff.Milliseconds()})
+	_ = e.Emit(publishEvent("a"))
+	_ = e.Close()
+	reqs := r.received()
+	if len(reqs) != 3 {
+		t.Fatalf("%d requests, want 3", len(reqs))
+	}
+	// 退避间隔每次翻倍
+	if d := reqs[1].at.Sub(reqs[0].at); d < backoff {
+		t.Fatalf("first retry after %v, want at least %v", d, backoff)
+	}
+	if d := reqs[2].at.Sub(reqs[1].at); d < 2*backoff {
+		t.Fatalf("second retry after %v, want at least %v", d, 2*backoff)
+	}
+	if s := e.Statistics(); s.Sent != 1 || s.Retries != 2 || s.Failed != 0 {
+		t.Fatalf("statistics %+v", s)
+	}
+}
+
+func TestEmitterGivesUp(t *testing.T) {
+	r := newReceiver(t, 500, 500, 500)
+	e := newTestEmitter(t, Options{Url: r.URL, BatchSize: 1, MaxRetries: 2, RetryBackoff: 1})
+	_ = e.Emit(publishEvent("a"))
+	_ = e.Close()
+	if n := len(r.received()); n != 3 {
+		t.Fatalf("%d requests, want 3", n)
+	}
+	if s := e.Statistics(); s.Failed != 1 || s.Retries != 2 {
+		t.Fatalf("statistics %+v", s)
+	}
+}
+
+func TestEmitterNoRetryOnClientError(t *testing.T) {
+	r := newReceiver(t, http.StatusBadRequest)
+	e := newTestEmitter(t, Options{Url: r.URL, BatchSize: 1, RetryBackoff: 1})
+	_ = e.Emit(publishEvent("a"))
+	_ = e.Close()
+	if n := len(r.received()); n != 1 {
+		t.Fatalf("%d requests, want 1", n)
+	}
+	if s := e.Statistics(); s.Failed != 1 || s.Retries != 0 {
+		t.Fatalf("statistics %+v", s)
+	}
+}
+
+func TestEmitterSignature(t *testing.T) {
+	const secret = "s3cret"
+	r := newReceiver(t)
+	e := newTestEmitter(t, Options{Url: r.URL, Secret: secret, BatchSize: 1, Header: map[string]string{"X-Test": "1"}})
+	_ = e.Emit(publishEvent("a"))
+	_ = e.Close()
+	reqs := r.received()
+	if len(reqs) != 1 {
+		t.Fatalf("%d requests, want 1", len(reqs))
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(reqs[0].body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if got := reqs[0].header.Get(SignatureHeader); got != want || Sign(secret, reqs[0].body) != want {
+		t.Fatalf("signature %q, want %q", got, want)
+	}
+	if reqs[0].header.Get("X-Test") != "1" || reqs[0].header.Get("Content-Type") != "application/json" {
+		t.Fatalf("header %v", reqs[0].header)
+	}
+}
+
+func TestEmitterUnsigned(t *testing.T) {
+	r := newReceiver(t)
+	e := newTestEmitter(t, Options{Url: r.URL, BatchSize: 1})
+	_ = e.Emit(publishEvent("a"))
+	_ = e.Close()
+	if reqs := r.received(); len(reqs) != 1 || reqs[0].header.Get(SignatureHeader) != "" {
+		t.Fatalf("requests %+v", reqs)
+	}
+}
+
+func TestEmitterTopicFilters(t *testing.T) {
+	r := newReceiver(t)
+	e := newTestEmitter(t, Options{
+		Url:       r.URL,
+		BatchSize: 100,
+		Events: map[enmu.WebhookEventType][]string{
+			enmu.PublishWebhook:     {"sensors/#"},
+			enmu.SubscribeWebhook:   {"cmd/+"},
+			enmu.UnsubscribeWebhook: {"cmd/+"},
+			enmu.ConnectedWebhook:   nil,
+		},
+	})
+	events := []struct {
+		ev     clients_dto.WebhookEvent
+		accept bool
+	}{
+		{publishEvent("sensors/1/temp"), true},
+		{publishEvent("other/1"), false},
+		{clients_dto.WebhookEvent{Event: enmu.SubscribeWebhook, Subscriptions: map[string]byte{"x": 0, "cmd/1": 1}}, true},
+		{clients_dto.WebhookEvent{Event: enmu.SubscribeWebhook, Subscriptions: map[string]byte{"x": 0}}, false},
+		{clients_dto.WebhookEvent{Event: enmu.UnsubscribeWebhook, Topics: []string{"cmd/2"}}, true},
+		{clients_dto.WebhookEvent{Event: enmu.UnsubscribeWebhook, Topics: []string{"cmd/2/x"}}, false},
+		{clients_dto.WebhookEvent{Event: enmu.ConnectedWebhook, ClientId: "c1"}, true},
+		{clients_dto.WebhookEvent{Event: enmu.DisconnectedWebhook, ClientId: "c1"}, false},
+	}
+	want := 0
+	for i, c := range events {
+		if got := e.Accept(&c.ev); got != c.accept {
+			t.Fatalf("event %d: accept %v, want %v", i, got, c.accept)
+		}
+		if err := e.Emit(c.ev); err != nil {
+			t.Fatal(err)
+		}
+		if c.accept {
+			want++
+		}
+	}
+	_ = e.Close()
+	got := 0
+	for _, req := range r.received() {
+		got += len(req.events)
+	}
+	if got != want {
+		t.Fatalf("received %d events, want %d", got, want)
+	}
+}
+
+func TestEmitterQueueFull(t *testing.T) {
+	arrived, release := make(chan struct{}, 1), make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case arrived <- struct{}{}:
+		default:
+		}
+		<-release
+	}))
+	defer srv.Close()
+	e := newTestEmitter(t, Options{Url: srv.URL, BatchSize: 1, QueueSize: 1, MaxRetries: -1})
+	defer close(release)
+	if err := e.Emit(publishEvent("a")); err != nil {
+		t.Fatal(err)
+	}
+	// 推送协程阻塞在第一次请求上
+	select {
+	case <-arrived:
+	case <-time.After(2 * time.Second):
+		t.Fatal("request is not sent")
+	}
+	if err := e.Emit(publishEvent("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Emit(publishEvent("a")); !errors.Is(err, enmu.WebhookQueueFullError) {
+		t.Fatalf("emit on a full queue returned %v", err)
+	}
+	if s := e.Statistics(); s.Dropped != 1 || s.Queued != 1 {
+		t.Fatalf("statistics %+v", s)
+	}
+}
+
+func TestEmitterClosed(t *testing.T) {
+	r := newReceiver(t)
+	e := newTestEmitter(t, Options{Url: r.URL})
+	_ = e.Close()
+	if err := e.Emit(publishEvent("a")); !errors.Is(err, enmu.WebhookClosedError) {
+		t.Fatalf("emit after close returned %v", err)
+	}
+}